@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -18,15 +19,25 @@ import (
 	"github.com/go-ozzo/ozzo-routing/v2/content"
 	"github.com/go-ozzo/ozzo-routing/v2/cors"
 	_ "github.com/lib/pq"
+	"github.com/qiangxue/go-rest-api/internal/account"
 	"github.com/qiangxue/go-rest-api/internal/album"
 	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/billing"
 	"github.com/qiangxue/go-rest-api/internal/config"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entitlement"
+	"github.com/qiangxue/go-rest-api/internal/entity"
 	"github.com/qiangxue/go-rest-api/internal/errors"
 	"github.com/qiangxue/go-rest-api/internal/file"
 	"github.com/qiangxue/go-rest-api/internal/healthcheck"
+	"github.com/qiangxue/go-rest-api/internal/promo"
+	"github.com/qiangxue/go-rest-api/internal/ratelimit"
+	"github.com/qiangxue/go-rest-api/internal/referral"
 	"github.com/qiangxue/go-rest-api/pkg/accesslog"
+	"github.com/qiangxue/go-rest-api/pkg/client"
 	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
 	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/qiangxue/go-rest-api/pkg/scheduler"
 )
 
 // Version indicates the current version of the application.
@@ -81,13 +92,49 @@ func main() {
 		o.BaseEndpoint = aws.String(fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfg.CloudflareR2AccountID))
 	})
 
+	jwtKeys, err := buildKeySet(cfg)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+
+	appleClient, err := auth.NewAppleClient(cfg.AppleAuthURL, cfg.AppleClientID, cfg.AppleTeamID, cfg.AppleKeyID, cfg.ApplePrivateKey)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+
+	appStoreVerifier, err := billing.NewAppStoreVerifier(cfg.AppStoreRootCA, cfg.AppStoreBundleID)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+
+	googlePlayClient, err := billing.NewGooglePlayClient(cfg.GooglePlayAPIURL, cfg.GooglePlayServiceAccount)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+
+	trustedProxies, err := client.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Error(err)
+		os.Exit(-1)
+	}
+
 	// build HTTP server
+	jobs := scheduler.New(logger)
 	address := fmt.Sprintf(":%v", cfg.ServerPort)
 	hs := &http.Server{
 		Addr:    address,
-		Handler: buildHandler(logger, dbcontext.New(db), awsClient, cfg),
+		Handler: buildHandler(logger, dbcontext.New(db), awsClient, appleClient, appStoreVerifier, googlePlayClient, jwtKeys, trustedProxies, jobs, cfg),
 	}
 
+	// start the background jobs registered while building the handler
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	jobs.Start(ctx)
+
 	// start the HTTP server with graceful shutdown
 	go routing.GracefulShutdown(hs, 10*time.Second, logger.Infof)
 	logger.Infof("server %v is running at %v", Version, address)
@@ -98,39 +145,196 @@ func main() {
 }
 
 // buildHandler sets up the HTTP routing and builds an HTTP handler.
-func buildHandler(logger log.Logger, db *dbcontext.DB, awsClient *s3.Client, cfg *config.Config) http.Handler {
+// The background jobs of the services are registered with the given scheduler.
+func buildHandler(
+	logger log.Logger,
+	db *dbcontext.DB,
+	awsClient *s3.Client,
+	appleClient auth.AppleClient,
+	appStoreVerifier billing.AppStoreVerifier,
+	googlePlayClient billing.GooglePlayClient,
+	jwtKeys *auth.KeySet,
+	trustedProxies []*net.IPNet,
+	jobs *scheduler.Scheduler,
+	cfg *config.Config,
+) http.Handler {
 	router := routing.New()
 
 	router.Use(
 		accesslog.Handler(logger),
+		client.Handler(cfg.ClientIPHeader, trustedProxies),
 		errors.Handler(logger),
 		content.TypeNegotiator(content.JSON),
 		cors.Handler(cors.AllowAll),
 	)
 
 	healthcheck.RegisterHandlers(router, Version)
+	auth.RegisterKeyHandlers(router, jwtKeys)
 
 	rg := router.Group("/v1")
-	authService := auth.NewService(cfg.JWTSigningKey, cfg.JWTExpiration, auth.NewRepository(db, logger), logger)
-	authHandler := auth.Handler(cfg.JWTSigningKey, authService)
+	userCache := auth.NewLRUUserCache(cfg.UserCacheSize, time.Duration(cfg.UserCacheTTL)*time.Second)
+	authService := auth.NewService(
+		jwtKeys,
+		cfg.JWTExpiration,
+		auth.NewRepository(db, logger),
+		auth.NewGoogleVerifier(cfg.GoogleJWKSURL, cfg.GoogleClientIDs),
+		auth.NewAppleVerifier(cfg.AppleJWKSURL, []string{cfg.AppleClientID}),
+		appleClient,
+		db.Transactional,
+		auth.NewRevocationStore(db, logger),
+		userCache,
+		time.Duration(cfg.AuthEventRetentionDays)*24*time.Hour,
+		logger,
+	)
+	authHandler := auth.Handler(jwtKeys, authService)
+	jobs.Add("prune refresh tokens", time.Hour, authService.PruneRefreshTokens)
+	jobs.Add("prune revoked tokens", time.Hour, authService.PruneRevokedTokens)
+	jobs.Add("prune auth events", 24*time.Hour, authService.PruneAuthEvents)
+
+	allowances := map[string]credit.Allowance{}
+	for plan, allowance := range cfg.CreditAllowances {
+		allowances[plan] = credit.Allowance(allowance)
+	}
+	creditService := credit.NewService(credit.NewRepository(db, logger), db.Transactional, allowances, userCache, logger)
+	jobs.Add("expire credits", time.Hour, creditService.ExpireCredits)
+	jobs.Add("grant credit allowances", 10*time.Minute, creditService.GrantAllowances)
+
+	referralService := referral.NewService(referral.NewRepository(db, logger), db.Transactional, creditService, referral.Program{
+		ReferrerCredits: cfg.Referral.ReferrerCredits,
+		RefereeCredits:  cfg.Referral.RefereeCredits,
+		MaxRewards:      cfg.Referral.MaxRewards,
+		RedeemWindow:    time.Duration(cfg.Referral.RedeemWindowDays) * 24 * time.Hour,
+	}, userCache, logger)
+	jobs.Add("reward referrals", 10*time.Minute, referralService.QualifyReferrals)
 
-	fileService := file.NewService(
-		file.NewRepository(db, logger),
-		// file.NewLocalStorage(cfg.LocalStoragePath, logger),
-		file.NewCloudStorage(awsClient, cfg.CloudflareR2BucketName, cfg.CloudflareR2PublicDomain, logger),
+	fileRepository := file.NewRepository(db, logger)
+	// fileStorage := file.NewLocalStorage(cfg.LocalStoragePath, logger)
+	fileStorage := file.NewCloudStorage(awsClient, cfg.CloudflareR2BucketName, cfg.CloudflareR2PublicDomain, logger)
+	fileService := file.NewService(fileRepository, fileStorage, referralService, logger)
+	exportStorage := file.NewCloudStorage(awsClient, cfg.CloudflareR2ExportBucketName, "", logger)
+
+	albumRepository := album.NewRepository(db, logger)
+
+	accountService := account.NewService(
+		account.NewRepository(db, logger),
+		fileRepository,
+		fileStorage,
+		exportStorage,
+		fileService,
+		albumRepository,
+		userCache,
+		time.Duration(cfg.AccountDeletionGraceDays)*24*time.Hour,
+		logger,
+	)
+	jobs.Add("purge deleted accounts", time.Hour, accountService.PurgeDeletedAccounts)
+	jobs.Add("process data exports", 30*time.Second, accountService.ProcessExports)
+	jobs.Add("expire data exports", time.Hour, accountService.ExpireExports)
+
+	promoService := promo.NewService(promo.NewRepository(db, logger), db.Transactional, creditService, userCache, logger)
+
+	features := map[string]entitlement.Feature{}
+	for name, feature := range cfg.Entitlements {
+		features[name] = entitlement.Feature(feature)
+	}
+	entitlements := entitlement.NewChecker(features, cfg.SubscriptionGraceAccess, creditService, logger)
+
+	products := map[string]billing.Product{}
+	for productID, product := range cfg.SubscriptionProducts {
+		products[productID] = billing.Product(product)
+	}
+	verifiers := map[string]billing.PurchaseVerifier{
+		billing.ProviderAppStore:   billing.NewAppStorePurchaseVerifier(appStoreVerifier, cfg.BillingSandbox),
+		billing.ProviderGooglePlay: billing.NewGooglePlayPurchaseVerifier(googlePlayClient, cfg.GooglePlayPackageName, cfg.BillingSandbox),
+	}
+	if cfg.FakePurchases {
+		logger.Infof("fake purchases are enabled")
+		verifiers[billing.ProviderFake] = billing.NewFakePurchaseVerifier()
+	}
+	billingService := billing.NewService(
+		billing.NewRepository(db, logger),
+		db.Transactional,
+		products,
+		cfg.CreditProducts,
+		verifiers,
+		cfg.RevenueCatWebhookAuth,
+		appStoreVerifier,
+		googlePlayClient,
+		cfg.GooglePlayPackageName,
+		cfg.GooglePlayPushToken,
+		cfg.BillingSandbox,
+		time.Duration(cfg.SubscriptionGraceDays)*24*time.Hour,
+		creditService,
+		referralService,
+		userCache,
 		logger,
 	)
+	jobs.Add("expire subscriptions", 5*time.Minute, billingService.ExpireSubscriptions)
 
 	album.RegisterHandlers(rg.Group(""),
-		album.NewService(album.NewRepository(db, logger), logger),
+		album.NewService(albumRepository, logger),
 		authHandler, logger,
 	)
-	auth.RegisterHandlers(rg.Group(""), authService, authHandler, logger)
-	file.RegisterHandlers(rg.Group(""), fileService, authHandler, logger)
+	billing.RegisterHandlers(rg.Group(""), billingService, authHandler, logger)
+	rateLimit := buildRateLimiter(db, jobs, cfg, logger)
+	auth.RegisterHandlers(rg.Group(""), authService, authHandler, auth.RateLimits{
+		Login:   rateLimit("login", cfg.RateLimits.Login),
+		Refresh: rateLimit("refresh", cfg.RateLimits.Refresh),
+		Signup:  rateLimit("signup", cfg.RateLimits.Signup),
+	}, logger)
+	file.RegisterHandlers(rg.Group(""), fileService, authHandler, entitlements.RequireEntitlement(file.FeatureImageUpload), logger)
+	account.RegisterHandlers(rg.Group(""), accountService, authHandler, logger)
+	credit.RegisterHandlers(rg.Group(""), creditService, authHandler, logger)
+	entitlement.RegisterHandlers(rg.Group(""), entitlements, authHandler, logger)
+	promo.RegisterHandlers(rg.Group(""), promoService, authHandler, rateLimit("promo_redeem", cfg.RateLimits.PromoRedeem), logger)
+	referral.RegisterHandlers(rg.Group(""), referralService, authHandler, logger)
+
+	// the admin endpoints are only reachable by the staff, and some of them by admins only
+	adminGroup := rg.Group("/admin")
+	adminGroup.Use(authHandler, auth.RequireRole(entity.RoleAdmin, entity.RoleSupport))
+	auth.RegisterAdminHandlers(adminGroup, authService, logger)
+	credit.RegisterAdminHandlers(adminGroup, creditService, logger)
+	billing.RegisterAdminHandlers(adminGroup, billingService, logger)
+	promo.RegisterAdminHandlers(adminGroup, promoService, logger)
 
 	return router
 }
 
+// buildRateLimiter returns a function creating the rate limiting middleware of a route group from its configured limits.
+// The middlewares share the same store.
+func buildRateLimiter(db *dbcontext.DB, jobs *scheduler.Scheduler, cfg *config.Config, logger log.Logger) func(string, config.RateLimitGroup) routing.Handler {
+	store := ratelimit.NewMemoryStore()
+	if cfg.RateLimitBackend == config.RateLimitBackendPostgres {
+		store = ratelimit.NewPostgresStore(db)
+	}
+	jobs.Add("prune rate limit buckets", 10*time.Minute, store.Prune)
+
+	limiter := ratelimit.New(store, logger)
+	return func(group string, limits config.RateLimitGroup) routing.Handler {
+		return limiter.Handler(group,
+			ratelimit.Rule{Name: "ip", Key: ratelimit.ByIP(), Limit: ratelimit.Limit(limits.IP)},
+			ratelimit.Rule{Name: "device", Key: ratelimit.ByJSONField("device_key"), Limit: ratelimit.Limit(limits.Device)},
+			ratelimit.Rule{Name: "user", Key: ratelimit.ByUser(), Limit: ratelimit.Limit(limits.User)},
+		)
+	}
+}
+
+// buildKeySet creates the key set that signs and verifies access tokens from the configuration.
+func buildKeySet(cfg *config.Config) (*auth.KeySet, error) {
+	var keys []auth.Key
+	for _, k := range cfg.JWTKeys {
+		key, err := auth.ParseKey(k.ID, k.Algorithm, k.PrivateKey, k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	hmacKey := cfg.JWTSigningKey
+	if cfg.JWTDisableHS256 {
+		hmacKey = ""
+	}
+	return auth.NewKeySet(cfg.JWTActiveKeyID, hmacKey, keys...)
+}
+
 // logDBQuery returns a logging function that can be used to log SQL queries.
 func logDBQuery(logger log.Logger) dbx.QueryLogFunc {
 	return func(ctx context.Context, t time.Duration, sql string, rows *sql.Rows, err error) {
@@ -0,0 +1,67 @@
+package account
+
+import (
+	"net/http"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/file"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Use(authHandler)
+
+	// the following endpoints require a valid JWT
+	rg.Post("/auth/user/export", res.requestExport)
+	rg.Get("/auth/user/export/<id>", res.getExport)
+	rg.Put("/auth/user/avatar", res.uploadAvatar)
+	rg.Delete("/auth/user/avatar", res.deleteAvatar)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) requestExport(c *routing.Context) error {
+	job, err := r.service.RequestExport(c.Request.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(job, http.StatusAccepted)
+}
+
+func (r resource) getExport(c *routing.Context) error {
+	job, err := r.service.GetExport(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.Write(job)
+}
+
+func (r resource) uploadAvatar(c *routing.Context) error {
+	fileBytes, fileSize, contentType, err := file.ReadImage(c, "image", r.logger)
+	if err != nil {
+		return err
+	}
+
+	avatar, err := r.service.UploadAvatar(c.Request.Context(), fileBytes, fileSize, contentType)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(avatar)
+}
+
+func (r resource) deleteAvatar(c *routing.Context) error {
+	if err := r.service.DeleteAvatar(c.Request.Context()); err != nil {
+		return err
+	}
+
+	return c.Write("success")
+}
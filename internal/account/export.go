@@ -0,0 +1,89 @@
+package account
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/entity"
+)
+
+// exportFormatVersion is the version of the layout of the export archive.
+const exportFormatVersion = 1
+
+// Profile is the account data of a user included in a data export.
+type Profile struct {
+	ID                    string     `json:"id" db:"id"`
+	Name                  string     `json:"name" db:"name"`
+	Handle                *string    `json:"handle" db:"handle"`
+	Locale                *string    `json:"locale" db:"locale"`
+	AvatarURL             *string    `json:"avatar_url" db:"avatar_url"`
+	Email                 *string    `json:"email" db:"email"`
+	CustomerID            string     `json:"customer_id" db:"customer_id"`
+	AuthMethod            string     `json:"auth_method" db:"auth_method"`
+	Credits               int        `json:"credits" db:"credits"`
+	SubscriptionPlan      *string    `json:"subscription_plan" db:"subscription_plan"`
+	SubscriptionType      *string    `json:"subscription_type" db:"subscription_type"`
+	SubscriptionPeriod    *string    `json:"subscription_period" db:"subscription_period"`
+	SubscriptionStatus    *string    `json:"subscription_status" db:"subscription_status"`
+	SubscriptionExpiresAt *time.Time `json:"subscription_expires_at" db:"subscription_expires_at"`
+	CreatedAt             time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// SessionRecord is a session of a user included in a data export.
+type SessionRecord struct {
+	ID         string     `json:"id" db:"family_id"`
+	DeviceName *string    `json:"device_name" db:"device_name"`
+	Platform   *string    `json:"platform" db:"platform"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	LastUsedAt time.Time  `json:"last_used_at" db:"last_used_at"`
+	EndedAt    *time.Time `json:"ended_at" db:"ended_at"`
+}
+
+// exportManifest describes the content of an export archive.
+type exportManifest struct {
+	Version     int       `json:"version"`
+	UserID      string    `json:"user_id"`
+	GeneratedAt time.Time `json:"generated_at"`
+	Files       []string  `json:"files"`
+	// MissingFiles are the IDs of the files whose objects could not be found in the storage.
+	MissingFiles []string `json:"missing_files,omitempty"`
+}
+
+// exportData is the data of a user collected for a data export.
+type exportData struct {
+	profile  Profile
+	sessions []SessionRecord
+	credits  []entity.CreditTransaction
+	albums   []entity.Album
+	files    []entity.File
+}
+
+// exportArchive writes the files of a data export into a ZIP archive and keeps track of them for the manifest.
+type exportArchive struct {
+	zw    *zip.Writer
+	files []string
+}
+
+// writeJSON adds the given value to the archive as an indented JSON file.
+func (a *exportArchive) writeJSON(name string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return a.write(name, data)
+}
+
+// write adds a file with the given content to the archive.
+func (a *exportArchive) write(name string, data []byte) error {
+	w, err := a.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	a.files = append(a.files, name)
+	return nil
+}
@@ -0,0 +1,283 @@
+package account
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access the account data of users.
+type Repository interface {
+	// ListUsersToPurge returns the IDs of the users deleted before the given time whose data is not purged yet.
+	ListUsersToPurge(ctx context.Context, deletedBefore time.Time, limit int) ([]string, error)
+	// AnonymizeUser removes the personal data and credentials of a deleted user and marks the user as purged.
+	AnonymizeUser(ctx context.Context, userID string) error
+
+	// CreateExportJob saves a new export job.
+	CreateExportJob(ctx context.Context, job entity.ExportJob) error
+	// GetExportJob returns the export job with the given ID requested by the given user.
+	GetExportJob(ctx context.Context, userID, jobID string) (entity.ExportJob, error)
+	// GetActiveExportJob returns the pending or running export job of the given user.
+	GetActiveExportJob(ctx context.Context, userID string) (entity.ExportJob, error)
+	// ClaimExportJob marks the oldest pending export job as running and returns it.
+	// Running jobs which were started before staleBefore are claimed again. sql.ErrNoRows is returned if there is no job.
+	ClaimExportJob(ctx context.Context, staleBefore time.Time) (entity.ExportJob, error)
+	// CompleteExportJob marks the export job as completed with the given archive file.
+	CompleteExportJob(ctx context.Context, jobID, fileID string, expiresAt time.Time) error
+	// FailExportJob marks the export job as failed.
+	FailExportJob(ctx context.Context, jobID, message string) error
+	// ListExpiredExportJobs returns the completed export jobs whose archives expired before the given time.
+	ListExpiredExportJobs(ctx context.Context, expiredBefore time.Time) ([]entity.ExportJob, error)
+	// ExpireExportJob marks the export job as expired after its archive has been removed.
+	ExpireExportJob(ctx context.Context, jobID string) error
+
+	// GetProfile returns the profile, subscription and credits of the user.
+	GetProfile(ctx context.Context, userID string) (Profile, error)
+	// ListSessionHistory returns every session of the user, including the ended ones.
+	ListSessionHistory(ctx context.Context, userID string) ([]SessionRecord, error)
+	// ListCreditTransactions returns the whole credit ledger of the user, the oldest transaction first.
+	ListCreditTransactions(ctx context.Context, userID string) ([]entity.CreditTransaction, error)
+
+	// SetAvatar sets the avatar of the user and returns the file ID of the previous avatar, if any.
+	// A nil file removes the avatar.
+	SetAvatar(ctx context.Context, userID string, avatar *entity.File) (*string, error)
+}
+
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new account repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// ListUsersToPurge implements Repository.
+func (r repository) ListUsersToPurge(ctx context.Context, deletedBefore time.Time, limit int) ([]string, error) {
+	var userIDs []string
+	err := r.db.With(ctx).Select("id").From("public.user").
+		Where(dbx.NewExp("deleted_at < {:deleted_before} and purged_at is null", dbx.Params{"deleted_before": deletedBefore})).
+		OrderBy("deleted_at").
+		Limit(int64(limit)).
+		Column(&userIDs)
+
+	return userIDs, err
+}
+
+// AnonymizeUser implements Repository.
+// The user row itself is kept, since other records may still refer to it.
+func (r repository) AnonymizeUser(ctx context.Context, userID string) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		for _, table := range []string{"credential", "apple_token", "refresh_token", "export_job"} {
+			if _, err := r.db.With(ctx).Delete(table, dbx.HashExp{"user_id": userID}).Execute(); err != nil {
+				return err
+			}
+		}
+
+		currentTime := time.Now()
+		_, err := r.db.With(ctx).Update("public.user", dbx.Params{
+			"name":           "Deleted User",
+			"auth_id":        "deleted:" + userID,
+			"email":          nil,
+			"fcm_token":      nil,
+			"handle":         nil,
+			"locale":         nil,
+			"avatar_file_id": nil,
+			"avatar_url":     nil,
+			"updated_at":     currentTime,
+			"purged_at":      currentTime,
+		}, dbx.HashExp{"id": userID}).Execute()
+
+		return err
+	})
+}
+
+// CreateExportJob implements Repository.
+func (r repository) CreateExportJob(ctx context.Context, job entity.ExportJob) error {
+	_, err := r.db.With(ctx).Insert("export_job", dbx.Params{
+		"id":         job.ID,
+		"user_id":    job.UserID,
+		"status":     job.Status,
+		"created_at": job.CreatedAt,
+	}).Execute()
+
+	return err
+}
+
+// GetExportJob implements Repository.
+func (r repository) GetExportJob(ctx context.Context, userID, jobID string) (entity.ExportJob, error) {
+	var job entity.ExportJob
+	err := r.db.With(ctx).Select().From("export_job").
+		Where(dbx.HashExp{"id": jobID, "user_id": userID}).
+		One(&job)
+
+	return job, err
+}
+
+// GetActiveExportJob implements Repository.
+func (r repository) GetActiveExportJob(ctx context.Context, userID string) (entity.ExportJob, error) {
+	var job entity.ExportJob
+	err := r.db.With(ctx).Select().From("export_job").
+		Where(dbx.HashExp{
+			"user_id": userID,
+			"status":  []interface{}{entity.ExportStatusPending, entity.ExportStatusRunning},
+		}).
+		OrderBy("created_at DESC").
+		One(&job)
+
+	return job, err
+}
+
+// ClaimExportJob implements Repository.
+// Jobs are locked with SKIP LOCKED so that several server instances never claim the same job.
+func (r repository) ClaimExportJob(ctx context.Context, staleBefore time.Time) (entity.ExportJob, error) {
+	var job entity.ExportJob
+	err := r.db.With(ctx).NewQuery(`UPDATE export_job SET status = {:running}, started_at = {:time}
+		WHERE id = (
+			SELECT id FROM export_job
+			WHERE status = {:pending} OR (status = {:running} AND started_at < {:stale_before})
+			ORDER BY created_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING *`,
+	).Bind(dbx.Params{
+		"running":      entity.ExportStatusRunning,
+		"pending":      entity.ExportStatusPending,
+		"time":         time.Now(),
+		"stale_before": staleBefore,
+	}).One(&job)
+
+	return job, err
+}
+
+// CompleteExportJob implements Repository.
+func (r repository) CompleteExportJob(ctx context.Context, jobID, fileID string, expiresAt time.Time) error {
+	_, err := r.db.With(ctx).Update("export_job", dbx.Params{
+		"status":       entity.ExportStatusCompleted,
+		"file_id":      fileID,
+		"completed_at": time.Now(),
+		"expires_at":   expiresAt,
+	}, dbx.HashExp{"id": jobID}).Execute()
+
+	return err
+}
+
+// FailExportJob implements Repository.
+func (r repository) FailExportJob(ctx context.Context, jobID, message string) error {
+	_, err := r.db.With(ctx).Update("export_job", dbx.Params{
+		"status":       entity.ExportStatusFailed,
+		"error":        message,
+		"completed_at": time.Now(),
+	}, dbx.HashExp{"id": jobID}).Execute()
+
+	return err
+}
+
+// ListExpiredExportJobs implements Repository.
+func (r repository) ListExpiredExportJobs(ctx context.Context, expiredBefore time.Time) ([]entity.ExportJob, error) {
+	var jobs []entity.ExportJob
+	err := r.db.With(ctx).Select().From("export_job").
+		Where(dbx.NewExp("status = {:status} and expires_at < {:expired_before}", dbx.Params{
+			"status":         entity.ExportStatusCompleted,
+			"expired_before": expiredBefore,
+		})).
+		All(&jobs)
+
+	return jobs, err
+}
+
+// ExpireExportJob implements Repository.
+func (r repository) ExpireExportJob(ctx context.Context, jobID string) error {
+	_, err := r.db.With(ctx).Update("export_job",
+		dbx.Params{"status": entity.ExportStatusExpired, "file_id": nil},
+		dbx.HashExp{"id": jobID},
+	).Execute()
+
+	return err
+}
+
+// GetProfile implements Repository.
+func (r repository) GetProfile(ctx context.Context, userID string) (Profile, error) {
+	var profile Profile
+	err := r.db.With(ctx).Select(
+		"id",
+		"name",
+		"handle",
+		"locale",
+		"avatar_url",
+		"email",
+		"customer_id",
+		"auth_method",
+		"credit_balance(id) AS credits",
+		"subscription_plan",
+		"subscription_type",
+		"subscription_period",
+		"subscription_status",
+		"subscription_expires_at",
+		"created_at",
+		"updated_at",
+	).From("public.user").Where(dbx.HashExp{"id": userID}).One(&profile)
+
+	return profile, err
+}
+
+// ListSessionHistory implements Repository.
+// Each session is a refresh token family. A session has ended when all of its tokens are revoked.
+func (r repository) ListSessionHistory(ctx context.Context, userID string) ([]SessionRecord, error) {
+	sessions := []SessionRecord{}
+	err := r.db.With(ctx).NewQuery(`SELECT family_id,
+			max(device_name) AS device_name,
+			max(platform) AS platform,
+			min(created_at) AS created_at,
+			max(created_at) AS last_used_at,
+			CASE WHEN bool_and(revoked_at IS NOT NULL) THEN max(revoked_at) END AS ended_at
+		FROM refresh_token
+		WHERE user_id = {:user_id}
+		GROUP BY family_id
+		ORDER BY created_at`,
+	).Bind(dbx.Params{"user_id": userID}).All(&sessions)
+
+	return sessions, err
+}
+
+// ListCreditTransactions implements Repository.
+func (r repository) ListCreditTransactions(ctx context.Context, userID string) ([]entity.CreditTransaction, error) {
+	transactions := []entity.CreditTransaction{}
+	err := r.db.With(ctx).Select().From("credit_transaction").
+		Where(dbx.HashExp{"user_id": userID}).
+		OrderBy("created_at", "id").
+		All(&transactions)
+
+	return transactions, err
+}
+
+// SetAvatar implements Repository.
+func (r repository) SetAvatar(ctx context.Context, userID string, avatar *entity.File) (*string, error) {
+	var previous struct {
+		FileID *string `db:"avatar_file_id"`
+	}
+	err := r.db.Transactional(ctx, func(ctx context.Context) error {
+		err := r.db.With(ctx).NewQuery(`SELECT avatar_file_id FROM public.user WHERE id = {:id} FOR UPDATE`).
+			Bind(dbx.Params{"id": userID}).
+			One(&previous)
+		if err != nil {
+			return err
+		}
+
+		params := dbx.Params{"avatar_file_id": nil, "avatar_url": nil, "updated_at": time.Now()}
+		if avatar != nil {
+			params["avatar_file_id"] = avatar.ID
+			params["avatar_url"] = avatar.URL
+		}
+		_, err = r.db.With(ctx).Update("public.user", params, dbx.HashExp{"id": userID}).Execute()
+		return err
+	})
+
+	return previous.FileID, err
+}
@@ -0,0 +1,389 @@
+package account
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	stderr "errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/album"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/internal/file"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+const (
+	// purgeBatchSize is the maximum number of accounts purged by one run of the purge job.
+	purgeBatchSize = 100
+	// exportBatchSize is the maximum number of exports built by one run of the export job.
+	exportBatchSize = 10
+	// exportRetention is how long an export archive can be downloaded after it is built.
+	exportRetention = 7 * 24 * time.Hour
+	// exportDownloadURLLifetime is how long a download URL of an export archive is valid.
+	exportDownloadURLLifetime = 15 * time.Minute
+	// exportStaleAfter is how long a running export may take before another run of the job retries it.
+	exportStaleAfter = time.Hour
+)
+
+// Service encapsulates the usecase logic for the lifecycle of user accounts.
+type Service interface {
+	// PurgeDeletedAccounts purges the data of the accounts deleted longer than the grace period ago.
+	// It is meant to be run as a background job.
+	PurgeDeletedAccounts(ctx context.Context) error
+
+	// RequestExport requests an export of the personal data of the current user.
+	// If an export is already in progress, that export is returned instead.
+	RequestExport(ctx context.Context) (entity.ExportJob, error)
+	// GetExport returns an export of the current user. Completed exports include a short-lived download URL.
+	GetExport(ctx context.Context, id string) (entity.ExportJob, error)
+	// ProcessExports builds the archives of the pending exports. It is meant to be run as a background job.
+	ProcessExports(ctx context.Context) error
+	// ExpireExports removes the archives of the exports older than the retention period.
+	// It is meant to be run as a background job.
+	ExpireExports(ctx context.Context) error
+
+	// UploadAvatar replaces the avatar of the current user with the given image.
+	UploadAvatar(ctx context.Context, fileBytes []byte, fileSize int64, contentType string) (entity.File, error)
+	// DeleteAvatar removes the avatar of the current user.
+	DeleteAvatar(ctx context.Context) error
+}
+
+type service struct {
+	repo        Repository
+	fileRepo    file.Repository
+	fileStorage file.FileStorage
+	// exportStorage is the private storage the export archives are written to.
+	// The archives are only reachable through signed URLs.
+	exportStorage file.FileStorage
+	fileService   file.Service
+	albumRepo     album.Repository
+	users         auth.UserCache
+	gracePeriod   time.Duration
+	logger        log.Logger
+}
+
+// NewService creates a new account service.
+func NewService(
+	repo Repository,
+	fileRepo file.Repository,
+	fileStorage file.FileStorage,
+	exportStorage file.FileStorage,
+	fileService file.Service,
+	albumRepo album.Repository,
+	users auth.UserCache,
+	gracePeriod time.Duration,
+	logger log.Logger,
+) Service {
+	return service{repo, fileRepo, fileStorage, exportStorage, fileService, albumRepo, users, gracePeriod, logger}
+}
+
+// PurgeDeletedAccounts implements Service.
+// Accounts are purged in stages: the uploaded files are removed from the storage and the database first,
+// then the user row is anonymized. A failed stage is retried by the next run of the job.
+func (s service) PurgeDeletedAccounts(ctx context.Context) error {
+	userIDs, err := s.repo.ListUsersToPurge(ctx, time.Now().Add(-s.gracePeriod), purgeBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, userID := range userIDs {
+		logger := s.logger.With(ctx, "user", userID)
+		if err := s.purgeFiles(ctx, userID); err != nil {
+			logger.Errorf("failed to purge the files of the deleted account: %v", err)
+			continue
+		}
+		if err := s.repo.AnonymizeUser(ctx, userID); err != nil {
+			logger.Errorf("failed to anonymize the deleted account: %v", err)
+			continue
+		}
+		logger.Infof("deleted account purged")
+	}
+	return nil
+}
+
+// purgeFiles removes the objects of every file of the user and then the file records.
+// The export archives are removed from the export storage they are written to.
+func (s service) purgeFiles(ctx context.Context, userID string) error {
+	files, err := s.fileRepo.ListFilesByUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		storage := s.fileStorage
+		if f.Subject == file.SubjectExport {
+			storage = s.exportStorage
+		}
+		if err := storage.DeleteFile(ctx, f); err != nil {
+			return err
+		}
+		if err := s.fileRepo.DeleteFile(ctx, f.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequestExport implements Service.
+func (s service) RequestExport(ctx context.Context) (entity.ExportJob, error) {
+	userID := auth.CurrentUser(ctx).GetID()
+
+	job, err := s.repo.GetActiveExportJob(ctx, userID)
+	if err == nil {
+		return job, nil
+	} else if !stderr.Is(err, sql.ErrNoRows) {
+		s.logger.Errorf("There is an error while getting the active export job %v", err)
+		return job, errors.InternalServerError("")
+	}
+
+	job = entity.ExportJob{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Status:    string(entity.ExportStatusPending),
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateExportJob(ctx, job); err != nil {
+		s.logger.Errorf("There is an error while creating the export job %v", err)
+		return job, errors.InternalServerError("")
+	}
+	return job, nil
+}
+
+// GetExport implements Service.
+func (s service) GetExport(ctx context.Context, id string) (entity.ExportJob, error) {
+	userID := auth.CurrentUser(ctx).GetID()
+	if _, err := uuid.Parse(id); err != nil {
+		return entity.ExportJob{}, errors.NotFound("")
+	}
+
+	job, err := s.repo.GetExportJob(ctx, userID, id)
+	if stderr.Is(err, sql.ErrNoRows) {
+		return job, errors.NotFound("")
+	} else if err != nil {
+		s.logger.Errorf("There is an error while getting the export job %v", err)
+		return job, errors.InternalServerError("")
+	}
+
+	if job.Status != string(entity.ExportStatusCompleted) || job.FileID == nil {
+		return job, nil
+	}
+
+	archive, err := s.fileRepo.GetFile(ctx, *job.FileID)
+	if err != nil {
+		s.logger.Errorf("There is an error while getting the export archive %v", err)
+		return job, errors.InternalServerError("")
+	}
+	job.DownloadURL, err = s.exportStorage.GetSignedURL(ctx, archive, exportDownloadURLLifetime)
+	if err != nil {
+		s.logger.Errorf("There is an error while signing the export archive URL %v", err)
+		return job, errors.InternalServerError("")
+	}
+	return job, nil
+}
+
+// ProcessExports implements Service.
+// Jobs are claimed one at a time, so several server instances can run the job concurrently.
+func (s service) ProcessExports(ctx context.Context) error {
+	for i := 0; i < exportBatchSize; i++ {
+		job, err := s.repo.ClaimExportJob(ctx, time.Now().Add(-exportStaleAfter))
+		if stderr.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		logger := s.logger.With(ctx, "user", job.UserID, "export", job.ID)
+		fileID, err := s.buildExport(ctx, job)
+		if err != nil {
+			logger.Errorf("failed to build the data export: %v", err)
+			if err := s.repo.FailExportJob(ctx, job.ID, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.repo.CompleteExportJob(ctx, job.ID, fileID, time.Now().Add(exportRetention)); err != nil {
+			return err
+		}
+		logger.Infof("data export completed")
+	}
+	return nil
+}
+
+// buildExport collects the data of the user of the job into a ZIP archive, stores it and returns its file ID.
+// The archive is streamed to the export storage while it is written, so it is never held in memory.
+func (s service) buildExport(ctx context.Context, job entity.ExportJob) (string, error) {
+	profile, err := s.repo.GetProfile(ctx, job.UserID)
+	if err != nil {
+		return "", fmt.Errorf("profile: %v", err)
+	}
+	sessions, err := s.repo.ListSessionHistory(ctx, job.UserID)
+	if err != nil {
+		return "", fmt.Errorf("sessions: %v", err)
+	}
+	credits, err := s.repo.ListCreditTransactions(ctx, job.UserID)
+	if err != nil {
+		return "", fmt.Errorf("credits: %v", err)
+	}
+	albums, err := s.albumRepo.QueryByUserID(ctx, job.UserID)
+	if err != nil {
+		return "", fmt.Errorf("albums: %v", err)
+	}
+	files, err := s.fileRepo.ListFilesByUserID(ctx, job.UserID)
+	if err != nil {
+		return "", fmt.Errorf("files: %v", err)
+	}
+
+	exportFile := entity.File{
+		ID:          uuid.New().String(),
+		UserID:      job.UserID,
+		Subject:     file.SubjectExport,
+		ContentType: "application/zip",
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.writeExport(ctx, pw, job, exportData{profile, sessions, credits, albums, files}))
+	}()
+	size, err := s.exportStorage.WriteStream(ctx, exportFile, pr)
+	// unblocks the writer if the upload stopped before reading the whole archive
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return "", fmt.Errorf("write archive: %v", err)
+	}
+
+	exportFile.Size = size
+	if err := s.fileRepo.CreateFile(ctx, exportFile); err != nil {
+		return "", fmt.Errorf("save archive: %v", err)
+	}
+	return exportFile.ID, nil
+}
+
+// writeExport writes the export archive of the given data into w.
+// Files whose objects no longer exist in the storage are skipped and listed in the manifest.
+func (s service) writeExport(ctx context.Context, w io.Writer, job entity.ExportJob, data exportData) error {
+	archive := &exportArchive{zw: zip.NewWriter(w)}
+	if err := archive.writeJSON("profile.json", data.profile); err != nil {
+		return err
+	}
+	if err := archive.writeJSON("sessions.json", data.sessions); err != nil {
+		return err
+	}
+	if err := archive.writeJSON("credits.json", data.credits); err != nil {
+		return err
+	}
+	if err := archive.writeJSON("albums.json", data.albums); err != nil {
+		return err
+	}
+	var missing []string
+	for _, f := range data.files {
+		if f.Subject == file.SubjectExport {
+			continue
+		}
+		content, err := s.fileStorage.ReadFile(ctx, f)
+		if stderr.Is(err, file.ErrNotFound) {
+			s.logger.With(ctx, "user", job.UserID, "export", job.ID).Infof("skipping the missing file %s", f.ID)
+			missing = append(missing, f.ID)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("file %s: %v", f.ID, err)
+		}
+		if err := archive.write("images/"+f.ID+f.GetExtension(), content); err != nil {
+			return err
+		}
+	}
+	if err := archive.writeJSON("manifest.json", exportManifest{
+		Version:      exportFormatVersion,
+		UserID:       job.UserID,
+		GeneratedAt:  time.Now(),
+		Files:        archive.files,
+		MissingFiles: missing,
+	}); err != nil {
+		return err
+	}
+	return archive.zw.Close()
+}
+
+// ExpireExports implements Service.
+func (s service) ExpireExports(ctx context.Context) error {
+	jobs, err := s.repo.ListExpiredExportJobs(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, job := range jobs {
+		logger := s.logger.With(ctx, "user", job.UserID, "export", job.ID)
+		if job.FileID != nil {
+			archive, err := s.fileRepo.GetFile(ctx, *job.FileID)
+			if err != nil && !stderr.Is(err, sql.ErrNoRows) {
+				logger.Errorf("failed to get the export archive: %v", err)
+				continue
+			}
+			if err == nil {
+				if err := s.exportStorage.DeleteFile(ctx, archive); err != nil {
+					logger.Errorf("failed to delete the export archive: %v", err)
+					continue
+				}
+				if err := s.fileRepo.DeleteFile(ctx, archive.ID); err != nil {
+					logger.Errorf("failed to delete the export archive record: %v", err)
+					continue
+				}
+			}
+		}
+		if err := s.repo.ExpireExportJob(ctx, job.ID); err != nil {
+			logger.Errorf("failed to expire the export job: %v", err)
+		}
+	}
+	return nil
+}
+
+// UploadAvatar implements Service.
+func (s service) UploadAvatar(ctx context.Context, fileBytes []byte, fileSize int64, contentType string) (entity.File, error) {
+	userID := auth.CurrentUser(ctx).GetID()
+
+	avatar, err := s.fileService.UploadImage(ctx, file.SubjectAvatar, fileBytes, fileSize, contentType)
+	if err != nil {
+		return avatar, err
+	}
+	if err := s.setAvatar(ctx, userID, &avatar); err != nil {
+		return avatar, err
+	}
+	return avatar, nil
+}
+
+// DeleteAvatar implements Service.
+func (s service) DeleteAvatar(ctx context.Context) error {
+	return s.setAvatar(ctx, auth.CurrentUser(ctx).GetID(), nil)
+}
+
+// setAvatar sets the avatar of the user and removes the previous avatar from the storage.
+func (s service) setAvatar(ctx context.Context, userID string, avatar *entity.File) error {
+	logger := s.logger.With(ctx, "user", userID)
+
+	previousFileID, err := s.repo.SetAvatar(ctx, userID, avatar)
+	if err != nil {
+		logger.Errorf("There is an error while setting the avatar %v", err)
+		return errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+
+	if previousFileID == nil {
+		return nil
+	}
+	previous, err := s.fileRepo.GetFile(ctx, *previousFileID)
+	if err == nil {
+		if err = s.fileStorage.DeleteFile(ctx, previous); err == nil {
+			err = s.fileRepo.DeleteFile(ctx, previous.ID)
+		}
+	}
+	if err != nil && !stderr.Is(err, sql.ErrNoRows) {
+		// the file is still removed when the account is purged
+		logger.Errorf("There is an error while deleting the previous avatar %v", err)
+	}
+	return nil
+}
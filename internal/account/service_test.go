@@ -0,0 +1,100 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/internal/file"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockRepository keeps the users to purge and the purged users in memory.
+type mockRepository struct {
+	Repository
+	toPurge []string
+	purged  []string
+}
+
+func (r *mockRepository) ListUsersToPurge(context.Context, time.Time, int) ([]string, error) {
+	return r.toPurge, nil
+}
+
+func (r *mockRepository) AnonymizeUser(_ context.Context, userID string) error {
+	r.purged = append(r.purged, userID)
+	return nil
+}
+
+func (r *mockRepository) GetExportJob(context.Context, string, string) (entity.ExportJob, error) {
+	return entity.ExportJob{}, sql.ErrNoRows
+}
+
+// mockFileRepository keeps the file records in memory.
+type mockFileRepository struct {
+	file.Repository
+	files map[string]entity.File
+}
+
+func (r *mockFileRepository) ListFilesByUserID(_ context.Context, userID string) ([]entity.File, error) {
+	var files []entity.File
+	for _, f := range r.files {
+		if f.UserID == userID {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+func (r *mockFileRepository) DeleteFile(_ context.Context, fileID string) error {
+	delete(r.files, fileID)
+	return nil
+}
+
+// mockStorage keeps the objects of a bucket in memory. Deleting a missing object succeeds, as it does in the buckets.
+type mockStorage struct {
+	file.FileStorage
+	objects map[string][]byte
+}
+
+func (s *mockStorage) DeleteFile(_ context.Context, f entity.File) error {
+	delete(s.objects, f.ID)
+	return nil
+}
+
+func TestService_PurgeDeletedAccounts(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{toPurge: []string{"user1"}}
+	fileRepo := &mockFileRepository{files: map[string]entity.File{
+		"image1":  {ID: "image1", UserID: "user1", Subject: file.SubjectAlbum},
+		"export1": {ID: "export1", UserID: "user1", Subject: file.SubjectExport},
+		"image2":  {ID: "image2", UserID: "user2", Subject: file.SubjectAlbum},
+	}}
+	fileStorage := &mockStorage{objects: map[string][]byte{"image1": {1}, "image2": {2}}}
+	exportStorage := &mockStorage{objects: map[string][]byte{"export1": {3}}}
+	s := NewService(repo, fileRepo, fileStorage, exportStorage, nil, nil, nil, 30*24*time.Hour, logger)
+
+	assert.NoError(t, s.PurgeDeletedAccounts(context.Background()))
+	assert.Equal(t, []string{"user1"}, repo.purged)
+	assert.Empty(t, exportStorage.objects)
+	assert.Equal(t, map[string][]byte{"image2": {2}}, fileStorage.objects)
+	assert.Equal(t, map[string]entity.File{"image2": {ID: "image2", UserID: "user2", Subject: file.SubjectAlbum}}, fileRepo.files)
+}
+
+func TestService_GetExport(t *testing.T) {
+	logger, _ := log.NewForTest()
+	s := NewService(&mockRepository{}, &mockFileRepository{}, &mockStorage{}, &mockStorage{}, nil, nil, nil, 0, logger)
+	ctx := auth.WithUser(context.Background(), entity.User{ID: "user1"})
+
+	for _, id := range []string{"not-a-uuid", "8c5dfa36-9b6d-4b2b-a1a0-4a3cbb1d9c0e"} {
+		_, err := s.GetExport(ctx, id)
+		if assert.IsType(t, errors.ErrorResponse{}, err) {
+			assert.Equal(t, http.StatusNotFound, err.(errors.ErrorResponse).Status)
+		}
+	}
+}
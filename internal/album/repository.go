@@ -2,6 +2,8 @@ package album
 
 import (
 	"context"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
 	"github.com/qiangxue/go-rest-api/internal/entity"
 	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
 	"github.com/qiangxue/go-rest-api/pkg/log"
@@ -15,6 +17,8 @@ type Repository interface {
 	Count(ctx context.Context) (int, error)
 	// Query returns the list of albums with the given offset and limit.
 	Query(ctx context.Context, offset, limit int) ([]entity.Album, error)
+	// QueryByUserID returns the list of albums owned by the given user.
+	QueryByUserID(ctx context.Context, userID string) ([]entity.Album, error)
 	// Create saves a new album in the storage.
 	Create(ctx context.Context, album entity.Album) error
 	// Update updates the album with given ID in the storage.
@@ -79,3 +83,14 @@ func (r repository) Query(ctx context.Context, offset, limit int) ([]entity.Albu
 		All(&albums)
 	return albums, err
 }
+
+// QueryByUserID retrieves the album records owned by the given user from the database.
+func (r repository) QueryByUserID(ctx context.Context, userID string) ([]entity.Album, error) {
+	var albums []entity.Album
+	err := r.db.With(ctx).
+		Select().
+		Where(dbx.HashExp{"user_id": userID}).
+		OrderBy("created_at").
+		All(&albums)
+	return albums, err
+}
@@ -3,7 +3,9 @@ package album
 import (
 	"context"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/qiangxue/go-rest-api/internal/auth"
 	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
 	"github.com/qiangxue/go-rest-api/pkg/log"
 	"time"
 )
@@ -73,9 +75,11 @@ func (s service) Create(ctx context.Context, req CreateAlbumRequest) (Album, err
 	}
 	id := entity.GenerateID()
 	now := time.Now()
+	userID := auth.CurrentUser(ctx).ID
 	err := s.repo.Create(ctx, entity.Album{
 		ID:        id,
 		Name:      req.Name,
+		UserID:    &userID,
 		CreatedAt: now,
 		UpdatedAt: now,
 	})
@@ -95,6 +99,9 @@ func (s service) Update(ctx context.Context, id string, req UpdateAlbumRequest)
 	if err != nil {
 		return album, err
 	}
+	if !canModify(ctx, album.Album) {
+		return album, errors.Forbidden("")
+	}
 	album.Name = req.Name
 	album.UpdatedAt = time.Now()
 
@@ -110,12 +117,27 @@ func (s service) Delete(ctx context.Context, id string) (Album, error) {
 	if err != nil {
 		return Album{}, err
 	}
+	if !canModify(ctx, album.Album) {
+		return Album{}, errors.Forbidden("")
+	}
 	if err = s.repo.Delete(ctx, id); err != nil {
 		return Album{}, err
 	}
 	return album, nil
 }
 
+// canModify returns whether the current user may change the album: only its owner and admins can.
+func canModify(ctx context.Context, album entity.Album) bool {
+	user := auth.CurrentUser(ctx)
+	if user == nil {
+		return false
+	}
+	if user.HasRole(entity.RoleAdmin) {
+		return true
+	}
+	return album.UserID != nil && *album.UserID == user.ID
+}
+
 // Count returns the number of albums.
 func (s service) Count(ctx context.Context) (int, error) {
 	return s.repo.Count(ctx)
@@ -2,26 +2,83 @@ package auth
 
 import (
 	"net/http"
+	"time"
 
 	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/entity"
 	"github.com/qiangxue/go-rest-api/internal/errors"
 	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/qiangxue/go-rest-api/pkg/pagination"
 )
 
+// RateLimits holds the rate limiting middlewares of the public endpoints. A nil middleware does not limit anything.
+type RateLimits struct {
+	Login   routing.Handler
+	Refresh routing.Handler
+	Signup  routing.Handler
+}
+
 // RegisterHandlers registers handlers for different HTTP requests.
-func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, limits RateLimits, logger log.Logger) {
 	r := resource{
 		service: service,
 		logger:  logger,
 	}
+	login, refresh, signup := orNoop(limits.Login), orNoop(limits.Refresh), orNoop(limits.Signup)
 
-	rg.Post("/auth/login/username", r.loginUsername)
-	rg.Post("/auth/login/anonymous", r.loginAnonymous)
-	rg.Post("/auth/refresh", r.refreshTokens)
+	rg.Use(deviceHandler)
+	rg.Post("/auth/register", signup, r.register)
+	rg.Post("/auth/login/username", login, r.loginUsername)
+	rg.Post("/auth/login/anonymous", signup, r.loginAnonymous)
+	rg.Post("/auth/login/google", login, r.loginGoogle)
+	rg.Post("/auth/login/apple", login, r.loginApple)
+	rg.Post("/auth/apple/notifications", r.appleNotifications)
+	rg.Post("/auth/refresh", refresh, r.refreshTokens)
 
 	rg.Use(authHandler)
 	rg.Get("/auth/user", r.getUser)
+	rg.Patch("/auth/user", r.updateUser)
+	rg.Delete("/auth/user", r.deleteUser)
+	rg.Put("/auth/user/fcm-token", r.registerFCMToken)
+	rg.Delete("/auth/user/fcm-token", r.unregisterFCMToken)
 	rg.Post("/auth/logout", r.logout)
+	rg.Post("/auth/link", r.linkIdentity)
+	rg.Post("/auth/password", r.changePassword)
+	rg.Post("/auth/logout-all", r.logoutAll)
+	rg.Get("/auth/sessions", r.listSessions)
+	rg.Delete("/auth/sessions/<id>", r.revokeSession)
+}
+
+// RegisterAdminHandlers registers the user management handlers of the admin route group.
+// The route group must only be reachable by the staff. Changing the users is restricted to admins,
+// while the audit log can also be read by the support.
+func RegisterAdminHandlers(rg *routing.RouteGroup, service Service, logger log.Logger) {
+	r := resource{
+		service: service,
+		logger:  logger,
+	}
+
+	adminOnly := RequireRole(entity.RoleAdmin)
+	rg.Post("/users/<id>/ban", adminOnly, r.banUser)
+	rg.Delete("/users/<id>/ban", adminOnly, r.unbanUser)
+	rg.Put("/users/<id>/role", adminOnly, r.setRole)
+	rg.Get("/cache/users", adminOnly, r.userCacheStats)
+	rg.Get("/auth-events", r.queryAuthEvents)
+}
+
+// RegisterKeyHandlers registers the handler that publishes the public keys verifying access tokens.
+func RegisterKeyHandlers(r *routing.Router, keys *KeySet) {
+	r.Get("/.well-known/jwks.json", func(c *routing.Context) error {
+		return c.Write(keys.JWKS())
+	})
+}
+
+func orNoop(handler routing.Handler) routing.Handler {
+	if handler == nil {
+		return func(*routing.Context) error { return nil }
+	}
+	return handler
 }
 
 type resource struct {
@@ -29,18 +86,50 @@ type resource struct {
 	logger  log.Logger
 }
 
+// register handles the registration of a username and password account.
+func (r resource) register(c *routing.Context) error {
+	var req struct {
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		DeviceKey string `json:"device_key"`
+	}
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if req.DeviceKey == "" {
+		r.logger.With(c.Request.Context()).Errorf("invalid request")
+		return errors.BadRequest("Device key is required", "")
+	}
+
+	authTokens, err := r.service.Register(c.Request.Context(), req.Username, req.Password, req.DeviceKey)
+	if err != nil {
+		return err
+	}
+	return c.WriteWithStatus(authTokens, http.StatusCreated)
+}
+
 // loginUsername returns a handler that handles user loginUsername request.
 func (r resource) loginUsername(c *routing.Context) error {
 	var req struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username  string `json:"username"`
+		Password  string `json:"password"`
+		DeviceKey string `json:"device_key"`
 	}
 
 	if err := c.Read(&req); err != nil {
 		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
 		return errors.BadRequest("", "")
 	}
-	authTokens, err := r.service.LoginUsername(c.Request.Context(), req.Username, req.Password)
+
+	if req.Username == "" || req.Password == "" || req.DeviceKey == "" {
+		r.logger.With(c.Request.Context()).Errorf("invalid request")
+		return errors.BadRequest("Username, password and device key are required", "")
+	}
+
+	authTokens, err := r.service.LoginUsername(c.Request.Context(), req.Username, req.Password, req.DeviceKey)
 	if err != nil {
 		return err
 	}
@@ -69,6 +158,70 @@ func (r resource) loginAnonymous(c *routing.Context) error {
 	return c.WriteWithStatus(authTokens, http.StatusOK)
 }
 
+func (r resource) loginGoogle(c *routing.Context) error {
+	var req struct {
+		IDToken   string `json:"id_token"`
+		DeviceKey string `json:"device_key"`
+	}
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if req.IDToken == "" || req.DeviceKey == "" {
+		r.logger.With(c.Request.Context()).Errorf("invalid request")
+		return errors.BadRequest("ID token and device key are required", "")
+	}
+
+	authTokens, err := r.service.LoginGoogle(c.Request.Context(), req.IDToken, req.DeviceKey)
+	if err != nil {
+		return err
+	}
+	return c.WriteWithStatus(authTokens, http.StatusOK)
+}
+
+func (r resource) loginApple(c *routing.Context) error {
+	var req struct {
+		IDToken           string `json:"id_token"`
+		AuthorizationCode string `json:"authorization_code"`
+		DeviceKey         string `json:"device_key"`
+	}
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if req.IDToken == "" || req.AuthorizationCode == "" || req.DeviceKey == "" {
+		r.logger.With(c.Request.Context()).Errorf("invalid request")
+		return errors.BadRequest("ID token, authorization code and device key are required", "")
+	}
+
+	authTokens, err := r.service.LoginApple(c.Request.Context(), req.IDToken, req.AuthorizationCode, req.DeviceKey)
+	if err != nil {
+		return err
+	}
+	return c.WriteWithStatus(authTokens, http.StatusOK)
+}
+
+// appleNotifications handles Sign in with Apple server-to-server notifications.
+func (r resource) appleNotifications(c *routing.Context) error {
+	var req struct {
+		Payload string `json:"payload"`
+	}
+
+	if err := c.Read(&req); err != nil || req.Payload == "" {
+		r.logger.With(c.Request.Context()).Errorf("invalid Apple notification: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if err := r.service.HandleAppleNotification(c.Request.Context(), req.Payload); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
 func (r resource) refreshTokens(c *routing.Context) error {
 	var req struct {
 		DeviceKey    string `json:"device_key"`
@@ -102,6 +255,58 @@ func (r resource) getUser(c *routing.Context) error {
 
 	return c.WriteWithStatus(user, http.StatusOK)
 }
+
+// updateUser changes the profile of the current user.
+func (r resource) updateUser(c *routing.Context) error {
+	var req ProfileUpdate
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	user, err := r.service.UpdateProfile(c.Request.Context(), req)
+	if err != nil {
+		return err
+	}
+	return c.WriteWithStatus(user, http.StatusOK)
+}
+
+func (r resource) registerFCMToken(c *routing.Context) error {
+	var req struct {
+		FCMToken string `json:"fcm_token"`
+	}
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if req.FCMToken == "" {
+		r.logger.With(c.Request.Context()).Errorf("invalid request")
+		return errors.BadRequest("FCM token is required", "")
+	}
+
+	if err := r.service.RegisterFCMToken(c.Request.Context(), req.FCMToken); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) unregisterFCMToken(c *routing.Context) error {
+	if err := r.service.RegisterFCMToken(c.Request.Context(), ""); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) deleteUser(c *routing.Context) error {
+	if err := r.service.DeleteAccount(c.Request.Context()); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
 func (r resource) logout(c *routing.Context) error {
 	ctx := c.Request.Context()
 
@@ -126,3 +331,144 @@ func (r resource) logout(c *routing.Context) error {
 
 	return c.WriteWithStatus("success", http.StatusOK)
 }
+
+// linkIdentity attaches a Google or Apple identity to the current anonymous user.
+func (r resource) linkIdentity(c *routing.Context) error {
+	var req struct {
+		Provider          string `json:"provider"`
+		IDToken           string `json:"id_token"`
+		AuthorizationCode string `json:"authorization_code"`
+		DeviceKey         string `json:"device_key"`
+	}
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	provider := entity.AuthMethod(req.Provider)
+	if req.IDToken == "" || req.DeviceKey == "" ||
+		(provider == entity.AuthMethodApple && req.AuthorizationCode == "") {
+		r.logger.With(c.Request.Context()).Errorf("invalid request")
+		return errors.BadRequest("ID token, authorization code and device key are required", "")
+	}
+
+	authTokens, err := r.service.LinkIdentity(c.Request.Context(), provider, req.IDToken, req.AuthorizationCode, req.DeviceKey)
+	if err != nil {
+		return err
+	}
+	return c.WriteWithStatus(authTokens, http.StatusOK)
+}
+
+// changePassword changes the password of the current user.
+func (r resource) changePassword(c *routing.Context) error {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if err := r.service.ChangePassword(c.Request.Context(), req.CurrentPassword, req.NewPassword); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) logoutAll(c *routing.Context) error {
+	if err := r.service.LogoutAll(c.Request.Context()); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) listSessions(c *routing.Context) error {
+	sessions, err := r.service.ListSessions(c.Request.Context())
+	if err != nil {
+		return err
+	}
+	return c.WriteWithStatus(sessions, http.StatusOK)
+}
+
+func (r resource) revokeSession(c *routing.Context) error {
+	if err := r.service.RevokeSession(c.Request.Context(), c.Param("id")); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) banUser(c *routing.Context) error {
+	if err := r.service.BanUser(c.Request.Context(), c.Param("id"), true); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) unbanUser(c *routing.Context) error {
+	if err := r.service.BanUser(c.Request.Context(), c.Param("id"), false); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) setRole(c *routing.Context) error {
+	var req struct {
+		Role string `json:"role"`
+	}
+
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if err := r.service.SetRole(c.Request.Context(), c.Param("id"), entity.Role(req.Role)); err != nil {
+		return err
+	}
+	return c.WriteWithStatus("success", http.StatusOK)
+}
+
+func (r resource) userCacheStats(c *routing.Context) error {
+	return c.WriteWithStatus(r.service.UserCacheStats(), http.StatusOK)
+}
+
+// queryAuthEvents returns a page of the audit log. The events can be filtered by
+// user_id, type, outcome, ip and a created_at range given by from and to in RFC 3339.
+func (r resource) queryAuthEvents(c *routing.Context) error {
+	ctx := c.Request.Context()
+	query := c.Request.URL.Query()
+	filter := AuthEventFilter{
+		UserID:  query.Get("user_id"),
+		Type:    query.Get("type"),
+		Outcome: query.Get("outcome"),
+		IP:      query.Get("ip"),
+	}
+	if filter.UserID != "" {
+		if _, err := uuid.Parse(filter.UserID); err != nil {
+			return errors.BadRequest("The user_id parameter must be a UUID", "invalid_user_id")
+		}
+	}
+	for param, t := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		if value := query.Get(param); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return errors.BadRequest("The "+param+" parameter must be an RFC 3339 time", "invalid_time")
+			}
+			*t = &parsed
+		}
+	}
+
+	count, err := r.service.CountAuthEvents(ctx, filter)
+	if err != nil {
+		return err
+	}
+	pages := pagination.NewFromRequest(c.Request, count)
+	events, err := r.service.QueryAuthEvents(ctx, filter, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = events
+	return c.Write(pages)
+}
@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const appleAudience = "https://appleid.apple.com"
+
+// Apple server-to-server notification event types.
+const (
+	AppleEventEmailDisabled  = "email-disabled"
+	AppleEventEmailEnabled   = "email-enabled"
+	AppleEventConsentRevoked = "consent-revoked"
+	AppleEventAccountDelete  = "account-delete"
+)
+
+// AppleEvent represents an event delivered by Apple's server-to-server notifications.
+type AppleEvent struct {
+	Type           string
+	Subject        string
+	Email          string
+	IsPrivateEmail bool
+}
+
+// AppleVerifier verifies identity tokens and server-to-server notifications signed by Apple.
+type AppleVerifier interface {
+	IdentityVerifier
+	// VerifyNotification verifies the signed payload of a server-to-server notification and returns its event.
+	VerifyNotification(ctx context.Context, payload string) (AppleEvent, error)
+}
+
+type appleVerifier struct {
+	idTokenVerifier
+}
+
+// NewAppleVerifier creates a verifier for tokens Apple issues to one of the given client IDs.
+func NewAppleVerifier(jwksURL string, clientIDs []string) AppleVerifier {
+	return appleVerifier{idTokenVerifier{newJWKS(jwksURL), []string{appleAudience}, clientIDs}}
+}
+
+// VerifyNotification implements AppleVerifier.
+func (v appleVerifier) VerifyNotification(ctx context.Context, payload string) (AppleEvent, error) {
+	claims, err := v.parse(ctx, payload)
+	if err != nil {
+		return AppleEvent{}, err
+	}
+
+	// the events claim is a JSON object encoded as a string
+	raw, _ := claims["events"].(string)
+	var event struct {
+		Type           string      `json:"type"`
+		Sub            string      `json:"sub"`
+		Email          string      `json:"email"`
+		IsPrivateEmail interface{} `json:"is_private_email"`
+	}
+	if err := json.Unmarshal([]byte(raw), &event); err != nil {
+		return AppleEvent{}, fmt.Errorf("invalid events claim: %v", err)
+	}
+	if event.Sub == "" {
+		return AppleEvent{}, fmt.Errorf("missing event subject")
+	}
+
+	return AppleEvent{
+		Type:           event.Type,
+		Subject:        event.Sub,
+		Email:          event.Email,
+		IsPrivateEmail: event.IsPrivateEmail == true || event.IsPrivateEmail == "true",
+	}, nil
+}
+
+// AppleClient calls Sign in with Apple's REST API on behalf of the app.
+type AppleClient interface {
+	// ExchangeCode exchanges an authorization code for an Apple refresh token.
+	ExchangeCode(ctx context.Context, code string) (string, error)
+	// RevokeToken revokes an Apple refresh token, e.g. when the user deletes their account.
+	RevokeToken(ctx context.Context, refreshToken string) error
+}
+
+type appleClient struct {
+	baseURL    string
+	clientID   string
+	teamID     string
+	keyID      string
+	privateKey *ecdsa.PrivateKey
+	httpClient *http.Client
+}
+
+// NewAppleClient creates a client for Apple's token endpoints.
+// The private key is the PEM encoded .p8 key downloaded from the Apple developer portal.
+func NewAppleClient(baseURL, clientID, teamID, keyID, privateKeyPEM string) (AppleClient, error) {
+	c := appleClient{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		clientID:   clientID,
+		teamID:     teamID,
+		keyID:      keyID,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+	if privateKeyPEM != "" {
+		key, err := jwt.ParseECPrivateKeyFromPEM([]byte(privateKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Apple private key: %v", err)
+		}
+		c.privateKey = key
+	}
+	return c, nil
+}
+
+// ExchangeCode implements AppleClient.
+func (c appleClient) ExchangeCode(ctx context.Context, code string) (string, error) {
+	var res struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := c.post(ctx, "/auth/token", url.Values{
+		"code":       {code},
+		"grant_type": {"authorization_code"},
+	}, &res)
+	if err != nil {
+		return "", err
+	}
+	if res.RefreshToken == "" {
+		return "", fmt.Errorf("no refresh token returned by Apple")
+	}
+	return res.RefreshToken, nil
+}
+
+// RevokeToken implements AppleClient.
+func (c appleClient) RevokeToken(ctx context.Context, refreshToken string) error {
+	return c.post(ctx, "/auth/revoke", url.Values{
+		"token":           {refreshToken},
+		"token_type_hint": {"refresh_token"},
+	}, nil)
+}
+
+func (c appleClient) post(ctx context.Context, path string, form url.Values, result interface{}) error {
+	secret, err := c.clientSecret()
+	if err != nil {
+		return err
+	}
+	form.Set("client_id", c.clientID)
+	form.Set("client_secret", secret)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&body)
+		return fmt.Errorf("Apple %s returned status %d: %s", path, res.StatusCode, body.Error)
+	}
+	if result != nil {
+		return json.NewDecoder(res.Body).Decode(result)
+	}
+	return nil
+}
+
+// clientSecret generates the short-lived ES256 JWT Apple requires as the client secret.
+func (c appleClient) clientSecret() (string, error) {
+	if c.privateKey == nil {
+		return "", fmt.Errorf("Sign in with Apple private key is not configured")
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": c.teamID,
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"aud": appleAudience,
+		"sub": c.clientID,
+	})
+	token.Header["kid"] = c.keyID
+	return token.SignedString(c.privateKey)
+}
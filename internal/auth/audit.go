@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	stderr "errors"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/client"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Types of the authentication events recorded in the audit log.
+const (
+	AuthEventRegister          = "register"
+	AuthEventLoginPassword     = "login_password"
+	AuthEventLoginAnonymous    = "login_anonymous"
+	AuthEventLoginGoogle       = "login_google"
+	AuthEventLoginApple        = "login_apple"
+	AuthEventRefresh           = "refresh"
+	AuthEventRefreshTokenReuse = "refresh_token_reuse"
+	AuthEventLogout            = "logout"
+	AuthEventLogoutAll         = "logout_all"
+	AuthEventLinkIdentity      = "link_identity"
+	AuthEventPasswordChange    = "password_change"
+	AuthEventSessionRevoke     = "session_revoke"
+	AuthEventAccountDelete     = "account_delete"
+	AuthEventUserBan           = "user_ban"
+	AuthEventUserUnban         = "user_unban"
+	AuthEventRoleChange        = "role_change"
+)
+
+// AuthEventFilter selects the authentication events returned by an audit log query.
+// Empty fields do not filter anything.
+type AuthEventFilter struct {
+	UserID  string
+	Type    string
+	Outcome string
+	IP      string
+	From    *time.Time
+	To      *time.Time
+}
+
+// expression returns the WHERE expression selecting the events matching the filter.
+func (f AuthEventFilter) expression() dbx.Expression {
+	exps := []dbx.Expression{}
+	for column, value := range map[string]string{"user_id": f.UserID, "type": f.Type, "outcome": f.Outcome, "ip": f.IP} {
+		if value != "" {
+			exps = append(exps, dbx.HashExp{column: value})
+		}
+	}
+	if f.From != nil {
+		exps = append(exps, dbx.NewExp("created_at >= {:from}", dbx.Params{"from": *f.From}))
+	}
+	if f.To != nil {
+		exps = append(exps, dbx.NewExp("created_at < {:to}", dbx.Params{"to": *f.To}))
+	}
+	return dbx.And(exps...)
+}
+
+// recordEvent appends an authentication event to the audit log. The outcome is derived from err.
+// The client and the request are taken from the context. Failing to record the event does not fail the request.
+func (s service) recordEvent(ctx context.Context, eventType, userID, deviceKey string, err error, details string) {
+	info := client.FromContext(ctx)
+	event := entity.AuthEvent{
+		ID:        uuid.New().String(),
+		Type:      eventType,
+		UserID:    nullIfEmpty(userID),
+		IP:        nullIfEmpty(info.IP),
+		UserAgent: nullIfEmpty(truncate(info.UserAgent, 500)),
+		RequestID: nullIfEmpty(log.RequestID(ctx)),
+		Outcome:   entity.AuthEventOutcomeSuccess,
+		Details:   nullIfEmpty(details),
+		CreatedAt: time.Now(),
+	}
+	if _, parseErr := uuid.Parse(userID); parseErr != nil {
+		event.UserID = nil
+	}
+	if deviceKey != "" {
+		hash := sha256.Sum256([]byte(deviceKey))
+		deviceKeyHash := hex.EncodeToString(hash[:])
+		event.DeviceKeyHash = &deviceKeyHash
+	}
+	if err != nil {
+		event.Outcome = entity.AuthEventOutcomeFailure
+		event.Reason = nullIfEmpty(truncate(failureReason(err), 100))
+	}
+
+	if err := s.repo.CreateAuthEvent(ctx, event); err != nil {
+		s.logger.With(ctx, "event", eventType).Errorf("There is an error while recording the auth event %v", err)
+	}
+}
+
+// failureReason returns the error code of the error response, or its message if it has no code.
+func failureReason(err error) string {
+	var res errors.ErrorResponse
+	if stderr.As(err, &res) {
+		if details, ok := res.Details.(map[string]string); ok && details["error_code"] != "" {
+			return details["error_code"]
+		}
+		return res.Message
+	}
+	return "internal_error"
+}
+
+// QueryAuthEvents implements Service.
+func (s service) QueryAuthEvents(ctx context.Context, filter AuthEventFilter, offset, limit int) ([]entity.AuthEvent, error) {
+	return s.repo.QueryAuthEvents(ctx, filter, offset, limit)
+}
+
+// CountAuthEvents implements Service.
+func (s service) CountAuthEvents(ctx context.Context, filter AuthEventFilter) (int, error) {
+	return s.repo.CountAuthEvents(ctx, filter)
+}
+
+// PruneAuthEvents implements Service.
+func (s service) PruneAuthEvents(ctx context.Context) error {
+	if s.auditRetention <= 0 {
+		return nil
+	}
+	deleted, err := s.repo.DeleteAuthEvents(ctx, time.Now().Add(-s.auditRetention))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		s.logger.With(ctx).Infof("pruned %d auth events", deleted)
+	}
+	return nil
+}
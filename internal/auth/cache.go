@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/entity"
+)
+
+// UserCache caches the users looked up by the authentication middleware, so that authenticated requests
+// do not load the user from the database every time. Services changing the credits, the subscription or
+// the profile of a user must invalidate the cached user. Caches are local to a server instance, so other
+// instances may serve a stale user until the cached entry expires.
+type UserCache interface {
+	// Get returns the cached user with the given ID.
+	Get(userID string) (entity.User, bool)
+	// Set caches the user.
+	Set(user entity.User)
+	// Invalidate removes the users with the given IDs from the cache.
+	Invalidate(userIDs ...string)
+	// Stats returns the usage statistics of the cache.
+	Stats() CacheStats
+}
+
+// CacheStats holds the usage statistics of a cache.
+type CacheStats struct {
+	Size     int     `json:"size"`
+	Capacity int     `json:"capacity"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+type lruEntry struct {
+	user      entity.User
+	expiresAt time.Time
+}
+
+// lruUserCache is a UserCache that keeps up to capacity users for ttl, evicting the least recently used user when full.
+type lruUserCache struct {
+	capacity int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits   uint64
+	misses uint64
+}
+
+// NewLRUUserCache creates an in-memory UserCache. A cache with zero capacity or TTL caches nothing.
+func NewLRUUserCache(capacity int, ttl time.Duration) UserCache {
+	return &lruUserCache{
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+// Get implements UserCache.
+func (c *lruUserCache) Get(userID string) (entity.User, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[userID]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return entity.User{}, false
+	}
+	entry := element.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.remove(element)
+		atomic.AddUint64(&c.misses, 1)
+		return entity.User{}, false
+	}
+
+	c.order.MoveToFront(element)
+	atomic.AddUint64(&c.hits, 1)
+	return entry.user, true
+}
+
+// Set implements UserCache.
+func (c *lruUserCache) Set(user entity.User) {
+	if c.capacity <= 0 || c.ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lruEntry{user: user, expiresAt: time.Now().Add(c.ttl)}
+	if element, ok := c.entries[user.ID]; ok {
+		element.Value = entry
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[user.ID] = c.order.PushFront(entry)
+	for c.order.Len() > c.capacity {
+		c.remove(c.order.Back())
+	}
+}
+
+// Invalidate implements UserCache.
+func (c *lruUserCache) Invalidate(userIDs ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, userID := range userIDs {
+		if element, ok := c.entries[userID]; ok {
+			c.remove(element)
+		}
+	}
+}
+
+// Stats implements UserCache.
+func (c *lruUserCache) Stats() CacheStats {
+	c.mu.Lock()
+	size := c.order.Len()
+	c.mu.Unlock()
+
+	stats := CacheStats{
+		Size:     size,
+		Capacity: c.capacity,
+		Hits:     atomic.LoadUint64(&c.hits),
+		Misses:   atomic.LoadUint64(&c.misses),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// remove removes the element from the cache. The caller must hold the lock.
+func (c *lruUserCache) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*lruEntry).user.ID)
+	c.order.Remove(element)
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUUserCache(t *testing.T) {
+	cache := NewLRUUserCache(2, time.Minute)
+	cache.Set(entity.User{ID: "user1"})
+	cache.Set(entity.User{ID: "user2"})
+
+	// user1 becomes the most recently used user, so that caching user3 evicts user2
+	_, ok := cache.Get("user1")
+	assert.True(t, ok)
+	cache.Set(entity.User{ID: "user3"})
+	_, ok = cache.Get("user2")
+	assert.False(t, ok)
+	user, ok := cache.Get("user3")
+	assert.True(t, ok)
+	assert.Equal(t, "user3", user.ID)
+
+	cache.Invalidate("user1", "unknown")
+	_, ok = cache.Get("user1")
+	assert.False(t, ok)
+
+	assert.Equal(t, CacheStats{Size: 1, Capacity: 2, Hits: 2, Misses: 2, HitRatio: 0.5}, cache.Stats())
+}
+
+func TestLRUUserCache_Expired(t *testing.T) {
+	cache := NewLRUUserCache(2, time.Minute)
+	cache.Set(entity.User{ID: "user1"})
+	cache.(*lruUserCache).entries["user1"].Value.(*lruEntry).expiresAt = time.Now().Add(-time.Second)
+
+	_, ok := cache.Get("user1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.Stats().Size)
+}
+
+func TestLRUUserCache_Disabled(t *testing.T) {
+	cache := NewLRUUserCache(0, time.Minute)
+	cache.Set(entity.User{ID: "user1"})
+
+	_, ok := cache.Get("user1")
+	assert.False(t, ok)
+}
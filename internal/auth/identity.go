@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var googleIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// Identity represents a user identity asserted by an external identity provider.
+type Identity struct {
+	// Subject is the provider's stable identifier of the user.
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+// IdentityVerifier verifies ID tokens issued by an external identity provider.
+type IdentityVerifier interface {
+	// Verify checks the signature and the standard claims of the given ID token.
+	// It returns the identity asserted by the token if the token is valid.
+	Verify(ctx context.Context, idToken string) (Identity, error)
+}
+
+// idTokenVerifier verifies RS256 signed OpenID Connect ID tokens against a JWKS.
+type idTokenVerifier struct {
+	keys      *jwks
+	issuers   []string
+	audiences []string
+}
+
+// NewGoogleVerifier creates a verifier for Google ID tokens issued to one of the given client IDs.
+func NewGoogleVerifier(jwksURL string, clientIDs []string) IdentityVerifier {
+	return idTokenVerifier{newJWKS(jwksURL), googleIssuers, clientIDs}
+}
+
+// Verify implements IdentityVerifier.
+// Unlike the JWT parser, which only checks the expiration of the tokens which have one, an ID token must expire.
+func (v idTokenVerifier) Verify(ctx context.Context, idToken string) (Identity, error) {
+	claims, err := v.parse(ctx, idToken)
+	if err != nil {
+		return Identity{}, err
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return Identity{}, fmt.Errorf("missing or expired exp claim")
+	}
+
+	identity := Identity{}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	switch verified := claims["email_verified"].(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	}
+	if identity.Subject == "" {
+		return Identity{}, fmt.Errorf("missing sub claim")
+	}
+	return identity, nil
+}
+
+// parse verifies the signature, expiration, issuer and audience of the given token and returns its claims.
+func (v idTokenVerifier) parse(ctx context.Context, token string) (jwt.MapClaims, error) {
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodRS256.Alg()}}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.Key(ctx, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	iss, _ := claims["iss"].(string)
+	if !contains(v.issuers, iss) {
+		return nil, fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if !v.hasValidAudience(claims["aud"]) {
+		return nil, fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+// hasValidAudience reports whether the aud claim, which can be a string or an array, contains an accepted audience.
+func (v idTokenVerifier) hasValidAudience(aud interface{}) bool {
+	switch aud := aud.(type) {
+	case string:
+		return contains(v.audiences, aud)
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && contains(v.audiences, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
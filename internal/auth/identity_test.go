@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestJWKS starts a JWKS server publishing the public key of the given private key under the key ID.
+func newTestJWKS(t *testing.T, kid string, key *rsa.PrivateKey) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func signTestToken(t *testing.T, kid string, key *rsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestGoogleVerifier_Verify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestJWKS(t, "key1", key)
+	verifier := NewGoogleVerifier(server.URL, []string{"client1"})
+
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"iss":            "https://accounts.google.com",
+			"aud":            "client1",
+			"sub":            "123",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"valid", signTestToken(t, "key1", key, claims(nil)), false},
+		{"audience in array", signTestToken(t, "key1", key, claims(jwt.MapClaims{"aud": []string{"other", "client1"}})), false},
+		{"missing exp", signTestToken(t, "key1", key, claims(jwt.MapClaims{"exp": nil})), true},
+		{"expired", signTestToken(t, "key1", key, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), true},
+		{"wrong issuer", signTestToken(t, "key1", key, claims(jwt.MapClaims{"iss": "https://example.com"})), true},
+		{"wrong audience", signTestToken(t, "key1", key, claims(jwt.MapClaims{"aud": "other"})), true},
+		{"missing sub", signTestToken(t, "key1", key, claims(jwt.MapClaims{"sub": nil})), true},
+		{"unknown key", signTestToken(t, "key2", key, claims(nil)), true},
+		{"wrong signature", signTestToken(t, "key1", otherKey, claims(nil)), true},
+		{"malformed", "not-a-token", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			identity, err := verifier.Verify(context.Background(), tc.token)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, Identity{Subject: "123", Email: "user@example.com", EmailVerified: true}, identity)
+			}
+		})
+	}
+}
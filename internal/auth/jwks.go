@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSCacheDuration = time.Hour
+	minJWKSRefreshInterval   = time.Minute
+)
+
+var maxAgeRegex = regexp.MustCompile(`max-age=(\d+)`)
+
+// jwks caches the public keys published by an identity provider as a JSON Web Key Set.
+// Keys are refreshed when the cache expires or when a token refers to an unknown key ID.
+type jwks struct {
+	url        string
+	httpClient *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	expiresAt   time.Time
+	lastFetched time.Time
+}
+
+func newJWKS(url string) *jwks {
+	return &jwks{
+		url:        url,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		keys:       map[string]*rsa.PublicKey{},
+	}
+}
+
+// Key returns the RSA public key with the given key ID.
+func (j *jwks) Key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	j.mu.RLock()
+	key, ok := j.keys[kid]
+	fresh := time.Now().Before(j.expiresAt)
+	recentlyFetched := time.Since(j.lastFetched) < minJWKSRefreshInterval
+	j.mu.RUnlock()
+
+	if ok && fresh {
+		return key, nil
+	}
+	if !fresh || !recentlyFetched {
+		if err := j.refresh(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+func (j *jwks) refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := j.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d while fetching %s", res.StatusCode, j.url)
+	}
+
+	var body struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range body.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("invalid modulus for key %q: %v", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("invalid exponent for key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	cacheDuration := defaultJWKSCacheDuration
+	if m := maxAgeRegex.FindStringSubmatch(res.Header.Get("Cache-Control")); m != nil {
+		if seconds, err := strconv.Atoi(m[1]); err == nil {
+			cacheDuration = time.Duration(seconds) * time.Second
+		}
+	}
+
+	now := time.Now()
+	j.mu.Lock()
+	j.keys = keys
+	j.expiresAt = now.Add(cacheDuration)
+	j.lastFetched = now
+	j.mu.Unlock()
+
+	return nil
+}
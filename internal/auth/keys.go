@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Supported algorithms of the asymmetric access token keys.
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// SigningMethodEdDSA signs tokens with Ed25519 as described in RFC 8037.
+var SigningMethodEdDSA = &signingMethodEdDSA{}
+
+func init() {
+	jwt.RegisterSigningMethod(SigningMethodEdDSA.Alg(), func() jwt.SigningMethod {
+		return SigningMethodEdDSA
+	})
+}
+
+type signingMethodEdDSA struct{}
+
+// Alg implements jwt.SigningMethod.
+func (m *signingMethodEdDSA) Alg() string {
+	return AlgorithmEdDSA
+}
+
+// Verify implements jwt.SigningMethod.
+func (m *signingMethodEdDSA) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// Sign implements jwt.SigningMethod.
+func (m *signingMethodEdDSA) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+// Key is an asymmetric key pair used to sign and verify access tokens.
+// A key without a private part can only verify tokens, which is how retired keys are kept around.
+type Key struct {
+	ID         string
+	method     jwt.SigningMethod
+	privateKey interface{}
+	publicKey  interface{}
+}
+
+// ParseKey parses a PEM encoded RS256 or EdDSA key. Either of the private and public keys may be empty,
+// in which case the public key is derived from the private key.
+func ParseKey(id, algorithm, privateKeyPEM, publicKeyPEM string) (Key, error) {
+	key := Key{ID: id}
+	var err error
+
+	switch algorithm {
+	case AlgorithmRS256:
+		key.method = jwt.SigningMethodRS256
+		if privateKeyPEM != "" {
+			var privateKey *rsa.PrivateKey
+			if privateKey, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(privateKeyPEM)); err == nil {
+				key.privateKey, key.publicKey = privateKey, &privateKey.PublicKey
+			}
+		} else {
+			key.publicKey, err = jwt.ParseRSAPublicKeyFromPEM([]byte(publicKeyPEM))
+		}
+	case AlgorithmEdDSA:
+		key.method = SigningMethodEdDSA
+		if privateKeyPEM != "" {
+			var privateKey interface{}
+			if privateKey, err = parsePEM(privateKeyPEM, x509.ParsePKCS8PrivateKey); err == nil {
+				edKey, ok := privateKey.(ed25519.PrivateKey)
+				if !ok {
+					return key, fmt.Errorf("key %q is not an Ed25519 private key", id)
+				}
+				key.privateKey, key.publicKey = edKey, edKey.Public()
+			}
+		} else {
+			if key.publicKey, err = parsePEM(publicKeyPEM, x509.ParsePKIXPublicKey); err == nil {
+				if _, ok := key.publicKey.(ed25519.PublicKey); !ok {
+					return key, fmt.Errorf("key %q is not an Ed25519 public key", id)
+				}
+			}
+		}
+	default:
+		return key, fmt.Errorf("unsupported algorithm %q for key %q", algorithm, id)
+	}
+
+	if err != nil {
+		return key, fmt.Errorf("invalid key %q: %v", id, err)
+	}
+	return key, nil
+}
+
+func parsePEM(value string, parse func([]byte) (interface{}, error)) (interface{}, error) {
+	block, _ := pem.Decode([]byte(value))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	return parse(block.Bytes)
+}
+
+// KeySet holds the keys that sign and verify access tokens.
+// New tokens are signed with the active key and carry its ID in the "kid" header, so that tokens
+// signed with an older key keep being accepted as long as that key is in the set.
+type KeySet struct {
+	active  *Key
+	keys    map[string]Key
+	hmacKey []byte
+}
+
+// NewKeySet creates a key set that signs with the key identified by activeKeyID.
+// If activeKeyID is empty, tokens are signed with HS256 using hmacKey, which is also
+// used to verify tokens without a "kid" header issued before asymmetric keys were introduced.
+// An empty hmacKey stops accepting HS256 tokens, which requires an active key.
+func NewKeySet(activeKeyID, hmacKey string, keys ...Key) (*KeySet, error) {
+	if activeKeyID == "" && hmacKey == "" {
+		return nil, fmt.Errorf("an active key is required when HS256 is disabled")
+	}
+	ks := &KeySet{keys: map[string]Key{}, hmacKey: []byte(hmacKey)}
+	for _, key := range keys {
+		ks.keys[key.ID] = key
+	}
+
+	if activeKeyID != "" {
+		key, ok := ks.keys[activeKeyID]
+		if !ok {
+			return nil, fmt.Errorf("active key %q is not configured", activeKeyID)
+		}
+		if key.privateKey == nil {
+			return nil, fmt.Errorf("active key %q has no private key", activeKeyID)
+		}
+		ks.active = &key
+	}
+	return ks, nil
+}
+
+// Sign creates a signed token with the given claims.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	if ks.active == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.hmacKey)
+	}
+	token := jwt.NewWithClaims(ks.active.method, claims)
+	token.Header["kid"] = ks.active.ID
+	return token.SignedString(ks.active.privateKey)
+}
+
+// Parse parses and validates a token signed by one of the keys in the set.
+func (ks *KeySet) Parse(tokenString string) (*jwt.Token, error) {
+	return jwt.Parse(tokenString, ks.verificationKey)
+}
+
+// verificationKey selects the key that verifies the token by the token's "kid" header.
+func (ks *KeySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		if token.Method != jwt.SigningMethodHS256 || len(ks.hmacKey) == 0 {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return ks.hmacKey, nil
+	}
+
+	key, ok := ks.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+	}
+	return key.publicKey, nil
+}
+
+// JWKS returns the public keys of the set as a JSON Web Key Set.
+func (ks *KeySet) JWKS() map[string]interface{} {
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	keys := []map[string]string{}
+	for _, id := range ids {
+		key := ks.keys[id]
+		jwk := map[string]string{
+			"kid": key.ID,
+			"alg": key.method.Alg(),
+			"use": "sig",
+		}
+		switch publicKey := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(publicKey)
+		}
+		keys = append(keys, jwk)
+	}
+	return map[string]interface{}{"keys": keys}
+}
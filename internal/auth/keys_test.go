@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestKeys returns the PEM encoded private and public keys of a new key pair of the given algorithm.
+func newTestKeys(t *testing.T, algorithm string) (string, string) {
+	var privateKey, publicKey interface{}
+	if algorithm == AlgorithmRS256 {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		assert.NoError(t, err)
+		privateKey, publicKey = key, &key.PublicKey
+	} else {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		assert.NoError(t, err)
+		privateKey, publicKey = private, public
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	assert.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}))
+}
+
+func TestParseKey(t *testing.T) {
+	rsaPrivate, rsaPublic := newTestKeys(t, AlgorithmRS256)
+	edPrivate, edPublic := newTestKeys(t, AlgorithmEdDSA)
+
+	tests := []struct {
+		name       string
+		algorithm  string
+		private    string
+		public     string
+		wantErr    bool
+		wantSigner bool
+	}{
+		{"RS256 private key", AlgorithmRS256, rsaPrivate, "", false, true},
+		{"RS256 public key", AlgorithmRS256, "", rsaPublic, false, false},
+		{"EdDSA private key", AlgorithmEdDSA, edPrivate, "", false, true},
+		{"EdDSA public key", AlgorithmEdDSA, "", edPublic, false, false},
+		{"EdDSA with an RSA key", AlgorithmEdDSA, "", rsaPublic, true, false},
+		{"invalid PEM", AlgorithmEdDSA, "invalid", "", true, false},
+		{"unsupported algorithm", "HS512", rsaPrivate, "", true, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, err := ParseKey("key1", tc.algorithm, tc.private, tc.public)
+			assert.Equal(t, tc.wantErr, err != nil)
+			if err == nil {
+				assert.Equal(t, "key1", key.ID)
+				assert.Equal(t, tc.wantSigner, key.privateKey != nil)
+				assert.NotNil(t, key.publicKey)
+			}
+		})
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	rsaPrivate, _ := newTestKeys(t, AlgorithmRS256)
+	edPrivate, edPublic := newTestKeys(t, AlgorithmEdDSA)
+	oldKey, err := ParseKey("old", AlgorithmRS256, rsaPrivate, "")
+	assert.NoError(t, err)
+	newKey, err := ParseKey("new", AlgorithmEdDSA, edPrivate, "")
+	assert.NoError(t, err)
+	newPublicKey, err := ParseKey("new", AlgorithmEdDSA, "", edPublic)
+	assert.NoError(t, err)
+	claims := jwt.MapClaims{"id": "user1"}
+
+	legacy, err := NewKeySet("", "secret", oldKey)
+	assert.NoError(t, err)
+	legacyToken, err := legacy.Sign(claims)
+	assert.NoError(t, err)
+	old, err := NewKeySet("old", "secret", oldKey)
+	assert.NoError(t, err)
+	oldToken, err := old.Sign(claims)
+	assert.NoError(t, err)
+
+	// the old key is retired, but still verifies the tokens it has signed
+	ks, err := NewKeySet("new", "secret", oldKey, newKey)
+	assert.NoError(t, err)
+	newToken, err := ks.Sign(claims)
+	assert.NoError(t, err)
+	for _, tokenString := range []string{legacyToken, oldToken, newToken} {
+		token, err := ks.Parse(tokenString)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "user1", token.Claims.(jwt.MapClaims)["id"])
+		}
+	}
+	token, _ := ks.Parse(newToken)
+	assert.Equal(t, "new", token.Header["kid"])
+	assert.Equal(t, "EdDSA", token.Header["alg"])
+
+	// HS256 tokens are rejected once HS256 is disabled
+	strict, err := NewKeySet("new", "", newKey)
+	assert.NoError(t, err)
+	_, err = strict.Parse(legacyToken)
+	assert.Error(t, err)
+	_, err = strict.Parse(oldToken)
+	assert.Error(t, err)
+	_, err = strict.Parse(newToken)
+	assert.NoError(t, err)
+
+	_, err = NewKeySet("", "")
+	assert.Error(t, err)
+	_, err = NewKeySet("unknown", "secret", oldKey)
+	assert.Error(t, err)
+	_, err = NewKeySet("new", "secret", newPublicKey)
+	assert.Error(t, err)
+}
+
+func TestKeySet_JWKS(t *testing.T) {
+	rsaPrivate, _ := newTestKeys(t, AlgorithmRS256)
+	_, edPublic := newTestKeys(t, AlgorithmEdDSA)
+	rsaKey, err := ParseKey("b", AlgorithmRS256, rsaPrivate, "")
+	assert.NoError(t, err)
+	edKey, err := ParseKey("a", AlgorithmEdDSA, "", edPublic)
+	assert.NoError(t, err)
+	ks, err := NewKeySet("b", "secret", rsaKey, edKey)
+	assert.NoError(t, err)
+
+	keys := ks.JWKS()["keys"].([]map[string]string)
+	if assert.Len(t, keys, 2) {
+		assert.Equal(t, map[string]string{"kid": "a", "alg": "EdDSA", "use": "sig", "kty": "OKP", "crv": "Ed25519", "x": keys[0]["x"]}, keys[0])
+		assert.NotEmpty(t, keys[0]["x"])
+		assert.Equal(t, "b", keys[1]["kid"])
+		assert.Equal(t, "RS256", keys[1]["alg"])
+		assert.Equal(t, "RSA", keys[1]["kty"])
+		assert.Equal(t, "AQAB", keys[1]["e"])
+		assert.NotContains(t, keys[1], "d")
+	}
+}
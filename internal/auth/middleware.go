@@ -2,39 +2,121 @@ package auth
 
 import (
 	"context"
+	stderr "errors"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	routing "github.com/go-ozzo/ozzo-routing/v2"
 	"github.com/go-ozzo/ozzo-routing/v2/auth"
 	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
 )
 
 // Handler returns a JWT-based authentication middleware.
-func Handler(verificationKey string, service Service) routing.Handler {
-	return auth.JWT(verificationKey, auth.JWTOptions{
-		TokenHandler: func(c *routing.Context, token *jwt.Token) error {
-			return handleToken(c, token, service)
-		},
-	})
+// The token is verified with the key of the key set selected by the token's "kid" header.
+// Why a token is invalid is not disclosed, only the errors of the service, e.g. a revoked token, are returned as they are.
+func Handler(keys *KeySet, service Service) routing.Handler {
+	return func(c *routing.Context) error {
+		header := c.Request.Header.Get("Authorization")
+		var err error = routing.NewHTTPError(http.StatusUnauthorized)
+		if strings.HasPrefix(header, "Bearer ") {
+			token, parseErr := keys.Parse(header[7:])
+			if parseErr == nil && token.Valid {
+				err = handleToken(c, token, service)
+			}
+			if err == nil {
+				return nil
+			}
+		}
+
+		c.Response.Header().Set("WWW-Authenticate", `Bearer realm="`+auth.DefaultRealm+`"`)
+		var errorResponse errors.ErrorResponse
+		if stderr.As(err, &errorResponse) {
+			return err
+		}
+		return routing.NewHTTPError(http.StatusUnauthorized)
+	}
 }
 
 // handleToken stores the user identity in the request context so that it can be accessed elsewhere.
+// Revoked tokens are rejected.
 func handleToken(c *routing.Context, token *jwt.Token, service Service) error {
 	ctx := c.Request.Context()
-	userID := token.Claims.(jwt.MapClaims)["id"].(string)
-	user, err := service.GetUser(ctx, userID)
+	claims := parseAccessTokenClaims(token.Claims.(jwt.MapClaims))
+	user, err := service.Authenticate(ctx, claims)
 	if err != nil {
 		return err
 	}
 	ctx = WithUser(ctx, user)
+	ctx = context.WithValue(ctx, tokenKey, claims)
 	c.Request = c.Request.WithContext(ctx)
 	return nil
 }
 
+// parseAccessTokenClaims extracts the claims of an access token. Tokens issued before the jti and iat
+// claims were introduced have an empty ID and a zero issue time. The issue time is taken from the iat_ms claim
+// when the token has one, and from iat otherwise.
+func parseAccessTokenClaims(claims jwt.MapClaims) AccessTokenClaims {
+	var result AccessTokenClaims
+	result.ID, _ = claims["jti"].(string)
+	result.UserID, _ = claims["id"].(string)
+	result.SessionID, _ = claims["sid"].(string)
+	if iat, ok := claims["iat_ms"].(float64); ok {
+		result.IssuedAt = time.UnixMilli(int64(iat))
+	} else if iat, ok := claims["iat"].(float64); ok {
+		result.IssuedAt = time.Unix(int64(iat), 0)
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		result.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return result
+}
+
+// RequireRole returns a middleware that only lets users with one of the given roles through.
+// It must be used after the authentication middleware.
+func RequireRole(roles ...entity.Role) routing.Handler {
+	return func(c *routing.Context) error {
+		user := CurrentUser(c.Request.Context())
+		if user == nil {
+			return errors.Unauthorized("")
+		}
+		if !user.HasRole(roles...) {
+			return errors.Forbidden("")
+		}
+		return nil
+	}
+}
+
+// deviceHandler stores the device name and platform reported by the client in the request context,
+// so that they can be recorded with the session created by the request.
+func deviceHandler(c *routing.Context) error {
+	name := c.Request.Header.Get("X-Device-Name")
+	platform := c.Request.Header.Get("X-Device-Platform")
+	if name != "" || platform != "" {
+		ctx := context.WithValue(c.Request.Context(), deviceKey, entity.Device{
+			Name:     truncate(name, 100),
+			Platform: truncate(platform, 20),
+		})
+		c.Request = c.Request.WithContext(ctx)
+	}
+	return nil
+}
+
+func truncate(value string, length int) string {
+	if runes := []rune(value); len(runes) > length {
+		return string(runes[:length])
+	}
+	return value
+}
+
 type contextKey int
 
 const (
 	userKey contextKey = iota
+	tokenKey
+	deviceKey
 )
 
 // WithUser returns a context that contains the user identity from the given JWT.
@@ -50,3 +132,22 @@ func CurrentUser(ctx context.Context) *entity.User {
 	}
 	return nil
 }
+
+// CurrentSessionID returns the ID of the session the access token of the request was issued for.
+// An empty string is returned if the session is unknown.
+func CurrentSessionID(ctx context.Context) string {
+	return currentAccessToken(ctx).SessionID
+}
+
+// currentAccessToken returns the claims of the access token of the request.
+func currentAccessToken(ctx context.Context) AccessTokenClaims {
+	claims, _ := ctx.Value(tokenKey).(AccessTokenClaims)
+	return claims
+}
+
+// currentDevice returns the device with the given key and the name and platform reported by the client.
+func currentDevice(ctx context.Context, key string) entity.Device {
+	device, _ := ctx.Value(deviceKey).(entity.Device)
+	device.Key = key
+	return device
+}
@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/test"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+func TestRequireRole(t *testing.T) {
+	logger, _ := log.NewForTest()
+	router := test.MockRouter(logger)
+	authenticate := func(c *routing.Context) error {
+		if role := c.Request.Header.Get("X-Role"); role != "" {
+			c.Request = c.Request.WithContext(WithUser(c.Request.Context(), entity.User{ID: "user1", Role: entity.Role(role)}))
+		}
+		return nil
+	}
+	router.Get("/admin", authenticate, RequireRole(entity.RoleAdmin, entity.RoleSupport), func(c *routing.Context) error {
+		return c.Write("ok")
+	})
+
+	tests := []test.APITestCase{
+		{Name: "admin", Method: "GET", URL: "/admin", Header: header("X-Role", "admin"), WantStatus: http.StatusOK, WantResponse: `"ok"`},
+		{Name: "support", Method: "GET", URL: "/admin", Header: header("X-Role", "support"), WantStatus: http.StatusOK, WantResponse: `"ok"`},
+		{Name: "user", Method: "GET", URL: "/admin", Header: header("X-Role", "user"), WantStatus: http.StatusForbidden},
+		{Name: "unauthenticated", Method: "GET", URL: "/admin", WantStatus: http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+}
+
+func header(key, value string) http.Header {
+	h := http.Header{}
+	h.Set(key, value)
+	return h
+}
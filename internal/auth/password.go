@@ -0,0 +1,46 @@
+package auth
+
+import (
+	"regexp"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// maxFailedLoginAttempts is the number of consecutive failed logins after which an account is locked.
+	maxFailedLoginAttempts = 5
+	// lockoutDuration is how long an account stays locked after too many failed logins.
+	lockoutDuration = 15 * time.Minute
+)
+
+var usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// dummyPasswordHash is compared against when the username does not exist,
+// so that unknown usernames take as long to reject as wrong passwords.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+// hashPassword returns the bcrypt hash of the given password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// comparePassword reports whether the password matches the hash. The comparison is done in constant time.
+func comparePassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// validatePassword validates the length of a new password. bcrypt only uses the first 72 bytes.
+func validatePassword(password string) error {
+	return validation.Validate(password, validation.Required, validation.Length(8, 72))
+}
+
+// validateCredentials validates the username and password of a new account.
+func validateCredentials(username, password string) error {
+	return validation.Errors{
+		"username": validation.Validate(username, validation.Required, validation.Length(3, 50), validation.Match(usernameRegex)),
+		"password": validatePassword(password),
+	}.Filter()
+}
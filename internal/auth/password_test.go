@@ -0,0 +1,41 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPassword(t *testing.T) {
+	hash, err := hashPassword("correct horse")
+	if assert.NoError(t, err) {
+		assert.NotEqual(t, "correct horse", hash)
+		assert.True(t, comparePassword(hash, "correct horse"))
+		assert.False(t, comparePassword(hash, "wrong horse"))
+		assert.False(t, comparePassword("not a hash", "correct horse"))
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{"valid", "john.doe_1", "password", false},
+		{"missing username", "", "password", true},
+		{"short username", "jo", "password", true},
+		{"invalid username", "john doe", "password", true},
+		{"missing password", "johndoe", "", true},
+		{"short password", "johndoe", "passwor", true},
+		{"longest password", "johndoe", strings.Repeat("p", 72), false},
+		{"long password", "johndoe", strings.Repeat("p", 73), true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.wantErr, validateCredentials(tc.username, tc.password) != nil)
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+// maxNameAttempts is the number of generated names tried before creating a user fails.
+const maxNameAttempts = 5
+
+var (
+	handleRegex = regexp.MustCompile(`^[a-z0-9_]+$`)
+	localeRegex = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+)
+
+var (
+	nameAdjectives = []string{
+		"Amber", "Bold", "Brave", "Bright", "Calm", "Clever", "Cosmic", "Curious", "Daring", "Eager",
+		"Gentle", "Golden", "Happy", "Jolly", "Kind", "Lively", "Lucky", "Mellow", "Merry", "Misty",
+		"Noble", "Quiet", "Rapid", "Rosy", "Silver", "Sleepy", "Sunny", "Swift", "Vivid", "Witty",
+	}
+	nameAnimals = []string{
+		"Badger", "Bear", "Beaver", "Crane", "Dolphin", "Eagle", "Falcon", "Fox", "Gecko", "Heron",
+		"Koala", "Lynx", "Marten", "Moose", "Otter", "Owl", "Panda", "Puffin", "Rabbit", "Raven",
+		"Robin", "Seal", "Sparrow", "Squirrel", "Swan", "Tiger", "Turtle", "Walrus", "Whale", "Wolf",
+	}
+)
+
+// generateName returns a random human-friendly name such as "SunnyOtter4821".
+func generateName() string {
+	return fmt.Sprintf("%s%s%04d",
+		nameAdjectives[rand.Intn(len(nameAdjectives))],
+		nameAnimals[rand.Intn(len(nameAnimals))],
+		rand.Intn(10000),
+	)
+}
+
+// ProfileUpdate holds the profile fields of a user to be changed. Fields that are nil are left unchanged.
+type ProfileUpdate struct {
+	Name   *string `json:"name"`
+	Handle *string `json:"handle"`
+	Locale *string `json:"locale"`
+}
+
+// normalize trims the fields and converts the handle to lowercase and the locale to a BCP 47 tag.
+func (p *ProfileUpdate) normalize() {
+	if p.Name != nil {
+		name := strings.TrimSpace(*p.Name)
+		p.Name = &name
+	}
+	if p.Handle != nil {
+		handle := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(*p.Handle), "@"))
+		p.Handle = &handle
+	}
+	if p.Locale != nil {
+		locale := strings.ReplaceAll(strings.TrimSpace(*p.Locale), "_", "-")
+		p.Locale = &locale
+	}
+}
+
+// Validate validates the ProfileUpdate fields. An empty locale clears the locale.
+func (p ProfileUpdate) Validate() error {
+	return validation.ValidateStruct(&p,
+		validation.Field(&p.Name, validation.NilOrNotEmpty, validation.Length(1, 50)),
+		validation.Field(&p.Handle, validation.NilOrNotEmpty, validation.Length(3, 30), validation.Match(handleRegex)),
+		validation.Field(&p.Locale, validation.Length(0, 35), validation.Match(localeRegex)),
+	)
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateName(t *testing.T) {
+	name := generateName()
+	assert.Regexp(t, regexp.MustCompile(`^[A-Z][a-z]+[A-Z][a-z]+\d{4}$`), name)
+}
+
+func TestProfileUpdate(t *testing.T) {
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name    string
+		profile ProfileUpdate
+		want    ProfileUpdate
+		wantErr bool
+	}{
+		{"nothing", ProfileUpdate{}, ProfileUpdate{}, false},
+		{"normalized", ProfileUpdate{Name: str(" John "), Handle: str(" @John_Doe"), Locale: str("pt_BR")},
+			ProfileUpdate{Name: str("John"), Handle: str("john_doe"), Locale: str("pt-BR")}, false},
+		{"empty locale", ProfileUpdate{Locale: str("")}, ProfileUpdate{Locale: str("")}, false},
+		{"empty name", ProfileUpdate{Name: str("  ")}, ProfileUpdate{Name: str("")}, true},
+		{"short handle", ProfileUpdate{Handle: str("jd")}, ProfileUpdate{Handle: str("jd")}, true},
+		{"invalid handle", ProfileUpdate{Handle: str("john.doe")}, ProfileUpdate{Handle: str("john.doe")}, true},
+		{"invalid locale", ProfileUpdate{Locale: str("english")}, ProfileUpdate{Locale: str("english")}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.profile.normalize()
+			assert.Equal(t, tc.want, tc.profile)
+			assert.Equal(t, tc.wantErr, tc.profile.Validate() != nil)
+		})
+	}
+}
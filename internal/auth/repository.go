@@ -2,7 +2,9 @@ package auth
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	dbx "github.com/go-ozzo/ozzo-dbx"
@@ -12,13 +14,50 @@ import (
 	"github.com/qiangxue/go-rest-api/pkg/log"
 )
 
+const refreshTokenLifetime = time.Hour * 24 * 7
+
+// ErrRefreshTokenRevoked is returned when a refresh token is rotated after it has been revoked.
+var ErrRefreshTokenRevoked = errors.New("refresh token is revoked")
+
 type Repository interface {
 	GetUserByDeviceKey(ctx context.Context, deviceKey string) (entity.User, error)
+	GetUserByAuthID(ctx context.Context, authMethod entity.AuthMethod, authID string) (entity.User, error)
 	GetUserByUserID(ctx context.Context, userID string) (entity.User, error)
 	CreateAnonymousUser(ctx context.Context, deviceKey string) (entity.User, error)
-	CreateNewRefreshToken(ctx context.Context, deviceKey, userID, hashedValue string) error
-	ValidateRefreshToken(ctx context.Context, deviceKey, hashedValue string) (string, error)
+	CreateUser(ctx context.Context, authMethod entity.AuthMethod, authID string) (entity.User, error)
+	CreateNewRefreshToken(ctx context.Context, device entity.Device, userID, hashedValue string) (string, error)
+	GetRefreshToken(ctx context.Context, deviceKey, hashedValue string) (entity.RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, parent entity.RefreshToken, device entity.Device, hashedValue string) error
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	DeleteStaleRefreshTokens(ctx context.Context, before time.Time) (int64, error)
+	CreateAuthEvent(ctx context.Context, event entity.AuthEvent) error
+	CountAuthEvents(ctx context.Context, filter AuthEventFilter) (int, error)
+	QueryAuthEvents(ctx context.Context, filter AuthEventFilter, offset, limit int) ([]entity.AuthEvent, error)
+	DeleteAuthEvents(ctx context.Context, before time.Time) (int64, error)
+	ListSessions(ctx context.Context, userID string) ([]entity.Session, error)
+	RevokeSession(ctx context.Context, userID, sessionID string) (bool, error)
 	InvalidateRefreshToken(ctx context.Context, userID string, deviceKey string) error
+	RevokeAllRefreshTokens(ctx context.Context, userID string) error
+	UpdateEmail(ctx context.Context, userID, email string, disabled bool) error
+	SoftDeleteUser(ctx context.Context, userID string) error
+	SetBanned(ctx context.Context, userID string, banned bool) (bool, error)
+	SetRole(ctx context.Context, userID string, role entity.Role) (bool, error)
+	UpdateProfile(ctx context.Context, userID string, profile ProfileUpdate) error
+	SetFCMToken(ctx context.Context, userID, fcmToken string) error
+	SaveAppleRefreshToken(ctx context.Context, userID, refreshToken string) error
+	GetAppleRefreshToken(ctx context.Context, userID string) (string, error)
+	DeleteAppleRefreshToken(ctx context.Context, userID string) error
+	LinkIdentity(ctx context.Context, userID string, authMethod entity.AuthMethod, authID string) error
+	MoveCredits(ctx context.Context, fromUserID, toUserID string) error
+	CopySubscription(ctx context.Context, fromUserID, toUserID string) error
+	MoveFiles(ctx context.Context, fromUserID, toUserID string) error
+	MoveAlbums(ctx context.Context, fromUserID, toUserID string) error
+	CreateCredential(ctx context.Context, userID, username, passwordHash string) error
+	GetCredentialByUsername(ctx context.Context, username string) (entity.Credential, error)
+	GetCredentialByUserID(ctx context.Context, userID string) (entity.Credential, error)
+	UpdateFailedAttempts(ctx context.Context, userID string, failedAttempts int, lockedUntil *time.Time) error
+	IncrementFailedAttempts(ctx context.Context, userID string, maxAttempts int, lockedUntil time.Time) (entity.Credential, error)
+	UpdatePasswordHash(ctx context.Context, userID, passwordHash string) error
 }
 
 type repistory struct {
@@ -35,11 +74,16 @@ func NewRepository(
 
 // GetUserByDeviceKey implements Repository.
 func (r repistory) GetUserByDeviceKey(ctx context.Context, deviceKey string) (entity.User, error) {
+	return r.GetUserByAuthID(ctx, entity.AuthMethodAnonymous, deviceKey)
+}
+
+// GetUserByAuthID implements Repository.
+func (r repistory) GetUserByAuthID(ctx context.Context, authMethod entity.AuthMethod, authID string) (entity.User, error) {
 	var user entity.User
 
-	err := r.db.With(ctx).Select("id", "name").From("public.user").Where(dbx.HashExp{
-		"auth_method": entity.AuthMethodAnonymous,
-		"auth_id":     deviceKey,
+	err := r.db.With(ctx).Select("id", "name", "role", "banned_at").From("public.user").Where(dbx.HashExp{
+		"auth_method": authMethod,
+		"auth_id":     authID,
 		"deleted_at":  nil,
 	}).One(&user)
 
@@ -53,35 +97,45 @@ func (r repistory) GetUserByUserID(ctx context.Context, userID string) (entity.U
 	var userDTO struct {
 		ID                    string     `db:"id"`
 		Name                  string     `db:"name"`
+		Handle                *string    `db:"handle"`
+		Locale                *string    `db:"locale"`
+		AvatarURL             *string    `db:"avatar_url"`
 		CustomerID            string     `db:"customer_id"`
 		FCMToken              *string    `db:"fcm_token"`
 		IsNewUser             bool       `db:"is_new_user"`
 		AuthMethod            string     `db:"auth_method"`
 		AuthID                string     `db:"auth_id"`
 		Credits               int        `db:"credits"`
-		CreditsExpiresAt      *time.Time `db:"credits_expires_at"`
 		SubscriptionPlan      *string    `db:"subscription_plan"`
 		SubscriptionExpiresAt *time.Time `db:"subscription_expires_at"`
+		SubscriptionGraceEnd  *time.Time `db:"subscription_grace_expires_at"`
 		SubscriptionStatus    *string    `db:"subscription_status"`
 		SubscriptionPeriod    *string    `db:"subscription_period"`
 		SubscriptionType      *string    `db:"subscription_type"`
+		Role                  string     `db:"role"`
+		BannedAt              *time.Time `db:"banned_at"`
 	}
 
 	err := r.db.With(ctx).Select(
 		"id",
 		"name",
+		"handle",
+		"locale",
+		"avatar_url",
 		"customer_id",
 		"fcm_token",
 		"is_new_user",
 		"auth_method",
 		"auth_id",
-		"credits",
-		"credits_expires_at",
+		"credit_balance(id) AS credits",
 		"subscription_expires_at",
+		"subscription_grace_expires_at",
 		"subscription_status",
 		"subscription_plan",
 		"subscription_period",
 		"subscription_type",
+		"role",
+		"banned_at",
 	).From("public.user").Where(dbx.HashExp{
 		"id":         userID,
 		"deleted_at": nil,
@@ -89,121 +143,265 @@ func (r repistory) GetUserByUserID(ctx context.Context, userID string) (entity.U
 
 	user.Name = userDTO.Name
 	user.ID = userDTO.ID
+	if userDTO.Handle != nil {
+		user.Handle = *userDTO.Handle
+	}
+	if userDTO.Locale != nil {
+		user.Locale = *userDTO.Locale
+	}
+	if userDTO.AvatarURL != nil {
+		user.AvatarURL = *userDTO.AvatarURL
+	}
 	user.AuthID = userDTO.AuthID
 	user.AuthMethod = userDTO.AuthMethod
 	user.IsNewUser = userDTO.IsNewUser
 	user.CustomerID = userDTO.CustomerID
+	user.Role = entity.Role(userDTO.Role)
+	user.BannedAt = userDTO.BannedAt
 	if userDTO.FCMToken != nil {
 		user.FCMToken = *userDTO.FCMToken
 	}
+	user.Credits = userDTO.Credits
 	currenTime := time.Now()
-	if userDTO.CreditsExpiresAt == nil || (userDTO.CreditsExpiresAt).After(currenTime) {
-		user.Credits = userDTO.Credits
-	}
-	subsExpires := userDTO.SubscriptionExpiresAt
 	subsStatus := userDTO.SubscriptionStatus
-	statusActive := string(entity.SubscriptionStatusActive)
-	if (subsExpires == nil || subsExpires.After(currenTime)) &&
-		(subsStatus != nil && (*subsStatus) == statusActive &&
-			userDTO.SubscriptionPlan != nil &&
-			userDTO.SubscriptionPeriod != nil &&
-			userDTO.SubscriptionType != nil) {
-		user.Subscription = &entity.Subscription{
-			Plan:   *userDTO.SubscriptionPlan,
-			Type:   *userDTO.SubscriptionType,
-			Period: *userDTO.SubscriptionPeriod,
-			Status: *userDTO.SubscriptionStatus,
+	// a subscription with a billing issue is kept during its grace period, whether it gives access is up to the features
+	if subsStatus != nil && isCurrentSubscriptionStatus(*subsStatus) &&
+		userDTO.SubscriptionPlan != nil &&
+		userDTO.SubscriptionPeriod != nil &&
+		userDTO.SubscriptionType != nil {
+		subscription := &entity.Subscription{
+			Plan:           *userDTO.SubscriptionPlan,
+			Type:           *userDTO.SubscriptionType,
+			Period:         *userDTO.SubscriptionPeriod,
+			Status:         *userDTO.SubscriptionStatus,
+			ExpiresAt:      userDTO.SubscriptionExpiresAt,
+			GraceExpiresAt: userDTO.SubscriptionGraceEnd,
+		}
+		if endsAt := subscription.EndsAt(); endsAt == nil || endsAt.After(currenTime) {
+			user.Subscription = subscription
 		}
 	}
 
 	return user, err
 }
 
+// isCurrentSubscriptionStatus reports whether a subscription with the status has not ended.
+func isCurrentSubscriptionStatus(status string) bool {
+	return status == string(entity.SubscriptionStatusActive) || status == string(entity.SubscriptionStatusBillingIssue)
+}
+
 func (r repistory) CreateAnonymousUser(ctx context.Context, deviceKey string) (entity.User, error) {
+	return r.CreateUser(ctx, entity.AuthMethodAnonymous, deviceKey)
+}
+
+// CreateUser implements Repository.
+// The user gets a generated name and the same name in lowercase as the handle. Since handles are unique,
+// a new name is generated when the handle is taken. The signup credits are granted in the same statement.
+func (r repistory) CreateUser(ctx context.Context, authMethod entity.AuthMethod, authID string) (entity.User, error) {
 	var user entity.User
 
 	userID := uuid.New().String()
 	customerID := uuid.New().String()
 	currentTime := time.Now()
-	username := "User" + fmt.Sprintf("%v", currentTime.Unix())
 
-	result, err := r.db.With(ctx).NewQuery(`INSERT INTO public.user ( id, name, customer_id, auth_method, auth_id, is_new_user, credits, created_at, updated_at)
-		 VALUES ( {:id}, {:name}, {:customer_id}, {:auth_method}, {:auth_id}, {:is_new_user}, {:credits}, {:created_at}, {:updated_at});
+	for attempt := 0; attempt < maxNameAttempts; attempt++ {
+		name := generateName()
+		handle := strings.ToLower(name)
+
+		result, err := r.db.With(ctx).NewQuery(`WITH new_user AS (
+			INSERT INTO public.user ( id, name, handle, customer_id, auth_method, auth_id, is_new_user, created_at, updated_at)
+			VALUES ( {:id}, {:name}, {:handle}, {:customer_id}, {:auth_method}, {:auth_id}, {:is_new_user}, {:created_at}, {:updated_at})
+			ON CONFLICT (handle) DO NOTHING
+			RETURNING id
+		 )
+		 INSERT INTO credit_transaction ( id, user_id, type, amount, remaining, reason, created_at)
+		 SELECT {:lot_id}, id, {:lot_type}, {:credits}, {:credits}, {:lot_reason}, {:created_at} FROM new_user;
 		 `).Bind(dbx.Params{
-		"id":          userID,
-		"name":        username,
-		"customer_id": customerID,
-		"auth_method": entity.AuthMethodAnonymous,
-		"auth_id":     deviceKey,
-		"is_new_user": true,
-		"credits":     3,
-		"created_at":  currentTime,
-		"updated_at":  currentTime,
-	}).Prepare().Execute()
+			"id":          userID,
+			"name":        name,
+			"handle":      handle,
+			"customer_id": customerID,
+			"auth_method": authMethod,
+			"auth_id":     authID,
+			"is_new_user": true,
+			"lot_id":      uuid.New().String(),
+			"lot_type":    entity.CreditTransactionGrant,
+			"lot_reason":  signupCreditsReason,
+			"credits":     signupCredits,
+			"created_at":  currentTime,
+			"updated_at":  currentTime,
+		}).Prepare().Execute()
 
-	if err != nil {
-		return user, err
-	}
+		if err != nil {
+			return user, err
+		}
 
-	rowsAffected, err := result.RowsAffected()
-	if rowsAffected <= 0 {
-		return user, fmt.Errorf("No rows is added for the device key %s", deviceKey)
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return user, err
+		}
+		if rowsAffected > 0 {
+			user.ID = userID
+			user.Name = name
+			user.Handle = handle
+			user.Role = entity.RoleUser
+			user.Credits = signupCredits
+			return user, nil
+		}
 	}
 
-	user.ID = userID
-	user.Name = username
-
-	return user, err
+	return user, fmt.Errorf("No unique name is found for the %s auth id %s", authMethod, authID)
 }
 
 // CreateNewRefreshToken implements Repository.
-func (r repistory) CreateNewRefreshToken(ctx context.Context, deviceKey, userID, hashedValue string) error {
+// The new token starts a new family and replaces any token previously issued to the device.
+// It returns the ID of the family, which identifies the session.
+func (r repistory) CreateNewRefreshToken(ctx context.Context, device entity.Device, userID, hashedValue string) (string, error) {
+	familyID := uuid.New().String()
+	err := r.db.Transactional(ctx, func(ctx context.Context) error {
+		_, err := r.db.With(ctx).Update("refresh_token",
+			dbx.Params{"revoked_at": time.Now()},
+			dbx.NewExp("device_key={:device_key} and user_id={:user_id} and revoked_at is null",
+				dbx.Params{"device_key": device.Key, "user_id": userID}),
+		).Execute()
+		if err != nil {
+			return err
+		}
 
-	tx, err := r.db.DB().Begin()
+		return r.insertRefreshToken(ctx, familyID, familyID, nil, device, userID, hashedValue)
+	})
 
-	_, err1 := tx.Update("refresh_token",
-		dbx.Params{"revoked_at": time.Now()},
-		dbx.HashExp{"device_key": deviceKey, "user_id": userID},
-	).Execute()
+	return familyID, err
+}
+
+// GetRefreshToken implements Repository.
+// The token is returned even if it is revoked or expired so that reuse can be detected.
+func (r repistory) GetRefreshToken(ctx context.Context, deviceKey string, hashedValue string) (entity.RefreshToken, error) {
+	var token entity.RefreshToken
+	err := r.db.With(ctx).Select("id", "user_id", "family_id", "parent_id", "device_key", "device_name", "platform", "created_at", "expires_at", "revoked_at", "rotated").
+		From("refresh_token").
+		Where(dbx.HashExp{"device_key": deviceKey, "hashed_value": hashedValue}).
+		One(&token)
+
+	return token, err
+}
+
+// RotateRefreshToken implements Repository.
+// It revokes the parent token as rotated and issues its child in the same family on the given device.
+// If the parent has been revoked concurrently, ErrRefreshTokenRevoked is returned and nothing is changed.
+func (r repistory) RotateRefreshToken(ctx context.Context, parent entity.RefreshToken, device entity.Device, hashedValue string) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		result, err := r.db.With(ctx).Update("refresh_token",
+			dbx.Params{"revoked_at": time.Now(), "rotated": true},
+			dbx.NewExp("id={:id} and revoked_at is null", dbx.Params{"id": parent.ID}),
+		).Execute()
+		if err != nil {
+			return err
+		}
+		if rowsAffected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rowsAffected <= 0 {
+			return ErrRefreshTokenRevoked
+		}
+
+		return r.insertRefreshToken(ctx, uuid.New().String(), parent.FamilyID, &parent.ID, device, parent.UserID, hashedValue)
+	})
+}
 
-	_, err2 := tx.Insert("refresh_token",
+func (r repistory) insertRefreshToken(ctx context.Context, id, familyID string, parentID *string, device entity.Device, userID, hashedValue string) error {
+	currentTime := time.Now()
+	_, err := r.db.With(ctx).Insert("refresh_token",
 		dbx.Params{
-			"id":           uuid.New().String(),
-			"device_key":   deviceKey,
+			"id":           id,
+			"family_id":    familyID,
+			"parent_id":    parentID,
+			"device_key":   device.Key,
+			"device_name":  nullIfEmpty(device.Name),
+			"platform":     nullIfEmpty(device.Platform),
 			"user_id":      userID,
 			"hashed_value": hashedValue,
-			"created_at":   time.Now(),
-			"expires_at":   time.Now().Add(time.Hour * 24 * 7),
+			"created_at":   currentTime,
+			"expires_at":   currentTime.Add(refreshTokenLifetime),
 		},
 	).Execute()
 
-	if err1 != nil || err2 != nil {
-		err = tx.Rollback()
-	} else {
-		err = tx.Commit()
+	return err
+}
+
+// RevokeRefreshTokenFamily implements Repository.
+func (r repistory) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	_, err := r.db.With(ctx).Update("refresh_token",
+		dbx.Params{"revoked_at": time.Now()},
+		dbx.NewExp("family_id={:family_id} and revoked_at is null", dbx.Params{"family_id": familyID}),
+	).Execute()
+
+	return err
+}
+
+// DeleteStaleRefreshTokens implements Repository.
+func (r repistory) DeleteStaleRefreshTokens(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.db.With(ctx).Delete("refresh_token",
+		dbx.NewExp("expires_at < {:before} or revoked_at < {:before}", dbx.Params{"before": before}),
+	).Execute()
+	if err != nil {
+		return 0, err
 	}
 
+	return result.RowsAffected()
+}
+
+// CreateAuthEvent implements Repository.
+func (r repistory) CreateAuthEvent(ctx context.Context, event entity.AuthEvent) error {
+	_, err := r.db.With(ctx).Insert("auth_event", dbx.Params{
+		"id":              event.ID,
+		"type":            event.Type,
+		"user_id":         event.UserID,
+		"device_key_hash": event.DeviceKeyHash,
+		"ip":              event.IP,
+		"user_agent":      event.UserAgent,
+		"request_id":      event.RequestID,
+		"outcome":         event.Outcome,
+		"reason":          event.Reason,
+		"details":         event.Details,
+		"created_at":      event.CreatedAt,
+	}).Execute()
+
 	return err
 }
 
-// ValidateRefreshToken implements Repository.
-func (r repistory) ValidateRefreshToken(ctx context.Context, deviceKey string, hashedValue string) (string, error) {
-	var userID string
-	err := r.db.With(ctx).Select("user_id").From("refresh_token").Where(
-		dbx.NewExp(
-			`device_key={:device_key} 
-			and hashed_value={:hashed_value} 
-			and revoked_at is null and expires_at > {:time}`,
-			dbx.Params{
-				"device_key":   deviceKey,
-				"hashed_value": hashedValue,
-				"time":         time.Now(),
-			},
-		),
-	).Row(&userID)
+// CountAuthEvents implements Repository.
+func (r repistory) CountAuthEvents(ctx context.Context, filter AuthEventFilter) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("auth_event").Where(filter.expression()).Row(&count)
+
+	return count, err
+}
+
+// QueryAuthEvents implements Repository.
+func (r repistory) QueryAuthEvents(ctx context.Context, filter AuthEventFilter, offset, limit int) ([]entity.AuthEvent, error) {
+	events := []entity.AuthEvent{}
+	err := r.db.With(ctx).Select().From("auth_event").
+		Where(filter.expression()).
+		OrderBy("created_at DESC").
+		Offset(int64(offset)).
+		Limit(int64(limit)).
+		All(&events)
 
-	return userID, err
+	return events, err
 }
+
+// DeleteAuthEvents implements Repository.
+func (r repistory) DeleteAuthEvents(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.db.With(ctx).Delete("auth_event",
+		dbx.NewExp("created_at < {:before}", dbx.Params{"before": before}),
+	).Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
 func (r repistory) InvalidateRefreshToken(ctx context.Context, userID string, deviceKey string) error {
 	_, err := r.db.With(ctx).Update("refresh_token",
 		dbx.Params{"revoked_at": time.Now()},
@@ -212,3 +410,328 @@ func (r repistory) InvalidateRefreshToken(ctx context.Context, userID string, de
 
 	return err
 }
+
+// RevokeAllRefreshTokens implements Repository.
+func (r repistory) RevokeAllRefreshTokens(ctx context.Context, userID string) error {
+	_, err := r.db.With(ctx).Update("refresh_token",
+		dbx.Params{"revoked_at": time.Now()},
+		dbx.NewExp("user_id={:user_id} and revoked_at is null", dbx.Params{"user_id": userID}),
+	).Execute()
+
+	return err
+}
+
+// UpdateEmail implements Repository.
+func (r repistory) UpdateEmail(ctx context.Context, userID, email string, disabled bool) error {
+	_, err := r.db.With(ctx).Update("public.user",
+		dbx.Params{"email": email, "email_disabled": disabled, "updated_at": time.Now()},
+		dbx.HashExp{"id": userID},
+	).Execute()
+
+	return err
+}
+
+// SoftDeleteUser implements Repository.
+func (r repistory) SoftDeleteUser(ctx context.Context, userID string) error {
+	currentTime := time.Now()
+	_, err := r.db.With(ctx).Update("public.user",
+		dbx.Params{"deleted_at": currentTime, "updated_at": currentTime},
+		dbx.HashExp{"id": userID, "deleted_at": nil},
+	).Execute()
+
+	return err
+}
+
+// SetBanned implements Repository.
+// It reports whether the user exists.
+func (r repistory) SetBanned(ctx context.Context, userID string, banned bool) (bool, error) {
+	currentTime := time.Now()
+	params := dbx.Params{"banned_at": nil, "updated_at": currentTime}
+	if banned {
+		params["banned_at"] = currentTime
+	}
+	result, err := r.db.With(ctx).Update("public.user", params, dbx.HashExp{"id": userID, "deleted_at": nil}).Execute()
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// SetRole implements Repository.
+// It reports whether the user exists.
+func (r repistory) SetRole(ctx context.Context, userID string, role entity.Role) (bool, error) {
+	result, err := r.db.With(ctx).Update("public.user",
+		dbx.Params{"role": role, "updated_at": time.Now()},
+		dbx.HashExp{"id": userID, "deleted_at": nil},
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+	updated, err := result.RowsAffected()
+	return updated > 0, err
+}
+
+// UpdateProfile implements Repository.
+// Only the fields that are set are updated.
+func (r repistory) UpdateProfile(ctx context.Context, userID string, profile ProfileUpdate) error {
+	params := dbx.Params{"updated_at": time.Now()}
+	if profile.Name != nil {
+		params["name"] = *profile.Name
+	}
+	if profile.Handle != nil {
+		params["handle"] = *profile.Handle
+	}
+	if profile.Locale != nil {
+		params["locale"] = nullIfEmpty(*profile.Locale)
+	}
+	_, err := r.db.With(ctx).Update("public.user", params, dbx.HashExp{"id": userID}).Execute()
+
+	return err
+}
+
+// SetFCMToken implements Repository.
+// A device receives the notifications of the last user who registered its token, so the token
+// is removed from any other user.
+func (r repistory) SetFCMToken(ctx context.Context, userID, fcmToken string) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		currentTime := time.Now()
+		if fcmToken != "" {
+			_, err := r.db.With(ctx).Update("public.user",
+				dbx.Params{"fcm_token": nil, "updated_at": currentTime},
+				dbx.NewExp("fcm_token = {:fcm_token} and id <> {:id}", dbx.Params{"fcm_token": fcmToken, "id": userID}),
+			).Execute()
+			if err != nil {
+				return err
+			}
+		}
+		_, err := r.db.With(ctx).Update("public.user",
+			dbx.Params{"fcm_token": nullIfEmpty(fcmToken), "updated_at": currentTime},
+			dbx.HashExp{"id": userID},
+		).Execute()
+		return err
+	})
+}
+
+// SaveAppleRefreshToken implements Repository.
+func (r repistory) SaveAppleRefreshToken(ctx context.Context, userID, refreshToken string) error {
+	currentTime := time.Now()
+	_, err := r.db.With(ctx).NewQuery(`INSERT INTO apple_token (user_id, refresh_token, created_at, updated_at)
+		VALUES ({:user_id}, {:refresh_token}, {:created_at}, {:updated_at})
+		ON CONFLICT (user_id) DO UPDATE SET refresh_token = excluded.refresh_token, updated_at = excluded.updated_at`,
+	).Bind(dbx.Params{
+		"user_id":       userID,
+		"refresh_token": refreshToken,
+		"created_at":    currentTime,
+		"updated_at":    currentTime,
+	}).Execute()
+
+	return err
+}
+
+// GetAppleRefreshToken implements Repository.
+func (r repistory) GetAppleRefreshToken(ctx context.Context, userID string) (string, error) {
+	var refreshToken string
+	err := r.db.With(ctx).Select("refresh_token").From("apple_token").
+		Where(dbx.HashExp{"user_id": userID}).Row(&refreshToken)
+
+	return refreshToken, err
+}
+
+// DeleteAppleRefreshToken implements Repository.
+func (r repistory) DeleteAppleRefreshToken(ctx context.Context, userID string) error {
+	_, err := r.db.With(ctx).Delete("apple_token", dbx.HashExp{"user_id": userID}).Execute()
+
+	return err
+}
+
+// LinkIdentity implements Repository.
+func (r repistory) LinkIdentity(ctx context.Context, userID string, authMethod entity.AuthMethod, authID string) error {
+	result, err := r.db.With(ctx).Update("public.user",
+		dbx.Params{"auth_method": authMethod, "auth_id": authID, "updated_at": time.Now()},
+		dbx.HashExp{"id": userID, "auth_method": entity.AuthMethodAnonymous, "deleted_at": nil},
+	).Execute()
+
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err == nil && rowsAffected <= 0 {
+		return fmt.Errorf("No anonymous user %s to link", userID)
+	}
+
+	return err
+}
+
+// MoveCredits implements Repository.
+// The whole ledger is moved, so the lots keep their remaining credits and their expiry.
+func (r repistory) MoveCredits(ctx context.Context, fromUserID, toUserID string) error {
+	_, err := r.db.With(ctx).Update("credit_transaction",
+		dbx.Params{"user_id": toUserID},
+		dbx.HashExp{"user_id": fromUserID},
+	).Execute()
+
+	return err
+}
+
+// CopySubscription implements Repository.
+// The customer ID is copied along with the subscription since the billing provider knows the subscriber by it.
+func (r repistory) CopySubscription(ctx context.Context, fromUserID, toUserID string) error {
+	_, err := r.db.With(ctx).NewQuery(`UPDATE public.user AS t SET
+		customer_id = f.customer_id,
+		subscription_plan = f.subscription_plan,
+		subscription_type = f.subscription_type,
+		subscription_period = f.subscription_period,
+		subscription_status = f.subscription_status,
+		subscription_expires_at = f.subscription_expires_at,
+		subscription_will_renew = f.subscription_will_renew,
+		subscription_grace_expires_at = f.subscription_grace_expires_at,
+		subscription_event_at = f.subscription_event_at,
+		updated_at = {:updated_at}
+		FROM public.user AS f
+		WHERE t.id = {:to_id} AND f.id = {:from_id}`,
+	).Bind(dbx.Params{
+		"from_id":    fromUserID,
+		"to_id":      toUserID,
+		"updated_at": time.Now(),
+	}).Execute()
+
+	return err
+}
+
+// MoveFiles implements Repository.
+func (r repistory) MoveFiles(ctx context.Context, fromUserID, toUserID string) error {
+	_, err := r.db.With(ctx).Update("file",
+		dbx.Params{"user_id": toUserID, "updated_at": time.Now()},
+		dbx.HashExp{"user_id": fromUserID},
+	).Execute()
+
+	return err
+}
+
+// MoveAlbums implements Repository.
+func (r repistory) MoveAlbums(ctx context.Context, fromUserID, toUserID string) error {
+	_, err := r.db.With(ctx).Update("album",
+		dbx.Params{"user_id": toUserID, "updated_at": time.Now()},
+		dbx.HashExp{"user_id": fromUserID},
+	).Execute()
+
+	return err
+}
+
+// CreateCredential implements Repository.
+func (r repistory) CreateCredential(ctx context.Context, userID, username, passwordHash string) error {
+	currentTime := time.Now()
+	_, err := r.db.With(ctx).Insert("credential", dbx.Params{
+		"user_id":       userID,
+		"username":      username,
+		"password_hash": passwordHash,
+		"created_at":    currentTime,
+		"updated_at":    currentTime,
+	}).Execute()
+
+	return err
+}
+
+// GetCredentialByUsername implements Repository.
+func (r repistory) GetCredentialByUsername(ctx context.Context, username string) (entity.Credential, error) {
+	var credential entity.Credential
+	err := r.db.With(ctx).Select("c.user_id", "c.username", "c.password_hash", "c.failed_attempts", "c.locked_until").
+		From("credential c").
+		InnerJoin("public.user u", dbx.NewExp("u.id = c.user_id")).
+		Where(dbx.NewExp("lower(c.username) = lower({:username}) and u.deleted_at is null", dbx.Params{"username": username})).
+		One(&credential)
+
+	return credential, err
+}
+
+// GetCredentialByUserID implements Repository.
+func (r repistory) GetCredentialByUserID(ctx context.Context, userID string) (entity.Credential, error) {
+	var credential entity.Credential
+	err := r.db.With(ctx).Select("user_id", "username", "password_hash", "failed_attempts", "locked_until").
+		From("credential").
+		Where(dbx.HashExp{"user_id": userID}).
+		One(&credential)
+
+	return credential, err
+}
+
+// UpdateFailedAttempts implements Repository.
+func (r repistory) UpdateFailedAttempts(ctx context.Context, userID string, failedAttempts int, lockedUntil *time.Time) error {
+	_, err := r.db.With(ctx).Update("credential",
+		dbx.Params{"failed_attempts": failedAttempts, "locked_until": lockedUntil, "updated_at": time.Now()},
+		dbx.HashExp{"user_id": userID},
+	).Execute()
+
+	return err
+}
+
+// IncrementFailedAttempts implements Repository.
+// The counter is incremented in a single statement, so that concurrent failures are all counted.
+// When it reaches maxAttempts, the credential is locked until lockedUntil and the counter starts over.
+func (r repistory) IncrementFailedAttempts(ctx context.Context, userID string, maxAttempts int, lockedUntil time.Time) (entity.Credential, error) {
+	var credential entity.Credential
+	err := r.db.With(ctx).NewQuery(`UPDATE credential SET
+			failed_attempts = CASE WHEN failed_attempts + 1 >= {:max_attempts} THEN 0 ELSE failed_attempts + 1 END,
+			locked_until = CASE WHEN failed_attempts + 1 >= {:max_attempts} THEN {:locked_until} ELSE locked_until END,
+			updated_at = {:updated_at}
+		WHERE user_id = {:user_id}
+		RETURNING user_id, username, failed_attempts, locked_until`,
+	).Bind(dbx.Params{
+		"user_id":      userID,
+		"max_attempts": maxAttempts,
+		"locked_until": lockedUntil,
+		"updated_at":   time.Now(),
+	}).One(&credential)
+
+	return credential, err
+}
+
+// UpdatePasswordHash implements Repository.
+func (r repistory) UpdatePasswordHash(ctx context.Context, userID, passwordHash string) error {
+	_, err := r.db.With(ctx).Update("credential",
+		dbx.Params{"password_hash": passwordHash, "failed_attempts": 0, "locked_until": nil, "updated_at": time.Now()},
+		dbx.HashExp{"user_id": userID},
+	).Execute()
+
+	return err
+}
+
+// ListSessions implements Repository.
+// A session is the active token of a family. The session was created with the first token
+// of the family and last used when the active token was issued.
+func (r repistory) ListSessions(ctx context.Context, userID string) ([]entity.Session, error) {
+	sessions := []entity.Session{}
+	err := r.db.With(ctx).NewQuery(`SELECT t.family_id AS id, t.device_name, t.platform, t.created_at AS last_used_at,
+		(SELECT min(f.created_at) FROM refresh_token f WHERE f.family_id = t.family_id) AS created_at
+		FROM refresh_token t
+		WHERE t.user_id = {:user_id} AND t.revoked_at IS NULL AND t.expires_at > {:time}
+		ORDER BY t.created_at DESC`,
+	).Bind(dbx.Params{"user_id": userID, "time": time.Now()}).All(&sessions)
+
+	return sessions, err
+}
+
+// RevokeSession implements Repository.
+// It returns false if the user has no active session with the given ID.
+func (r repistory) RevokeSession(ctx context.Context, userID, sessionID string) (bool, error) {
+	result, err := r.db.With(ctx).Update("refresh_token",
+		dbx.Params{"revoked_at": time.Now()},
+		dbx.NewExp("family_id={:family_id} and user_id={:user_id} and revoked_at is null",
+			dbx.Params{"family_id": sessionID, "user_id": userID}),
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+func nullIfEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+const (
+	// revocationSyncInterval is how often the revocations made by other server instances are loaded.
+	revocationSyncInterval = 5 * time.Second
+	// revocationSyncOverlap is subtracted from the time of the last sync to tolerate clock skew between instances.
+	revocationSyncOverlap = time.Minute
+)
+
+// Kinds of revocation entries.
+const (
+	// revocationToken revokes a single access token identified by its jti claim.
+	revocationToken = "token"
+	// revocationSession revokes the access tokens issued for a session before the revocation.
+	revocationSession = "session"
+	// revocationUser revokes the access tokens issued to a user before the revocation.
+	revocationUser = "user"
+)
+
+// AccessTokenClaims holds the claims of an access token the revocation checks rely on.
+type AccessTokenClaims struct {
+	ID        string
+	UserID    string
+	SessionID string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// RevocationStore keeps track of access tokens revoked before they expire.
+// An entry only needs to be kept until every token it revokes has expired on its own.
+type RevocationStore interface {
+	// RevokeToken revokes the access token with the given jti.
+	RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error
+	// RevokeSession revokes every access token issued for the session so far.
+	RevokeSession(ctx context.Context, sessionID string, expiresAt time.Time) error
+	// RevokeUser revokes every access token issued to the user so far.
+	RevokeUser(ctx context.Context, userID string, expiresAt time.Time) error
+	// IsRevoked reports whether the access token with the given claims has been revoked.
+	IsRevoked(ctx context.Context, claims AccessTokenClaims) (bool, error)
+	// Prune deletes the entries of revoked tokens which have expired. It is meant to be run as a background job.
+	Prune(ctx context.Context) error
+}
+
+type revocationKey struct {
+	kind  string
+	value string
+}
+
+type revocation struct {
+	Kind      string    `db:"kind"`
+	Value     string    `db:"value"`
+	RevokedAt time.Time `db:"revoked_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// revocationStore stores revocations in Postgres and caches all of them in memory,
+// so that checking a token does not hit the database. Revocations made by other server instances
+// are picked up within revocationSyncInterval.
+type revocationStore struct {
+	db     *dbcontext.DB
+	logger log.Logger
+
+	syncMu   sync.Mutex
+	mu       sync.RWMutex
+	entries  map[revocationKey]revocation
+	lastSync time.Time
+}
+
+// NewRevocationStore creates a revocation store backed by the revoked_token table.
+func NewRevocationStore(db *dbcontext.DB, logger log.Logger) RevocationStore {
+	return &revocationStore{db: db, logger: logger, entries: map[revocationKey]revocation{}}
+}
+
+// RevokeToken implements RevocationStore.
+func (s *revocationStore) RevokeToken(ctx context.Context, tokenID string, expiresAt time.Time) error {
+	return s.revoke(ctx, revocationToken, tokenID, expiresAt)
+}
+
+// RevokeSession implements RevocationStore.
+func (s *revocationStore) RevokeSession(ctx context.Context, sessionID string, expiresAt time.Time) error {
+	return s.revoke(ctx, revocationSession, sessionID, expiresAt)
+}
+
+// RevokeUser implements RevocationStore.
+func (s *revocationStore) RevokeUser(ctx context.Context, userID string, expiresAt time.Time) error {
+	return s.revoke(ctx, revocationUser, userID, expiresAt)
+}
+
+// revoke stores a revocation entry. The revocation time is truncated to the millisecond precision of the
+// issue time of the access tokens, so a token issued in the same millisecond as the revocation is revoked too.
+func (s *revocationStore) revoke(ctx context.Context, kind, value string, expiresAt time.Time) error {
+	entry := revocation{Kind: kind, Value: value, RevokedAt: time.Now().Truncate(time.Millisecond), ExpiresAt: expiresAt}
+	_, err := s.db.With(ctx).NewQuery(`INSERT INTO revoked_token (kind, value, revoked_at, expires_at)
+		VALUES ({:kind}, {:value}, {:revoked_at}, {:expires_at})
+		ON CONFLICT (kind, value) DO UPDATE SET
+			revoked_at = excluded.revoked_at,
+			expires_at = greatest(revoked_token.expires_at, excluded.expires_at)`,
+	).Bind(dbx.Params{
+		"kind":       entry.Kind,
+		"value":      entry.Value,
+		"revoked_at": entry.RevokedAt,
+		"expires_at": entry.ExpiresAt,
+	}).Execute()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.store(entry)
+	s.mu.Unlock()
+	return nil
+}
+
+// IsRevoked implements RevocationStore.
+// Session and user revocations only apply to tokens issued before the revocation. Tokens without
+// the iat_ms claim only carry their issue time in seconds, so they are revoked if they were issued
+// in the second of the revocation.
+func (s *revocationStore) IsRevoked(ctx context.Context, claims AccessTokenClaims) (bool, error) {
+	if err := s.sync(ctx); err != nil {
+		return false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.entries[revocationKey{revocationToken, claims.ID}]; ok && claims.ID != "" {
+		return true, nil
+	}
+	if entry, ok := s.entries[revocationKey{revocationSession, claims.SessionID}]; ok && claims.SessionID != "" &&
+		!claims.IssuedAt.After(entry.RevokedAt) {
+		return true, nil
+	}
+	if entry, ok := s.entries[revocationKey{revocationUser, claims.UserID}]; ok && !claims.IssuedAt.After(entry.RevokedAt) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// sync loads the revocations made since the last sync and evicts the expired ones from the cache.
+// If another request is already syncing, the cache is used as it is.
+func (s *revocationStore) sync(ctx context.Context) error {
+	s.mu.RLock()
+	fresh := time.Since(s.lastSync) < revocationSyncInterval
+	s.mu.RUnlock()
+	if fresh || !s.syncMu.TryLock() {
+		return nil
+	}
+	defer s.syncMu.Unlock()
+
+	now := time.Now()
+	s.mu.RLock()
+	since := s.lastSync.Add(-revocationSyncOverlap)
+	s.mu.RUnlock()
+
+	var entries []revocation
+	err := s.db.With(ctx).Select("kind", "value", "revoked_at", "expires_at").From("revoked_token").
+		Where(dbx.NewExp("revoked_at >= {:since} and expires_at > {:now}", dbx.Params{"since": since, "now": now})).
+		All(&entries)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range entries {
+		s.store(entry)
+	}
+	for key, entry := range s.entries {
+		if entry.ExpiresAt.Before(now) {
+			delete(s.entries, key)
+		}
+	}
+	s.lastSync = now
+	return nil
+}
+
+// store adds the entry to the cache unless a later revocation of the same tokens is already cached.
+// The caller must hold the write lock.
+func (s *revocationStore) store(entry revocation) {
+	key := revocationKey{entry.Kind, entry.Value}
+	if cached, ok := s.entries[key]; ok && cached.RevokedAt.After(entry.RevokedAt) {
+		return
+	}
+	s.entries[key] = entry
+}
+
+// Prune implements RevocationStore.
+func (s *revocationStore) Prune(ctx context.Context) error {
+	result, err := s.db.With(ctx).Delete("revoked_token",
+		dbx.NewExp("expires_at < {:now}", dbx.Params{"now": time.Now()}),
+	).Execute()
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		s.logger.With(ctx).Infof("pruned %d expired token revocations", deleted)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationStore_IsRevoked(t *testing.T) {
+	revokedAt := time.Date(2026, 10, 17, 12, 0, 0, 700*int(time.Millisecond), time.UTC)
+	store := &revocationStore{
+		entries: map[revocationKey]revocation{
+			{revocationSession, "session1"}: {Kind: revocationSession, Value: "session1", RevokedAt: revokedAt},
+			{revocationUser, "user1"}:       {Kind: revocationUser, Value: "user1", RevokedAt: revokedAt},
+		},
+		// the cache is fresh, so the store does not sync with the database
+		lastSync: time.Now(),
+	}
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   bool
+	}{
+		{"session token issued before", jwt.MapClaims{"sid": "session1", "iat_ms": float64(revokedAt.Add(-100 * time.Millisecond).UnixMilli())}, true},
+		{"session token issued at", jwt.MapClaims{"sid": "session1", "iat_ms": float64(revokedAt.UnixMilli())}, true},
+		{"session token issued after in the same second", jwt.MapClaims{"sid": "session1", "iat_ms": float64(revokedAt.Add(100 * time.Millisecond).UnixMilli())}, false},
+		{"user token issued before", jwt.MapClaims{"id": "user1", "iat_ms": float64(revokedAt.Add(-time.Second).UnixMilli())}, true},
+		{"user token issued after in the same second", jwt.MapClaims{"id": "user1", "iat_ms": float64(revokedAt.Add(100 * time.Millisecond).UnixMilli())}, false},
+		{"legacy token issued in the same second", jwt.MapClaims{"id": "user1", "iat": float64(revokedAt.Unix())}, true},
+		{"legacy token issued in the next second", jwt.MapClaims{"id": "user1", "iat": float64(revokedAt.Unix() + 1)}, false},
+		{"other user", jwt.MapClaims{"id": "user2", "iat_ms": float64(revokedAt.Add(-time.Second).UnixMilli())}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			revoked, err := store.IsRevoked(context.Background(), parseAccessTokenClaims(tc.claims))
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, revoked)
+			}
+		})
+	}
+}
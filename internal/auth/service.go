@@ -3,69 +3,344 @@ package auth
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 	"time"
 
 	stderr "errors"
 
 	"github.com/dgrijalva/jwt-go"
+	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/qiangxue/go-rest-api/internal/entity"
 	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
 	"github.com/qiangxue/go-rest-api/pkg/log"
 )
 
+const (
+	// signupCredits is the number of credits granted to every new user.
+	signupCredits = 3
+	// signupCreditsReason is the reason of the lot of the signup credits in the credit ledger.
+	signupCreditsReason = "signup_bonus"
+)
+
+// refreshTokenRetention is how long revoked and expired refresh tokens are kept so that reuse can still be detected.
+const refreshTokenRetention = refreshTokenLifetime
+
+// errAccountBanned is returned when a banned user tries to sign in or use a token.
+var errAccountBanned = errors.ForbiddenWithCode("The account has been banned", "account_banned")
+
 // Service encapsulates the authentication logic.
 type Service interface {
-	// authenticate authenticates a user using username and password.
-	// It returns a JWT token if authentication succeeds. Otherwise, an error is returned.
-	LoginUsername(ctx context.Context, username, password string) (entity.AuthTokens, error)
+	// Register creates a user that signs in with a username and password.
+	Register(ctx context.Context, username, password, deviceKey string) (entity.AuthTokens, error)
+	// LoginUsername authenticates a user using username and password.
+	// It returns the auth tokens if authentication succeeds. Otherwise, an error is returned.
+	LoginUsername(ctx context.Context, username, password, deviceKey string) (entity.AuthTokens, error)
+	// ChangePassword changes the password of the current user and revokes all of their refresh tokens.
+	ChangePassword(ctx context.Context, currentPassword, newPassword string) error
 	LoginAnonymous(ctx context.Context, deviceKey string) (entity.AuthTokens, error)
+	// LoginGoogle authenticates a user with a Google ID token, creating the user on the first sign-in.
+	LoginGoogle(ctx context.Context, idToken, deviceKey string) (entity.AuthTokens, error)
+	// LoginApple authenticates a user with an Apple identity token and stores the Apple refresh token
+	// obtained from the authorization code so that it can be revoked later.
+	LoginApple(ctx context.Context, idToken, authorizationCode, deviceKey string) (entity.AuthTokens, error)
+	// HandleAppleNotification processes a signed Sign in with Apple server-to-server notification.
+	HandleAppleNotification(ctx context.Context, payload string) error
+	// LinkIdentity attaches a Google or Apple identity to the current anonymous user.
+	// If the identity already belongs to another user, the current user is merged into that user.
+	LinkIdentity(ctx context.Context, authMethod entity.AuthMethod, idToken, authorizationCode, deviceKey string) (entity.AuthTokens, error)
 	RefreshTokens(ctx context.Context, refreshToken, deviceKey string) (entity.AuthTokens, error)
 
 	Logout(ctx context.Context, deviceKey string) error
+	// LogoutAll revokes every session of the current user.
+	LogoutAll(ctx context.Context) error
+	// DeleteAccount soft-deletes the current user and revokes all of their tokens immediately.
+	// The data of the user is purged after a grace period by a background job.
+	DeleteAccount(ctx context.Context) error
+	// ListSessions returns the active sessions of the current user.
+	ListSessions(ctx context.Context) ([]entity.Session, error)
+	// RevokeSession revokes a session of the current user, logging out the device remotely.
+	RevokeSession(ctx context.Context, sessionID string) error
+	// PruneRefreshTokens deletes stale refresh tokens. It is meant to be run as a background job.
+	PruneRefreshTokens(ctx context.Context) error
+	// PruneRevokedTokens deletes the revocations of expired access tokens. It is meant to be run as a background job.
+	PruneRevokedTokens(ctx context.Context) error
+	// BanUser bans or unbans a user. Banning revokes all tokens of the user immediately.
+	BanUser(ctx context.Context, userID string, banned bool) error
+	// SetRole changes the role of a user. The access tokens of the user are revoked, so that
+	// the new role takes effect in the claims of the next token.
+	SetRole(ctx context.Context, userID string, role entity.Role) error
+	// Authenticate returns the user of a valid access token. Revoked tokens and banned users are rejected.
+	Authenticate(ctx context.Context, claims AccessTokenClaims) (entity.User, error)
 	GetUser(ctx context.Context, userID string) (entity.User, error)
+	// UpdateProfile changes the name, the handle or the locale of the current user.
+	UpdateProfile(ctx context.Context, profile ProfileUpdate) (entity.User, error)
+	// RegisterFCMToken registers the Firebase Cloud Messaging token of the current user's device.
+	// An empty token unregisters the device.
+	RegisterFCMToken(ctx context.Context, fcmToken string) error
+	// InvalidateUser removes the user from the cache of the authenticated users.
+	// It must be called whenever the credits, the subscription or the profile of the user change.
+	InvalidateUser(userID string)
+	// UserCacheStats returns the usage statistics of the cache of the authenticated users.
+	UserCacheStats() CacheStats
+	// QueryAuthEvents returns the authentication events matching the filter, the latest first.
+	QueryAuthEvents(ctx context.Context, filter AuthEventFilter, offset, limit int) ([]entity.AuthEvent, error)
+	// CountAuthEvents returns the number of the authentication events matching the filter.
+	CountAuthEvents(ctx context.Context, filter AuthEventFilter) (int, error)
+	// PruneAuthEvents deletes the authentication events older than the retention period.
+	// It is meant to be run as a background job.
+	PruneAuthEvents(ctx context.Context) error
 }
 
 type service struct {
-	signingKey      string
+	keys            *KeySet
 	tokenExpiration int
 	repo            Repository
+	googleVerifier  IdentityVerifier
+	appleVerifier   AppleVerifier
+	appleClient     AppleClient
+	transact        dbcontext.TransactionFunc
+	revocations     RevocationStore
+	users           UserCache
+	auditRetention  time.Duration
 	logger          log.Logger
 }
 
 // NewService creates a new authentication service.
-func NewService(signingKey string, tokenExpiration int, repository Repository, logger log.Logger) Service {
-	return service{signingKey, tokenExpiration, repository, logger}
+func NewService(
+	keys *KeySet,
+	tokenExpiration int,
+	repository Repository,
+	googleVerifier IdentityVerifier,
+	appleVerifier AppleVerifier,
+	appleClient AppleClient,
+	transact dbcontext.TransactionFunc,
+	revocations RevocationStore,
+	users UserCache,
+	auditRetention time.Duration,
+	logger log.Logger,
+) Service {
+	return service{keys, tokenExpiration, repository, googleVerifier, appleVerifier, appleClient, transact, revocations, users, auditRetention, logger}
+}
+
+// Authenticate implements Service.
+func (s service) Authenticate(ctx context.Context, claims AccessTokenClaims) (entity.User, error) {
+	revoked, err := s.revocations.IsRevoked(ctx, claims)
+	if err != nil {
+		s.logger.Errorf("There is an error while checking the token revocations %v", err)
+		return entity.User{}, errors.InternalServerError("")
+	}
+	if revoked {
+		return entity.User{}, errors.UnauthorizedWithCode("The access token has been revoked", "token_revoked")
+	}
+
+	user, ok := s.users.Get(claims.UserID)
+	if !ok {
+		if user, err = s.repo.GetUserByUserID(ctx, claims.UserID); err != nil {
+			return user, err
+		}
+		s.users.Set(user)
+	}
+	if user.IsBanned() {
+		return user, errAccountBanned
+	}
+	return user, nil
+}
+
+// UpdateProfile implements Service.
+func (s service) UpdateProfile(ctx context.Context, profile ProfileUpdate) (entity.User, error) {
+	userID := CurrentUser(ctx).ID
+	profile.normalize()
+	if err := profile.Validate(); err != nil {
+		return entity.User{}, err
+	}
+
+	if err := s.repo.UpdateProfile(ctx, userID, profile); err != nil {
+		if isUniqueViolation(err) {
+			return entity.User{}, errors.BadRequest("The handle is already taken", "handle_taken")
+		}
+		s.logger.Errorf("There is an error while updating the profile of user %s %v", userID, err)
+		return entity.User{}, errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+
+	return s.GetUser(ctx, userID)
+}
+
+// RegisterFCMToken implements Service.
+func (s service) RegisterFCMToken(ctx context.Context, fcmToken string) error {
+	userID := CurrentUser(ctx).ID
+	if len(fcmToken) > 4096 {
+		return errors.BadRequest("The FCM token is too long", "invalid_fcm_token")
+	}
+
+	if err := s.repo.SetFCMToken(ctx, userID, fcmToken); err != nil {
+		s.logger.Errorf("There is an error while registering the FCM token of user %s %v", userID, err)
+		return errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+	return nil
+}
+
+// InvalidateUser implements Service.
+func (s service) InvalidateUser(userID string) {
+	s.users.Invalidate(userID)
+}
+
+// UserCacheStats implements Service.
+func (s service) UserCacheStats() CacheStats {
+	return s.users.Stats()
 }
 
 // GetUser implements Service.
+// The user is always loaded from the database, and the cached user is refreshed with it.
 func (s service) GetUser(ctx context.Context, userID string) (entity.User, error) {
-	return s.repo.GetUserByUserID(ctx, userID)
+	user, err := s.repo.GetUserByUserID(ctx, userID)
+	if err != nil {
+		return user, err
+	}
+	s.users.Set(user)
+	return user, nil
 }
 
-// Login authenticates a user and generates a JWT token if authentication succeeds.
-// Otherwise, an error is returned.
-func (s service) LoginUsername(ctx context.Context, username, password string) (entity.AuthTokens, error) {
-	logger := s.logger.With(ctx, "user", username)
+func (s service) Register(ctx context.Context, username, password, deviceKey string) (authTokens entity.AuthTokens, err error) {
+	var userID string
+	defer func() { s.recordEvent(ctx, AuthEventRegister, userID, deviceKey, err, "") }()
+
+	if err := validateCredentials(username, password); err != nil {
+		return authTokens, err
+	}
+
+	_, err = s.repo.GetCredentialByUsername(ctx, username)
+	if err == nil {
+		return authTokens, errors.BadRequest("The username is already taken", "username_taken")
+	} else if !stderr.Is(err, sql.ErrNoRows) {
+		s.logger.Errorf("There is an error while getting the credential of %s %v", username, err)
+		return authTokens, errors.InternalServerError("")
+	}
+
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return authTokens, err
+	}
+
 	var user entity.User
-	if username == "demo" && password == "pass" {
-		logger.Infof("authentication successful")
-		user = entity.User{ID: "100", Name: "demo"}
+	err = s.transact(ctx, func(ctx context.Context) error {
+		user, err = s.repo.CreateUser(ctx, entity.AuthMethodPassword, strings.ToLower(username))
+		if err != nil {
+			return err
+		}
+		return s.repo.CreateCredential(ctx, user.ID, username, passwordHash)
+	})
+	if err != nil {
+		if isUniqueViolation(err) {
+			return authTokens, errors.BadRequest("The username is already taken", "username_taken")
+		}
+		s.logger.Errorf("There is an error while registering %s %v", username, err)
+		return authTokens, errors.InternalServerError("")
 	}
+	userID = user.ID
 
-	accessToken, err := s.generateJWT(user)
+	return s.createAuthTokens(ctx, user, deviceKey)
+}
+
+// LoginUsername authenticates a user and generates the auth tokens if authentication succeeds.
+// Accounts are locked for a while after repeated failures. Otherwise, an error is returned.
+func (s service) LoginUsername(ctx context.Context, username, password, deviceKey string) (authTokens entity.AuthTokens, err error) {
+	var userID string
+	defer func() { s.recordEvent(ctx, AuthEventLoginPassword, userID, deviceKey, err, "") }()
+	logger := s.logger.With(ctx, "user", username)
+
+	credential, err := s.repo.GetCredentialByUsername(ctx, username)
+	if stderr.Is(err, sql.ErrNoRows) {
+		comparePassword(string(dummyPasswordHash), password)
+		logger.Infof("authentication failed: unknown username")
+		return authTokens, errors.Unauthorized("")
+	} else if err != nil {
+		logger.Errorf("There is an error while getting the credential %v", err)
+		return authTokens, errors.InternalServerError("")
+	}
+	userID = credential.UserID
 
+	if credential.IsLocked() {
+		logger.Infof("authentication rejected: account locked")
+		return authTokens, errors.TooManyRequests("The account is locked because of too many failed login attempts. Please try again later.", "account_locked")
+	}
+
+	if !comparePassword(credential.PasswordHash, password) {
+		s.recordWrongPassword(ctx, credential.UserID)
+		logger.Infof("authentication failed: wrong password")
+		return authTokens, errors.Unauthorized("")
+	}
+
+	if credential.FailedAttempts > 0 {
+		if err := s.repo.UpdateFailedAttempts(ctx, credential.UserID, 0, nil); err != nil {
+			logger.Errorf("There is an error while resetting the failed logins %v", err)
+		}
+	}
+
+	user, err := s.repo.GetUserByUserID(ctx, credential.UserID)
 	if err != nil {
-		return entity.AuthTokens{}, err
+		return authTokens, err
 	}
-	return entity.AuthTokens{
-		AccessToken:  accessToken,
-		RefreshToken: "",
-	}, nil
+	logger.Infof("authentication successful")
+
+	return s.createAuthTokens(ctx, user, deviceKey)
 }
 
-func (s service) LoginAnonymous(ctx context.Context, deviceKey string) (entity.AuthTokens, error) {
-	var authTokens entity.AuthTokens
+func (s service) ChangePassword(ctx context.Context, currentPassword, newPassword string) (err error) {
+	userID := CurrentUser(ctx).ID
+	defer func() { s.recordEvent(ctx, AuthEventPasswordChange, userID, "", err, "") }()
+
+	credential, err := s.repo.GetCredentialByUserID(ctx, userID)
+	if stderr.Is(err, sql.ErrNoRows) {
+		return errors.BadRequest("The account does not have a password", "password_not_set")
+	} else if err != nil {
+		return err
+	}
+
+	if credential.IsLocked() {
+		return errors.TooManyRequests("The account is locked because of too many failed login attempts. Please try again later.", "account_locked")
+	}
+	if !comparePassword(credential.PasswordHash, currentPassword) {
+		s.recordWrongPassword(ctx, userID)
+		return errors.Unauthorized("The current password is wrong")
+	}
+	if err := (validation.Errors{"new_password": validatePassword(newPassword)}).Filter(); err != nil {
+		return err
+	}
+
+	passwordHash, err := hashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	return s.transact(ctx, func(ctx context.Context) error {
+		if err := s.repo.UpdatePasswordHash(ctx, userID, passwordHash); err != nil {
+			return err
+		}
+		return s.repo.RevokeAllRefreshTokens(ctx, userID)
+	})
+}
+
+// recordWrongPassword counts a wrong password of the user towards the lockout of the account.
+// The logins and the password changes share the counter, so that a stolen access token does not allow guessing the password.
+func (s service) recordWrongPassword(ctx context.Context, userID string) {
+	credential, err := s.repo.IncrementFailedAttempts(ctx, userID, maxFailedLoginAttempts, time.Now().Add(lockoutDuration))
+	if err != nil {
+		s.logger.Errorf("There is an error while recording the wrong password of user %s %v", userID, err)
+	} else if credential.IsLocked() {
+		s.logger.With(ctx, "user", userID).Infof("account locked after %d wrong passwords", maxFailedLoginAttempts)
+	}
+}
+
+func (s service) LoginAnonymous(ctx context.Context, deviceKey string) (authTokens entity.AuthTokens, err error) {
+	var userID string
+	defer func() { s.recordEvent(ctx, AuthEventLoginAnonymous, userID, deviceKey, err, "") }()
+
 	// check if there is a user with the device key
 	user, err := s.repo.GetUserByDeviceKey(ctx, deviceKey)
 
@@ -79,52 +354,565 @@ func (s service) LoginAnonymous(ctx context.Context, deviceKey string) (entity.A
 		s.logger.Errorf("There is an error while getting the user by device key %s %v", deviceKey, err)
 		return authTokens, errors.InternalServerError("")
 	}
+	userID = user.ID
 
 	return s.createAuthTokens(ctx, user, deviceKey)
 }
 
-func (s service) RefreshTokens(ctx context.Context, refreshToken, deviceKey string) (entity.AuthTokens, error) {
-	var authTokens entity.AuthTokens
+func (s service) LoginGoogle(ctx context.Context, idToken, deviceKey string) (_ entity.AuthTokens, err error) {
+	var userID string
+	defer func() { s.recordEvent(ctx, AuthEventLoginGoogle, userID, deviceKey, err, "") }()
+
+	identity, err := s.googleVerifier.Verify(ctx, idToken)
+	if err != nil {
+		s.logger.With(ctx).Infof("Google ID token verification failed %v", err)
+		return entity.AuthTokens{}, errors.Unauthorized("")
+	}
+
+	user, err := s.findOrCreateUser(ctx, entity.AuthMethodGoogle, identity)
+	if err != nil {
+		return entity.AuthTokens{}, err
+	}
+	userID = user.ID
+	return s.createAuthTokens(ctx, user, deviceKey)
+}
+
+func (s service) LoginApple(ctx context.Context, idToken, authorizationCode, deviceKey string) (_ entity.AuthTokens, err error) {
+	var userID string
+	defer func() { s.recordEvent(ctx, AuthEventLoginApple, userID, deviceKey, err, "") }()
+
+	identity, err := s.appleVerifier.Verify(ctx, idToken)
+	if err != nil {
+		s.logger.With(ctx).Infof("Apple identity token verification failed %v", err)
+		return entity.AuthTokens{}, errors.Unauthorized("")
+	}
+
+	appleRefreshToken, err := s.appleClient.ExchangeCode(ctx, authorizationCode)
+	if err != nil {
+		s.logger.With(ctx).Errorf("Apple authorization code exchange failed %v", err)
+		return entity.AuthTokens{}, errors.Unauthorized("Invalid authorization code")
+	}
+
+	user, err := s.findOrCreateUser(ctx, entity.AuthMethodApple, identity)
+	if err != nil {
+		return entity.AuthTokens{}, err
+	}
+	userID = user.ID
+
+	if err := s.repo.SaveAppleRefreshToken(ctx, user.ID, appleRefreshToken); err != nil {
+		s.logger.Errorf("There is an error while saving the Apple refresh token of user %s %v", user.ID, err)
+		return entity.AuthTokens{}, errors.InternalServerError("")
+	}
+	if identity.Email != "" {
+		if err := s.repo.UpdateEmail(ctx, user.ID, identity.Email, false); err != nil {
+			s.logger.Errorf("There is an error while updating the email of user %s %v", user.ID, err)
+		}
+	}
+
+	return s.createAuthTokens(ctx, user, deviceKey)
+}
+
+func (s service) HandleAppleNotification(ctx context.Context, payload string) error {
+	event, err := s.appleVerifier.VerifyNotification(ctx, payload)
+	if err != nil {
+		s.logger.With(ctx).Infof("Apple notification verification failed %v", err)
+		return errors.Unauthorized("")
+	}
+
+	logger := s.logger.With(ctx, "event", event.Type)
+	user, err := s.repo.GetUserByAuthID(ctx, entity.AuthMethodApple, event.Subject)
+	if stderr.Is(err, sql.ErrNoRows) {
+		logger.Infof("No user found for the Apple notification subject %s", event.Subject)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// the sessions of a user who revoked the consent or deleted the Apple account are ended like those of a deleted account
+	signOut := false
+	switch event.Type {
+	case AppleEventEmailDisabled:
+		err = s.repo.UpdateEmail(ctx, user.ID, event.Email, true)
+	case AppleEventEmailEnabled:
+		err = s.repo.UpdateEmail(ctx, user.ID, event.Email, false)
+	case AppleEventConsentRevoked:
+		signOut = true
+		err = s.transact(ctx, func(ctx context.Context) error {
+			if err := s.repo.RevokeAllRefreshTokens(ctx, user.ID); err != nil {
+				return err
+			}
+			return s.repo.DeleteAppleRefreshToken(ctx, user.ID)
+		})
+	case AppleEventAccountDelete:
+		signOut = true
+		err = s.transact(ctx, func(ctx context.Context) error {
+			if err := s.repo.SoftDeleteUser(ctx, user.ID); err != nil {
+				return err
+			}
+			if err := s.repo.RevokeAllRefreshTokens(ctx, user.ID); err != nil {
+				return err
+			}
+			return s.repo.DeleteAppleRefreshToken(ctx, user.ID)
+		})
+	default:
+		logger.Infof("Ignoring unknown Apple notification type")
+		return nil
+	}
+
+	if err != nil {
+		logger.Errorf("There is an error while handling the Apple notification for user %s %v", user.ID, err)
+		return errors.InternalServerError("")
+	}
+	s.users.Invalidate(user.ID)
+	if signOut {
+		if err := s.revocations.RevokeUser(ctx, user.ID, s.accessTokenExpiry()); err != nil {
+			logger.Errorf("There is an error while revoking the access tokens of user %s %v", user.ID, err)
+		}
+	}
+	logger.Infof("Handled Apple notification for user %s", user.ID)
+	return nil
+}
+
+func (s service) LinkIdentity(ctx context.Context, authMethod entity.AuthMethod, idToken, authorizationCode, deviceKey string) (authTokens entity.AuthTokens, err error) {
+	current := CurrentUser(ctx)
+	details := string(authMethod)
+	defer func() { s.recordEvent(ctx, AuthEventLinkIdentity, current.ID, deviceKey, err, details) }()
+
+	if !current.IsAnonymous() {
+		return authTokens, errors.BadRequest("The account is already linked to an identity", "account_already_linked")
+	}
+
+	var identity Identity
+	var appleRefreshToken string
+	switch authMethod {
+	case entity.AuthMethodGoogle:
+		identity, err = s.googleVerifier.Verify(ctx, idToken)
+	case entity.AuthMethodApple:
+		if identity, err = s.appleVerifier.Verify(ctx, idToken); err == nil {
+			appleRefreshToken, err = s.appleClient.ExchangeCode(ctx, authorizationCode)
+		}
+	default:
+		return authTokens, errors.BadRequest("Unsupported identity provider", "unsupported_provider")
+	}
+	if err != nil {
+		s.logger.With(ctx).Infof("%s identity verification failed %v", authMethod, err)
+		return authTokens, errors.Unauthorized("")
+	}
+
+	user := *current
+	err = s.transact(ctx, func(ctx context.Context) error {
+		owner, err := s.repo.GetUserByAuthID(ctx, authMethod, identity.Subject)
+		if stderr.Is(err, sql.ErrNoRows) {
+			return s.repo.LinkIdentity(ctx, current.ID, authMethod, identity.Subject)
+		} else if err != nil {
+			return err
+		}
+		user = owner
+		details = fmt.Sprintf("%s, merged into user %s", authMethod, owner.ID)
+		return s.mergeUsers(ctx, current.ID, owner.ID)
+	})
+	if err != nil {
+		s.logger.Errorf("There is an error while linking the %s identity to user %s %v", authMethod, current.ID, err)
+		return authTokens, errors.InternalServerError("")
+	}
+	s.users.Invalidate(current.ID, user.ID)
+	if user.ID != current.ID {
+		// the refresh tokens of the merged user are revoked with it, but its access tokens stay valid until revoked
+		if err := s.revocations.RevokeUser(ctx, current.ID, s.accessTokenExpiry()); err != nil {
+			s.logger.Errorf("There is an error while revoking the access tokens of the merged user %s %v", current.ID, err)
+		}
+	}
+
+	if appleRefreshToken != "" {
+		if err := s.repo.SaveAppleRefreshToken(ctx, user.ID, appleRefreshToken); err != nil {
+			s.logger.Errorf("There is an error while saving the Apple refresh token of user %s %v", user.ID, err)
+		}
+	}
+	if identity.Email != "" {
+		if err := s.repo.UpdateEmail(ctx, user.ID, identity.Email, false); err != nil {
+			s.logger.Errorf("There is an error while updating the email of user %s %v", user.ID, err)
+		}
+	}
+
+	return s.createAuthTokens(ctx, user, deviceKey)
+}
+
+// mergeUsers merges the anonymous user into the user owning the identity being linked.
+// The files, the albums and the credit ledger are moved, the better subscription is kept
+// and the anonymous user is soft-deleted. It must be called within a transaction.
+func (s service) mergeUsers(ctx context.Context, fromUserID, toUserID string) error {
+	from, err := s.repo.GetUserByUserID(ctx, fromUserID)
+	if err != nil {
+		return err
+	}
+	to, err := s.repo.GetUserByUserID(ctx, toUserID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.MoveFiles(ctx, fromUserID, toUserID); err != nil {
+		return err
+	}
+
+	if err := s.repo.MoveAlbums(ctx, fromUserID, toUserID); err != nil {
+		return err
+	}
+
+	if err := s.repo.MoveCredits(ctx, fromUserID, toUserID); err != nil {
+		return err
+	}
+
+	if from.Subscription.IsBetterThan(to.Subscription) {
+		if err := s.repo.CopySubscription(ctx, fromUserID, toUserID); err != nil {
+			return err
+		}
+	}
+
+	if err := s.repo.SoftDeleteUser(ctx, fromUserID); err != nil {
+		return err
+	}
+	return s.repo.RevokeAllRefreshTokens(ctx, fromUserID)
+}
+
+// findOrCreateUser returns the user owning an identity verified by an external provider.
+// The user is created if this is the first sign-in with the identity.
+func (s service) findOrCreateUser(ctx context.Context, authMethod entity.AuthMethod, identity Identity) (entity.User, error) {
+	user, err := s.repo.GetUserByAuthID(ctx, authMethod, identity.Subject)
+
+	if err != nil && stderr.Is(err, sql.ErrNoRows) {
+		user, err = s.repo.CreateUser(ctx, authMethod, identity.Subject)
+		if isUniqueViolation(err) {
+			// a concurrent first sign-in with the same identity has created the user
+			user, err = s.repo.GetUserByAuthID(ctx, authMethod, identity.Subject)
+		}
+		if err != nil {
+			s.logger.Errorf("There is an error while creating the %s user %s %v", authMethod, identity.Subject, err)
+			return user, errors.InternalServerError("")
+		}
+	} else if err != nil {
+		s.logger.Errorf("There is an error while getting the %s user %s %v", authMethod, identity.Subject, err)
+		return user, errors.InternalServerError("")
+	}
+
+	return user, nil
+}
+
+// RefreshTokens rotates the given refresh token and issues a new pair of tokens.
+// Presenting a refresh token that has already been rotated is treated as token theft:
+// the whole token family is revoked and the client is forced to log in again.
+// A token revoked otherwise, e.g. by a logout, is only rejected.
+func (s service) RefreshTokens(ctx context.Context, refreshToken, deviceKey string) (authTokens entity.AuthTokens, err error) {
+	var userID string
+	defer func() { s.recordEvent(ctx, AuthEventRefresh, userID, deviceKey, err, "") }()
+
 	refreshTokenHashed, err := s.hashToken(refreshToken)
 
 	if err != nil {
 		return authTokens, err
 	}
 
-	userID, err := s.repo.ValidateRefreshToken(ctx, deviceKey, refreshTokenHashed)
+	token, err := s.repo.GetRefreshToken(ctx, deviceKey, refreshTokenHashed)
 
 	if stderr.Is(err, sql.ErrNoRows) {
 		return authTokens, errors.Unauthorized("")
 	} else if err != nil {
 		return authTokens, errors.InternalServerError("")
 	}
+	userID = token.UserID
 
-	user, err := s.repo.GetUserByUserID(ctx, userID)
+	if token.RevokedAt != nil {
+		return authTokens, s.rejectRevokedRefreshToken(ctx, token)
+	}
+	if token.ExpiresAt.Before(time.Now()) {
+		return authTokens, errors.Unauthorized("")
+	}
 
-	return s.createAuthTokens(ctx, user, deviceKey)
+	user, err := s.repo.GetUserByUserID(ctx, token.UserID)
+	if stderr.Is(err, sql.ErrNoRows) {
+		return authTokens, errors.Unauthorized("")
+	} else if err != nil {
+		return authTokens, errors.InternalServerError("")
+	}
+	if user.IsBanned() {
+		return authTokens, errAccountBanned
+	}
+
+	accessToken, err := s.generateJWT(user, token.FamilyID)
+	if err != nil {
+		return authTokens, errors.Unauthorized("")
+	}
+
+	newRefreshToken := uuid.New().String()
+	newRefreshTokenHashed, err := s.hashToken(newRefreshToken)
+	if err != nil {
+		return authTokens, err
+	}
+
+	// keep the device details of the session unless the client reports new ones
+	device := currentDevice(ctx, token.DeviceKey)
+	if device.Name == "" && token.DeviceName != nil {
+		device.Name = *token.DeviceName
+	}
+	if device.Platform == "" && token.Platform != nil {
+		device.Platform = *token.Platform
+	}
+
+	err = s.repo.RotateRefreshToken(ctx, token, device, newRefreshTokenHashed)
+	if stderr.Is(err, ErrRefreshTokenRevoked) {
+		// the same token has been rotated or revoked concurrently
+		if token, err = s.repo.GetRefreshToken(ctx, deviceKey, refreshTokenHashed); err != nil {
+			return authTokens, errors.InternalServerError("")
+		}
+		return authTokens, s.rejectRevokedRefreshToken(ctx, token)
+	} else if err != nil {
+		return authTokens, err
+	}
+
+	authTokens.AccessToken = accessToken
+	authTokens.RefreshToken = newRefreshToken
+
+	return authTokens, nil
 }
 
-func (s service) Logout(ctx context.Context, deviceKey string) error {
-	return s.repo.InvalidateRefreshToken(ctx, CurrentUser(ctx).ID, deviceKey)
+// rejectRevokedRefreshToken rejects a revoked refresh token, handling it as reuse if it has been rotated.
+func (s service) rejectRevokedRefreshToken(ctx context.Context, token entity.RefreshToken) error {
+	if token.Rotated {
+		return s.handleRefreshTokenReuse(ctx, token)
+	}
+	s.logger.With(ctx, "user", token.UserID, "family", token.FamilyID).Infof("revoked refresh token rejected")
+	return errors.Unauthorized("")
 }
 
-func (s service) createAuthTokens(ctx context.Context, user entity.User, deviceKey string) (entity.AuthTokens, error) {
-	var authTokens entity.AuthTokens
+// handleRefreshTokenReuse revokes the family of a replayed refresh token and records an audit event.
+func (s service) handleRefreshTokenReuse(ctx context.Context, token entity.RefreshToken) error {
+	logger := s.logger.With(ctx, "user", token.UserID, "family", token.FamilyID)
+	logger.Infof("revoked refresh token reused, revoking the token family")
 
-	accessToken, err := s.generateJWT(user)
+	if err := s.repo.RevokeRefreshTokenFamily(ctx, token.FamilyID); err != nil {
+		logger.Errorf("There is an error while revoking the refresh token family %v", err)
+		return errors.InternalServerError("")
+	}
+	if err := s.revocations.RevokeSession(ctx, token.FamilyID, s.accessTokenExpiry()); err != nil {
+		logger.Errorf("There is an error while revoking the access tokens of the session %v", err)
+	}
+
+	err := errors.UnauthorizedWithCode("The session has been revoked. Please log in again.", "refresh_token_reused")
+	details := fmt.Sprintf("refresh token %s of family %s reused", token.ID, token.FamilyID)
+	s.recordEvent(ctx, AuthEventRefreshTokenReuse, token.UserID, token.DeviceKey, err, details)
+
+	return err
+}
+
+// PruneRefreshTokens deletes refresh tokens that expired or were revoked longer than the retention period ago.
+func (s service) PruneRefreshTokens(ctx context.Context) error {
+	deleted, err := s.repo.DeleteStaleRefreshTokens(ctx, time.Now().Add(-refreshTokenRetention))
 	if err != nil {
-		return authTokens, errors.Unauthorized("")
+		return err
+	}
+	if deleted > 0 {
+		s.logger.With(ctx).Infof("pruned %d stale refresh tokens", deleted)
+	}
+	return nil
+}
+
+// PruneRevokedTokens implements Service.
+func (s service) PruneRevokedTokens(ctx context.Context) error {
+	return s.revocations.Prune(ctx)
+}
+
+func (s service) Logout(ctx context.Context, deviceKey string) (err error) {
+	userID := CurrentUser(ctx).ID
+	defer func() { s.recordEvent(ctx, AuthEventLogout, userID, deviceKey, err, "") }()
+
+	if err := s.repo.InvalidateRefreshToken(ctx, userID, deviceKey); err != nil {
+		return err
+	}
+
+	token := currentAccessToken(ctx)
+	switch {
+	case token.ID != "":
+		return s.revocations.RevokeToken(ctx, token.ID, token.ExpiresAt)
+	case token.SessionID != "":
+		// tokens issued before the jti claim was introduced can only be revoked with their session
+		return s.revocations.RevokeSession(ctx, token.SessionID, s.accessTokenExpiry())
+	}
+	return nil
+}
+
+// SetRole implements Service.
+func (s service) SetRole(ctx context.Context, userID string, role entity.Role) (err error) {
+	defer func() {
+		s.recordEvent(ctx, AuthEventRoleChange, userID, "", err, fmt.Sprintf("role %s set by %s", role, CurrentUser(ctx).GetID()))
+	}()
+
+	if !role.IsValid() {
+		return errors.BadRequest("The role is invalid", "invalid_role")
+	}
+	if _, err := uuid.Parse(userID); err != nil {
+		return errors.NotFound("")
+	}
+	logger := s.logger.With(ctx, "user", userID)
+
+	found, err := s.repo.SetRole(ctx, userID, role)
+	if err != nil {
+		logger.Errorf("There is an error while updating the role of the user %v", err)
+		return errors.InternalServerError("")
+	}
+	if !found {
+		return errors.NotFound("")
+	}
+	s.users.Invalidate(userID)
+	if err := s.revocations.RevokeUser(ctx, userID, s.accessTokenExpiry()); err != nil {
+		logger.Errorf("There is an error while revoking the access tokens of the user %v", err)
+	}
+
+	logger.Infof("role changed to %s", role)
+	return nil
+}
+
+func (s service) LogoutAll(ctx context.Context) (err error) {
+	userID := CurrentUser(ctx).ID
+	defer func() { s.recordEvent(ctx, AuthEventLogoutAll, userID, "", err, "") }()
+
+	if err := s.repo.RevokeAllRefreshTokens(ctx, userID); err != nil {
+		return err
+	}
+	return s.revocations.RevokeUser(ctx, userID, s.accessTokenExpiry())
+}
+
+// BanUser implements Service.
+func (s service) BanUser(ctx context.Context, userID string, banned bool) (err error) {
+	defer func() {
+		eventType := AuthEventUserBan
+		if !banned {
+			eventType = AuthEventUserUnban
+		}
+		s.recordEvent(ctx, eventType, userID, "", err, "by "+CurrentUser(ctx).GetID())
+	}()
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return errors.NotFound("")
+	}
+	logger := s.logger.With(ctx, "user", userID)
+
+	var found bool
+	err = s.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if found, err = s.repo.SetBanned(ctx, userID, banned); err != nil || !found || !banned {
+			return err
+		}
+		return s.repo.RevokeAllRefreshTokens(ctx, userID)
+	})
+	if err != nil {
+		logger.Errorf("There is an error while updating the ban of the user %v", err)
+		return errors.InternalServerError("")
+	}
+	if !found {
+		return errors.NotFound("")
+	}
+	s.users.Invalidate(userID)
+
+	if banned {
+		if err := s.revocations.RevokeUser(ctx, userID, s.accessTokenExpiry()); err != nil {
+			logger.Errorf("There is an error while revoking the access tokens of the user %v", err)
+			return errors.InternalServerError("")
+		}
+		logger.Infof("user banned")
+	} else {
+		logger.Infof("user unbanned")
+	}
+	return nil
+}
+
+func (s service) DeleteAccount(ctx context.Context) (err error) {
+	userID := CurrentUser(ctx).ID
+	defer func() { s.recordEvent(ctx, AuthEventAccountDelete, userID, "", err, "") }()
+	logger := s.logger.With(ctx, "user", userID)
+
+	err = s.transact(ctx, func(ctx context.Context) error {
+		if err := s.repo.SoftDeleteUser(ctx, userID); err != nil {
+			return err
+		}
+		return s.repo.RevokeAllRefreshTokens(ctx, userID)
+	})
+	if err != nil {
+		logger.Errorf("There is an error while deleting the account %v", err)
+		return errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+	if err := s.revocations.RevokeUser(ctx, userID, s.accessTokenExpiry()); err != nil {
+		logger.Errorf("There is an error while revoking the access tokens of the account %v", err)
+	}
+
+	// Sign in with Apple tokens must be revoked when the account is deleted
+	appleRefreshToken, err := s.repo.GetAppleRefreshToken(ctx, userID)
+	if err == nil {
+		if err = s.appleClient.RevokeToken(ctx, appleRefreshToken); err == nil {
+			err = s.repo.DeleteAppleRefreshToken(ctx, userID)
+		}
+	}
+	if err != nil && !stderr.Is(err, sql.ErrNoRows) {
+		logger.Errorf("There is an error while revoking the Apple refresh token %v", err)
+	}
+
+	logger.Infof("account deleted")
+	return nil
+}
+
+func (s service) ListSessions(ctx context.Context) ([]entity.Session, error) {
+	sessions, err := s.repo.ListSessions(ctx, CurrentUser(ctx).ID)
+	if err != nil {
+		return nil, err
+	}
+
+	currentSessionID := CurrentSessionID(ctx)
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentSessionID
+	}
+	return sessions, nil
+}
+
+func (s service) RevokeSession(ctx context.Context, sessionID string) (err error) {
+	userID := CurrentUser(ctx).ID
+	defer func() { s.recordEvent(ctx, AuthEventSessionRevoke, userID, "", err, "session "+sessionID) }()
+
+	if _, err := uuid.Parse(sessionID); err != nil {
+		return errors.NotFound("")
+	}
+
+	revoked, err := s.repo.RevokeSession(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return errors.NotFound("")
+	}
+	return s.revocations.RevokeSession(ctx, sessionID, s.accessTokenExpiry())
+}
+
+func (s service) createAuthTokens(ctx context.Context, user entity.User, deviceKey string) (entity.AuthTokens, error) {
+	var authTokens entity.AuthTokens
+	if user.IsBanned() {
+		return authTokens, errAccountBanned
 	}
 
 	refreshToken := uuid.New().String()
 	refreshTokenHashed, err := s.hashToken(refreshToken)
+	if err != nil {
+		return authTokens, err
+	}
 
-	err = s.repo.CreateNewRefreshToken(ctx, deviceKey, user.ID, refreshTokenHashed)
+	sessionID, err := s.repo.CreateNewRefreshToken(ctx, currentDevice(ctx, deviceKey), user.ID, refreshTokenHashed)
 
 	if err != nil {
 		return authTokens, err
 	}
 
+	accessToken, err := s.generateJWT(user, sessionID)
+	if err != nil {
+		return authTokens, errors.Unauthorized("")
+	}
+
 	authTokens.AccessToken = accessToken
 	authTokens.RefreshToken = refreshToken
 
@@ -136,11 +924,31 @@ func (s service) hashToken(token string) (string, error) {
 
 }
 
-// generateJWT generates a JWT that encodes an identity.
-func (s service) generateJWT(user entity.User) (string, error) {
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":   user.GetID(),
-		"name": user.GetName(),
-		"exp":  time.Now().Add(time.Duration(s.tokenExpiration) * time.Minute).Unix(),
-	}).SignedString([]byte(s.signingKey))
+// generateJWT generates a JWT that encodes an identity and the session it is issued for.
+// Every token gets a unique ID in the jti claim so that it can be revoked before it expires.
+// The iat_ms claim holds the issue time in milliseconds, because iat is too coarse to tell apart
+// the tokens issued in the same second before and after a session or user is revoked.
+func (s service) generateJWT(user entity.User, sessionID string) (string, error) {
+	now := time.Now()
+	return s.keys.Sign(jwt.MapClaims{
+		"jti":    uuid.New().String(),
+		"id":     user.GetID(),
+		"name":   user.GetName(),
+		"role":   user.Role,
+		"sid":    sessionID,
+		"iat":    now.Unix(),
+		"iat_ms": now.UnixMilli(),
+		"exp":    now.Add(time.Duration(s.tokenExpiration) * time.Minute).Unix(),
+	})
+}
+
+// accessTokenExpiry returns the time by which every access token issued until now has expired.
+func (s service) accessTokenExpiry() time.Time {
+	return time.Now().Add(time.Duration(s.tokenExpiration) * time.Minute)
+}
+
+// isUniqueViolation reports whether the error is caused by a unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return stderr.As(err, &pqErr) && pqErr.Code == "23505"
 }
@@ -0,0 +1,445 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockTransactor runs the functions as transactions and records the calls made within them.
+type mockTransactor struct {
+	active bool
+	calls  []string
+}
+
+func (m *mockTransactor) transact(ctx context.Context, f func(ctx context.Context) error) error {
+	m.active = true
+	defer func() { m.active = false }()
+	return f(ctx)
+}
+
+// record records a call, marking the calls made outside a transaction.
+func (m *mockTransactor) record(call string) {
+	if !m.active {
+		call += " (no transaction)"
+	}
+	m.calls = append(m.calls, call)
+}
+
+type mockAppleVerifier struct {
+	AppleVerifier
+	event AppleEvent
+}
+
+func (v mockAppleVerifier) VerifyNotification(context.Context, string) (AppleEvent, error) {
+	return v.event, nil
+}
+
+type mockRepository struct {
+	Repository
+	tx    *mockTransactor
+	users map[string]entity.User
+}
+
+func (r mockRepository) GetUserByAuthID(_ context.Context, _ entity.AuthMethod, authID string) (entity.User, error) {
+	return entity.User{ID: "user-" + authID}, nil
+}
+
+func (r mockRepository) GetUserByUserID(_ context.Context, userID string) (entity.User, error) {
+	return r.users[userID], nil
+}
+
+func (r mockRepository) CopySubscription(_ context.Context, fromUserID, toUserID string) error {
+	r.tx.record("copy subscription of " + fromUserID + " to " + toUserID)
+	return nil
+}
+
+func (r mockRepository) MoveFiles(_ context.Context, fromUserID, toUserID string) error {
+	r.tx.record("move files of " + fromUserID + " to " + toUserID)
+	return nil
+}
+
+func (r mockRepository) MoveAlbums(_ context.Context, fromUserID, toUserID string) error {
+	r.tx.record("move albums of " + fromUserID + " to " + toUserID)
+	return nil
+}
+
+func (r mockRepository) MoveCredits(_ context.Context, fromUserID, toUserID string) error {
+	r.tx.record("move credits of " + fromUserID + " to " + toUserID)
+	return nil
+}
+
+func (r mockRepository) SoftDeleteUser(context.Context, string) error {
+	r.tx.record("delete user")
+	return nil
+}
+
+func (r mockRepository) RevokeAllRefreshTokens(context.Context, string) error {
+	r.tx.record("revoke refresh tokens")
+	return nil
+}
+
+func (r mockRepository) DeleteAppleRefreshToken(context.Context, string) error {
+	r.tx.record("delete Apple refresh token")
+	return nil
+}
+
+func (r mockRepository) GetAppleRefreshToken(context.Context, string) (string, error) {
+	return "", sql.ErrNoRows
+}
+
+func (r mockRepository) CreateAuthEvent(context.Context, entity.AuthEvent) error {
+	return nil
+}
+
+type mockRevocations struct {
+	RevocationStore
+	tx *mockTransactor
+}
+
+func (r mockRevocations) RevokeUser(_ context.Context, userID string, _ time.Time) error {
+	r.tx.record("revoke access tokens of " + userID)
+	return nil
+}
+
+func (r mockRevocations) RevokeSession(_ context.Context, sessionID string, _ time.Time) error {
+	r.tx.record("revoke access tokens of session " + sessionID)
+	return nil
+}
+
+type mockCache struct {
+	UserCache
+	tx *mockTransactor
+}
+
+func (c mockCache) Invalidate(userIDs ...string) {
+	for _, id := range userIDs {
+		c.tx.record("invalidate " + id)
+	}
+}
+
+func TestService_HandleAppleNotification(t *testing.T) {
+	tests := []struct {
+		name  string
+		event string
+		want  []string
+	}{
+		{"account deleted", AppleEventAccountDelete, []string{
+			"delete user",
+			"revoke refresh tokens",
+			"delete Apple refresh token",
+			"invalidate user-apple1 (no transaction)",
+			"revoke access tokens of user-apple1 (no transaction)",
+		}},
+		{"consent revoked", AppleEventConsentRevoked, []string{
+			"revoke refresh tokens",
+			"delete Apple refresh token",
+			"invalidate user-apple1 (no transaction)",
+			"revoke access tokens of user-apple1 (no transaction)",
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, _ := log.NewForTest()
+			tx := &mockTransactor{}
+			s := NewService(nil, 3600, mockRepository{tx: tx}, nil,
+				mockAppleVerifier{event: AppleEvent{Type: tc.event, Subject: "apple1"}}, nil,
+				tx.transact, mockRevocations{tx: tx}, mockCache{tx: tx}, 0, logger)
+
+			assert.NoError(t, s.HandleAppleNotification(context.Background(), "payload"))
+			assert.Equal(t, tc.want, tx.calls)
+		})
+	}
+}
+
+// errorCode returns the error code of an error response, or its status if it has no code.
+func errorCode(err error) string {
+	res, ok := err.(errors.ErrorResponse)
+	if !ok {
+		return ""
+	}
+	if details, ok := res.Details.(map[string]string); ok && details["error_code"] != "" {
+		return details["error_code"]
+	}
+	return http.StatusText(res.StatusCode())
+}
+
+// credentialRepository holds the password credential of a single user.
+type credentialRepository struct {
+	Repository
+	credential *entity.Credential
+}
+
+func (r credentialRepository) GetCredentialByUsername(_ context.Context, username string) (entity.Credential, error) {
+	if username != r.credential.Username {
+		return entity.Credential{}, sql.ErrNoRows
+	}
+	return *r.credential, nil
+}
+
+func (r credentialRepository) IncrementFailedAttempts(_ context.Context, _ string, maxAttempts int, lockedUntil time.Time) (entity.Credential, error) {
+	r.credential.FailedAttempts++
+	if r.credential.FailedAttempts >= maxAttempts {
+		r.credential.FailedAttempts = 0
+		r.credential.LockedUntil = &lockedUntil
+	}
+	return *r.credential, nil
+}
+
+func (r credentialRepository) UpdateFailedAttempts(_ context.Context, _ string, failedAttempts int, lockedUntil *time.Time) error {
+	r.credential.FailedAttempts, r.credential.LockedUntil = failedAttempts, lockedUntil
+	return nil
+}
+
+func (r credentialRepository) GetUserByUserID(_ context.Context, userID string) (entity.User, error) {
+	return entity.User{ID: userID}, nil
+}
+
+func (r credentialRepository) CreateNewRefreshToken(context.Context, entity.Device, string, string) (string, error) {
+	return "session1", nil
+}
+
+func (r credentialRepository) CreateAuthEvent(context.Context, entity.AuthEvent) error {
+	return nil
+}
+
+func TestService_LoginUsername(t *testing.T) {
+	logger, _ := log.NewForTest()
+	keys, _ := NewKeySet("", "secret")
+	hash, _ := hashPassword("password")
+	credential := &entity.Credential{UserID: "user1", Username: "john", PasswordHash: hash}
+	s := NewService(keys, 60, credentialRepository{credential: credential}, nil, nil, nil, nil, nil, nil, 0, logger)
+	ctx := context.Background()
+
+	_, err := s.LoginUsername(ctx, "jane", "password", "device1")
+	assert.Equal(t, "Unauthorized", errorCode(err))
+
+	// a successful login resets the failed attempts
+	for i := 0; i < maxFailedLoginAttempts-1; i++ {
+		_, err = s.LoginUsername(ctx, "john", "wrong password", "device1")
+		assert.Equal(t, "Unauthorized", errorCode(err))
+	}
+	tokens, err := s.LoginUsername(ctx, "john", "password", "device1")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tokens.AccessToken)
+	assert.Equal(t, 0, credential.FailedAttempts)
+
+	// the account is locked after too many wrong passwords, even for the right password
+	for i := 0; i < maxFailedLoginAttempts; i++ {
+		_, err = s.LoginUsername(ctx, "john", "wrong password", "device1")
+		assert.Equal(t, "Unauthorized", errorCode(err))
+	}
+	_, err = s.LoginUsername(ctx, "john", "password", "device1")
+	assert.Equal(t, "account_locked", errorCode(err))
+
+	// the lock expires
+	lockedUntil := time.Now().Add(-time.Second)
+	credential.LockedUntil = &lockedUntil
+	_, err = s.LoginUsername(ctx, "john", "password", "device1")
+	assert.NoError(t, err)
+}
+
+// refreshTokenRepository holds the refresh tokens by their device key.
+type refreshTokenRepository struct {
+	Repository
+	tx     *mockTransactor
+	tokens map[string]entity.RefreshToken
+}
+
+func (r refreshTokenRepository) GetRefreshToken(_ context.Context, deviceKey, _ string) (entity.RefreshToken, error) {
+	token, ok := r.tokens[deviceKey]
+	if !ok {
+		return token, sql.ErrNoRows
+	}
+	return token, nil
+}
+
+func (r refreshTokenRepository) GetUserByUserID(_ context.Context, userID string) (entity.User, error) {
+	return entity.User{ID: userID}, nil
+}
+
+func (r refreshTokenRepository) RotateRefreshToken(_ context.Context, parent entity.RefreshToken, _ entity.Device, _ string) error {
+	r.tx.record("rotate refresh token " + parent.ID)
+	return nil
+}
+
+func (r refreshTokenRepository) RevokeRefreshTokenFamily(_ context.Context, familyID string) error {
+	r.tx.record("revoke refresh token family " + familyID)
+	return nil
+}
+
+func (r refreshTokenRepository) CreateAuthEvent(context.Context, entity.AuthEvent) error {
+	return nil
+}
+
+func TestService_RefreshTokens(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		token    entity.RefreshToken
+		wantCode string
+		want     []string
+	}{
+		{"active", entity.RefreshToken{ID: "token1", FamilyID: "family1", ExpiresAt: now.Add(time.Hour)},
+			"", []string{"rotate refresh token token1 (no transaction)"}},
+		{"expired", entity.RefreshToken{ID: "token1", FamilyID: "family1", ExpiresAt: now.Add(-time.Hour)},
+			"Unauthorized", nil},
+		{"logged out", entity.RefreshToken{ID: "token1", FamilyID: "family1", ExpiresAt: now.Add(time.Hour), RevokedAt: &now},
+			"Unauthorized", nil},
+		{"reused", entity.RefreshToken{ID: "token1", FamilyID: "family1", ExpiresAt: now.Add(time.Hour), RevokedAt: &now, Rotated: true},
+			"refresh_token_reused", []string{
+				"revoke refresh token family family1 (no transaction)",
+				"revoke access tokens of session family1 (no transaction)",
+			}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, _ := log.NewForTest()
+			keys, _ := NewKeySet("", "secret")
+			tx := &mockTransactor{}
+			tc.token.UserID, tc.token.DeviceKey = "user1", "device1"
+			repo := refreshTokenRepository{tx: tx, tokens: map[string]entity.RefreshToken{"device1": tc.token}}
+			s := NewService(keys, 60, repo, nil, nil, nil, tx.transact, mockRevocations{tx: tx}, nil, 0, logger)
+
+			tokens, err := s.RefreshTokens(context.Background(), "refresh token", "device1")
+			assert.Equal(t, tc.wantCode, errorCode(err))
+			if tc.wantCode == "" {
+				assert.NotEmpty(t, tokens.AccessToken)
+				assert.NotEqual(t, "refresh token", tokens.RefreshToken)
+			}
+			assert.Equal(t, tc.want, tx.calls)
+
+			_, err = s.RefreshTokens(context.Background(), "refresh token", "device2")
+			assert.Equal(t, "Unauthorized", errorCode(err))
+		})
+	}
+}
+
+// sessionRepository holds the sessions of a single user.
+type sessionRepository struct {
+	Repository
+	tx       *mockTransactor
+	sessions []entity.Session
+}
+
+func (r sessionRepository) ListSessions(context.Context, string) ([]entity.Session, error) {
+	return r.sessions, nil
+}
+
+func (r sessionRepository) RevokeSession(_ context.Context, _, sessionID string) (bool, error) {
+	for _, session := range r.sessions {
+		if session.ID == sessionID {
+			r.tx.record("revoke session " + sessionID)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r sessionRepository) CreateAuthEvent(context.Context, entity.AuthEvent) error {
+	return nil
+}
+
+func TestService_Sessions(t *testing.T) {
+	const (
+		session1 = "8a0a2fd5-2bc1-4bd5-9a4d-25c8fa3d8bde"
+		session2 = "f2c5d1e3-8b5a-4a0e-8f7e-1c2b3d4e5f60"
+	)
+	logger, _ := log.NewForTest()
+	tx := &mockTransactor{}
+	repo := sessionRepository{tx: tx, sessions: []entity.Session{{ID: session1}, {ID: session2}}}
+	s := NewService(nil, 60, repo, nil, nil, nil, tx.transact, mockRevocations{tx: tx}, nil, 0, logger)
+	ctx := WithUser(context.Background(), entity.User{ID: "user1"})
+	ctx = context.WithValue(ctx, tokenKey, AccessTokenClaims{UserID: "user1", SessionID: session2})
+
+	sessions, err := s.ListSessions(ctx)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []entity.Session{{ID: session1}, {ID: session2, Current: true}}, sessions)
+	}
+
+	assert.NoError(t, s.RevokeSession(ctx, session1))
+	assert.Equal(t, "Not Found", errorCode(s.RevokeSession(ctx, "8a0a2fd5-0000-4bd5-9a4d-25c8fa3d8bde")))
+	assert.Equal(t, "Not Found", errorCode(s.RevokeSession(ctx, "invalid")))
+	assert.Equal(t, []string{
+		"revoke session " + session1 + " (no transaction)",
+		"revoke access tokens of session " + session1 + " (no transaction)",
+	}, tx.calls)
+}
+
+func TestService_DeleteAccount(t *testing.T) {
+	logger, _ := log.NewForTest()
+	tx := &mockTransactor{}
+	s := NewService(nil, 60, mockRepository{tx: tx}, nil, nil, nil, tx.transact, mockRevocations{tx: tx}, mockCache{tx: tx}, 0, logger)
+
+	assert.NoError(t, s.DeleteAccount(WithUser(context.Background(), entity.User{ID: "user1"})))
+	assert.Equal(t, []string{
+		"delete user",
+		"revoke refresh tokens",
+		"invalidate user1 (no transaction)",
+		"revoke access tokens of user1 (no transaction)",
+	}, tx.calls)
+}
+
+func TestService_LinkIdentity(t *testing.T) {
+	logger, _ := log.NewForTest()
+	tx := &mockTransactor{}
+	s := service{repo: mockRepository{tx: tx}, transact: tx.transact, logger: logger}
+	ctx := WithUser(context.Background(), entity.User{ID: "100", AuthMethod: string(entity.AuthMethodGoogle)})
+
+	_, err := s.LinkIdentity(ctx, entity.AuthMethodApple, "token", "code", "device1")
+	assert.Error(t, err)
+	assert.Empty(t, tx.calls)
+}
+
+func TestService_mergeUsers(t *testing.T) {
+	expiresAt := time.Now().Add(24 * time.Hour)
+	subscription := &entity.Subscription{ExpiresAt: &expiresAt}
+	tests := []struct {
+		name string
+		from entity.User
+		to   entity.User
+		want []string
+	}{
+		{"subscription merged", entity.User{ID: "anon", Subscription: subscription}, entity.User{ID: "owner"},
+			[]string{
+				"move files of anon to owner",
+				"move albums of anon to owner",
+				"move credits of anon to owner",
+				"copy subscription of anon to owner",
+				"delete user",
+				"revoke refresh tokens",
+			}},
+		{"owner subscription kept", entity.User{ID: "anon"}, entity.User{ID: "owner", Subscription: subscription},
+			[]string{
+				"move files of anon to owner",
+				"move albums of anon to owner",
+				"move credits of anon to owner",
+				"delete user",
+				"revoke refresh tokens",
+			}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, _ := log.NewForTest()
+			tx := &mockTransactor{}
+			repo := mockRepository{
+				tx:    tx,
+				users: map[string]entity.User{tc.from.ID: tc.from, tc.to.ID: tc.to},
+			}
+			s := service{repo: repo, transact: tx.transact, logger: logger}
+
+			err := s.transact(context.Background(), func(ctx context.Context) error {
+				return s.mergeUsers(ctx, tc.from.ID, tc.to.ID)
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, tx.calls)
+		})
+	}
+}
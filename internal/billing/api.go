@@ -0,0 +1,132 @@
+package billing
+
+import (
+	"io"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/qiangxue/go-rest-api/pkg/pagination"
+)
+
+// maxWebhookSize is the maximum size of a webhook payload in bytes.
+const maxWebhookSize = 1 << 20
+
+// RegisterHandlers sets up the routing of the HTTP handlers. The webhooks authenticate the stores themselves.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Post("/webhooks/revenuecat", res.revenueCatWebhook)
+	rg.Post("/webhooks/app-store", res.appStoreNotification)
+	rg.Post("/webhooks/google-play", res.googlePlayNotification)
+
+	rg.Use(authHandler)
+
+	// the following endpoints require a valid JWT
+	rg.Post("/credits/purchase", res.purchaseCredits)
+}
+
+// RegisterAdminHandlers registers the billing handlers of the admin route group.
+// The route group must only be reachable by the staff. Replaying events is restricted to admins.
+func RegisterAdminHandlers(rg *routing.RouteGroup, service Service, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Post("/webhook-events/<id>/replay", auth.RequireRole(entity.RoleAdmin), res.replayWebhookEvent)
+	rg.Get("/subscription-events", res.subscriptionEvents)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) revenueCatWebhook(c *routing.Context) error {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookSize))
+	if err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if err := r.service.HandleRevenueCatWebhook(c.Request.Context(), c.Request.Header.Get("Authorization"), payload); err != nil {
+		return err
+	}
+
+	return c.Write("success")
+}
+
+func (r resource) appStoreNotification(c *routing.Context) error {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookSize))
+	if err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if err := r.service.HandleAppStoreNotification(c.Request.Context(), payload); err != nil {
+		return err
+	}
+
+	return c.Write("success")
+}
+
+// googlePlayNotification handles the Pub/Sub push requests of the Google Play Real-Time Developer Notifications.
+// The push subscription authenticates with the token query parameter of its endpoint URL.
+func (r resource) googlePlayNotification(c *routing.Context) error {
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, maxWebhookSize))
+	if err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if err := r.service.HandleGooglePlayNotification(c.Request.Context(), c.Query("token"), payload); err != nil {
+		return err
+	}
+
+	return c.Write("success")
+}
+
+func (r resource) purchaseCredits(c *routing.Context) error {
+	var req PurchaseRequest
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	purchase, err := r.service.PurchaseCredits(c.Request.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(purchase)
+}
+
+func (r resource) replayWebhookEvent(c *routing.Context) error {
+	event, err := r.service.ReplayWebhookEvent(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		return err
+	}
+
+	return c.Write(event)
+}
+
+// subscriptionEvents returns a page of the subscription lifecycle events, which can be filtered by user and type.
+func (r resource) subscriptionEvents(c *routing.Context) error {
+	ctx := c.Request.Context()
+	userID, eventType := c.Query("user_id"), c.Query("type")
+	if _, err := uuid.Parse(userID); userID != "" && err != nil {
+		return errors.BadRequest("The user ID is not valid", "invalid_user_id")
+	}
+	count, err := r.service.CountSubscriptionEvents(ctx, userID, eventType)
+	if err != nil {
+		return err
+	}
+	pages := pagination.NewFromRequest(c.Request, count)
+	events, err := r.service.QuerySubscriptionEvents(ctx, userID, eventType, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = events
+	return c.Write(pages)
+}
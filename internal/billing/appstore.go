@@ -0,0 +1,387 @@
+package billing
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+)
+
+// ProviderAppStore is the provider of the App Store Server Notifications.
+const ProviderAppStore = "app_store"
+
+// appStoreProduction is the environment of the notifications and the transactions of the purchases made in production.
+const appStoreProduction = "Production"
+
+// The types of the App Store Server Notifications V2 applied to the subscriptions.
+const (
+	appStoreSubscribed             = "SUBSCRIBED"
+	appStoreDidRenew               = "DID_RENEW"
+	appStoreDidChangeRenewalStatus = "DID_CHANGE_RENEWAL_STATUS"
+	appStoreDidChangeRenewalPref   = "DID_CHANGE_RENEWAL_PREF"
+	appStoreOfferRedeemed          = "OFFER_REDEEMED"
+	appStoreRenewalExtended        = "RENEWAL_EXTENDED"
+	appStoreRefundReversed         = "REFUND_REVERSED"
+	appStoreDidFailToRenew         = "DID_FAIL_TO_RENEW"
+	appStoreExpired                = "EXPIRED"
+	appStoreGracePeriodExpired     = "GRACE_PERIOD_EXPIRED"
+	appStoreRefund                 = "REFUND"
+	appStoreRevoke                 = "REVOKE"
+)
+
+const (
+	// appStoreOfferTypeIntroductory is the offer type of the introductory offers, which include the free trials.
+	appStoreOfferTypeIntroductory = 1
+	// appStoreOfferDiscountFreeTrial is the discount type of the free trials.
+	appStoreOfferDiscountFreeTrial = "FREE_TRIAL"
+	// appStoreAutoRenewOn is the auto-renew status of the subscriptions which renew at their expiry.
+	appStoreAutoRenewOn = 1
+	// appStoreMinimumChainLength is the minimum number of certificates in the x5c header: the signing and the intermediate certificates.
+	appStoreMinimumChainLength = 2
+)
+
+var (
+	// appStoreLeafOID marks the certificates Apple signs the App Store payloads with.
+	appStoreLeafOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 11, 1}
+	// appStoreIntermediateOID marks the Apple intermediate certificate authority issuing the signing certificates.
+	appStoreIntermediateOID = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 1}
+)
+
+// AppStoreNotification is a verified App Store Server Notification V2 with its decoded transaction and renewal info.
+type AppStoreNotification struct {
+	NotificationUUID string
+	NotificationType string
+	Subtype          string
+	SignedDate       time.Time
+	BundleID         string
+	Environment      string
+	// Transaction is the signed transaction info of the notification, if any.
+	Transaction *AppStoreTransaction
+	// Renewal is the signed renewal info of the notification, if any.
+	Renewal *AppStoreRenewal
+}
+
+// AppStoreTransaction is the decoded signed transaction info of a notification.
+type AppStoreTransaction struct {
+	TransactionID         string `json:"transactionId"`
+	OriginalTransactionID string `json:"originalTransactionId"`
+	BundleID              string `json:"bundleId"`
+	ProductID             string `json:"productId"`
+	// AppAccountToken is the customer ID of the user, set by the app when the purchase is made.
+	AppAccountToken   string `json:"appAccountToken"`
+	PurchaseDate      int64  `json:"purchaseDate"`
+	ExpiresDate       *int64 `json:"expiresDate"`
+	RevocationDate    *int64 `json:"revocationDate"`
+	OfferType         int    `json:"offerType"`
+	OfferDiscountType string `json:"offerDiscountType"`
+	Type              string `json:"type"`
+	Quantity          int    `json:"quantity"`
+	// Environment is Production for the purchases made in production, or Sandbox.
+	Environment string `json:"environment"`
+}
+
+// AppStoreRenewal is the decoded signed renewal info of a notification.
+type AppStoreRenewal struct {
+	OriginalTransactionID  string `json:"originalTransactionId"`
+	AutoRenewProductID     string `json:"autoRenewProductId"`
+	AutoRenewStatus        int    `json:"autoRenewStatus"`
+	IsInBillingRetryPeriod bool   `json:"isInBillingRetryPeriod"`
+	GracePeriodExpiresDate *int64 `json:"gracePeriodExpiresDate"`
+}
+
+// subscriptionType returns the type of the subscription bought with the transaction.
+func (t AppStoreTransaction) subscriptionType() entity.SubscriptionType {
+	switch {
+	case t.OfferType == 0:
+		return entity.SubscriptionTypeNormal
+	case t.OfferType == appStoreOfferTypeIntroductory && t.OfferDiscountType == appStoreOfferDiscountFreeTrial:
+		return entity.SubscriptionTypeTrial
+	case t.OfferType == appStoreOfferTypeIntroductory:
+		return entity.SubscriptionTypeIntro
+	default:
+		// promotional offers, offer codes and win-back offers
+		return entity.SubscriptionTypePromo
+	}
+}
+
+// AppStoreVerifier verifies the payloads signed by the App Store.
+type AppStoreVerifier interface {
+	// Verify checks the signature and the certificate chain of the signed payload of a notification
+	// and decodes the notification along with its signed transaction and renewal info.
+	Verify(signedPayload string) (AppStoreNotification, error)
+	// VerifyTransaction checks the signature and the certificate chain of a signed transaction,
+	// e.g. the JWS representation of a StoreKit 2 transaction sent by the app, and decodes the transaction.
+	VerifyTransaction(signedTransaction string) (AppStoreTransaction, error)
+}
+
+// appStoreVerifier verifies ES256 signed JWS whose x5c certificate chain ends at one of the trusted roots.
+type appStoreVerifier struct {
+	roots    *x509.CertPool
+	bundleID string
+}
+
+// NewAppStoreVerifier creates a verifier trusting the given PEM encoded root certificates, which is the
+// Apple Root CA - G3 in production. Only the notifications and the transactions of the app with the given
+// bundle ID are accepted, so nothing is accepted if it is empty.
+func NewAppStoreVerifier(rootCAPEM, bundleID string) (AppStoreVerifier, error) {
+	v := appStoreVerifier{bundleID: bundleID}
+	if rootCAPEM != "" {
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM([]byte(rootCAPEM)) {
+			return nil, fmt.Errorf("invalid App Store root certificate")
+		}
+	}
+	return v, nil
+}
+
+// appStoreNotificationPayload is the payload of the signed notification.
+type appStoreNotificationPayload struct {
+	NotificationType string `json:"notificationType"`
+	Subtype          string `json:"subtype"`
+	NotificationUUID string `json:"notificationUUID"`
+	SignedDate       int64  `json:"signedDate"`
+	Data             struct {
+		BundleID              string `json:"bundleId"`
+		Environment           string `json:"environment"`
+		SignedTransactionInfo string `json:"signedTransactionInfo"`
+		SignedRenewalInfo     string `json:"signedRenewalInfo"`
+	} `json:"data"`
+}
+
+// Verify implements AppStoreVerifier.
+func (v appStoreVerifier) Verify(signedPayload string) (AppStoreNotification, error) {
+	var payload appStoreNotificationPayload
+	if err := v.verifyJWS(signedPayload, &payload); err != nil {
+		return AppStoreNotification{}, err
+	}
+	if payload.NotificationUUID == "" {
+		return AppStoreNotification{}, fmt.Errorf("missing notificationUUID")
+	}
+	if err := v.verifyBundleID(payload.Data.BundleID); err != nil {
+		return AppStoreNotification{}, err
+	}
+
+	notification := AppStoreNotification{
+		NotificationUUID: payload.NotificationUUID,
+		NotificationType: payload.NotificationType,
+		Subtype:          payload.Subtype,
+		SignedDate:       time.UnixMilli(payload.SignedDate),
+		BundleID:         payload.Data.BundleID,
+		Environment:      payload.Data.Environment,
+	}
+	if payload.Data.SignedTransactionInfo != "" {
+		notification.Transaction = &AppStoreTransaction{}
+		if err := v.verifyJWS(payload.Data.SignedTransactionInfo, notification.Transaction); err != nil {
+			return AppStoreNotification{}, fmt.Errorf("signedTransactionInfo: %v", err)
+		}
+		if err := v.verifyBundleID(notification.Transaction.BundleID); err != nil {
+			return AppStoreNotification{}, fmt.Errorf("signedTransactionInfo: %v", err)
+		}
+	}
+	if payload.Data.SignedRenewalInfo != "" {
+		notification.Renewal = &AppStoreRenewal{}
+		if err := v.verifyJWS(payload.Data.SignedRenewalInfo, notification.Renewal); err != nil {
+			return AppStoreNotification{}, fmt.Errorf("signedRenewalInfo: %v", err)
+		}
+	}
+	return notification, nil
+}
+
+// VerifyTransaction implements AppStoreVerifier.
+func (v appStoreVerifier) VerifyTransaction(signedTransaction string) (AppStoreTransaction, error) {
+	var transaction AppStoreTransaction
+	if err := v.verifyJWS(signedTransaction, &transaction); err != nil {
+		return transaction, err
+	}
+	if transaction.TransactionID == "" {
+		return transaction, fmt.Errorf("missing transactionId")
+	}
+	if err := v.verifyBundleID(transaction.BundleID); err != nil {
+		return transaction, err
+	}
+	return transaction, nil
+}
+
+// verifyBundleID checks that a payload is about the configured app.
+func (v appStoreVerifier) verifyBundleID(bundleID string) error {
+	if v.bundleID == "" {
+		return fmt.Errorf("no App Store bundle ID is configured")
+	}
+	if bundleID != v.bundleID {
+		return fmt.Errorf("unexpected bundle ID %q", bundleID)
+	}
+	return nil
+}
+
+// verifyJWS verifies the certificate chain in the x5c header and the signature of the JWS,
+// and decodes its payload into v.
+func (v appStoreVerifier) verifyJWS(token string, payload interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWS")
+	}
+
+	var header struct {
+		Alg string   `json:"alg"`
+		X5c []string `json:"x5c"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return fmt.Errorf("header: %v", err)
+	}
+	if header.Alg != jwt.SigningMethodES256.Alg() {
+		return fmt.Errorf("unexpected signing method %q", header.Alg)
+	}
+
+	leaf, err := v.verifyChain(header.X5c)
+	if err != nil {
+		return err
+	}
+	publicKey, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("the signing certificate does not have an ECDSA key")
+	}
+	if err := jwt.SigningMethodES256.Verify(parts[0]+"."+parts[1], parts[2], publicKey); err != nil {
+		return err
+	}
+
+	return decodeSegment(parts[1], payload)
+}
+
+// verifyChain verifies that the certificates of the x5c header form a chain to one of the trusted roots,
+// with the Apple marker extensions on the signing and the intermediate certificates. It returns the signing certificate.
+func (v appStoreVerifier) verifyChain(x5c []string) (*x509.Certificate, error) {
+	if v.roots == nil {
+		return nil, fmt.Errorf("no App Store root certificate is configured")
+	}
+	if len(x5c) < appStoreMinimumChainLength {
+		return nil, fmt.Errorf("the x5c header has %d certificates", len(x5c))
+	}
+
+	certificates := make([]*x509.Certificate, len(x5c))
+	for i, encoded := range x5c {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("x5c certificate %d: %v", i, err)
+		}
+		if certificates[i], err = x509.ParseCertificate(der); err != nil {
+			return nil, fmt.Errorf("x5c certificate %d: %v", i, err)
+		}
+	}
+	leaf := certificates[0]
+	if !hasExtension(leaf, appStoreLeafOID) {
+		return nil, fmt.Errorf("the signing certificate is not an App Store certificate")
+	}
+	if !hasExtension(certificates[1], appStoreIntermediateOID) {
+		return nil, fmt.Errorf("the intermediate certificate is not an Apple certificate authority")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return leaf, nil
+}
+
+func hasExtension(certificate *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, extension := range certificate.Extensions {
+		if extension.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// applyAppStoreNotification updates the subscription of the user the App Store notification is about.
+// The user is found by the app account token of the transaction. It returns the IDs of the users whose subscription has changed.
+func (s service) applyAppStoreNotification(ctx context.Context, payload []byte) ([]string, error) {
+	notification, err := s.verifyAppStorePayload(payload)
+	if err != nil {
+		return nil, fail("invalid notification: %v", err)
+	}
+	if notification.Environment != appStoreProduction && !s.sandbox {
+		return nil, ignore("notification of the %s environment", notification.Environment)
+	}
+	transaction := notification.Transaction
+	if transaction == nil {
+		return nil, ignore("%s notification without a transaction", notification.NotificationType)
+	}
+
+	var status entity.SubscriptionStatus
+	switch notification.NotificationType {
+	case appStoreSubscribed, appStoreDidRenew, appStoreDidChangeRenewalStatus, appStoreDidChangeRenewalPref,
+		appStoreOfferRedeemed, appStoreRenewalExtended, appStoreRefundReversed:
+		status = entity.SubscriptionStatusActive
+	case appStoreDidFailToRenew:
+		status = entity.SubscriptionStatusBillingIssue
+	case appStoreExpired, appStoreGracePeriodExpired, appStoreRefund, appStoreRevoke:
+		status = entity.SubscriptionStatusExpired
+	default:
+		return nil, ignore("unsupported notification type %s", notification.NotificationType)
+	}
+
+	product, ok := s.products[transaction.ProductID]
+	if !ok {
+		return nil, fail("unknown product %s", transaction.ProductID)
+	}
+
+	expiresAt := millisToTime(transaction.ExpiresDate)
+	var graceExpiresAt *time.Time
+	if status == entity.SubscriptionStatusBillingIssue && notification.Renewal != nil {
+		graceExpiresAt = millisToTime(notification.Renewal.GracePeriodExpiresDate)
+	}
+	if transaction.RevocationDate != nil {
+		status = entity.SubscriptionStatusExpired
+		expiresAt = millisToTime(transaction.RevocationDate)
+	}
+	if status == entity.SubscriptionStatusActive && expiresAt != nil && expiresAt.Before(time.Now()) {
+		status = entity.SubscriptionStatusExpired
+	}
+	willRenew := status != entity.SubscriptionStatusExpired && notification.Renewal != nil &&
+		notification.Renewal.AutoRenewStatus == appStoreAutoRenewOn
+
+	return s.updateSubscription(ctx, customerIDs([]string{transaction.AppAccountToken}), SubscriptionUpdate{
+		Plan:           product.Plan,
+		Type:           string(transaction.subscriptionType()),
+		Period:         product.Period,
+		Status:         string(status),
+		ExpiresAt:      expiresAt,
+		WillRenew:      willRenew,
+		GraceExpiresAt: graceExpiresAt,
+		EventAt:        notification.SignedDate,
+	})
+}
+
+// verifyAppStorePayload verifies the signed payload in the body of an App Store notification.
+func (s service) verifyAppStorePayload(payload []byte) (AppStoreNotification, error) {
+	var body struct {
+		SignedPayload string `json:"signedPayload"`
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return AppStoreNotification{}, err
+	}
+	return s.appStore.Verify(body.SignedPayload)
+}
@@ -0,0 +1,169 @@
+package billing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBundleID = "com.example.app"
+
+// testCertificate is a certificate generated for the tests along with its private key.
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// newTestCertificate creates a certificate with the given marker extension, signed by the parent,
+// or self-signed if the parent is nil.
+func newTestCertificate(t *testing.T, name string, isCA bool, marker asn1.ObjectIdentifier, parent *testCertificate) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	if marker != nil {
+		// the Apple marker extensions have a NULL value
+		template.ExtraExtensions = []pkix.Extension{{Id: marker, Value: []byte{0x05, 0x00}}}
+	}
+	issuer, issuerKey := template, key
+	if parent != nil {
+		issuer, issuerKey = parent.certificate, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCertificate{certificate, key}
+}
+
+func (c testCertificate) pem() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw}))
+}
+
+// signTestJWS signs the payload with the key of the first certificate of the chain, which is put in the x5c header.
+func signTestJWS(t *testing.T, chain []testCertificate, payload interface{}) string {
+	x5c := make([]string, len(chain))
+	for i, c := range chain {
+		x5c[i] = base64.StdEncoding.EncodeToString(c.certificate.Raw)
+	}
+	header, err := json.Marshal(map[string]interface{}{"alg": "ES256", "x5c": x5c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingString := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	signature, err := jwt.SigningMethodES256.Sign(signingString, chain[0].key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingString + "." + signature
+}
+
+func TestAppStoreVerifier_Verify(t *testing.T) {
+	root := newTestCertificate(t, "root", true, nil, nil)
+	intermediate := newTestCertificate(t, "intermediate", true, appStoreIntermediateOID, &root)
+	leaf := newTestCertificate(t, "leaf", false, appStoreLeafOID, &intermediate)
+	chain := []testCertificate{leaf, intermediate, root}
+	otherRoot := newTestCertificate(t, "other root", true, nil, nil)
+	unmarkedLeaf := newTestCertificate(t, "unmarked leaf", false, nil, &intermediate)
+
+	transaction := func(bundleID string) string {
+		return signTestJWS(t, chain, map[string]interface{}{
+			"transactionId":         "1000",
+			"originalTransactionId": "1000",
+			"bundleId":              bundleID,
+			"productId":             "pro_monthly",
+		})
+	}
+	notification := func(chain []testCertificate, bundleID, signedTransaction string) string {
+		return signTestJWS(t, chain, map[string]interface{}{
+			"notificationType": appStoreSubscribed,
+			"notificationUUID": "b5b4b8a2-2b7f-4a47-9a6a-4d0b2f1c9e11",
+			"signedDate":       time.Now().UnixMilli(),
+			"data": map[string]interface{}{
+				"bundleId":              bundleID,
+				"environment":           appStoreProduction,
+				"signedTransactionInfo": signedTransaction,
+			},
+		})
+	}
+	valid := notification(chain, testBundleID, transaction(testBundleID))
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + strings.Split(notification(chain, testBundleID, ""), ".")[1] + "." + parts[2]
+
+	verifier, err := NewAppStoreVerifier(root.pem(), testBundleID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	otherRootVerifier, err := NewAppStoreVerifier(otherRoot.pem(), testBundleID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	noBundleIDVerifier, err := NewAppStoreVerifier(root.pem(), "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name     string
+		verifier AppStoreVerifier
+		payload  string
+		wantErr  bool
+	}{
+		{"valid", verifier, valid, false},
+		{"wrong root", otherRootVerifier, valid, true},
+		{"tampered signature", verifier, tampered, true},
+		{"wrong bundle ID", verifier, notification(chain, "com.example.other", transaction(testBundleID)), true},
+		{"wrong transaction bundle ID", verifier, notification(chain, testBundleID, transaction("com.example.other")), true},
+		{"bundle ID not configured", noBundleIDVerifier, valid, true},
+		{"not an App Store certificate", verifier, notification([]testCertificate{unmarkedLeaf, intermediate, root}, testBundleID, ""), true},
+		{"missing intermediate", verifier, notification([]testCertificate{leaf}, testBundleID, ""), true},
+		{"malformed", verifier, "not-a-jws", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := tc.verifier.Verify(tc.payload)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, appStoreSubscribed, result.NotificationType)
+				assert.Equal(t, appStoreProduction, result.Environment)
+				if assert.NotNil(t, result.Transaction) {
+					assert.Equal(t, "1000", result.Transaction.TransactionID)
+					assert.Equal(t, testBundleID, result.Transaction.BundleID)
+				}
+			}
+		})
+	}
+}
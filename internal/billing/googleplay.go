@@ -0,0 +1,566 @@
+package billing
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	stderr "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+)
+
+// ProviderGooglePlay is the provider of the Google Play Real-Time Developer Notifications.
+const ProviderGooglePlay = "google_play"
+
+// googlePlayScope is the OAuth scope of the Google Play Developer API.
+const googlePlayScope = "https://www.googleapis.com/auth/androidpublisher"
+
+// The types of the one-time product notifications.
+const (
+	googlePlayProductPurchased = 1
+	googlePlayProductCanceled  = 2
+)
+
+// googlePlayPurchaseTypeTest is the purchase type of the one-time product purchases made with a license testing account.
+const googlePlayPurchaseTypeTest = 0
+
+// googlePlaySubscriptionTypes names the types of the subscription notifications.
+var googlePlaySubscriptionTypes = map[int]string{
+	1:  "SUBSCRIPTION_RECOVERED",
+	2:  "SUBSCRIPTION_RENEWED",
+	3:  "SUBSCRIPTION_CANCELED",
+	4:  "SUBSCRIPTION_PURCHASED",
+	5:  "SUBSCRIPTION_ON_HOLD",
+	6:  "SUBSCRIPTION_IN_GRACE_PERIOD",
+	7:  "SUBSCRIPTION_RESTARTED",
+	8:  "SUBSCRIPTION_PRICE_CHANGE_CONFIRMED",
+	9:  "SUBSCRIPTION_DEFERRED",
+	10: "SUBSCRIPTION_PAUSED",
+	11: "SUBSCRIPTION_PAUSE_SCHEDULE_CHANGED",
+	12: "SUBSCRIPTION_REVOKED",
+	13: "SUBSCRIPTION_EXPIRED",
+	19: "SUBSCRIPTION_PRICE_CHANGE_UPDATED",
+	20: "SUBSCRIPTION_PENDING_PURCHASE_CANCELED",
+}
+
+// googlePlaySubscriptionStates maps the states of the subscription purchases to the subscription statuses.
+// The states which are missing, e.g. a pending purchase, do not change the subscription.
+var googlePlaySubscriptionStates = map[string]entity.SubscriptionStatus{
+	"SUBSCRIPTION_STATE_ACTIVE": entity.SubscriptionStatusActive,
+	// a canceled subscription does not renew, but it stays active until it expires
+	"SUBSCRIPTION_STATE_CANCELED":        entity.SubscriptionStatusActive,
+	"SUBSCRIPTION_STATE_IN_GRACE_PERIOD": entity.SubscriptionStatusBillingIssue,
+	"SUBSCRIPTION_STATE_ON_HOLD":         entity.SubscriptionStatusExpired,
+	"SUBSCRIPTION_STATE_PAUSED":          entity.SubscriptionStatusExpired,
+	"SUBSCRIPTION_STATE_EXPIRED":         entity.SubscriptionStatusExpired,
+}
+
+// googlePlayPushMessage is the body of a Pub/Sub push request.
+type googlePlayPushMessage struct {
+	Message struct {
+		// Data is the base64 encoded developer notification.
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+// googlePlayNotification is a Real-Time Developer Notification.
+type googlePlayNotification struct {
+	Version                    string                          `json:"version"`
+	PackageName                string                          `json:"packageName"`
+	EventTimeMillis            string                          `json:"eventTimeMillis"`
+	SubscriptionNotification   *googlePlayPurchaseNotification `json:"subscriptionNotification"`
+	OneTimeProductNotification *googlePlayPurchaseNotification `json:"oneTimeProductNotification"`
+	TestNotification           *struct{}                       `json:"testNotification"`
+}
+
+// googlePlayPurchaseNotification is the subscription or the one-time product notification of a developer notification.
+type googlePlayPurchaseNotification struct {
+	NotificationType int    `json:"notificationType"`
+	PurchaseToken    string `json:"purchaseToken"`
+	SubscriptionID   string `json:"subscriptionId"`
+	SKU              string `json:"sku"`
+}
+
+// eventType returns the type of the developer notification the events are stored with.
+func (n googlePlayNotification) eventType() string {
+	switch {
+	case n.SubscriptionNotification != nil:
+		if name, ok := googlePlaySubscriptionTypes[n.SubscriptionNotification.NotificationType]; ok {
+			return name
+		}
+		return fmt.Sprintf("SUBSCRIPTION_%d", n.SubscriptionNotification.NotificationType)
+	case n.OneTimeProductNotification != nil:
+		switch n.OneTimeProductNotification.NotificationType {
+		case googlePlayProductPurchased:
+			return "ONE_TIME_PRODUCT_PURCHASED"
+		case googlePlayProductCanceled:
+			return "ONE_TIME_PRODUCT_CANCELED"
+		}
+		return fmt.Sprintf("ONE_TIME_PRODUCT_%d", n.OneTimeProductNotification.NotificationType)
+	case n.TestNotification != nil:
+		return "TEST"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// GooglePlaySubscription is a subscription purchase returned by the Google Play Developer API.
+type GooglePlaySubscription struct {
+	SubscriptionState    string               `json:"subscriptionState"`
+	AcknowledgementState string               `json:"acknowledgementState"`
+	LineItems            []GooglePlayLineItem `json:"lineItems"`
+	// TestPurchase is only set for the purchases made with a license testing account.
+	TestPurchase               *struct{} `json:"testPurchase"`
+	ExternalAccountIdentifiers *struct {
+		// ObfuscatedExternalAccountID is the customer ID of the user, set by the app when the purchase is made.
+		ObfuscatedExternalAccountID string `json:"obfuscatedExternalAccountId"`
+	} `json:"externalAccountIdentifiers"`
+}
+
+// GooglePlayLineItem is a product of a subscription purchase.
+type GooglePlayLineItem struct {
+	ProductID    string     `json:"productId"`
+	ExpiryTime   *time.Time `json:"expiryTime"`
+	OfferDetails *struct {
+		OfferID string `json:"offerId"`
+	} `json:"offerDetails"`
+	OfferPhase *struct {
+		FreeTrial         *struct{} `json:"freeTrial"`
+		IntroductoryPrice *struct{} `json:"introductoryPrice"`
+	} `json:"offerPhase"`
+	PrepaidPlan      *struct{} `json:"prepaidPlan"`
+	AutoRenewingPlan *struct {
+		AutoRenewEnabled bool `json:"autoRenewEnabled"`
+	} `json:"autoRenewingPlan"`
+}
+
+// GooglePlayProductPurchase is a one-time product purchase returned by the Google Play Developer API.
+type GooglePlayProductPurchase struct {
+	// PurchaseState is 0 for a purchased, 1 for a canceled and 2 for a pending purchase.
+	PurchaseState int `json:"purchaseState"`
+	// ConsumptionState is 0 until the purchase is consumed.
+	ConsumptionState int    `json:"consumptionState"`
+	OrderID          string `json:"orderId"`
+	// ObfuscatedExternalAccountID is the customer ID of the user, set by the app when the purchase is made.
+	ObfuscatedExternalAccountID string `json:"obfuscatedExternalAccountId"`
+	Quantity                    int    `json:"quantity"`
+	// PurchaseType is only set for the purchases which are not paid: 0 for a test purchase made with a license
+	// testing account, 1 for a promo code and 2 for a rewarded purchase.
+	PurchaseType *int `json:"purchaseType"`
+}
+
+// isTest reports whether the purchase has been made with a license testing account.
+func (p GooglePlayProductPurchase) isTest() bool {
+	return p.PurchaseType != nil && *p.PurchaseType == googlePlayPurchaseTypeTest
+}
+
+// GooglePlayClient calls the Google Play Developer API on behalf of the app.
+type GooglePlayClient interface {
+	// GetSubscription returns the subscription purchase with the given purchase token.
+	GetSubscription(ctx context.Context, packageName, purchaseToken string) (GooglePlaySubscription, error)
+	// AcknowledgeSubscription acknowledges a subscription purchase. Purchases which are not acknowledged in three days are refunded.
+	AcknowledgeSubscription(ctx context.Context, packageName, subscriptionID, purchaseToken string) error
+	// GetProductPurchase returns the one-time product purchase with the given purchase token.
+	GetProductPurchase(ctx context.Context, packageName, productID, purchaseToken string) (GooglePlayProductPurchase, error)
+	// ConsumeProductPurchase consumes a one-time product purchase, so that the product can be bought again.
+	ConsumeProductPurchase(ctx context.Context, packageName, productID, purchaseToken string) error
+}
+
+type googlePlayClient struct {
+	baseURL        string
+	serviceAccount *googleServiceAccount
+	httpClient     *http.Client
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+// googleServiceAccount is the key of the service account the client authenticates as.
+type googleServiceAccount struct {
+	ClientEmail string `json:"client_email"`
+	TokenURI    string `json:"token_uri"`
+	privateKey  *rsa.PrivateKey
+}
+
+// NewGooglePlayClient creates a client for the Google Play Developer API at the given base URL.
+// The service account key is the JSON key downloaded from the Google Cloud console. It is required.
+func NewGooglePlayClient(baseURL, serviceAccountJSON string) (GooglePlayClient, error) {
+	if serviceAccountJSON == "" {
+		return nil, fmt.Errorf("no Google service account key is configured")
+	}
+	var key struct {
+		googleServiceAccount
+		PrivateKey string `json:"private_key"`
+	}
+	if err := json.Unmarshal([]byte(serviceAccountJSON), &key); err != nil {
+		return nil, fmt.Errorf("invalid Google service account key: %v", err)
+	}
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Google service account private key: %v", err)
+	}
+	key.googleServiceAccount.privateKey = privateKey
+
+	return &googlePlayClient{
+		baseURL:        strings.TrimRight(baseURL, "/"),
+		serviceAccount: &key.googleServiceAccount,
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// GetSubscription implements GooglePlayClient.
+func (c *googlePlayClient) GetSubscription(ctx context.Context, packageName, purchaseToken string) (GooglePlaySubscription, error) {
+	var subscription GooglePlaySubscription
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/androidpublisher/v3/applications/%s/purchases/subscriptionsv2/tokens/%s",
+		url.PathEscape(packageName), url.PathEscape(purchaseToken)), &subscription)
+	return subscription, err
+}
+
+// AcknowledgeSubscription implements GooglePlayClient.
+func (c *googlePlayClient) AcknowledgeSubscription(ctx context.Context, packageName, subscriptionID, purchaseToken string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/androidpublisher/v3/applications/%s/purchases/subscriptions/%s/tokens/%s:acknowledge",
+		url.PathEscape(packageName), url.PathEscape(subscriptionID), url.PathEscape(purchaseToken)), nil)
+}
+
+// GetProductPurchase implements GooglePlayClient.
+func (c *googlePlayClient) GetProductPurchase(ctx context.Context, packageName, productID, purchaseToken string) (GooglePlayProductPurchase, error) {
+	var purchase GooglePlayProductPurchase
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/androidpublisher/v3/applications/%s/purchases/products/%s/tokens/%s",
+		url.PathEscape(packageName), url.PathEscape(productID), url.PathEscape(purchaseToken)), &purchase)
+	return purchase, err
+}
+
+// ConsumeProductPurchase implements GooglePlayClient.
+func (c *googlePlayClient) ConsumeProductPurchase(ctx context.Context, packageName, productID, purchaseToken string) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/androidpublisher/v3/applications/%s/purchases/products/%s/tokens/%s:consume",
+		url.PathEscape(packageName), url.PathEscape(productID), url.PathEscape(purchaseToken)), nil)
+}
+
+// googlePlayError is an error response of the Google Play Developer API.
+type googlePlayError struct {
+	path    string
+	status  int
+	message string
+}
+
+func (e googlePlayError) Error() string {
+	return fmt.Sprintf("Google Play %s returned status %d: %s", e.path, e.status, e.message)
+}
+
+func (c *googlePlayClient) do(ctx context.Context, method, path string, result interface{}) error {
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader("{}")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	accessToken, err := c.token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		var body struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&body)
+		return googlePlayError{path, res.StatusCode, body.Error.Message}
+	}
+	if result != nil {
+		return json.NewDecoder(res.Body).Decode(result)
+	}
+	return nil
+}
+
+// token returns an access token of the service account, exchanging a signed assertion for a new one when it is about to expire.
+func (c *googlePlayClient) token(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.accessToken != "" && time.Now().Add(time.Minute).Before(c.expiresAt) {
+		return c.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   c.serviceAccount.ClientEmail,
+		"scope": googlePlayScope,
+		"aud":   c.serviceAccount.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(c.serviceAccount.privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.serviceAccount.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	_ = json.NewDecoder(res.Body).Decode(&body)
+	if res.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", fmt.Errorf("Google token endpoint returned status %d: %s", res.StatusCode, body.Error)
+	}
+	c.accessToken = body.AccessToken
+	c.expiresAt = now.Add(time.Duration(body.ExpiresIn) * time.Second)
+	return c.accessToken, nil
+}
+
+// verifyGooglePlayToken checks the token of the Pub/Sub push subscription against the configured value.
+func (s service) verifyGooglePlayToken(token string) bool {
+	if s.googlePlayToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.googlePlayToken)) == 1
+}
+
+// decodeGooglePlayMessage decodes the developer notification of a Pub/Sub push request.
+func decodeGooglePlayMessage(payload []byte) (googlePlayPushMessage, googlePlayNotification, error) {
+	var message googlePlayPushMessage
+	var notification googlePlayNotification
+	if err := json.Unmarshal(payload, &message); err != nil {
+		return message, notification, err
+	}
+	data, err := base64.StdEncoding.DecodeString(message.Message.Data)
+	if err != nil {
+		return message, notification, err
+	}
+	err = json.Unmarshal(data, &notification)
+	return message, notification, err
+}
+
+// googlePlayPurchase is the purchase a Google Play notification is about. As the notifications only carry
+// the purchase token, the purchase is looked up with the Google Play Developer API before the notification
+// is applied, so that the event is not locked while the API is called.
+type googlePlayPurchase struct {
+	notification googlePlayNotification
+	// subscription is the purchase of a subscription notification.
+	subscription *GooglePlaySubscription
+	// product is the purchase of a one-time product purchase notification.
+	product *GooglePlayProductPurchase
+}
+
+// lookupGooglePlayPurchase decodes a Google Play notification and looks up the purchase it is about.
+func (s service) lookupGooglePlayPurchase(ctx context.Context, payload []byte) (googlePlayPurchase, error) {
+	_, notification, err := decodeGooglePlayMessage(payload)
+	if err != nil {
+		return googlePlayPurchase{}, fail("invalid payload: %v", err)
+	}
+	purchase := googlePlayPurchase{notification: notification}
+	if s.googlePlayPackage != "" && notification.PackageName != s.googlePlayPackage {
+		return purchase, ignore("unexpected package %s", notification.PackageName)
+	}
+
+	switch {
+	case notification.SubscriptionNotification != nil:
+		subscription, err := s.googlePlay.GetSubscription(ctx, notification.PackageName, notification.SubscriptionNotification.PurchaseToken)
+		if err != nil {
+			return purchase, err
+		}
+		purchase.subscription = &subscription
+	case notification.OneTimeProductNotification != nil:
+		productNotification := notification.OneTimeProductNotification
+		if productNotification.NotificationType != googlePlayProductPurchased {
+			// a canceled purchase is looked up among the credited purchases
+			break
+		}
+		product, err := s.googlePlay.GetProductPurchase(ctx, notification.PackageName, productNotification.SKU, productNotification.PurchaseToken)
+		if err != nil {
+			return purchase, err
+		}
+		purchase.product = &product
+	}
+	return purchase, nil
+}
+
+// applyGooglePlayNotification updates the subscription or the credits of the user the Google Play notification is about.
+// It returns the IDs of the users who have changed.
+func (s service) applyGooglePlayNotification(ctx context.Context, purchase googlePlayPurchase) ([]string, error) {
+	notification := purchase.notification
+	switch {
+	case notification.SubscriptionNotification != nil:
+		return s.applyGooglePlaySubscription(ctx, notification, *purchase.subscription)
+	case notification.OneTimeProductNotification == nil:
+		return nil, ignore("unsupported notification %s", notification.eventType())
+	}
+
+	switch notification.OneTimeProductNotification.NotificationType {
+	case googlePlayProductPurchased:
+		return s.applyGooglePlayProduct(ctx, notification, *purchase.product)
+	case googlePlayProductCanceled:
+		return s.revokeGooglePlayProduct(ctx, notification)
+	default:
+		return nil, ignore("unsupported notification %s", notification.eventType())
+	}
+}
+
+// applyGooglePlaySubscription updates the subscription of the user with the current state of the subscription purchase.
+func (s service) applyGooglePlaySubscription(ctx context.Context, notification googlePlayNotification, subscription GooglePlaySubscription) ([]string, error) {
+	if subscription.TestPurchase != nil && !s.sandbox {
+		return nil, ignore("test purchase")
+	}
+	status, ok := googlePlaySubscriptionStates[subscription.SubscriptionState]
+	if !ok {
+		return nil, ignore("unsupported subscription state %s", subscription.SubscriptionState)
+	}
+	item, err := subscription.currentLineItem()
+	if err != nil {
+		return nil, fail("%v", err)
+	}
+	product, ok := s.products[item.ProductID]
+	if !ok {
+		return nil, fail("unknown product %s", item.ProductID)
+	}
+	if subscription.ExternalAccountIdentifiers == nil {
+		return nil, fail("the purchase has no obfuscated account ID")
+	}
+	eventAt, err := millisStringToTime(notification.EventTimeMillis)
+	if err != nil {
+		return nil, fail("invalid eventTimeMillis: %v", err)
+	}
+
+	if status == entity.SubscriptionStatusActive && item.ExpiryTime != nil && item.ExpiryTime.Before(time.Now()) {
+		status = entity.SubscriptionStatusExpired
+	}
+	// the auto-renewing plan of a canceled subscription has auto-renew disabled
+	willRenew := status != entity.SubscriptionStatusExpired && item.AutoRenewingPlan != nil && item.AutoRenewingPlan.AutoRenewEnabled
+	subscriptionType := entity.SubscriptionTypeNormal
+	switch {
+	case item.OfferPhase != nil && item.OfferPhase.FreeTrial != nil:
+		subscriptionType = entity.SubscriptionTypeTrial
+	case item.OfferPhase != nil && item.OfferPhase.IntroductoryPrice != nil:
+		subscriptionType = entity.SubscriptionTypeIntro
+	case item.PrepaidPlan != nil:
+		subscriptionType = entity.SubscriptionTypePrepaid
+	case item.OfferDetails != nil && item.OfferDetails.OfferID != "":
+		subscriptionType = entity.SubscriptionTypePromo
+	}
+
+	return s.updateSubscription(ctx, customerIDs([]string{subscription.ExternalAccountIdentifiers.ObfuscatedExternalAccountID}), SubscriptionUpdate{
+		Plan:      product.Plan,
+		Type:      string(subscriptionType),
+		Period:    product.Period,
+		Status:    string(status),
+		ExpiresAt: item.ExpiryTime,
+		WillRenew: willRenew,
+		EventAt:   eventAt,
+	})
+}
+
+// applyGooglePlayProduct credits a one-time product purchase to the user.
+func (s service) applyGooglePlayProduct(ctx context.Context, notification googlePlayNotification, purchase GooglePlayProductPurchase) ([]string, error) {
+	productNotification := notification.OneTimeProductNotification
+	if purchase.PurchaseState != 0 {
+		return nil, ignore("the purchase is in state %d", purchase.PurchaseState)
+	}
+	if purchase.isTest() && !s.sandbox {
+		return nil, ignore("test purchase")
+	}
+
+	userID, err := s.creditPurchase(ctx, ProviderGooglePlay, productNotification.PurchaseToken,
+		purchase.ObfuscatedExternalAccountID, productNotification.SKU, max(purchase.Quantity, 1))
+	if err != nil {
+		return nil, err
+	}
+	return []string{userID}, nil
+}
+
+// revokeGooglePlayProduct takes back the credits of a canceled one-time product purchase which have not been spent.
+func (s service) revokeGooglePlayProduct(ctx context.Context, notification googlePlayNotification) ([]string, error) {
+	purchase, err := s.repo.GetStorePurchase(ctx, ProviderGooglePlay, notification.OneTimeProductNotification.PurchaseToken)
+	if stderr.Is(err, sql.ErrNoRows) {
+		return nil, ignore("the purchase has not been credited")
+	} else if err != nil {
+		return nil, err
+	}
+
+	revoked, err := s.credits.Revoke(ctx, purchase.UserID, purchase.ID)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.With(ctx, "user", purchase.UserID).Infof("purchase %s canceled: %d of %d credits revoked", purchase.ID, revoked, purchase.Credits)
+	return []string{purchase.UserID}, nil
+}
+
+// finishGooglePlayPurchase acknowledges the subscription purchase or consumes the one-time product purchase
+// of an applied notification, once the notification has been committed.
+func (s service) finishGooglePlayPurchase(ctx context.Context, purchase googlePlayPurchase) error {
+	notification := purchase.notification
+	switch {
+	case purchase.subscription != nil && purchase.subscription.AcknowledgementState == "ACKNOWLEDGEMENT_STATE_PENDING":
+		item, err := purchase.subscription.currentLineItem()
+		if err != nil {
+			return err
+		}
+		return s.googlePlay.AcknowledgeSubscription(ctx, notification.PackageName, item.ProductID, notification.SubscriptionNotification.PurchaseToken)
+	case purchase.product != nil && purchase.product.PurchaseState == 0 && purchase.product.ConsumptionState == 0:
+		productNotification := notification.OneTimeProductNotification
+		return s.googlePlay.ConsumeProductPurchase(ctx, notification.PackageName, productNotification.SKU, productNotification.PurchaseToken)
+	}
+	return nil
+}
+
+// currentLineItem returns the line item of the plan the user is subscribed to, which is the one that expires the latest.
+func (p GooglePlaySubscription) currentLineItem() (GooglePlayLineItem, error) {
+	if len(p.LineItems) == 0 {
+		return GooglePlayLineItem{}, fmt.Errorf("subscription without line items")
+	}
+	item := p.LineItems[0]
+	for _, other := range p.LineItems[1:] {
+		if other.ExpiryTime != nil && (item.ExpiryTime == nil || other.ExpiryTime.After(*item.ExpiryTime)) {
+			item = other
+		}
+	}
+	return item, nil
+}
+
+func millisStringToTime(ms string) (time.Time, error) {
+	millis, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(millis), nil
+}
@@ -0,0 +1,165 @@
+package billing
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	stderr "errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeGooglePlay is a fake of the Google Play Developer API and of the Google token endpoint.
+type fakeGooglePlay struct {
+	*httptest.Server
+	key         *rsa.PrivateKey
+	tokenCalls  int
+	requests    []string
+	unavailable bool
+}
+
+func newFakeGooglePlay(t *testing.T) *fakeGooglePlay {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeGooglePlay{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		f.tokenCalls++
+		assertion, err := jwt.Parse(r.PostFormValue("assertion"), func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil || assertion.Claims.(jwt.MapClaims)["scope"] != googlePlayScope {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "token1", "expires_in": 3600})
+	})
+	mux.HandleFunc("/androidpublisher/v3/applications/", func(w http.ResponseWriter, r *http.Request) {
+		f.requests = append(f.requests, r.Method+" "+r.URL.EscapedPath())
+		switch {
+		case r.Header.Get("Authorization") != "Bearer token1":
+			w.WriteHeader(http.StatusUnauthorized)
+		case f.unavailable:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"message": "backend error"}})
+		case r.Method == http.MethodGet && r.URL.Path == "/androidpublisher/v3/applications/com.example.app/purchases/subscriptionsv2/tokens/token-1":
+			_, _ = w.Write([]byte(`{
+				"subscriptionState": "SUBSCRIPTION_STATE_ACTIVE",
+				"acknowledgementState": "ACKNOWLEDGEMENT_STATE_PENDING",
+				"lineItems": [{"productId": "pro_monthly", "expiryTime": "2026-11-17T10:00:00Z"}],
+				"externalAccountIdentifiers": {"obfuscatedExternalAccountId": "customer1"}
+			}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/androidpublisher/v3/applications/com.example.app/purchases/products/credits_100/tokens/token-2":
+			_, _ = w.Write([]byte(`{"purchaseState": 0, "consumptionState": 0, "orderId": "GPA.1", "quantity": 2}`))
+		case r.Method == http.MethodPost:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]string{"message": "not found"}})
+		}
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// serviceAccount returns the JSON key of a service account whose assertions are accepted by the fake token endpoint.
+func (f *fakeGooglePlay) serviceAccount() string {
+	key, _ := json.Marshal(map[string]string{
+		"client_email": "billing@example.iam.gserviceaccount.com",
+		"token_uri":    f.URL + "/token",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(f.key),
+		})),
+	})
+	return string(key)
+}
+
+func TestNewGooglePlayClient(t *testing.T) {
+	_, err := NewGooglePlayClient("https://androidpublisher.googleapis.com", "")
+	assert.Error(t, err)
+	_, err = NewGooglePlayClient("https://androidpublisher.googleapis.com", `{"private_key": "invalid"}`)
+	assert.Error(t, err)
+}
+
+func TestGooglePlayClient(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGooglePlay(t)
+	client, err := NewGooglePlayClient(fake.URL+"/", fake.serviceAccount())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	subscription, err := client.GetSubscription(ctx, "com.example.app", "token-1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "SUBSCRIPTION_STATE_ACTIVE", subscription.SubscriptionState)
+		assert.Equal(t, "ACKNOWLEDGEMENT_STATE_PENDING", subscription.AcknowledgementState)
+		if assert.Len(t, subscription.LineItems, 1) {
+			assert.Equal(t, "pro_monthly", subscription.LineItems[0].ProductID)
+			assert.NotNil(t, subscription.LineItems[0].ExpiryTime)
+		}
+		if assert.NotNil(t, subscription.ExternalAccountIdentifiers) {
+			assert.Equal(t, "customer1", subscription.ExternalAccountIdentifiers.ObfuscatedExternalAccountID)
+		}
+	}
+
+	purchase, err := client.GetProductPurchase(ctx, "com.example.app", "credits_100", "token-2")
+	if assert.NoError(t, err) {
+		assert.Equal(t, GooglePlayProductPurchase{OrderID: "GPA.1", Quantity: 2}, purchase)
+	}
+
+	assert.NoError(t, client.AcknowledgeSubscription(ctx, "com.example.app", "pro_monthly", "token-1"))
+	assert.NoError(t, client.ConsumeProductPurchase(ctx, "com.example.app", "credits_100", "token/2"))
+
+	assert.Equal(t, []string{
+		"GET /androidpublisher/v3/applications/com.example.app/purchases/subscriptionsv2/tokens/token-1",
+		"GET /androidpublisher/v3/applications/com.example.app/purchases/products/credits_100/tokens/token-2",
+		"POST /androidpublisher/v3/applications/com.example.app/purchases/subscriptions/pro_monthly/tokens/token-1:acknowledge",
+		"POST /androidpublisher/v3/applications/com.example.app/purchases/products/credits_100/tokens/token%2F2:consume",
+	}, fake.requests)
+	// the access token is reused until it is about to expire
+	assert.Equal(t, 1, fake.tokenCalls)
+
+	_, err = client.GetProductPurchase(ctx, "com.example.app", "credits_100", "unknown")
+	var apiErr googlePlayError
+	if assert.True(t, stderr.As(err, &apiErr)) {
+		assert.Equal(t, http.StatusNotFound, apiErr.status)
+		assert.Equal(t, "not found", apiErr.message)
+	}
+
+	fake.unavailable = true
+	err = client.ConsumeProductPurchase(ctx, "com.example.app", "credits_100", "token-2")
+	if assert.True(t, stderr.As(err, &apiErr)) {
+		assert.Equal(t, http.StatusServiceUnavailable, apiErr.status)
+	}
+}
+
+func TestGooglePlayClient_InvalidServiceAccount(t *testing.T) {
+	fake := newFakeGooglePlay(t)
+	other := newFakeGooglePlay(t)
+	// the key of the other fake is not accepted by the token endpoint of the first one
+	serviceAccount := map[string]string{}
+	_ = json.Unmarshal([]byte(other.serviceAccount()), &serviceAccount)
+	serviceAccount["token_uri"] = fake.URL + "/token"
+	key, _ := json.Marshal(serviceAccount)
+
+	client, err := NewGooglePlayClient(fake.URL, string(key))
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = client.GetSubscription(context.Background(), "com.example.app", "token-1")
+	assert.Error(t, err)
+	assert.Empty(t, fake.requests)
+}
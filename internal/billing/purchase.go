@@ -0,0 +1,166 @@
+package billing
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"net/http"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+)
+
+const (
+	// ProviderFake is the provider of the fake purchases, which are accepted without a store for development and testing.
+	ProviderFake = "fake"
+	// appStoreConsumable is the type of the App Store transactions of the consumable products.
+	appStoreConsumable = "Consumable"
+)
+
+// ErrInvalidPurchase is returned by a PurchaseVerifier when the store does not confirm the purchase.
+var ErrInvalidPurchase = stderr.New("invalid purchase")
+
+// VerifiedPurchase is a consumable purchase confirmed by its store.
+type VerifiedPurchase struct {
+	// TransactionID identifies the purchase in the store. A purchase is credited once per transaction ID.
+	TransactionID string
+	ProductID     string
+	Quantity      int
+	// CustomerID is the customer ID of the user the app has made the purchase for, if the store keeps it.
+	CustomerID string
+	// Receipt is the receipt or the purchase token the purchase has been verified with.
+	Receipt string
+}
+
+// PurchaseVerifier verifies the consumable purchases made in a store.
+type PurchaseVerifier interface {
+	// VerifyPurchase verifies the receipt or the purchase token of a purchase of the product.
+	// It returns an error wrapping ErrInvalidPurchase if the store does not confirm the purchase.
+	VerifyPurchase(ctx context.Context, productID, receipt string) (VerifiedPurchase, error)
+	// FinishPurchase tells the store that the purchase has been credited, e.g. consumes it so that it can be bought again.
+	FinishPurchase(ctx context.Context, purchase VerifiedPurchase) error
+}
+
+// PurchaseRequest represents a request to credit a consumable purchase made in a store.
+type PurchaseRequest struct {
+	// Store is the provider of the purchase: app_store, google_play, or fake if the fake purchases are enabled.
+	Store     string `json:"store"`
+	ProductID string `json:"product_id"`
+	// Receipt is the signed transaction of the App Store, or the purchase token of Google Play.
+	Receipt string `json:"receipt"`
+}
+
+// Validate validates the PurchaseRequest fields.
+func (m PurchaseRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Store, validation.Required),
+		validation.Field(&m.ProductID, validation.Required, validation.Length(0, 200)),
+		validation.Field(&m.Receipt, validation.Required, validation.Length(0, 64<<10)),
+	)
+}
+
+// appStorePurchaseVerifier verifies the signed transactions of the App Store.
+type appStorePurchaseVerifier struct {
+	verifier AppStoreVerifier
+	sandbox  bool
+}
+
+// NewAppStorePurchaseVerifier creates a verifier of the consumable purchases of the App Store,
+// which takes the signed transactions of StoreKit 2 as the receipts.
+// The transactions of the sandbox environment are rejected unless sandbox is set.
+func NewAppStorePurchaseVerifier(verifier AppStoreVerifier, sandbox bool) PurchaseVerifier {
+	return appStorePurchaseVerifier{verifier, sandbox}
+}
+
+// VerifyPurchase implements PurchaseVerifier.
+func (v appStorePurchaseVerifier) VerifyPurchase(_ context.Context, productID, receipt string) (VerifiedPurchase, error) {
+	transaction, err := v.verifier.VerifyTransaction(receipt)
+	switch {
+	case err != nil:
+		return VerifiedPurchase{}, fmt.Errorf("%w: %v", ErrInvalidPurchase, err)
+	case transaction.ProductID != productID:
+		return VerifiedPurchase{}, fmt.Errorf("%w: the transaction is for product %s", ErrInvalidPurchase, transaction.ProductID)
+	case transaction.Type != appStoreConsumable:
+		return VerifiedPurchase{}, fmt.Errorf("%w: the transaction is a %s", ErrInvalidPurchase, transaction.Type)
+	case transaction.RevocationDate != nil:
+		return VerifiedPurchase{}, fmt.Errorf("%w: the transaction has been revoked", ErrInvalidPurchase)
+	case transaction.Environment != appStoreProduction && !v.sandbox:
+		return VerifiedPurchase{}, fmt.Errorf("%w: the transaction is of the %s environment", ErrInvalidPurchase, transaction.Environment)
+	}
+
+	return VerifiedPurchase{
+		TransactionID: transaction.TransactionID,
+		ProductID:     transaction.ProductID,
+		Quantity:      max(transaction.Quantity, 1),
+		CustomerID:    transaction.AppAccountToken,
+		Receipt:       receipt,
+	}, nil
+}
+
+// FinishPurchase implements PurchaseVerifier. The app finishes the App Store transactions itself.
+func (v appStorePurchaseVerifier) FinishPurchase(context.Context, VerifiedPurchase) error {
+	return nil
+}
+
+// googlePlayPurchaseVerifier verifies the purchase tokens of Google Play with the Google Play Developer API.
+type googlePlayPurchaseVerifier struct {
+	client      GooglePlayClient
+	packageName string
+	sandbox     bool
+}
+
+// NewGooglePlayPurchaseVerifier creates a verifier of the one-time product purchases of the app with the given package name.
+// The test purchases made with a license testing account are rejected unless sandbox is set.
+func NewGooglePlayPurchaseVerifier(client GooglePlayClient, packageName string, sandbox bool) PurchaseVerifier {
+	return googlePlayPurchaseVerifier{client, packageName, sandbox}
+}
+
+// VerifyPurchase implements PurchaseVerifier.
+// The purchase token identifies the purchase, as it does in the Real-Time Developer Notifications,
+// so that a purchase credited by a notification is not credited again.
+func (v googlePlayPurchaseVerifier) VerifyPurchase(ctx context.Context, productID, receipt string) (VerifiedPurchase, error) {
+	purchase, err := v.client.GetProductPurchase(ctx, v.packageName, productID, receipt)
+	var apiErr googlePlayError
+	if stderr.As(err, &apiErr) && (apiErr.status == http.StatusBadRequest || apiErr.status == http.StatusNotFound || apiErr.status == http.StatusGone) {
+		return VerifiedPurchase{}, fmt.Errorf("%w: %v", ErrInvalidPurchase, err)
+	} else if err != nil {
+		return VerifiedPurchase{}, err
+	}
+	if purchase.PurchaseState != 0 {
+		return VerifiedPurchase{}, fmt.Errorf("%w: the purchase is in state %d", ErrInvalidPurchase, purchase.PurchaseState)
+	}
+	if purchase.isTest() && !v.sandbox {
+		return VerifiedPurchase{}, fmt.Errorf("%w: the purchase is a test purchase", ErrInvalidPurchase)
+	}
+
+	return VerifiedPurchase{
+		TransactionID: receipt,
+		ProductID:     productID,
+		Quantity:      max(purchase.Quantity, 1),
+		CustomerID:    purchase.ObfuscatedExternalAccountID,
+		Receipt:       receipt,
+	}, nil
+}
+
+// FinishPurchase implements PurchaseVerifier. A purchase which is not consumed cannot be bought again.
+func (v googlePlayPurchaseVerifier) FinishPurchase(ctx context.Context, purchase VerifiedPurchase) error {
+	return v.client.ConsumeProductPurchase(ctx, v.packageName, purchase.ProductID, purchase.Receipt)
+}
+
+// fakePurchaseVerifier accepts any receipt as the transaction ID of a purchase.
+type fakePurchaseVerifier struct{}
+
+// NewFakePurchaseVerifier creates a verifier which accepts any receipt without a store, taking it as the transaction ID.
+// It must not be enabled in production.
+func NewFakePurchaseVerifier() PurchaseVerifier {
+	return fakePurchaseVerifier{}
+}
+
+// VerifyPurchase implements PurchaseVerifier.
+func (fakePurchaseVerifier) VerifyPurchase(_ context.Context, productID, receipt string) (VerifiedPurchase, error) {
+	return VerifiedPurchase{TransactionID: receipt, ProductID: productID, Quantity: 1, Receipt: receipt}, nil
+}
+
+// FinishPurchase implements PurchaseVerifier.
+func (fakePurchaseVerifier) FinishPurchase(context.Context, VerifiedPurchase) error {
+	return nil
+}
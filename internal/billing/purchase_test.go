@@ -0,0 +1,95 @@
+package billing
+
+import (
+	"context"
+	stderr "errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAppStoreVerifier decodes every signed transaction as the given transaction.
+type fakeAppStoreVerifier struct {
+	AppStoreVerifier
+	transaction AppStoreTransaction
+}
+
+func (v fakeAppStoreVerifier) VerifyTransaction(string) (AppStoreTransaction, error) {
+	return v.transaction, nil
+}
+
+// fakeGooglePlayClient returns the given purchase for every purchase token.
+type fakeGooglePlayClient struct {
+	GooglePlayClient
+	purchase GooglePlayProductPurchase
+}
+
+func (c fakeGooglePlayClient) GetProductPurchase(context.Context, string, string, string) (GooglePlayProductPurchase, error) {
+	return c.purchase, nil
+}
+
+func TestAppStorePurchaseVerifier_VerifyPurchase(t *testing.T) {
+	transaction := AppStoreTransaction{
+		TransactionID:   "1000",
+		ProductID:       "credits_100",
+		AppAccountToken: "customer1",
+		Type:            appStoreConsumable,
+		Environment:     appStoreProduction,
+	}
+	sandboxTransaction := transaction
+	sandboxTransaction.Environment = "Sandbox"
+
+	tests := []struct {
+		name        string
+		transaction AppStoreTransaction
+		sandbox     bool
+		wantErr     bool
+	}{
+		{"production", transaction, false, false},
+		{"sandbox", sandboxTransaction, false, true},
+		{"sandbox allowed", sandboxTransaction, true, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier := NewAppStorePurchaseVerifier(fakeAppStoreVerifier{transaction: tc.transaction}, tc.sandbox)
+			purchase, err := verifier.VerifyPurchase(context.Background(), "credits_100", "receipt")
+			if tc.wantErr {
+				assert.True(t, stderr.Is(err, ErrInvalidPurchase))
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, VerifiedPurchase{TransactionID: "1000", ProductID: "credits_100", Quantity: 1, CustomerID: "customer1", Receipt: "receipt"}, purchase)
+			}
+		})
+	}
+}
+
+func TestGooglePlayPurchaseVerifier_VerifyPurchase(t *testing.T) {
+	testType, promoType := 0, 1
+
+	tests := []struct {
+		name     string
+		purchase GooglePlayProductPurchase
+		sandbox  bool
+		wantErr  bool
+	}{
+		{"paid", GooglePlayProductPurchase{ObfuscatedExternalAccountID: "customer1"}, false, false},
+		{"promo code", GooglePlayProductPurchase{ObfuscatedExternalAccountID: "customer1", PurchaseType: &promoType}, false, false},
+		{"test", GooglePlayProductPurchase{ObfuscatedExternalAccountID: "customer1", PurchaseType: &testType}, false, true},
+		{"test allowed", GooglePlayProductPurchase{ObfuscatedExternalAccountID: "customer1", PurchaseType: &testType}, true, false},
+		{"pending", GooglePlayProductPurchase{PurchaseState: 2}, true, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			verifier := NewGooglePlayPurchaseVerifier(fakeGooglePlayClient{purchase: tc.purchase}, "com.example.app", tc.sandbox)
+			purchase, err := verifier.VerifyPurchase(context.Background(), "credits_100", "token")
+			if tc.wantErr {
+				assert.True(t, stderr.Is(err, ErrInvalidPurchase))
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, VerifiedPurchase{TransactionID: "token", ProductID: "credits_100", Quantity: 1, CustomerID: "customer1", Receipt: "token"}, purchase)
+			}
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access the billing data.
+type Repository interface {
+	// CreateWebhookEvent saves a received event. It returns false without saving the event
+	// if an event with the same provider and event ID already exists.
+	CreateWebhookEvent(ctx context.Context, event entity.WebhookEvent) (bool, error)
+	// GetWebhookEvent returns the event with the given ID.
+	GetWebhookEvent(ctx context.Context, id string) (entity.WebhookEvent, error)
+	// LockWebhookEvent returns the event of the provider with the given event ID.
+	// The event is locked until the end of the transaction.
+	LockWebhookEvent(ctx context.Context, provider, eventID string) (entity.WebhookEvent, error)
+	// SetWebhookEventStatus records the outcome of processing the event.
+	SetWebhookEventStatus(ctx context.Context, id string, status entity.WebhookEventStatus, message string) error
+
+	// ListUserIDsByCustomerID returns the IDs of the users who are not deleted with one of the given customer IDs.
+	ListUserIDsByCustomerID(ctx context.Context, customerIDs []string) ([]string, error)
+	// UpdateSubscription updates the subscription of the user unless it has been updated by a later event.
+	// It returns false if the update is skipped.
+	UpdateSubscription(ctx context.Context, userID string, update SubscriptionUpdate) (bool, error)
+	// TransferSubscription moves the subscription of a user to another user and clears it.
+	TransferSubscription(ctx context.Context, fromUserID, toUserID string, eventAt time.Time) error
+
+	// CreateStorePurchase saves a credited store purchase. It returns false without saving the purchase
+	// if a purchase with the same provider and transaction ID already exists.
+	CreateStorePurchase(ctx context.Context, purchase entity.StorePurchase) (bool, error)
+	// GetStorePurchase returns the credited store purchase of the provider with the given transaction ID.
+	GetStorePurchase(ctx context.Context, provider, transactionID string) (entity.StorePurchase, error)
+
+	// StartGracePeriods gives the grace period to the subscriptions past their expiry which are either active,
+	// bought in a store and set to renew, or have a billing issue the store has given no grace period.
+	// The subscriptions are moved to a billing issue and their grace period ends the grace after their expiry,
+	// which is left unchanged. It returns the events of the changed subscriptions.
+	StartGracePeriods(ctx context.Context, grace time.Duration, limit int) ([]entity.SubscriptionEvent, error)
+	// ExpireSubscriptions moves the subscriptions with a billing issue whose grace period has ended to expired,
+	// along with the past subscriptions which get no grace period: the active ones which are promotional or not
+	// set to renew, or all of them if noGrace is set. It returns the events of the changed subscriptions.
+	ExpireSubscriptions(ctx context.Context, noGrace bool, limit int) ([]entity.SubscriptionEvent, error)
+	// CreateSubscriptionEvents saves the lifecycle events of the subscriptions.
+	CreateSubscriptionEvents(ctx context.Context, events []entity.SubscriptionEvent) error
+	// CountSubscriptionEvents returns the number of the lifecycle events of the user of the given type.
+	// An empty user ID or type matches all.
+	CountSubscriptionEvents(ctx context.Context, userID, eventType string) (int, error)
+	// QuerySubscriptionEvents returns the lifecycle events of the user of the given type, the latest first.
+	QuerySubscriptionEvents(ctx context.Context, userID, eventType string, offset, limit int) ([]entity.SubscriptionEvent, error)
+}
+
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new billing repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// CreateWebhookEvent implements Repository.
+func (r repository) CreateWebhookEvent(ctx context.Context, event entity.WebhookEvent) (bool, error) {
+	result, err := r.db.With(ctx).NewQuery(`INSERT INTO webhook_event (id, provider, event_id, type, payload, status, received_at)
+		VALUES ({:id}, {:provider}, {:event_id}, {:type}, {:payload}, {:status}, {:received_at})
+		ON CONFLICT (provider, event_id) DO NOTHING`,
+	).Bind(dbx.Params{
+		"id":          event.ID,
+		"provider":    event.Provider,
+		"event_id":    event.EventID,
+		"type":        event.Type,
+		"payload":     event.Payload,
+		"status":      event.Status,
+		"received_at": event.ReceivedAt,
+	}).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// GetWebhookEvent implements Repository.
+func (r repository) GetWebhookEvent(ctx context.Context, id string) (entity.WebhookEvent, error) {
+	var event entity.WebhookEvent
+	err := r.db.With(ctx).Select().From("webhook_event").Where(dbx.HashExp{"id": id}).One(&event)
+
+	return event, err
+}
+
+// LockWebhookEvent implements Repository.
+func (r repository) LockWebhookEvent(ctx context.Context, provider, eventID string) (entity.WebhookEvent, error) {
+	var event entity.WebhookEvent
+	err := r.db.With(ctx).NewQuery(`SELECT * FROM webhook_event
+		WHERE provider = {:provider} AND event_id = {:event_id}
+		FOR UPDATE`,
+	).Bind(dbx.Params{"provider": provider, "event_id": eventID}).One(&event)
+
+	return event, err
+}
+
+// SetWebhookEventStatus implements Repository.
+func (r repository) SetWebhookEventStatus(ctx context.Context, id string, status entity.WebhookEventStatus, message string) error {
+	var errorMessage *string
+	if message != "" {
+		errorMessage = &message
+	}
+	_, err := r.db.With(ctx).Update("webhook_event",
+		dbx.Params{"status": status, "error": errorMessage, "processed_at": time.Now()},
+		dbx.HashExp{"id": id},
+	).Execute()
+
+	return err
+}
+
+// ListUserIDsByCustomerID implements Repository.
+func (r repository) ListUserIDsByCustomerID(ctx context.Context, customerIDs []string) ([]string, error) {
+	userIDs := []string{}
+	if len(customerIDs) == 0 {
+		return userIDs, nil
+	}
+
+	values := make([]interface{}, len(customerIDs))
+	for i, customerID := range customerIDs {
+		values[i] = customerID
+	}
+	err := r.db.With(ctx).Select("id").From("public.user").
+		Where(dbx.HashExp{"customer_id": values, "deleted_at": nil}).
+		Column(&userIDs)
+
+	return userIDs, err
+}
+
+// UpdateSubscription implements Repository.
+func (r repository) UpdateSubscription(ctx context.Context, userID string, update SubscriptionUpdate) (bool, error) {
+	result, err := r.db.With(ctx).Update("public.user",
+		dbx.Params{
+			"subscription_plan":             update.Plan,
+			"subscription_type":             update.Type,
+			"subscription_period":           update.Period,
+			"subscription_status":           update.Status,
+			"subscription_expires_at":       update.ExpiresAt,
+			"subscription_will_renew":       update.WillRenew,
+			"subscription_grace_expires_at": update.GraceExpiresAt,
+			"subscription_event_at":         update.EventAt,
+			"updated_at":                    time.Now(),
+		},
+		dbx.NewExp("id = {:id} AND (subscription_event_at IS NULL OR subscription_event_at <= {:event_at})",
+			dbx.Params{"id": userID, "event_at": update.EventAt}),
+	).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// TransferSubscription implements Repository.
+func (r repository) TransferSubscription(ctx context.Context, fromUserID, toUserID string, eventAt time.Time) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		_, err := r.db.With(ctx).NewQuery(`UPDATE public.user AS t SET
+			subscription_plan = f.subscription_plan,
+			subscription_type = f.subscription_type,
+			subscription_period = f.subscription_period,
+			subscription_status = f.subscription_status,
+			subscription_expires_at = f.subscription_expires_at,
+			subscription_will_renew = f.subscription_will_renew,
+			subscription_grace_expires_at = f.subscription_grace_expires_at,
+			subscription_event_at = {:event_at},
+			updated_at = {:updated_at}
+			FROM public.user AS f
+			WHERE t.id = {:to_id} AND f.id = {:from_id}`,
+		).Bind(dbx.Params{
+			"from_id":    fromUserID,
+			"to_id":      toUserID,
+			"event_at":   eventAt,
+			"updated_at": time.Now(),
+		}).Execute()
+		if err != nil {
+			return err
+		}
+
+		_, err = r.db.With(ctx).Update("public.user",
+			dbx.Params{
+				"subscription_plan":             nil,
+				"subscription_type":             nil,
+				"subscription_period":           nil,
+				"subscription_status":           nil,
+				"subscription_expires_at":       nil,
+				"subscription_will_renew":       false,
+				"subscription_grace_expires_at": nil,
+				"subscription_event_at":         eventAt,
+				"updated_at":                    time.Now(),
+			},
+			dbx.HashExp{"id": fromUserID},
+		).Execute()
+		return err
+	})
+}
+
+// CreateStorePurchase implements Repository.
+func (r repository) CreateStorePurchase(ctx context.Context, purchase entity.StorePurchase) (bool, error) {
+	result, err := r.db.With(ctx).NewQuery(`INSERT INTO store_purchase (id, provider, transaction_id, user_id, product_id, credits, created_at)
+		VALUES ({:id}, {:provider}, {:transaction_id}, {:user_id}, {:product_id}, {:credits}, {:created_at})
+		ON CONFLICT (provider, transaction_id) DO NOTHING`,
+	).Bind(dbx.Params{
+		"id":             purchase.ID,
+		"provider":       purchase.Provider,
+		"transaction_id": purchase.TransactionID,
+		"user_id":        purchase.UserID,
+		"product_id":     purchase.ProductID,
+		"credits":        purchase.Credits,
+		"created_at":     purchase.CreatedAt,
+	}).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// GetStorePurchase implements Repository.
+func (r repository) GetStorePurchase(ctx context.Context, provider, transactionID string) (entity.StorePurchase, error) {
+	var purchase entity.StorePurchase
+	err := r.db.With(ctx).Select().From("store_purchase").
+		Where(dbx.HashExp{"provider": provider, "transaction_id": transactionID}).
+		One(&purchase)
+
+	return purchase, err
+}
+
+// StartGracePeriods implements Repository.
+// The subscriptions are locked without waiting, so that a concurrent run or a billing event is not blocked.
+func (r repository) StartGracePeriods(ctx context.Context, grace time.Duration, limit int) ([]entity.SubscriptionEvent, error) {
+	events := []entity.SubscriptionEvent{}
+	err := r.db.With(ctx).NewQuery(`UPDATE public.user SET
+			subscription_status = {:billing_issue},
+			subscription_grace_expires_at = subscription_expires_at + make_interval(secs => {:grace}),
+			updated_at = {:now}
+		WHERE id IN (
+			SELECT id FROM public.user
+			WHERE subscription_expires_at <= {:now} AND (
+				(subscription_status = {:active} AND subscription_will_renew AND subscription_type IS DISTINCT FROM {:promo})
+				OR (subscription_status = {:billing_issue} AND subscription_grace_expires_at IS NULL))
+			LIMIT {:limit}
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + subscriptionEventColumns,
+	).Bind(dbx.Params{
+		"billing_issue": string(entity.SubscriptionStatusBillingIssue),
+		"active":        string(entity.SubscriptionStatusActive),
+		"promo":         string(entity.SubscriptionTypePromo),
+		"grace":         grace.Seconds(),
+		"now":           time.Now(),
+		"limit":         limit,
+	}).All(&events)
+
+	return events, err
+}
+
+// ExpireSubscriptions implements Repository.
+func (r repository) ExpireSubscriptions(ctx context.Context, noGrace bool, limit int) ([]entity.SubscriptionEvent, error) {
+	events := []entity.SubscriptionEvent{}
+	err := r.db.With(ctx).NewQuery(`UPDATE public.user SET
+			subscription_status = {:expired},
+			updated_at = {:now}
+		WHERE id IN (
+			SELECT id FROM public.user
+			WHERE subscription_expires_at <= {:now} AND (
+				(subscription_status = {:billing_issue} AND (subscription_grace_expires_at <= {:now}
+					OR (subscription_grace_expires_at IS NULL AND {:no_grace})))
+				OR (subscription_status = {:active} AND ({:no_grace} OR NOT subscription_will_renew OR subscription_type = {:promo})))
+			LIMIT {:limit}
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + subscriptionEventColumns,
+	).Bind(dbx.Params{
+		"expired":       string(entity.SubscriptionStatusExpired),
+		"billing_issue": string(entity.SubscriptionStatusBillingIssue),
+		"active":        string(entity.SubscriptionStatusActive),
+		"promo":         string(entity.SubscriptionTypePromo),
+		"no_grace":      noGrace,
+		"now":           time.Now(),
+		"limit":         limit,
+	}).All(&events)
+
+	return events, err
+}
+
+// subscriptionEventColumns are the columns of the changed subscriptions returned as their lifecycle events.
+const subscriptionEventColumns = `id AS user_id, subscription_plan AS plan, subscription_status AS status,
+	subscription_expires_at AS expires_at, subscription_grace_expires_at AS grace_expires_at`
+
+// CreateSubscriptionEvents implements Repository.
+func (r repository) CreateSubscriptionEvents(ctx context.Context, events []entity.SubscriptionEvent) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		for _, event := range events {
+			_, err := r.db.With(ctx).Insert("subscription_event", dbx.Params{
+				"id":               event.ID,
+				"user_id":          event.UserID,
+				"type":             event.Type,
+				"plan":             event.Plan,
+				"status":           event.Status,
+				"expires_at":       event.ExpiresAt,
+				"grace_expires_at": event.GraceExpiresAt,
+				"created_at":       event.CreatedAt,
+			}).Execute()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CountSubscriptionEvents implements Repository.
+func (r repository) CountSubscriptionEvents(ctx context.Context, userID, eventType string) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("subscription_event").
+		Where(subscriptionEventExp(userID, eventType)).
+		Row(&count)
+
+	return count, err
+}
+
+// QuerySubscriptionEvents implements Repository.
+func (r repository) QuerySubscriptionEvents(ctx context.Context, userID, eventType string, offset, limit int) ([]entity.SubscriptionEvent, error) {
+	events := []entity.SubscriptionEvent{}
+	err := r.db.With(ctx).Select().From("subscription_event").
+		Where(subscriptionEventExp(userID, eventType)).
+		OrderBy("created_at DESC").
+		Offset(int64(offset)).
+		Limit(int64(limit)).
+		All(&events)
+
+	return events, err
+}
+
+func subscriptionEventExp(userID, eventType string) dbx.Expression {
+	exp := dbx.HashExp{}
+	if userID != "" {
+		exp["user_id"] = userID
+	}
+	if eventType != "" {
+		exp["type"] = eventType
+	}
+	return exp
+}
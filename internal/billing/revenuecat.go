@@ -0,0 +1,159 @@
+package billing
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+)
+
+// ProviderRevenueCat is the provider of the events received from the RevenueCat webhook.
+const ProviderRevenueCat = "revenuecat"
+
+// revenueCatProduction is the environment of the events of the purchases made in production.
+const revenueCatProduction = "PRODUCTION"
+
+// The types of the RevenueCat events applied to the subscriptions.
+const (
+	revenueCatInitialPurchase = "INITIAL_PURCHASE"
+	revenueCatRenewal         = "RENEWAL"
+	revenueCatCancellation    = "CANCELLATION"
+	revenueCatExpiration      = "EXPIRATION"
+	revenueCatBillingIssue    = "BILLING_ISSUE"
+	revenueCatProductChange   = "PRODUCT_CHANGE"
+	revenueCatTransfer        = "TRANSFER"
+)
+
+// revenueCatPeriodTypes maps the period types of RevenueCat to the subscription types.
+var revenueCatPeriodTypes = map[string]entity.SubscriptionType{
+	"TRIAL":       entity.SubscriptionTypeTrial,
+	"INTRO":       entity.SubscriptionTypeIntro,
+	"NORMAL":      entity.SubscriptionTypeNormal,
+	"PREPAID":     entity.SubscriptionTypePrepaid,
+	"PROMOTIONAL": entity.SubscriptionTypePromo,
+}
+
+// revenueCatWebhook is the body of a RevenueCat webhook.
+type revenueCatWebhook struct {
+	APIVersion string          `json:"api_version"`
+	Event      revenueCatEvent `json:"event"`
+}
+
+// revenueCatEvent is a RevenueCat event. The app user IDs are the customer IDs of the users.
+type revenueCatEvent struct {
+	ID                        string   `json:"id"`
+	Type                      string   `json:"type"`
+	AppUserID                 string   `json:"app_user_id"`
+	OriginalAppUserID         string   `json:"original_app_user_id"`
+	Aliases                   []string `json:"aliases"`
+	ProductID                 string   `json:"product_id"`
+	NewProductID              string   `json:"new_product_id"`
+	PeriodType                string   `json:"period_type"`
+	EventTimestampMs          int64    `json:"event_timestamp_ms"`
+	ExpirationAtMs            *int64   `json:"expiration_at_ms"`
+	GracePeriodExpirationAtMs *int64   `json:"grace_period_expiration_at_ms"`
+	TransferredFrom           []string `json:"transferred_from"`
+	TransferredTo             []string `json:"transferred_to"`
+	Environment               string   `json:"environment"`
+}
+
+// verifyRevenueCatAuthorization checks the Authorization header sent by RevenueCat against the configured value.
+func (s service) verifyRevenueCatAuthorization(authorization string) bool {
+	if s.revenueCatAuth == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(authorization), []byte(s.revenueCatAuth)) == 1
+}
+
+// applyRevenueCatEvent updates the subscriptions of the users the RevenueCat event is about.
+// It returns the IDs of the users whose subscription has changed.
+func (s service) applyRevenueCatEvent(ctx context.Context, payload []byte) ([]string, error) {
+	var webhook revenueCatWebhook
+	if err := json.Unmarshal(payload, &webhook); err != nil {
+		return nil, fail("invalid payload: %v", err)
+	}
+	event := webhook.Event
+	eventAt := time.UnixMilli(event.EventTimestampMs)
+	if event.Environment != revenueCatProduction && !s.sandbox {
+		return nil, ignore("event of the %s environment", event.Environment)
+	}
+
+	if event.Type == revenueCatTransfer {
+		return s.transferSubscription(ctx, event.TransferredFrom, event.TransferredTo, eventAt)
+	}
+
+	var status entity.SubscriptionStatus
+	switch event.Type {
+	case revenueCatInitialPurchase, revenueCatRenewal, revenueCatProductChange, revenueCatCancellation:
+		// a cancellation only turns off the renewal, so the subscription stays active until it expires
+		status = entity.SubscriptionStatusActive
+	case revenueCatExpiration:
+		status = entity.SubscriptionStatusExpired
+	case revenueCatBillingIssue:
+		status = entity.SubscriptionStatusBillingIssue
+	default:
+		return nil, ignore("unsupported event type %s", event.Type)
+	}
+
+	productID := event.ProductID
+	if event.Type == revenueCatProductChange && event.NewProductID != "" {
+		productID = event.NewProductID
+	}
+	product, ok := s.products[productID]
+	if !ok {
+		return nil, fail("unknown product %s", productID)
+	}
+
+	expiresAt := millisToTime(event.ExpirationAtMs)
+	var graceExpiresAt *time.Time
+	if status == entity.SubscriptionStatusBillingIssue {
+		graceExpiresAt = millisToTime(event.GracePeriodExpirationAtMs)
+	}
+	if status == entity.SubscriptionStatusActive && expiresAt != nil && expiresAt.Before(time.Now()) {
+		// e.g. a cancellation because of a refund ends the subscription immediately
+		status = entity.SubscriptionStatusExpired
+	}
+	subscriptionType, ok := revenueCatPeriodTypes[event.PeriodType]
+	if !ok {
+		subscriptionType = entity.SubscriptionTypeNormal
+	}
+	// the store keeps retrying to renew a subscription with a billing issue, while the prepaid and promotional ones do not renew
+	willRenew := status != entity.SubscriptionStatusExpired && event.Type != revenueCatCancellation &&
+		subscriptionType != entity.SubscriptionTypePrepaid && subscriptionType != entity.SubscriptionTypePromo
+
+	return s.updateSubscription(ctx, customerIDs(append([]string{event.AppUserID, event.OriginalAppUserID}, event.Aliases...)), SubscriptionUpdate{
+		Plan:           product.Plan,
+		Type:           string(subscriptionType),
+		Period:         product.Period,
+		Status:         string(status),
+		ExpiresAt:      expiresAt,
+		WillRenew:      willRenew,
+		GraceExpiresAt: graceExpiresAt,
+		EventAt:        eventAt,
+	})
+}
+
+// customerIDs returns the distinct app user IDs which are customer IDs. Other IDs, e.g. the anonymous IDs
+// generated by RevenueCat, cannot belong to a user.
+func customerIDs(appUserIDs []string) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, id := range appUserIDs {
+		if _, err := uuid.Parse(id); err == nil && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func millisToTime(ms *int64) *time.Time {
+	if ms == nil {
+		return nil
+	}
+	t := time.UnixMilli(*ms)
+	return &t
+}
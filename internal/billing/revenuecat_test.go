@@ -0,0 +1,164 @@
+package billing
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testCustomer1 = "0b5ac2a6-51bd-4c3c-9a4c-3f8f4d1c4a01"
+	testCustomer2 = "0b5ac2a6-51bd-4c3c-9a4c-3f8f4d1c4a02"
+)
+
+// fakeSubscriptionRepository maps the customer IDs to user IDs and records the subscription changes.
+type fakeSubscriptionRepository struct {
+	Repository
+	users     map[string]string
+	updates   map[string]SubscriptionUpdate
+	transfers []string
+}
+
+func (r *fakeSubscriptionRepository) ListUserIDsByCustomerID(_ context.Context, customerIDs []string) ([]string, error) {
+	var userIDs []string
+	for _, id := range customerIDs {
+		if userID, ok := r.users[id]; ok {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs, nil
+}
+
+func (r *fakeSubscriptionRepository) UpdateSubscription(_ context.Context, userID string, update SubscriptionUpdate) (bool, error) {
+	r.updates[userID] = update
+	return true, nil
+}
+
+func (r *fakeSubscriptionRepository) TransferSubscription(_ context.Context, fromUserID, toUserID string, _ time.Time) error {
+	r.transfers = append(r.transfers, fromUserID+" -> "+toUserID)
+	return nil
+}
+
+func revenueCatPayload(t *testing.T, event revenueCatEvent) []byte {
+	payload, err := json.Marshal(revenueCatWebhook{APIVersion: "1.0", Event: event})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestService_ApplyRevenueCatEvent(t *testing.T) {
+	now := time.Now()
+	future, past := now.Add(30*24*time.Hour).UnixMilli(), now.Add(-time.Hour).UnixMilli()
+	grace := now.Add(7 * 24 * time.Hour).UnixMilli()
+	event := func(eventType, periodType string, expiresAt int64) revenueCatEvent {
+		return revenueCatEvent{
+			ID:               "event1",
+			Type:             eventType,
+			AppUserID:        testCustomer1,
+			ProductID:        "pro_monthly",
+			PeriodType:       periodType,
+			EventTimestampMs: now.UnixMilli(),
+			ExpirationAtMs:   &expiresAt,
+			Environment:      revenueCatProduction,
+		}
+	}
+	billingIssue := event(revenueCatBillingIssue, "NORMAL", future)
+	billingIssue.GracePeriodExpirationAtMs = &grace
+	productChange := event(revenueCatProductChange, "NORMAL", future)
+	productChange.NewProductID = "pro_yearly"
+	alias := event(revenueCatRenewal, "NORMAL", future)
+	alias.AppUserID, alias.Aliases = "$RCAnonymousID:123", []string{testCustomer1}
+	sandbox := event(revenueCatInitialPurchase, "NORMAL", future)
+	sandbox.Environment = "SANDBOX"
+	unknownProduct := event(revenueCatInitialPurchase, "NORMAL", future)
+	unknownProduct.ProductID = "unknown"
+	unknownCustomer := event(revenueCatInitialPurchase, "NORMAL", future)
+	unknownCustomer.AppUserID = testCustomer2
+
+	tests := []struct {
+		name       string
+		event      revenueCatEvent
+		want       SubscriptionUpdate
+		wantStatus entity.WebhookEventStatus
+	}{
+		{"initial purchase", event(revenueCatInitialPurchase, "NORMAL", future),
+			SubscriptionUpdate{Plan: "pro", Type: "normal", Period: "1m", Status: "active", WillRenew: true}, ""},
+		{"trial", event(revenueCatInitialPurchase, "TRIAL", future),
+			SubscriptionUpdate{Plan: "pro", Type: "trial", Period: "1m", Status: "active", WillRenew: true}, ""},
+		{"prepaid", event(revenueCatInitialPurchase, "PREPAID", future),
+			SubscriptionUpdate{Plan: "pro", Type: "prepaid", Period: "1m", Status: "active"}, ""},
+		{"renewal of an alias", alias,
+			SubscriptionUpdate{Plan: "pro", Type: "normal", Period: "1m", Status: "active", WillRenew: true}, ""},
+		{"cancellation", event(revenueCatCancellation, "NORMAL", future),
+			SubscriptionUpdate{Plan: "pro", Type: "normal", Period: "1m", Status: "active"}, ""},
+		{"refund", event(revenueCatCancellation, "NORMAL", past),
+			SubscriptionUpdate{Plan: "pro", Type: "normal", Period: "1m", Status: "expired"}, ""},
+		{"expiration", event(revenueCatExpiration, "NORMAL", past),
+			SubscriptionUpdate{Plan: "pro", Type: "normal", Period: "1m", Status: "expired"}, ""},
+		{"billing issue", billingIssue,
+			SubscriptionUpdate{Plan: "pro", Type: "normal", Period: "1m", Status: "billing_issue", WillRenew: true}, ""},
+		{"product change", productChange,
+			SubscriptionUpdate{Plan: "pro", Type: "normal", Period: "1y", Status: "active", WillRenew: true}, ""},
+		{"sandbox", sandbox, SubscriptionUpdate{}, entity.WebhookEventStatusIgnored},
+		{"unsupported type", event("SUBSCRIPTION_PAUSED", "NORMAL", future), SubscriptionUpdate{}, entity.WebhookEventStatusIgnored},
+		{"unknown product", unknownProduct, SubscriptionUpdate{}, entity.WebhookEventStatusFailed},
+		{"unknown customer", unknownCustomer, SubscriptionUpdate{}, entity.WebhookEventStatusFailed},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			logger, _ := log.NewForTest()
+			repo := &fakeSubscriptionRepository{users: map[string]string{testCustomer1: "user1"}, updates: map[string]SubscriptionUpdate{}}
+			s := service{
+				repo:     repo,
+				products: map[string]Product{"pro_monthly": {Plan: "pro", Period: "1m"}, "pro_yearly": {Plan: "pro", Period: "1y"}},
+				logger:   logger,
+			}
+
+			userIDs, err := s.applyRevenueCatEvent(context.Background(), revenueCatPayload(t, tc.event))
+			if tc.wantStatus != "" {
+				if assert.IsType(t, eventError{}, err) {
+					assert.Equal(t, tc.wantStatus, err.(eventError).status)
+				}
+				assert.Empty(t, repo.updates)
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, []string{"user1"}, userIDs)
+			update := repo.updates["user1"]
+			assert.Equal(t, time.UnixMilli(*tc.event.ExpirationAtMs), *update.ExpiresAt)
+			assert.Equal(t, time.UnixMilli(now.UnixMilli()), update.EventAt)
+			if tc.event.Type == revenueCatBillingIssue {
+				assert.Equal(t, time.UnixMilli(grace), *update.GraceExpiresAt)
+			} else {
+				assert.Nil(t, update.GraceExpiresAt)
+			}
+			update.ExpiresAt, update.GraceExpiresAt, update.EventAt = nil, nil, time.Time{}
+			assert.Equal(t, tc.want, update)
+		})
+	}
+}
+
+func TestService_ApplyRevenueCatEvent_Transfer(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &fakeSubscriptionRepository{users: map[string]string{testCustomer1: "user1", testCustomer2: "user2"}}
+	s := service{repo: repo, logger: logger}
+
+	userIDs, err := s.applyRevenueCatEvent(context.Background(), revenueCatPayload(t, revenueCatEvent{
+		Type:            revenueCatTransfer,
+		TransferredFrom: []string{testCustomer1, "$RCAnonymousID:123"},
+		TransferredTo:   []string{testCustomer2},
+		Environment:     revenueCatProduction,
+	}))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"user1", "user2"}, userIDs)
+		assert.Equal(t, []string{"user1 -> user2"}, repo.transfers)
+	}
+}
@@ -0,0 +1,548 @@
+package billing
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	stderr "errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/internal/referral"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Service encapsulates the usecase logic for the billing events of the stores.
+type Service interface {
+	// HandleRevenueCatWebhook verifies the Authorization header of a RevenueCat webhook and processes its event.
+	// An event which has already been processed is not applied again.
+	HandleRevenueCatWebhook(ctx context.Context, authorization string, payload []byte) error
+	// HandleAppStoreNotification verifies an App Store Server Notification V2 and processes it.
+	// A notification which has already been processed is not applied again.
+	HandleAppStoreNotification(ctx context.Context, payload []byte) error
+	// HandleGooglePlayNotification verifies the token of a Pub/Sub push request carrying a Google Play
+	// Real-Time Developer Notification and processes the notification.
+	// A notification which has already been processed is not applied again.
+	HandleGooglePlayNotification(ctx context.Context, token string, payload []byte) error
+	// ReplayWebhookEvent processes a stored event again from its raw payload.
+	ReplayWebhookEvent(ctx context.Context, id string) (entity.WebhookEvent, error)
+	// ExpireSubscriptions moves the subscriptions which are past their expiry to their next state and records
+	// their lifecycle events: a subscription bought in a store which is set to renew, or whose billing issue
+	// the store has reported without a grace period, gets a grace period, and expires at the end of it. It is meant to be run as a background job, which catches up with
+	// the subscriptions the stores have not sent an event for.
+	ExpireSubscriptions(ctx context.Context) error
+	// CountSubscriptionEvents returns the number of the lifecycle events of the user of the given type.
+	// An empty user ID or type matches all.
+	CountSubscriptionEvents(ctx context.Context, userID, eventType string) (int, error)
+	// QuerySubscriptionEvents returns the lifecycle events of the user of the given type, the latest first.
+	QuerySubscriptionEvents(ctx context.Context, userID, eventType string, offset, limit int) ([]entity.SubscriptionEvent, error)
+	// PurchaseCredits verifies a consumable purchase with its store and grants its credits to the current user.
+	// A purchase is credited only once: sending it again returns the purchase as it has been credited.
+	PurchaseCredits(ctx context.Context, req PurchaseRequest) (entity.StorePurchase, error)
+}
+
+const (
+	// storePurchaseReason is the reason of the credits granted for a store purchase.
+	storePurchaseReason = "store_purchase"
+	// lifecycleBatchSize is the maximum number of subscriptions moved to each state by one run of the lifecycle job.
+	lifecycleBatchSize = 500
+)
+
+// Product is the subscription plan and period a store product gives.
+type Product struct {
+	Plan   string
+	Period string
+}
+
+// SubscriptionUpdate is the state of a subscription reported by a billing event.
+type SubscriptionUpdate struct {
+	Plan      string
+	Type      string
+	Period    string
+	Status    string
+	ExpiresAt *time.Time
+	// WillRenew tells whether the store renews the subscription at its expiry.
+	WillRenew bool
+	// GraceExpiresAt is the end of the grace period the store gives a subscription with a billing issue, if any.
+	GraceExpiresAt *time.Time
+	// EventAt is the time of the event. Events older than the last applied one are skipped.
+	EventAt time.Time
+}
+
+// eventError is a permanent failure of an event: retrying the webhook would not change the outcome.
+// The status tells whether the event is failed, so that it is worth replaying it later, or ignored.
+type eventError struct {
+	status  entity.WebhookEventStatus
+	message string
+}
+
+func (e eventError) Error() string {
+	return e.message
+}
+
+// fail returns an error which marks the event as failed.
+func fail(format string, args ...interface{}) error {
+	return eventError{entity.WebhookEventStatusFailed, fmt.Sprintf(format, args...)}
+}
+
+// ignore returns an error which marks the event as ignored.
+func ignore(format string, args ...interface{}) error {
+	return eventError{entity.WebhookEventStatusIgnored, fmt.Sprintf(format, args...)}
+}
+
+type service struct {
+	repo              Repository
+	transact          dbcontext.TransactionFunc
+	products          map[string]Product
+	creditProducts    map[string]int
+	verifiers         map[string]PurchaseVerifier
+	revenueCatAuth    string
+	appStore          AppStoreVerifier
+	googlePlay        GooglePlayClient
+	googlePlayPackage string
+	googlePlayToken   string
+	sandbox           bool
+	gracePeriod       time.Duration
+	credits           credit.Service
+	referrals         referral.Service
+	users             auth.UserCache
+	logger            log.Logger
+}
+
+// NewService creates a new billing service. The products map the store product IDs to the subscriptions they give,
+// and the credit products map the IDs of the one-time store products to the number of credits they give.
+// The purchases of the credit products sent by the app are verified by the verifiers, keyed by the provider.
+// Only the Google Play notifications of the given package are applied, unless it is empty.
+// The events of the sandbox environments of the stores are ignored unless sandbox is set.
+// The subscriptions bought in a store which are set to renew but are not renewed by their expiry get the grace period
+// with a billing issue before they expire, as do the billing issues the stores report without a grace period.
+// A zero grace period expires them right away.
+func NewService(
+	repo Repository,
+	transact dbcontext.TransactionFunc,
+	products map[string]Product,
+	creditProducts map[string]int,
+	verifiers map[string]PurchaseVerifier,
+	revenueCatAuth string,
+	appStore AppStoreVerifier,
+	googlePlay GooglePlayClient,
+	googlePlayPackage string,
+	googlePlayToken string,
+	sandbox bool,
+	gracePeriod time.Duration,
+	credits credit.Service,
+	referrals referral.Service,
+	users auth.UserCache,
+	logger log.Logger,
+) Service {
+	return service{
+		repo, transact, products, creditProducts, verifiers, revenueCatAuth, appStore,
+		googlePlay, googlePlayPackage, googlePlayToken, sandbox, gracePeriod, credits, referrals, users, logger,
+	}
+}
+
+// HandleRevenueCatWebhook implements Service.
+func (s service) HandleRevenueCatWebhook(ctx context.Context, authorization string, payload []byte) error {
+	if !s.verifyRevenueCatAuthorization(authorization) {
+		s.logger.With(ctx).Infof("RevenueCat webhook rejected: invalid authorization")
+		return errors.Unauthorized("")
+	}
+
+	var webhook revenueCatWebhook
+	if err := json.Unmarshal(payload, &webhook); err != nil || webhook.Event.ID == "" {
+		return errors.BadRequest("The payload is not a RevenueCat event", "invalid_payload")
+	}
+
+	return s.receive(ctx, ProviderRevenueCat, webhook.Event.ID, webhook.Event.Type, payload)
+}
+
+// HandleAppStoreNotification implements Service.
+func (s service) HandleAppStoreNotification(ctx context.Context, payload []byte) error {
+	notification, err := s.verifyAppStorePayload(payload)
+	if err != nil {
+		s.logger.With(ctx).Infof("App Store notification rejected: %v", err)
+		return errors.BadRequest("The notification cannot be verified", "invalid_signature")
+	}
+
+	return s.receive(ctx, ProviderAppStore, notification.NotificationUUID, notification.NotificationType, payload)
+}
+
+// HandleGooglePlayNotification implements Service.
+func (s service) HandleGooglePlayNotification(ctx context.Context, token string, payload []byte) error {
+	if !s.verifyGooglePlayToken(token) {
+		s.logger.With(ctx).Infof("Google Play notification rejected: invalid token")
+		return errors.Unauthorized("")
+	}
+
+	message, notification, err := decodeGooglePlayMessage(payload)
+	if err != nil || message.Message.MessageID == "" {
+		return errors.BadRequest("The payload is not a Google Play notification", "invalid_payload")
+	}
+
+	return s.receive(ctx, ProviderGooglePlay, message.Message.MessageID, notification.eventType(), payload)
+}
+
+// ReplayWebhookEvent implements Service.
+func (s service) ReplayWebhookEvent(ctx context.Context, id string) (entity.WebhookEvent, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return entity.WebhookEvent{}, errors.NotFound("")
+	}
+	event, err := s.repo.GetWebhookEvent(ctx, id)
+	if stderr.Is(err, sql.ErrNoRows) {
+		return event, errors.NotFound("")
+	} else if err != nil {
+		return event, err
+	}
+
+	if err := s.process(ctx, event.Provider, event.EventID, []byte(event.Payload), true); err != nil {
+		return event, err
+	}
+	return s.repo.GetWebhookEvent(ctx, id)
+}
+
+// receive stores a received event with its raw payload and processes it.
+// The event is stored only once, and an event which has already been processed is skipped.
+func (s service) receive(ctx context.Context, provider, eventID, eventType string, payload []byte) error {
+	_, err := s.repo.CreateWebhookEvent(ctx, entity.WebhookEvent{
+		ID:         uuid.New().String(),
+		Provider:   provider,
+		EventID:    eventID,
+		Type:       eventType,
+		Payload:    string(payload),
+		Status:     string(entity.WebhookEventStatusReceived),
+		ReceivedAt: time.Now(),
+	})
+	if err != nil {
+		s.logger.Errorf("There is an error while saving the %s event %s %v", provider, eventID, err)
+		return errors.InternalServerError("")
+	}
+
+	return s.process(ctx, provider, eventID, payload, false)
+}
+
+// process applies a stored event in a transaction and records the outcome. Unless force is set,
+// events which have been processed or ignored are skipped. An unexpected error is returned so that
+// the provider retries the webhook, while the permanent failures are only recorded.
+// The purchase of a Google Play notification is looked up before the event is locked, and it is
+// acknowledged or consumed once the event has been applied.
+func (s service) process(ctx context.Context, provider, eventID string, payload []byte, force bool) error {
+	logger := s.logger.With(ctx, "provider", provider, "event", eventID)
+
+	var googlePlay *googlePlayPurchase
+	var lookupErr error
+	if provider == ProviderGooglePlay {
+		purchase, err := s.lookupGooglePlayPurchase(ctx, payload)
+		googlePlay, lookupErr = &purchase, err
+	}
+
+	var userIDs []string
+	var event entity.WebhookEvent
+	applied := false
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+		if event, err = s.repo.LockWebhookEvent(ctx, provider, eventID); err != nil {
+			return err
+		}
+		if !force && (event.Status == string(entity.WebhookEventStatusProcessed) || event.Status == string(entity.WebhookEventStatusIgnored)) {
+			logger.Infof("event already processed")
+			applied = event.Status == string(entity.WebhookEventStatusProcessed)
+			return nil
+		}
+
+		if err = lookupErr; err == nil {
+			userIDs, err = s.apply(ctx, event, googlePlay)
+		}
+		var eventErr eventError
+		switch {
+		case err == nil:
+			applied = true
+			return s.repo.SetWebhookEventStatus(ctx, event.ID, entity.WebhookEventStatusProcessed, "")
+		case stderr.As(err, &eventErr):
+			logger.Infof("event %s: %s", eventErr.status, eventErr.message)
+			return s.repo.SetWebhookEventStatus(ctx, event.ID, eventErr.status, eventErr.message)
+		default:
+			return err
+		}
+	})
+	if err != nil {
+		logger.Errorf("There is an error while processing the event %v", err)
+		if event.ID != "" {
+			if err := s.repo.SetWebhookEventStatus(ctx, event.ID, entity.WebhookEventStatusFailed, err.Error()); err != nil {
+				logger.Errorf("There is an error while recording the failure of the event %v", err)
+			}
+		}
+		return errors.InternalServerError("")
+	}
+
+	if len(userIDs) > 0 {
+		s.users.Invalidate(userIDs...)
+	}
+	// a renewal starts a new allowance period, and a purchase qualifies the referral of the user.
+	// The allowances and the referral rewards which fail here are granted by their jobs.
+	for _, userID := range userIDs {
+		if err := s.credits.GrantAllowance(ctx, userID); err != nil {
+			logger.Errorf("There is an error while granting the credit allowance of user %s %v", userID, err)
+		}
+		_ = s.referrals.Qualify(ctx, userID)
+	}
+
+	// a purchase which is not finished here is finished when the provider retries the notification
+	if applied && googlePlay != nil {
+		if err := s.finishGooglePlayPurchase(ctx, *googlePlay); err != nil {
+			logger.Errorf("There is an error while finishing the Google Play purchase %v", err)
+			return errors.InternalServerError("")
+		}
+	}
+	return nil
+}
+
+// apply applies the event according to its provider and returns the IDs of the users it has changed.
+// A Google Play notification is applied with the purchase looked up for it.
+func (s service) apply(ctx context.Context, event entity.WebhookEvent, googlePlay *googlePlayPurchase) ([]string, error) {
+	switch event.Provider {
+	case ProviderRevenueCat:
+		return s.applyRevenueCatEvent(ctx, []byte(event.Payload))
+	case ProviderAppStore:
+		return s.applyAppStoreNotification(ctx, []byte(event.Payload))
+	case ProviderGooglePlay:
+		return s.applyGooglePlayNotification(ctx, *googlePlay)
+	default:
+		return nil, fail("unknown provider %s", event.Provider)
+	}
+}
+
+// updateSubscription updates the subscription of the users with the given customer IDs.
+func (s service) updateSubscription(ctx context.Context, customerIDs []string, update SubscriptionUpdate) ([]string, error) {
+	userIDs, err := s.repo.ListUserIDsByCustomerID(ctx, customerIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(userIDs) == 0 {
+		return nil, fail("unknown customer %v", customerIDs)
+	}
+
+	var updated []string
+	for _, userID := range userIDs {
+		ok, err := s.repo.UpdateSubscription(ctx, userID, update)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			updated = append(updated, userID)
+		}
+	}
+	if len(updated) == 0 {
+		return nil, ignore("the subscription has been updated by a later event")
+	}
+	return updated, nil
+}
+
+// transferSubscription moves the subscription of the users with the from customer IDs to the user with the to customer IDs.
+func (s service) transferSubscription(ctx context.Context, from, to []string, eventAt time.Time) ([]string, error) {
+	toUserIDs, err := s.repo.ListUserIDsByCustomerID(ctx, customerIDs(to))
+	if err != nil {
+		return nil, err
+	}
+	if len(toUserIDs) == 0 {
+		return nil, fail("unknown customer %v", to)
+	}
+	fromUserIDs, err := s.repo.ListUserIDsByCustomerID(ctx, customerIDs(from))
+	if err != nil {
+		return nil, err
+	}
+	if len(fromUserIDs) == 0 {
+		return nil, ignore("no subscriber to transfer from %v", from)
+	}
+
+	toUserID := toUserIDs[0]
+	for _, fromUserID := range fromUserIDs {
+		if fromUserID == toUserID {
+			continue
+		}
+		if err := s.repo.TransferSubscription(ctx, fromUserID, toUserID, eventAt); err != nil {
+			return nil, err
+		}
+	}
+	return append(fromUserIDs, toUserID), nil
+}
+
+// creditPurchase grants the credits of a one-time store purchase to the user with the given customer ID
+// and returns the ID of the user. A purchase which has already been credited is ignored.
+func (s service) creditPurchase(ctx context.Context, provider, transactionID, customerID, productID string, quantity int) (string, error) {
+	credits, ok := s.creditProducts[productID]
+	if !ok {
+		return "", fail("unknown credit product %s", productID)
+	}
+	userIDs, err := s.repo.ListUserIDsByCustomerID(ctx, customerIDs([]string{customerID}))
+	if err != nil {
+		return "", err
+	}
+	if len(userIDs) == 0 {
+		return "", fail("unknown customer %s", customerID)
+	}
+
+	purchase, created, err := s.grantPurchase(ctx, provider, transactionID, userIDs[0], productID, credits*quantity)
+	if err != nil {
+		return "", err
+	}
+	if !created {
+		return "", ignore("the purchase has already been credited")
+	}
+	return purchase.UserID, nil
+}
+
+// grantPurchase records a store purchase and grants its credits to the user. If the purchase has already been
+// recorded, nothing is granted and false is returned.
+func (s service) grantPurchase(ctx context.Context, provider, transactionID, userID, productID string, credits int) (entity.StorePurchase, bool, error) {
+	purchase := entity.StorePurchase{
+		ID:            uuid.New().String(),
+		Provider:      provider,
+		TransactionID: transactionID,
+		UserID:        userID,
+		ProductID:     productID,
+		Credits:       credits,
+		CreatedAt:     time.Now(),
+	}
+	created, err := s.repo.CreateStorePurchase(ctx, purchase)
+	if err != nil || !created {
+		return purchase, false, err
+	}
+
+	if _, err := s.credits.Grant(ctx, purchase.UserID, purchase.Credits, nil, storePurchaseReason, purchase.ID); err != nil {
+		return purchase, false, err
+	}
+	return purchase, true, nil
+}
+
+// PurchaseCredits implements Service.
+// A purchase sent both by the app and by a store notification is credited by whichever comes first,
+// since they are recorded under the same transaction ID.
+func (s service) PurchaseCredits(ctx context.Context, req PurchaseRequest) (entity.StorePurchase, error) {
+	if err := req.Validate(); err != nil {
+		return entity.StorePurchase{}, err
+	}
+	user := auth.CurrentUser(ctx)
+	logger := s.logger.With(ctx, "user", user.ID, "provider", req.Store)
+
+	verifier, ok := s.verifiers[req.Store]
+	if !ok {
+		return entity.StorePurchase{}, errors.BadRequest("The store is not supported", "unsupported_store")
+	}
+	credits, ok := s.creditProducts[req.ProductID]
+	if !ok {
+		return entity.StorePurchase{}, errors.BadRequest("The product is not a credit pack", "unknown_product")
+	}
+
+	verified, err := verifier.VerifyPurchase(ctx, req.ProductID, req.Receipt)
+	if stderr.Is(err, ErrInvalidPurchase) {
+		logger.Infof("purchase of %s rejected: %v", req.ProductID, err)
+		return entity.StorePurchase{}, errors.BadRequest("The purchase cannot be verified", "invalid_receipt")
+	} else if err != nil {
+		logger.Errorf("There is an error while verifying the purchase of %s %v", req.ProductID, err)
+		return entity.StorePurchase{}, errors.InternalServerError("")
+	}
+	if verified.CustomerID != "" && verified.CustomerID != user.CustomerID {
+		logger.Infof("purchase %s rejected: made for customer %s", verified.TransactionID, verified.CustomerID)
+		return entity.StorePurchase{}, errors.BadRequest("The purchase belongs to another account", "purchase_not_owned")
+	}
+
+	var purchase entity.StorePurchase
+	var created bool
+	err = s.transact(ctx, func(ctx context.Context) error {
+		var err error
+		purchase, created, err = s.grantPurchase(ctx, req.Store, verified.TransactionID, user.ID, verified.ProductID, credits*verified.Quantity)
+		if err != nil || created {
+			return err
+		}
+		purchase, err = s.repo.GetStorePurchase(ctx, req.Store, verified.TransactionID)
+		if err != nil {
+			return err
+		}
+		if purchase.UserID != user.ID {
+			return errors.BadRequest("The purchase has already been redeemed", "already_redeemed")
+		}
+		return nil
+	})
+	var errorResponse errors.ErrorResponse
+	if stderr.As(err, &errorResponse) {
+		logger.Infof("purchase %s rejected: credited to another user", verified.TransactionID)
+		return entity.StorePurchase{}, err
+	} else if err != nil {
+		logger.Errorf("There is an error while crediting the purchase %s %v", verified.TransactionID, err)
+		return entity.StorePurchase{}, errors.InternalServerError("")
+	}
+
+	// a purchase which is not finished here is finished again when it is sent again or by the store notification
+	if err := verifier.FinishPurchase(ctx, verified); err != nil {
+		logger.Errorf("There is an error while finishing the purchase %s %v", verified.TransactionID, err)
+	}
+	if created {
+		s.users.Invalidate(user.ID)
+		_ = s.referrals.Qualify(ctx, user.ID)
+		logger.Infof("purchase %s of %s credited with %d credits", verified.TransactionID, verified.ProductID, purchase.Credits)
+	}
+	return purchase, nil
+}
+
+// ExpireSubscriptions implements Service.
+// The subscriptions whose grace period has ended are expired before the new grace periods are started,
+// so that a subscription goes through one state per run.
+func (s service) ExpireSubscriptions(ctx context.Context) error {
+	var events []entity.SubscriptionEvent
+	err := s.transact(ctx, func(ctx context.Context) error {
+		expired, err := s.repo.ExpireSubscriptions(ctx, s.gracePeriod <= 0, lifecycleBatchSize)
+		if err != nil {
+			return err
+		}
+		events = append(events, newSubscriptionEvents(expired, entity.SubscriptionEventExpired)...)
+
+		if s.gracePeriod > 0 {
+			graced, err := s.repo.StartGracePeriods(ctx, s.gracePeriod, lifecycleBatchSize)
+			if err != nil {
+				return err
+			}
+			events = append(events, newSubscriptionEvents(graced, entity.SubscriptionEventGracePeriodStarted)...)
+		}
+		return s.repo.CreateSubscriptionEvents(ctx, events)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(events) > 0 {
+		userIDs := make([]string, len(events))
+		for i, event := range events {
+			userIDs[i] = event.UserID
+		}
+		s.users.Invalidate(userIDs...)
+		s.logger.With(ctx).Infof("recorded %d subscription lifecycle events", len(events))
+	}
+	return nil
+}
+
+// CountSubscriptionEvents implements Service.
+func (s service) CountSubscriptionEvents(ctx context.Context, userID, eventType string) (int, error) {
+	return s.repo.CountSubscriptionEvents(ctx, userID, eventType)
+}
+
+// QuerySubscriptionEvents implements Service.
+func (s service) QuerySubscriptionEvents(ctx context.Context, userID, eventType string, offset, limit int) ([]entity.SubscriptionEvent, error) {
+	return s.repo.QuerySubscriptionEvents(ctx, userID, eventType, offset, limit)
+}
+
+// newSubscriptionEvents completes the events returned for the changed subscriptions with their type.
+func newSubscriptionEvents(events []entity.SubscriptionEvent, eventType entity.SubscriptionEventType) []entity.SubscriptionEvent {
+	currentTime := time.Now()
+	for i := range events {
+		events[i].ID = uuid.New().String()
+		events[i].Type = string(eventType)
+		events[i].CreatedAt = currentTime
+	}
+	return events
+}
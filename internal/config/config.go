@@ -2,6 +2,7 @@ package config
 
 import (
 	"io/ioutil"
+	"time"
 
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/qiangxue/go-env"
@@ -12,6 +13,22 @@ import (
 const (
 	defaultServerPort       = 8080
 	defaultJWTExpirationMin = 60
+	defaultGoogleJWKSURL    = "https://www.googleapis.com/oauth2/v3/certs"
+	defaultAppleJWKSURL     = "https://appleid.apple.com/auth/keys"
+	defaultAppleAuthURL     = "https://appleid.apple.com"
+	defaultGooglePlayAPIURL = "https://androidpublisher.googleapis.com"
+
+	defaultAccountDeletionGraceDays = 30
+	defaultUserCacheSize            = 10000
+	defaultUserCacheTTLSeconds      = 30
+	defaultAuthEventRetentionDays   = 180
+	defaultReferralRedeemWindowDays = 7
+	defaultSubscriptionGraceDays    = 3
+
+	// RateLimitBackendMemory keeps the rate limit buckets in memory, so the limits apply per server instance.
+	RateLimitBackendMemory = "memory"
+	// RateLimitBackendPostgres keeps the rate limit buckets in Postgres, so the limits are shared by all instances.
+	RateLimitBackendPostgres = "postgres"
 )
 
 // Config represents an application configuration.
@@ -22,8 +39,25 @@ type Config struct {
 	DSN string `yaml:"dsn" env:"DSN,secret"`
 	// JWT signing key. required.
 	JWTSigningKey string `yaml:"jwt_signing_key" env:"JWT_SIGNING_KEY,secret"`
+	// the ID of the key in JWTKeys that signs new access tokens.
+	// If empty, access tokens are signed with HS256 using JWTSigningKey.
+	JWTActiveKeyID string `yaml:"jwt_active_key_id" env:"JWT_ACTIVE_KEY_ID"`
+	// the RS256 or EdDSA keys that sign and verify access tokens. Keep retired keys
+	// (public key only) in the list until the tokens signed with them have expired.
+	JWTKeys []JWTKey `yaml:"jwt_keys" env:"JWT_KEYS,secret"`
+	// whether the access tokens signed with HS256 using JWTSigningKey are rejected. Enable it once
+	// JWTActiveKeyID is set and the HS256 tokens issued before have expired.
+	JWTDisableHS256 bool `yaml:"jwt_disable_hs256" env:"JWT_DISABLE_HS256"`
 	// JWT expiration in hours. Defaults to 72 hours (3 days)
 	JWTExpiration int `yaml:"jwt_expiration" env:"JWT_EXPIRATION"`
+	// the number of days after which the data of a deleted account is purged. Defaults to 30 days.
+	AccountDeletionGraceDays int `yaml:"account_deletion_grace_days" env:"ACCOUNT_DELETION_GRACE_DAYS"`
+	// the maximum number of users cached by the authentication middleware. Defaults to 10000. Set to 0 to disable the cache.
+	UserCacheSize int `yaml:"user_cache_size" env:"USER_CACHE_SIZE"`
+	// how long a user stays in the cache, in seconds. Defaults to 30 seconds.
+	UserCacheTTL int `yaml:"user_cache_ttl" env:"USER_CACHE_TTL"`
+	// the number of days the authentication events of the audit log are kept. Defaults to 180 days. Set to 0 to keep them forever.
+	AuthEventRetentionDays int `yaml:"auth_event_retention_days" env:"AUTH_EVENT_RETENTION_DAYS"`
 	// Local Storage Path
 	LocalStoragePath string `yaml:"local_storage_path" env:"LOCAL_STORAGE_PATH"`
 	// Cloudflare R2 Configuration
@@ -32,6 +66,150 @@ type Config struct {
 	CloudflareR2AccessKeyID      string `yaml:"cloudflare_r2_access_key_id" env:"CLOUDFLARE_R2_ACCESS_KEY_ID"`
 	CloudflareR2AccessKeySecrect string `yaml:"cloudflare_r2_access_key_secret" env:"CLOUDFLARE_R2_ACCESS_KEY_SECRET"`
 	CloudflareR2PublicDomain     string `yaml:"cloudflare_r2_public_domain" env:"CLOUDFLARE_R2_PUBLIC_DOMAIN"`
+	// the bucket the data exports are written to. It must not be public, the exports are only
+	// downloaded through signed URLs.
+	CloudflareR2ExportBucketName string `yaml:"cloudflare_r2_export_bucket_name" env:"CLOUDFLARE_R2_EXPORT_BUCKET_NAME"`
+	// Google Sign-In Configuration
+	// the URL of the JWKS used to verify Google ID tokens. Defaults to Google's public certificates.
+	GoogleJWKSURL string `yaml:"google_jwks_url" env:"GOOGLE_JWKS_URL"`
+	// the OAuth client IDs that Google ID tokens must be issued to
+	GoogleClientIDs []string `yaml:"google_client_ids" env:"GOOGLE_CLIENT_IDS"`
+	// Sign in with Apple Configuration
+	// the URL of the JWKS used to verify Apple identity tokens. Defaults to Apple's public keys.
+	AppleJWKSURL string `yaml:"apple_jwks_url" env:"APPLE_JWKS_URL"`
+	// the base URL of Apple's token and revoke endpoints. Defaults to https://appleid.apple.com
+	AppleAuthURL string `yaml:"apple_auth_url" env:"APPLE_AUTH_URL"`
+	// the bundle ID or services ID the app signs in with. Also used as client_id for the token endpoints.
+	AppleClientID string `yaml:"apple_client_id" env:"APPLE_CLIENT_ID"`
+	AppleTeamID   string `yaml:"apple_team_id" env:"APPLE_TEAM_ID"`
+	AppleKeyID    string `yaml:"apple_key_id" env:"APPLE_KEY_ID"`
+	// the PEM encoded .p8 private key used to sign the client secret
+	ApplePrivateKey string `yaml:"apple_private_key" env:"APPLE_PRIVATE_KEY,secret"`
+	// the header holding the client IP set by the reverse proxy, e.g. CF-Connecting-IP.
+	// If empty, the remote address of the connection is used.
+	ClientIPHeader string `yaml:"client_ip_header" env:"CLIENT_IP_HEADER"`
+	// the IP addresses or CIDR ranges of the reverse proxies allowed to set the client IP header.
+	// The header of requests from any other address is ignored.
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// Billing Configuration
+	// the value of the Authorization header sent with the RevenueCat webhooks. Webhooks are rejected if empty.
+	RevenueCatWebhookAuth string `yaml:"revenuecat_webhook_auth" env:"REVENUECAT_WEBHOOK_AUTH,secret"`
+	// whether the events and the purchases of the sandbox and test environments of the stores are applied.
+	// They are ignored by default, as they are not paid for. It must not be enabled in production.
+	BillingSandbox bool `yaml:"billing_sandbox" env:"BILLING_SANDBOX"`
+	// the subscription plans and periods given by the store products, keyed by the product ID
+	SubscriptionProducts map[string]SubscriptionProduct `yaml:"subscription_products"`
+	// the PEM encoded root certificate the App Store Server Notifications are signed under, i.e. Apple Root CA - G3.
+	// App Store notifications are rejected if empty.
+	AppStoreRootCA string `yaml:"app_store_root_ca" env:"APP_STORE_ROOT_CA"`
+	// the bundle ID of the app whose App Store notifications and transactions are accepted. They are rejected if empty.
+	AppStoreBundleID string `yaml:"app_store_bundle_id" env:"APP_STORE_BUNDLE_ID"`
+	// the base URL of the Google Play Developer API. Defaults to https://androidpublisher.googleapis.com
+	GooglePlayAPIURL string `yaml:"google_play_api_url" env:"GOOGLE_PLAY_API_URL"`
+	// the JSON key of the service account the Google Play Developer API is called with. Required.
+	GooglePlayServiceAccount string `yaml:"google_play_service_account" env:"GOOGLE_PLAY_SERVICE_ACCOUNT,secret"`
+	// the package name of the app whose Google Play notifications are applied. If empty, any app is accepted.
+	GooglePlayPackageName string `yaml:"google_play_package_name" env:"GOOGLE_PLAY_PACKAGE_NAME"`
+	// the token query parameter of the Pub/Sub push endpoint. Google Play notifications are rejected if empty.
+	GooglePlayPushToken string `yaml:"google_play_push_token" env:"GOOGLE_PLAY_PUSH_TOKEN,secret"`
+	// the days a store subscription which is not renewed by its expiry keeps a billing issue before it expires.
+	// Zero expires it right away. Defaults to 3.
+	SubscriptionGraceDays int `yaml:"subscription_grace_days" env:"SUBSCRIPTION_GRACE_DAYS"`
+	// whether a subscription with a billing issue gives access to its plan during its grace period. Defaults to true.
+	SubscriptionGraceAccess bool `yaml:"subscription_grace_access" env:"SUBSCRIPTION_GRACE_ACCESS"`
+	// the number of credits given by the one-time store products, keyed by the product ID
+	CreditProducts map[string]int `yaml:"credit_products"`
+	// whether the credit packs can be bought with fake purchases, which are accepted without a store.
+	// It must not be enabled in production.
+	FakePurchases bool `yaml:"fake_purchases" env:"FAKE_PURCHASES"`
+	// the credits the subscription plans give every period of the subscription, keyed by the plan
+	CreditAllowances map[string]CreditAllowance `yaml:"credit_allowances"`
+	// the rewards and the limits of the referral program
+	Referral Referral `yaml:"referral"`
+	// the features gated on the subscription and the credits of the users, keyed by the feature name.
+	// Defaults to an image_upload feature which is free for every user.
+	Entitlements map[string]Entitlement `yaml:"entitlements"`
+	// Rate Limiting Configuration
+	// where the rate limit buckets are kept: "memory" or "postgres". Defaults to memory.
+	RateLimitBackend string `yaml:"rate_limit_backend" env:"RATE_LIMIT_BACKEND"`
+	// the limits of the rate limited route groups
+	RateLimits RateLimits `yaml:"rate_limits"`
+}
+
+// SubscriptionProduct is the subscription plan and period a store product gives.
+type SubscriptionProduct struct {
+	// the subscription plan, e.g. pro
+	Plan string `yaml:"plan"`
+	// the subscription period: 1w, 1m, 6m or 1y
+	Period string `yaml:"period"`
+}
+
+// CreditAllowance is the credits a subscription plan gives every period of the subscription.
+type CreditAllowance struct {
+	// the number of credits given every period
+	Credits int `yaml:"credits"`
+	// whether the credits not used in a period are kept. Otherwise they expire at the end of the period.
+	Rollover bool `yaml:"rollover"`
+}
+
+// Referral holds the rewards and the limits of the referral program.
+type Referral struct {
+	// the number of credits the referrer gets for a referral
+	ReferrerCredits int `yaml:"referrer_credits"`
+	// the number of credits the referred user gets
+	RefereeCredits int `yaml:"referee_credits"`
+	// the number of referrals a referrer can be rewarded for. Zero means no limit.
+	MaxRewards int `yaml:"max_rewards"`
+	// how many days after signing up a user can redeem a referral code. Defaults to 7.
+	RedeemWindowDays int `yaml:"redeem_window_days"`
+}
+
+// Entitlement is what a user needs to use a feature. The subscribers of one of the plans use the feature
+// for free, while the other users pay its credits. A feature with plans and without credits is only available
+// to the subscribers.
+type Entitlement struct {
+	// the subscription plans which give the feature, e.g. pro
+	Plans []string `yaml:"plans"`
+	// the number of credits a request using the feature costs
+	Credits int `yaml:"credits"`
+}
+
+// RateLimits holds the limits of the rate limited route groups.
+type RateLimits struct {
+	// the username, Google and Apple login endpoints
+	Login RateLimitGroup `yaml:"login"`
+	// the token refresh endpoint
+	Refresh RateLimitGroup `yaml:"refresh"`
+	// the endpoints creating new users: registration and anonymous login
+	Signup RateLimitGroup `yaml:"signup"`
+	// the promo code redemption endpoint
+	PromoRedeem RateLimitGroup `yaml:"promo_redeem"`
+}
+
+// RateLimitGroup holds the per-IP, per-device and per-user limits of a route group.
+// The per-user limit only applies to the endpoints requiring authentication.
+type RateLimitGroup struct {
+	IP     RateLimit `yaml:"ip"`
+	Device RateLimit `yaml:"device"`
+	User   RateLimit `yaml:"user"`
+}
+
+// RateLimit allows Requests requests per Period with bursts of up to Burst requests (defaults to Requests).
+// A limit with zero requests is disabled.
+type RateLimit struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst"`
+}
+
+// JWTKey represents a key pair used for access tokens. The PEM encoded keys can be given inline or as file paths.
+type JWTKey struct {
+	ID             string `yaml:"id" json:"id"`
+	Algorithm      string `yaml:"algorithm" json:"algorithm"`
+	PrivateKey     string `yaml:"private_key" json:"private_key"`
+	PrivateKeyFile string `yaml:"private_key_file" json:"private_key_file"`
+	PublicKey      string `yaml:"public_key" json:"public_key"`
+	PublicKeyFile  string `yaml:"public_key_file" json:"public_key_file"`
 }
 
 // Validate validates the application configuration.
@@ -45,6 +223,8 @@ func (c Config) Validate() error {
 		validation.Field(&c.CloudflareR2AccountID, validation.Required),
 		validation.Field(&c.CloudflareR2AccessKeySecrect, validation.Required),
 		validation.Field(&c.CloudflareR2PublicDomain, validation.Required),
+		validation.Field(&c.CloudflareR2ExportBucketName, validation.Required),
+		validation.Field(&c.RateLimitBackend, validation.In(RateLimitBackendMemory, RateLimitBackendPostgres)),
 	)
 }
 
@@ -54,6 +234,40 @@ func Load(file string, logger log.Logger) (*Config, error) {
 	c := Config{
 		ServerPort:    defaultServerPort,
 		JWTExpiration: defaultJWTExpirationMin,
+		GoogleJWKSURL: defaultGoogleJWKSURL,
+		AppleJWKSURL:  defaultAppleJWKSURL,
+		AppleAuthURL:  defaultAppleAuthURL,
+
+		GooglePlayAPIURL: defaultGooglePlayAPIURL,
+
+		AccountDeletionGraceDays: defaultAccountDeletionGraceDays,
+		UserCacheSize:            defaultUserCacheSize,
+		UserCacheTTL:             defaultUserCacheTTLSeconds,
+		AuthEventRetentionDays:   defaultAuthEventRetentionDays,
+		Referral:                 Referral{RedeemWindowDays: defaultReferralRedeemWindowDays},
+		SubscriptionGraceDays:    defaultSubscriptionGraceDays,
+		SubscriptionGraceAccess:  true,
+		Entitlements:             map[string]Entitlement{"image_upload": {}},
+
+		RateLimitBackend: RateLimitBackendMemory,
+		RateLimits: RateLimits{
+			Login: RateLimitGroup{
+				IP:     RateLimit{Requests: 30, Period: time.Minute},
+				Device: RateLimit{Requests: 10, Period: time.Minute},
+			},
+			Refresh: RateLimitGroup{
+				IP:     RateLimit{Requests: 120, Period: time.Minute},
+				Device: RateLimit{Requests: 20, Period: time.Minute},
+			},
+			Signup: RateLimitGroup{
+				IP:     RateLimit{Requests: 20, Period: time.Hour, Burst: 5},
+				Device: RateLimit{Requests: 5, Period: time.Hour},
+			},
+			PromoRedeem: RateLimitGroup{
+				IP:   RateLimit{Requests: 30, Period: time.Hour, Burst: 10},
+				User: RateLimit{Requests: 10, Period: time.Hour, Burst: 5},
+			},
+		},
 	}
 
 	// load from YAML config file
@@ -70,6 +284,22 @@ func Load(file string, logger log.Logger) (*Config, error) {
 		return nil, err
 	}
 
+	// read the PEM files of the JWT keys
+	for i, key := range c.JWTKeys {
+		if key.PrivateKeyFile != "" {
+			if bytes, err = ioutil.ReadFile(key.PrivateKeyFile); err != nil {
+				return nil, err
+			}
+			c.JWTKeys[i].PrivateKey = string(bytes)
+		}
+		if key.PublicKeyFile != "" {
+			if bytes, err = ioutil.ReadFile(key.PublicKeyFile); err != nil {
+				return nil, err
+			}
+			c.JWTKeys[i].PublicKey = string(bytes)
+		}
+	}
+
 	// validation
 	if err = c.Validate(); err != nil {
 		return nil, err
@@ -0,0 +1,62 @@
+package credit
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/qiangxue/go-rest-api/pkg/pagination"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Use(authHandler)
+
+	// the following endpoints require a valid JWT
+	rg.Get("/credits/history", res.history)
+}
+
+// RegisterAdminHandlers registers the credit management handlers of the admin route group.
+// The route group must only be reachable by the staff. Adjusting the credits is restricted to admins.
+func RegisterAdminHandlers(rg *routing.RouteGroup, service Service, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Post("/users/<id>/credits", auth.RequireRole(entity.RoleAdmin), res.adjust)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) history(c *routing.Context) error {
+	ctx := c.Request.Context()
+	count, err := r.service.CountHistory(ctx)
+	if err != nil {
+		return err
+	}
+	pages := pagination.NewFromRequest(c.Request, count)
+	transactions, err := r.service.QueryHistory(ctx, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = transactions
+	return c.Write(pages)
+}
+
+func (r resource) adjust(c *routing.Context) error {
+	var req AdjustRequest
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	if err := r.service.Adjust(c.Request.Context(), c.Param("id"), req.Amount, req.Reason); err != nil {
+		return err
+	}
+
+	return c.Write("success")
+}
@@ -0,0 +1,260 @@
+package credit
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access the credit ledger.
+type Repository interface {
+	// GetBalance returns the credits remaining in the lots of the user that have not expired.
+	GetBalance(ctx context.Context, userID string) (int, error)
+	// CountTransactions returns the number of the transactions of the user.
+	CountTransactions(ctx context.Context, userID string) (int, error)
+	// QueryTransactions returns the transactions of the user, the latest first.
+	QueryTransactions(ctx context.Context, userID string, offset, limit int) ([]entity.CreditTransaction, error)
+	// LockLots returns the lots of the user which have credits left and have not expired, the soonest expiring first.
+	// The lots are locked until the end of the transaction.
+	LockLots(ctx context.Context, userID string) ([]entity.CreditTransaction, error)
+	// LockConsumptions returns the consumptions of the user with the given reference.
+	// The consumptions are locked until the end of the transaction.
+	LockConsumptions(ctx context.Context, userID, reference string) ([]entity.CreditTransaction, error)
+	// HasRefund tells whether the consumptions with the given reference have been refunded.
+	HasRefund(ctx context.Context, userID, reference string) (bool, error)
+	// LockGrants returns the lots of the user granted with the given reference which have credits left.
+	// The lots are locked until the end of the transaction.
+	LockGrants(ctx context.Context, userID, reference string) ([]entity.CreditTransaction, error)
+	// LockExpiredLots returns the lots which expired before the given time with credits left.
+	// The lots are locked until the end of the transaction, and lots locked by others are skipped.
+	LockExpiredLots(ctx context.Context, expiredBefore time.Time, limit int) ([]entity.CreditTransaction, error)
+	// CreateTransaction saves a new transaction.
+	CreateTransaction(ctx context.Context, transaction entity.CreditTransaction) error
+	// AddRemaining adds the given number of credits to the credits remaining in the lot. The number may be negative.
+	AddRemaining(ctx context.Context, lotID string, credits int) error
+
+	// ListDueSubscribers returns the active subscribers of the given plans and periods who have no allowance for the current time.
+	// If userIDs is not empty, only the given users are returned.
+	ListDueSubscribers(ctx context.Context, plans, periods, userIDs []string, limit int) ([]Subscriber, error)
+	// CreateAllowance saves a granted allowance. It returns false without saving the allowance
+	// if the user already has an allowance for the same period.
+	CreateAllowance(ctx context.Context, allowance entity.CreditAllowance) (bool, error)
+}
+
+// Subscriber is the subscription of a user an allowance is granted for.
+type Subscriber struct {
+	UserID    string     `db:"user_id"`
+	Plan      string     `db:"plan"`
+	Period    string     `db:"period"`
+	ExpiresAt *time.Time `db:"expires_at"`
+}
+
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new credit repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// GetBalance implements Repository.
+func (r repository) GetBalance(ctx context.Context, userID string) (int, error) {
+	var balance int
+	err := r.db.With(ctx).NewQuery("SELECT credit_balance({:user_id})").
+		Bind(dbx.Params{"user_id": userID}).
+		Row(&balance)
+
+	return balance, err
+}
+
+// CountTransactions implements Repository.
+func (r repository) CountTransactions(ctx context.Context, userID string) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("credit_transaction").
+		Where(dbx.HashExp{"user_id": userID}).
+		Row(&count)
+
+	return count, err
+}
+
+// QueryTransactions implements Repository.
+func (r repository) QueryTransactions(ctx context.Context, userID string, offset, limit int) ([]entity.CreditTransaction, error) {
+	transactions := []entity.CreditTransaction{}
+	err := r.db.With(ctx).Select().From("credit_transaction").
+		Where(dbx.HashExp{"user_id": userID}).
+		OrderBy("created_at DESC", "id").
+		Offset(int64(offset)).
+		Limit(int64(limit)).
+		All(&transactions)
+
+	return transactions, err
+}
+
+// LockLots implements Repository.
+// Lots without an expiry are used last, and lots expiring at the same time are used in the order they were granted.
+func (r repository) LockLots(ctx context.Context, userID string) ([]entity.CreditTransaction, error) {
+	var lots []entity.CreditTransaction
+	err := r.db.With(ctx).NewQuery(`SELECT * FROM credit_transaction
+		WHERE user_id = {:user_id} AND remaining > 0 AND (expires_at IS NULL OR expires_at > {:now})
+		ORDER BY expires_at NULLS LAST, created_at
+		FOR UPDATE`,
+	).Bind(dbx.Params{"user_id": userID, "now": time.Now()}).All(&lots)
+
+	return lots, err
+}
+
+// LockConsumptions implements Repository.
+func (r repository) LockConsumptions(ctx context.Context, userID, reference string) ([]entity.CreditTransaction, error) {
+	var consumptions []entity.CreditTransaction
+	err := r.db.With(ctx).NewQuery(`SELECT * FROM credit_transaction
+		WHERE user_id = {:user_id} AND reference = {:reference} AND type = {:type}
+		ORDER BY created_at
+		FOR UPDATE`,
+	).Bind(dbx.Params{
+		"user_id":   userID,
+		"reference": reference,
+		"type":      entity.CreditTransactionConsume,
+	}).All(&consumptions)
+
+	return consumptions, err
+}
+
+// HasRefund implements Repository.
+func (r repository) HasRefund(ctx context.Context, userID, reference string) (bool, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("credit_transaction").
+		Where(dbx.HashExp{
+			"user_id":   userID,
+			"reference": reference,
+			"type":      entity.CreditTransactionRefund,
+		}).
+		Row(&count)
+
+	return count > 0, err
+}
+
+// LockGrants implements Repository.
+func (r repository) LockGrants(ctx context.Context, userID, reference string) ([]entity.CreditTransaction, error) {
+	var lots []entity.CreditTransaction
+	err := r.db.With(ctx).NewQuery(`SELECT * FROM credit_transaction
+		WHERE user_id = {:user_id} AND reference = {:reference} AND type = {:type} AND remaining > 0
+		ORDER BY created_at
+		FOR UPDATE`,
+	).Bind(dbx.Params{
+		"user_id":   userID,
+		"reference": reference,
+		"type":      entity.CreditTransactionGrant,
+	}).All(&lots)
+
+	return lots, err
+}
+
+// LockExpiredLots implements Repository.
+func (r repository) LockExpiredLots(ctx context.Context, expiredBefore time.Time, limit int) ([]entity.CreditTransaction, error) {
+	var lots []entity.CreditTransaction
+	err := r.db.With(ctx).NewQuery(`SELECT * FROM credit_transaction
+		WHERE remaining > 0 AND expires_at <= {:expired_before}
+		ORDER BY expires_at
+		LIMIT {:limit}
+		FOR UPDATE SKIP LOCKED`,
+	).Bind(dbx.Params{"expired_before": expiredBefore, "limit": limit}).All(&lots)
+
+	return lots, err
+}
+
+// CreateTransaction implements Repository.
+func (r repository) CreateTransaction(ctx context.Context, transaction entity.CreditTransaction) error {
+	_, err := r.db.With(ctx).Insert("credit_transaction", dbx.Params{
+		"id":         transaction.ID,
+		"user_id":    transaction.UserID,
+		"type":       transaction.Type,
+		"amount":     transaction.Amount,
+		"lot_id":     transaction.LotID,
+		"remaining":  transaction.Remaining,
+		"expires_at": transaction.ExpiresAt,
+		"reason":     transaction.Reason,
+		"reference":  transaction.Reference,
+		"created_at": transaction.CreatedAt,
+	}).Execute()
+
+	return err
+}
+
+// AddRemaining implements Repository.
+func (r repository) AddRemaining(ctx context.Context, lotID string, credits int) error {
+	_, err := r.db.With(ctx).Update("credit_transaction",
+		dbx.Params{"remaining": dbx.NewExp("remaining + {:credits}", dbx.Params{"credits": credits})},
+		dbx.HashExp{"id": lotID},
+	).Execute()
+
+	return err
+}
+
+// ListDueSubscribers implements Repository.
+func (r repository) ListDueSubscribers(ctx context.Context, plans, periods, userIDs []string, limit int) ([]Subscriber, error) {
+	subscribers := []Subscriber{}
+	if len(plans) == 0 || len(periods) == 0 {
+		return subscribers, nil
+	}
+
+	where := dbx.And(
+		dbx.HashExp{
+			"u.subscription_status": string(entity.SubscriptionStatusActive),
+			"u.subscription_plan":   toValues(plans),
+			"u.subscription_period": toValues(periods),
+			"u.deleted_at":          nil,
+		},
+		dbx.NewExp(`(u.subscription_expires_at IS NULL OR u.subscription_expires_at > {:now})
+			AND NOT EXISTS (SELECT 1 FROM credit_allowance AS a
+				WHERE a.user_id = u.id AND a.period_start <= {:now} AND a.period_end > {:now})`,
+			dbx.Params{"now": time.Now()}),
+	)
+	if len(userIDs) > 0 {
+		where = dbx.And(where, dbx.HashExp{"u.id": toValues(userIDs)})
+	}
+	err := r.db.With(ctx).
+		Select("u.id AS user_id", "u.subscription_plan AS plan", "u.subscription_period AS period", "u.subscription_expires_at AS expires_at").
+		From("public.user AS u").
+		Where(where).
+		OrderBy("u.id").
+		Limit(int64(limit)).
+		All(&subscribers)
+
+	return subscribers, err
+}
+
+// CreateAllowance implements Repository.
+func (r repository) CreateAllowance(ctx context.Context, allowance entity.CreditAllowance) (bool, error) {
+	result, err := r.db.With(ctx).NewQuery(`INSERT INTO credit_allowance (id, user_id, plan, period_start, period_end, credits, created_at)
+		VALUES ({:id}, {:user_id}, {:plan}, {:period_start}, {:period_end}, {:credits}, {:created_at})
+		ON CONFLICT (user_id, period_start) DO NOTHING`,
+	).Bind(dbx.Params{
+		"id":           allowance.ID,
+		"user_id":      allowance.UserID,
+		"plan":         allowance.Plan,
+		"period_start": allowance.PeriodStart,
+		"period_end":   allowance.PeriodEnd,
+		"credits":      allowance.Credits,
+		"created_at":   allowance.CreatedAt,
+	}).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+func toValues(values []string) []interface{} {
+	result := make([]interface{}, len(values))
+	for i, value := range values {
+		result[i] = value
+	}
+	return result
+}
@@ -0,0 +1,549 @@
+package credit
+
+import (
+	"context"
+	stderr "errors"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+const (
+	// expireBatchSize is the maximum number of lots expired by one run of the expiry job.
+	expireBatchSize = 500
+	// allowanceBatchSize is the maximum number of allowances granted by one run of the allowance job.
+	allowanceBatchSize = 500
+	// allowanceReason is the reason of the lots granted as the allowance of a subscription.
+	allowanceReason = "subscription_allowance"
+)
+
+// ErrInsufficientCredits is returned when the balance of a user does not cover a consumption.
+var ErrInsufficientCredits = stderr.New("insufficient credits")
+
+// Service encapsulates the usecase logic for the credits of users.
+// The balance of a user is derived from the ledger: it is the sum of the credits remaining in the lots that have not expired.
+// Every method changing the balance can be called within a transaction of the caller.
+type Service interface {
+	// GetBalance returns the balance of the user.
+	GetBalance(ctx context.Context, userID string) (int, error)
+	// CountHistory returns the number of the credit transactions of the current user.
+	CountHistory(ctx context.Context) (int, error)
+	// QueryHistory returns the credit transactions of the current user, the latest first.
+	QueryHistory(ctx context.Context, offset, limit int) ([]entity.CreditTransaction, error)
+
+	// Grant adds a new lot of credits to the user. A nil expiresAt means the credits never expire.
+	Grant(ctx context.Context, userID string, amount int, expiresAt *time.Time, reason, reference string) (entity.CreditTransaction, error)
+	// Consume takes credits from the lots of the user, the soonest expiring lot first.
+	// ErrInsufficientCredits is returned if the balance does not cover the amount.
+	Consume(ctx context.Context, userID string, amount int, reason, reference string) ([]entity.CreditTransaction, error)
+	// Refund gives the credits of the consumptions with the given reference back to the lots they were taken from.
+	// It returns the number of the credits refunded. Refunding the same reference again does nothing.
+	Refund(ctx context.Context, userID, reference string) (int, error)
+	// Revoke takes back the credits remaining in the lots granted with the given reference, e.g. when the store
+	// cancels the purchase they were granted for. The credits which have been spent are not taken back.
+	// It returns the number of the credits revoked. Revoking the same reference again does nothing.
+	Revoke(ctx context.Context, userID, reference string) (int, error)
+	// Adjust corrects the balance of a user on behalf of an admin. A positive amount grants a lot which never expires,
+	// while a negative amount is consumed.
+	Adjust(ctx context.Context, userID string, amount int, reason string) error
+	// ExpireCredits records the expiry of the lots whose credits have expired. It is meant to be run as a background job.
+	ExpireCredits(ctx context.Context) error
+
+	// GrantAllowance grants the allowance of the current period to the user if they are a subscriber who has not got it yet,
+	// e.g. right after their subscription has renewed.
+	GrantAllowance(ctx context.Context, userID string) error
+	// GrantAllowances grants the allowance of the current period to the subscribers who have not got it yet.
+	// It is meant to be run as a background job, which also makes up for the grants missed while the server was down.
+	GrantAllowances(ctx context.Context) error
+}
+
+// Allowance is the credits a subscription plan gives every period of the subscription.
+type Allowance struct {
+	Credits int
+	// Rollover tells whether the credits which are not used in a period are kept. Otherwise they expire at the end of the period.
+	Rollover bool
+}
+
+// AdjustRequest represents a credit adjustment made by an admin.
+type AdjustRequest struct {
+	Amount int    `json:"amount"`
+	Reason string `json:"reason"`
+}
+
+// Validate validates the AdjustRequest fields.
+func (m AdjustRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Amount, validation.Required),
+		validation.Field(&m.Reason, validation.Required, validation.Length(0, 50)),
+	)
+}
+
+type service struct {
+	repo       Repository
+	transact   dbcontext.TransactionFunc
+	allowances map[string]Allowance
+	users      auth.UserCache
+	logger     log.Logger
+}
+
+// NewService creates a new credit service. The allowances are keyed by the subscription plan.
+func NewService(
+	repo Repository,
+	transact dbcontext.TransactionFunc,
+	allowances map[string]Allowance,
+	users auth.UserCache,
+	logger log.Logger,
+) Service {
+	return service{repo, transact, allowances, users, logger}
+}
+
+// GetBalance implements Service.
+func (s service) GetBalance(ctx context.Context, userID string) (int, error) {
+	return s.repo.GetBalance(ctx, userID)
+}
+
+// CountHistory implements Service.
+func (s service) CountHistory(ctx context.Context) (int, error) {
+	return s.repo.CountTransactions(ctx, auth.CurrentUser(ctx).GetID())
+}
+
+// QueryHistory implements Service.
+func (s service) QueryHistory(ctx context.Context, offset, limit int) ([]entity.CreditTransaction, error) {
+	return s.repo.QueryTransactions(ctx, auth.CurrentUser(ctx).GetID(), offset, limit)
+}
+
+// Grant implements Service.
+func (s service) Grant(ctx context.Context, userID string, amount int, expiresAt *time.Time, reason, reference string) (entity.CreditTransaction, error) {
+	return s.grant(ctx, userID, entity.CreditTransactionGrant, amount, expiresAt, reason, reference)
+}
+
+func (s service) grant(
+	ctx context.Context,
+	userID string,
+	transactionType entity.CreditTransactionType,
+	amount int,
+	expiresAt *time.Time,
+	reason, reference string,
+) (entity.CreditTransaction, error) {
+	if amount <= 0 {
+		return entity.CreditTransaction{}, errors.BadRequest("The amount must be positive", "invalid_amount")
+	}
+
+	lot := entity.CreditTransaction{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Type:      string(transactionType),
+		Amount:    amount,
+		Remaining: &amount,
+		ExpiresAt: expiresAt,
+		Reason:    reason,
+		Reference: nullIfEmpty(reference),
+		CreatedAt: time.Now(),
+	}
+	if err := s.repo.CreateTransaction(ctx, lot); err != nil {
+		s.logger.Errorf("There is an error while granting %d credits to user %s %v", amount, userID, err)
+		return lot, errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+
+	return lot, nil
+}
+
+// Consume implements Service.
+func (s service) Consume(ctx context.Context, userID string, amount int, reason, reference string) ([]entity.CreditTransaction, error) {
+	return s.consume(ctx, userID, entity.CreditTransactionConsume, amount, reason, reference)
+}
+
+// consume takes the amount from the lots of the user in a transaction. A transaction is recorded for each lot used.
+func (s service) consume(
+	ctx context.Context,
+	userID string,
+	transactionType entity.CreditTransactionType,
+	amount int,
+	reason, reference string,
+) ([]entity.CreditTransaction, error) {
+	if amount <= 0 {
+		return nil, errors.BadRequest("The amount must be positive", "invalid_amount")
+	}
+
+	var debits []entity.CreditTransaction
+	err := s.transact(ctx, func(ctx context.Context) error {
+		lots, err := s.repo.LockLots(ctx, userID)
+		if err != nil {
+			return err
+		}
+		available := 0
+		for _, lot := range lots {
+			available += *lot.Remaining
+		}
+		if available < amount {
+			return ErrInsufficientCredits
+		}
+
+		currentTime := time.Now()
+		for _, lot := range lots {
+			if amount == 0 {
+				break
+			}
+			taken := min(amount, *lot.Remaining)
+			amount -= taken
+
+			lotID := lot.ID
+			debit := entity.CreditTransaction{
+				ID:        uuid.New().String(),
+				UserID:    userID,
+				Type:      string(transactionType),
+				Amount:    -taken,
+				LotID:     &lotID,
+				Reason:    reason,
+				Reference: nullIfEmpty(reference),
+				CreatedAt: currentTime,
+			}
+			if err := s.repo.CreateTransaction(ctx, debit); err != nil {
+				return err
+			}
+			if err := s.repo.AddRemaining(ctx, lot.ID, -taken); err != nil {
+				return err
+			}
+			debits = append(debits, debit)
+		}
+		return nil
+	})
+	if stderr.Is(err, ErrInsufficientCredits) {
+		return nil, err
+	} else if err != nil {
+		s.logger.Errorf("There is an error while consuming the credits of user %s %v", userID, err)
+		return nil, errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+
+	return debits, nil
+}
+
+// Refund implements Service.
+func (s service) Refund(ctx context.Context, userID, reference string) (int, error) {
+	if reference == "" {
+		return 0, errors.BadRequest("The reference is required", "invalid_reference")
+	}
+
+	refunded := 0
+	err := s.transact(ctx, func(ctx context.Context) error {
+		// locking the consumptions serializes the refunds of the same reference
+		consumptions, err := s.repo.LockConsumptions(ctx, userID, reference)
+		if err != nil || len(consumptions) == 0 {
+			return err
+		}
+		if done, err := s.repo.HasRefund(ctx, userID, reference); err != nil || done {
+			return err
+		}
+
+		currentTime := time.Now()
+		for _, consumption := range consumptions {
+			lotID := *consumption.LotID
+			refund := entity.CreditTransaction{
+				ID:        uuid.New().String(),
+				UserID:    userID,
+				Type:      string(entity.CreditTransactionRefund),
+				Amount:    -consumption.Amount,
+				LotID:     &lotID,
+				Reason:    consumption.Reason,
+				Reference: &reference,
+				CreatedAt: currentTime,
+			}
+			if err := s.repo.CreateTransaction(ctx, refund); err != nil {
+				return err
+			}
+			// a lot which has expired in the meantime gets the credits back too, and the expiry job removes them again
+			if err := s.repo.AddRemaining(ctx, lotID, refund.Amount); err != nil {
+				return err
+			}
+			refunded += refund.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("There is an error while refunding the credits of user %s for %s %v", userID, reference, err)
+		return 0, errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+
+	return refunded, nil
+}
+
+// Revoke implements Service.
+func (s service) Revoke(ctx context.Context, userID, reference string) (int, error) {
+	if reference == "" {
+		return 0, errors.BadRequest("The reference is required", "invalid_reference")
+	}
+
+	revoked := 0
+	err := s.transact(ctx, func(ctx context.Context) error {
+		lots, err := s.repo.LockGrants(ctx, userID, reference)
+		if err != nil {
+			return err
+		}
+
+		currentTime := time.Now()
+		for _, lot := range lots {
+			lotID := lot.ID
+			revocation := entity.CreditTransaction{
+				ID:        uuid.New().String(),
+				UserID:    userID,
+				Type:      string(entity.CreditTransactionRevoke),
+				Amount:    -*lot.Remaining,
+				LotID:     &lotID,
+				Reason:    lot.Reason,
+				Reference: &reference,
+				CreatedAt: currentTime,
+			}
+			if err := s.repo.CreateTransaction(ctx, revocation); err != nil {
+				return err
+			}
+			if err := s.repo.AddRemaining(ctx, lotID, revocation.Amount); err != nil {
+				return err
+			}
+			revoked -= revocation.Amount
+		}
+		return nil
+	})
+	if err != nil {
+		s.logger.Errorf("There is an error while revoking the credits of user %s for %s %v", userID, reference, err)
+		return 0, errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+
+	return revoked, nil
+}
+
+// Adjust implements Service.
+func (s service) Adjust(ctx context.Context, userID string, amount int, reason string) error {
+	if _, err := uuid.Parse(userID); err != nil {
+		return errors.NotFound("")
+	}
+	if err := (AdjustRequest{Amount: amount, Reason: reason}).Validate(); err != nil {
+		return err
+	}
+	logger := s.logger.With(ctx, "user", userID)
+
+	var err error
+	if amount > 0 {
+		_, err = s.grant(ctx, userID, entity.CreditTransactionAdjustment, amount, nil, reason, "")
+	} else {
+		_, err = s.consume(ctx, userID, entity.CreditTransactionAdjustment, -amount, reason, "")
+		if stderr.Is(err, ErrInsufficientCredits) {
+			return errors.BadRequest("The balance of the user is lower than the amount", "insufficient_credits")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Infof("credits adjusted by %d by %s: %s", amount, auth.CurrentUser(ctx).GetID(), reason)
+	return nil
+}
+
+// ExpireCredits implements Service.
+func (s service) ExpireCredits(ctx context.Context) error {
+	var userIDs []string
+	err := s.transact(ctx, func(ctx context.Context) error {
+		lots, err := s.repo.LockExpiredLots(ctx, time.Now(), expireBatchSize)
+		if err != nil {
+			return err
+		}
+
+		currentTime := time.Now()
+		for _, lot := range lots {
+			lotID := lot.ID
+			err := s.repo.CreateTransaction(ctx, entity.CreditTransaction{
+				ID:        uuid.New().String(),
+				UserID:    lot.UserID,
+				Type:      string(entity.CreditTransactionExpire),
+				Amount:    -*lot.Remaining,
+				LotID:     &lotID,
+				Reason:    lot.Reason,
+				Reference: lot.Reference,
+				CreatedAt: currentTime,
+			})
+			if err != nil {
+				return err
+			}
+			if err := s.repo.AddRemaining(ctx, lot.ID, -*lot.Remaining); err != nil {
+				return err
+			}
+			userIDs = append(userIDs, lot.UserID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(userIDs) > 0 {
+		s.users.Invalidate(userIDs...)
+		s.logger.With(ctx).Infof("expired %d credit lots", len(userIDs))
+	}
+	return nil
+}
+
+// GrantAllowance implements Service.
+func (s service) GrantAllowance(ctx context.Context, userID string) error {
+	subscribers, err := s.repo.ListDueSubscribers(ctx, s.allowancePlans(), allowancePeriods(), []string{userID}, 1)
+	if err != nil {
+		return err
+	}
+	for _, subscriber := range subscribers {
+		if err := s.grantAllowance(ctx, subscriber); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GrantAllowances implements Service.
+func (s service) GrantAllowances(ctx context.Context) error {
+	subscribers, err := s.repo.ListDueSubscribers(ctx, s.allowancePlans(), allowancePeriods(), nil, allowanceBatchSize)
+	if err != nil {
+		return err
+	}
+
+	granted := 0
+	for _, subscriber := range subscribers {
+		if err := s.grantAllowance(ctx, subscriber); err != nil {
+			return err
+		}
+		granted++
+	}
+	if granted > 0 {
+		s.logger.With(ctx).Infof("granted %d credit allowances", granted)
+	}
+	return nil
+}
+
+// grantAllowance grants the allowance of the current period of the subscription.
+// The allowance is recorded along with its lot, and a period which has already been granted,
+// e.g. by another server instance, is skipped. The cached user is invalidated once the grant is committed.
+func (s service) grantAllowance(ctx context.Context, subscriber Subscriber) error {
+	allowance := s.allowances[subscriber.Plan]
+	start, end, ok := allowancePeriod(entity.SubscriptionPlanPeriod(subscriber.Period), subscriber.ExpiresAt, time.Now())
+	if allowance.Credits <= 0 || !ok {
+		return nil
+	}
+
+	granted := false
+	err := s.transact(ctx, func(ctx context.Context) error {
+		record := entity.CreditAllowance{
+			ID:          uuid.New().String(),
+			UserID:      subscriber.UserID,
+			Plan:        subscriber.Plan,
+			PeriodStart: start,
+			PeriodEnd:   end,
+			Credits:     allowance.Credits,
+			CreatedAt:   time.Now(),
+		}
+		created, err := s.repo.CreateAllowance(ctx, record)
+		if err != nil || !created {
+			return err
+		}
+
+		var expiresAt *time.Time
+		if !allowance.Rollover {
+			expiresAt = &end
+		}
+		_, err = s.grant(ctx, subscriber.UserID, entity.CreditTransactionGrant, allowance.Credits, expiresAt, allowanceReason, record.ID)
+		granted = err == nil
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the user cached before the commit would still have the previous balance
+	if granted {
+		s.users.Invalidate(subscriber.UserID)
+	}
+	return nil
+}
+
+// allowancePlans returns the subscription plans which give an allowance.
+func (s service) allowancePlans() []string {
+	var plans []string
+	for plan, allowance := range s.allowances {
+		if allowance.Credits > 0 {
+			plans = append(plans, plan)
+		}
+	}
+	return plans
+}
+
+// periodLengths are the lengths of the subscription periods which give an allowance, in calendar months and days.
+var periodLengths = map[entity.SubscriptionPlanPeriod]struct{ months, days int }{
+	entity.SubscriptionPlanPeriod1W: {days: 7},
+	entity.SubscriptionPlanPeriod1M: {months: 1},
+	entity.SubscriptionPlanPeriod6M: {months: 6},
+	entity.SubscriptionPlanPeriod1Y: {months: 12},
+}
+
+// allowancePeriods returns the subscription periods which give an allowance.
+func allowancePeriods() []string {
+	periods := make([]string, 0, len(periodLengths))
+	for period := range periodLengths {
+		periods = append(periods, string(period))
+	}
+	return periods
+}
+
+// allowancePeriod returns the allowance period of a subscription the given time is in.
+// The periods are the terms of the subscription: they end with the expiry of the subscription and go back by
+// calendar months, as the stores renew subscriptions, so that a term is granted once whatever the length of its months,
+// and a renewal starts a new period. The periods of a subscription without an expiry are counted from the Unix epoch.
+func allowancePeriod(period entity.SubscriptionPlanPeriod, expiresAt *time.Time, now time.Time) (time.Time, time.Time, bool) {
+	length, ok := periodLengths[period]
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	anchor := time.Unix(0, 0).UTC()
+	if expiresAt != nil {
+		anchor = *expiresAt
+	}
+	shift := func(n int) time.Time {
+		if length.months == 0 {
+			return anchor.AddDate(0, 0, n*length.days)
+		}
+		return addMonths(anchor, n*length.months)
+	}
+
+	// estimate the number of periods between the anchor and now, then correct it as the months differ in length
+	approx := time.Duration(length.months*30+length.days) * 24 * time.Hour
+	n := int(now.Sub(anchor) / approx)
+	for shift(n).After(now) {
+		n--
+	}
+	for !shift(n + 1).After(now) {
+		n++
+	}
+	return shift(n), shift(n + 1), true
+}
+
+// addMonths adds the given number of months to a time. Unlike time.AddDate, the day is clamped to the end
+// of a shorter month instead of overflowing into the next one, e.g. a month before March 31 is February 28.
+func addMonths(t time.Time, months int) time.Time {
+	year, month, day := t.Date()
+	first := time.Date(year, month+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	if last := first.AddDate(0, 1, -1).Day(); day > last {
+		day = last
+	}
+	return first.AddDate(0, 0, day-1)
+}
+
+func nullIfEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
@@ -0,0 +1,246 @@
+package credit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 12, 0, 0, 0, time.UTC)
+}
+
+func TestAllowancePeriod(t *testing.T) {
+	tests := []struct {
+		name      string
+		period    entity.SubscriptionPlanPeriod
+		expiresAt time.Time
+		now       time.Time
+		start     time.Time
+		end       time.Time
+	}{
+		{"yearly term", entity.SubscriptionPlanPeriod1Y, date(2027, 1, 10), date(2026, 1, 10), date(2026, 1, 10), date(2027, 1, 10)},
+		{"end of yearly term", entity.SubscriptionPlanPeriod1Y, date(2027, 1, 10), date(2027, 1, 5), date(2026, 1, 10), date(2027, 1, 10)},
+		{"31-day month", entity.SubscriptionPlanPeriod1M, date(2026, 8, 15), date(2026, 7, 16), date(2026, 7, 15), date(2026, 8, 15)},
+		{"end of month", entity.SubscriptionPlanPeriod1M, date(2026, 3, 31), date(2026, 3, 1), date(2026, 2, 28), date(2026, 3, 31)},
+		{"prepaid months", entity.SubscriptionPlanPeriod1M, date(2026, 12, 31), date(2026, 10, 1), date(2026, 9, 30), date(2026, 10, 31)},
+		{"half year", entity.SubscriptionPlanPeriod6M, date(2026, 8, 31), date(2026, 3, 1), date(2026, 2, 28), date(2026, 8, 31)},
+		{"week", entity.SubscriptionPlanPeriod1W, date(2026, 1, 15), date(2026, 1, 8), date(2026, 1, 8), date(2026, 1, 15)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end, ok := allowancePeriod(tc.period, &tc.expiresAt, tc.now)
+			assert.True(t, ok)
+			assert.Equal(t, tc.start, start)
+			assert.Equal(t, tc.end, end)
+		})
+	}
+}
+
+func TestAllowancePeriod_Renewal(t *testing.T) {
+	// the allowance of a term is not granted again until the subscription renews
+	expiresAt := date(2027, 1, 10)
+	start, _, _ := allowancePeriod(entity.SubscriptionPlanPeriod1Y, &expiresAt, date(2026, 1, 10))
+	for now := date(2026, 1, 10); now.Before(expiresAt); now = now.AddDate(0, 0, 1) {
+		s, _, _ := allowancePeriod(entity.SubscriptionPlanPeriod1Y, &expiresAt, now)
+		assert.Equal(t, start, s)
+	}
+
+	renewed := date(2028, 1, 10)
+	s, e, _ := allowancePeriod(entity.SubscriptionPlanPeriod1Y, &renewed, expiresAt)
+	assert.Equal(t, expiresAt, s)
+	assert.Equal(t, renewed, e)
+}
+
+func TestAllowancePeriod_NoExpiry(t *testing.T) {
+	now := date(2026, 10, 17)
+	start, end, ok := allowancePeriod(entity.SubscriptionPlanPeriod1M, nil, now)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), start)
+	assert.Equal(t, time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC), end)
+}
+
+func TestAllowancePeriod_UnknownPeriod(t *testing.T) {
+	expiresAt := date(2027, 1, 10)
+	_, _, ok := allowancePeriod("lifetime", &expiresAt, date(2026, 1, 10))
+	assert.False(t, ok)
+}
+
+// mockRepository keeps the allowances and the lots in memory.
+type mockRepository struct {
+	Repository
+	subscribers []Subscriber
+	allowances  map[string]bool
+	lots        []entity.CreditTransaction
+}
+
+func (r *mockRepository) ListDueSubscribers(context.Context, []string, []string, []string, int) ([]Subscriber, error) {
+	return r.subscribers, nil
+}
+
+func (r *mockRepository) CreateAllowance(_ context.Context, allowance entity.CreditAllowance) (bool, error) {
+	key := allowance.UserID + allowance.PeriodStart.String()
+	if r.allowances[key] {
+		return false, nil
+	}
+	r.allowances[key] = true
+	return true, nil
+}
+
+func (r *mockRepository) CreateTransaction(_ context.Context, transaction entity.CreditTransaction) error {
+	r.lots = append(r.lots, transaction)
+	return nil
+}
+
+// mockTransactor runs the functions as transactions and tells whether one is running.
+type mockTransactor struct {
+	active bool
+}
+
+func (m *mockTransactor) transact(ctx context.Context, f func(ctx context.Context) error) error {
+	m.active = true
+	defer func() { m.active = false }()
+	return f(ctx)
+}
+
+// mockCache records the users invalidated after the transactions have been committed.
+type mockCache struct {
+	auth.UserCache
+	tx          *mockTransactor
+	invalidated []string
+}
+
+func (c *mockCache) Invalidate(userIDs ...string) {
+	if !c.tx.active {
+		c.invalidated = append(c.invalidated, userIDs...)
+	}
+}
+
+func TestService_GrantAllowances(t *testing.T) {
+	logger, _ := log.NewForTest()
+	expiresAt := time.Now().AddDate(0, 1, 0)
+	repo := &mockRepository{
+		subscribers: []Subscriber{{UserID: "user1", Plan: "pro", Period: string(entity.SubscriptionPlanPeriod1M), ExpiresAt: &expiresAt}},
+		allowances:  map[string]bool{},
+	}
+	tx := &mockTransactor{}
+	cache := &mockCache{tx: tx}
+	s := NewService(repo, tx.transact, map[string]Allowance{"pro": {Credits: 100}}, cache, logger)
+
+	assert.NoError(t, s.GrantAllowances(context.Background()))
+	if assert.Len(t, repo.lots, 1) {
+		assert.Equal(t, 100, repo.lots[0].Amount)
+	}
+	assert.Equal(t, []string{"user1"}, cache.invalidated)
+
+	// the period has been granted already
+	assert.NoError(t, s.GrantAllowances(context.Background()))
+	assert.Len(t, repo.lots, 1)
+	assert.Equal(t, []string{"user1"}, cache.invalidated)
+}
+
+func (r *mockRepository) LockLots(_ context.Context, userID string) ([]entity.CreditTransaction, error) {
+	var lots []entity.CreditTransaction
+	for _, lot := range r.lots {
+		if lot.UserID == userID && lot.IsLot() && *lot.Remaining > 0 {
+			lots = append(lots, lot)
+		}
+	}
+	return lots, nil
+}
+
+func (r *mockRepository) AddRemaining(_ context.Context, lotID string, credits int) error {
+	for _, lot := range r.lots {
+		if lot.ID == lotID {
+			*lot.Remaining += credits
+		}
+	}
+	return nil
+}
+
+func (r *mockRepository) LockConsumptions(_ context.Context, userID, reference string) ([]entity.CreditTransaction, error) {
+	return r.transactions(userID, entity.CreditTransactionConsume, reference), nil
+}
+
+func (r *mockRepository) HasRefund(_ context.Context, userID, reference string) (bool, error) {
+	return len(r.transactions(userID, entity.CreditTransactionRefund, reference)) > 0, nil
+}
+
+func (r *mockRepository) GetBalance(_ context.Context, userID string) (int, error) {
+	balance := 0
+	for _, lot := range r.lots {
+		if lot.UserID == userID && lot.IsLot() {
+			balance += *lot.Remaining
+		}
+	}
+	return balance, nil
+}
+
+// transactions returns the transactions of the user with the given type and reference.
+func (r *mockRepository) transactions(userID string, transactionType entity.CreditTransactionType, reference string) []entity.CreditTransaction {
+	var transactions []entity.CreditTransaction
+	for _, transaction := range r.lots {
+		if transaction.UserID == userID && transaction.Type == string(transactionType) &&
+			transaction.Reference != nil && *transaction.Reference == reference {
+			transactions = append(transactions, transaction)
+		}
+	}
+	return transactions
+}
+
+func TestService_ConsumeAndRefund(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := &mockRepository{}
+	tx := &mockTransactor{}
+	cache := &mockCache{tx: tx}
+	s := NewService(repo, tx.transact, nil, cache, logger)
+	ctx := context.Background()
+
+	expiresAt := time.Now().Add(time.Hour)
+	first, err := s.Grant(ctx, "user1", 30, &expiresAt, "promo", "")
+	assert.NoError(t, err)
+	second, err := s.Grant(ctx, "user1", 50, nil, "purchase", "")
+	assert.NoError(t, err)
+	_, err = s.Grant(ctx, "user2", 100, nil, "purchase", "")
+	assert.NoError(t, err)
+	_, err = s.Grant(ctx, "user1", 0, nil, "purchase", "")
+	assert.Error(t, err)
+
+	// the credits are taken from the lots in the order they are locked
+	debits, err := s.Consume(ctx, "user1", 40, "image", "job1")
+	if assert.NoError(t, err) && assert.Len(t, debits, 2) {
+		assert.Equal(t, -30, debits[0].Amount)
+		assert.Equal(t, first.ID, *debits[0].LotID)
+		assert.Equal(t, -10, debits[1].Amount)
+		assert.Equal(t, second.ID, *debits[1].LotID)
+	}
+	balance, _ := s.GetBalance(ctx, "user1")
+	assert.Equal(t, 40, balance)
+
+	_, err = s.Consume(ctx, "user1", 41, "image", "job2")
+	assert.Equal(t, ErrInsufficientCredits, err)
+	balance, _ = s.GetBalance(ctx, "user1")
+	assert.Equal(t, 40, balance)
+
+	// the credits go back to their lots once
+	refunded, err := s.Refund(ctx, "user1", "job1")
+	assert.NoError(t, err)
+	assert.Equal(t, 40, refunded)
+	assert.Equal(t, 30, *first.Remaining)
+	assert.Equal(t, 50, *second.Remaining)
+	refunded, err = s.Refund(ctx, "user1", "job1")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, refunded)
+	refunded, err = s.Refund(ctx, "user1", "unknown")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, refunded)
+
+	balance, _ = s.GetBalance(ctx, "user2")
+	assert.Equal(t, 100, balance)
+	assert.Equal(t, []string{"user1", "user1", "user2", "user1", "user1", "user1", "user1"}, cache.invalidated)
+}
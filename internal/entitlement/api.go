@@ -0,0 +1,42 @@
+package entitlement
+
+import (
+	"sort"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers.
+func RegisterHandlers(rg *routing.RouteGroup, checker Checker, authHandler routing.Handler, logger log.Logger) {
+	res := resource{checker, logger}
+
+	rg.Use(authHandler)
+
+	// the following endpoints require a valid JWT
+	rg.Get("/entitlements", res.list)
+}
+
+type resource struct {
+	checker Checker
+	logger  log.Logger
+}
+
+// list returns the entitlements of the current user to all the features, so that the app knows the paywalls up front.
+func (r resource) list(c *routing.Context) error {
+	user := auth.CurrentUser(c.Request.Context())
+	if user == nil {
+		return errors.Unauthorized("")
+	}
+
+	entitlements := []Entitlement{}
+	for name := range r.checker.features {
+		entitlements = append(entitlements, r.checker.Check(*user, name))
+	}
+	sort.Slice(entitlements, func(i, j int) bool {
+		return entitlements[i].Feature < entitlements[j].Feature
+	})
+	return c.Write(entitlements)
+}
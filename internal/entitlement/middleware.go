@@ -0,0 +1,153 @@
+package entitlement
+
+import (
+	"context"
+	stderr "errors"
+	"fmt"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/google/uuid"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// The error codes telling the app which paywall to show.
+const (
+	ErrorSubscriptionRequired = "subscription_required"
+	ErrorInsufficientCredits  = "insufficient_credits"
+)
+
+// Feature is what a user needs to use a feature of the app.
+// The subscribers of one of the plans use the feature for free, while the other users pay its credits.
+// A feature with plans and without credits is only available to the subscribers.
+type Feature struct {
+	// Plans are the subscription plans which give the feature.
+	Plans []string
+	// Credits is the number of credits a request using the feature costs the users without one of the plans.
+	Credits int
+}
+
+// Entitlement tells whether a user can use a feature and what it costs them.
+type Entitlement struct {
+	Feature string `json:"feature"`
+	Allowed bool   `json:"allowed"`
+	// Credits is the number of credits a request using the feature costs the user.
+	Credits int `json:"credits"`
+	// ErrorCode tells why the feature is not allowed.
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// Checker gates the features on the subscription and the credits of the current user.
+type Checker struct {
+	features    map[string]Feature
+	graceAccess bool
+	credits     credit.Service
+	logger      log.Logger
+}
+
+// NewChecker creates a checker of the given features, keyed by the feature name. If graceAccess is set,
+// a subscription with a billing issue gives access to its plan during its grace period.
+func NewChecker(features map[string]Feature, graceAccess bool, credits credit.Service, logger log.Logger) Checker {
+	return Checker{features, graceAccess, credits, logger}
+}
+
+// Check returns the entitlement of the user to the feature. The credits are checked against the balance
+// the user has been loaded with, which may be stale, so it only tells the app which paywall to show:
+// RequireEntitlement lets the reservation of the credits decide.
+func (ch Checker) Check(user entity.User, name string) Entitlement {
+	entitlement := ch.cost(user, name)
+	if entitlement.Allowed && entitlement.Credits > user.Credits {
+		entitlement.Allowed = false
+		entitlement.ErrorCode = ErrorInsufficientCredits
+	}
+	return entitlement
+}
+
+// cost returns the entitlement of the user to the feature regardless of the balance of the user:
+// either the feature is allowed for the credits it costs the user, or it requires a subscription.
+func (ch Checker) cost(user entity.User, name string) Entitlement {
+	entitlement := Entitlement{Feature: name}
+	feature, ok := ch.features[name]
+	switch {
+	case !ok:
+		entitlement.ErrorCode = ErrorSubscriptionRequired
+	case hasPlan(user.Subscription, feature.Plans, ch.graceAccess):
+		entitlement.Allowed = true
+	case feature.Credits == 0 && len(feature.Plans) > 0:
+		entitlement.ErrorCode = ErrorSubscriptionRequired
+	default:
+		entitlement.Allowed = true
+		entitlement.Credits = feature.Credits
+	}
+	return entitlement
+}
+
+// RequireEntitlement returns a middleware that only lets the users entitled to the feature through.
+// It must be used after the authentication middleware. The credits of the feature are reserved before
+// the request is handled, and released if the handler fails.
+// It panics if the feature is not configured, so that a missing entitlement shows up at startup.
+func (ch Checker) RequireEntitlement(name string) routing.Handler {
+	if _, ok := ch.features[name]; !ok {
+		panic(fmt.Sprintf("entitlement: unknown feature %q", name))
+	}
+
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		user := auth.CurrentUser(ctx)
+		if user == nil {
+			return errors.Unauthorized("")
+		}
+
+		entitlement := ch.cost(*user, name)
+		if !entitlement.Allowed {
+			return errors.ForbiddenWithCode("A subscription is required to use this feature.", ErrorSubscriptionRequired)
+		}
+		if entitlement.Credits == 0 {
+			return nil
+		}
+
+		// the cached balance of the user may be stale, so the reservation decides whether the user has enough credits
+		reference := "request:" + uuid.New().String()
+		if _, err := ch.credits.Consume(ctx, user.ID, entitlement.Credits, "feature:"+name, reference); stderr.Is(err, credit.ErrInsufficientCredits) {
+			return errors.PaymentRequired("You do not have enough credits to use this feature.", ErrorInsufficientCredits)
+		} else if err != nil {
+			return err
+		}
+
+		handled := false
+		defer func() {
+			if !handled {
+				ch.release(ctx, user.ID, reference)
+			}
+		}()
+		err := c.Next()
+		handled = err == nil
+		return err
+	}
+}
+
+// release refunds the credits reserved for a request which has failed. The refund is not canceled along with the request.
+func (ch Checker) release(ctx context.Context, userID, reference string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if _, err := ch.credits.Refund(ctx, userID, reference); err != nil {
+		ch.logger.With(ctx).Errorf("There is an error while releasing the credits reserved for %s %v", reference, err)
+	}
+}
+
+// hasPlan returns whether the subscription is one of the plans and gives access to it.
+func hasPlan(subscription *entity.Subscription, plans []string, graceAccess bool) bool {
+	if !subscription.HasAccess(graceAccess) {
+		return false
+	}
+	for _, plan := range plans {
+		if subscription.Plan == plan {
+			return true
+		}
+	}
+	return false
+}
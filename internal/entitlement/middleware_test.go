@@ -0,0 +1,137 @@
+package entitlement
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/internal/test"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockCredits keeps the balance of a single user in memory.
+type mockCredits struct {
+	credit.Service
+	balance  int
+	reserved map[string]int
+}
+
+func (m *mockCredits) Consume(_ context.Context, _ string, amount int, _, reference string) ([]entity.CreditTransaction, error) {
+	if m.balance < amount {
+		return nil, credit.ErrInsufficientCredits
+	}
+	m.balance -= amount
+	m.reserved[reference] += amount
+	return nil, nil
+}
+
+func (m *mockCredits) Refund(_ context.Context, _ string, reference string) (int, error) {
+	refunded := m.reserved[reference]
+	m.balance += refunded
+	delete(m.reserved, reference)
+	return refunded, nil
+}
+
+// withUser returns a middleware standing in for the authentication middleware. The requests with an X-User header
+// are authenticated as the user with the plan given in the X-Plan header, if any.
+func withUser() routing.Handler {
+	return func(c *routing.Context) error {
+		id := c.Request.Header.Get("X-User")
+		if id == "" {
+			return errors.Unauthorized("")
+		}
+		user := entity.User{ID: id}
+		if plan := c.Request.Header.Get("X-Plan"); plan != "" {
+			expiresAt := time.Now().Add(time.Hour)
+			user.Subscription = &entity.Subscription{Plan: plan, Status: string(entity.SubscriptionStatusActive), ExpiresAt: &expiresAt}
+		}
+		c.Request = c.Request.WithContext(auth.WithUser(c.Request.Context(), user))
+		return nil
+	}
+}
+
+func TestRequireEntitlement(t *testing.T) {
+	logger, _ := log.NewForTest()
+	credits := &mockCredits{balance: 10, reserved: map[string]int{}}
+	checker := NewChecker(map[string]Feature{
+		"generate": {Plans: []string{"pro"}, Credits: 5},
+		"hd":       {Plans: []string{"pro"}},
+	}, true, credits, logger)
+
+	router := test.MockRouter(logger)
+	rg := router.Group("")
+	rg.Use(withUser())
+	rg.Post("/generate", checker.RequireEntitlement("generate"), func(c *routing.Context) error {
+		return c.Write("ok")
+	})
+	rg.Post("/generate/fail", checker.RequireEntitlement("generate"), func(c *routing.Context) error {
+		return errors.InternalServerError("")
+	})
+	rg.Post("/hd", checker.RequireEntitlement("hd"), func(c *routing.Context) error {
+		return c.Write("ok")
+	})
+
+	header := func(plan string) http.Header {
+		h := http.Header{}
+		h.Set("X-User", "user1")
+		if plan != "" {
+			h.Set("X-Plan", plan)
+		}
+		return h
+	}
+	// the balance starts at 10 credits, and every generation costs 5 of them. The users are authenticated
+	// with no credits, as a stale cached user would be, so that the reservation alone decides
+	tests := []test.APITestCase{
+		{Name: "unauthenticated", Method: "POST", URL: "/generate", WantStatus: http.StatusUnauthorized},
+		{Name: "subscription required", Method: "POST", URL: "/hd", Header: header(""),
+			WantStatus: http.StatusForbidden, WantResponse: `*"error_code":"subscription_required"*`},
+		{Name: "subscriber", Method: "POST", URL: "/hd", Header: header("pro"), WantStatus: http.StatusOK},
+		{Name: "subscriber pays no credits", Method: "POST", URL: "/generate", Header: header("pro"), WantStatus: http.StatusOK},
+		{Name: "credits released on failure", Method: "POST", URL: "/generate/fail", Header: header(""), WantStatus: http.StatusInternalServerError},
+		{Name: "credits reserved", Method: "POST", URL: "/generate", Header: header(""), WantStatus: http.StatusOK},
+		{Name: "credits reserved again", Method: "POST", URL: "/generate", Header: header(""), WantStatus: http.StatusOK},
+		{Name: "insufficient credits", Method: "POST", URL: "/generate", Header: header(""),
+			WantStatus: http.StatusPaymentRequired, WantResponse: `*"error_code":"insufficient_credits"*`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+	assert.Equal(t, 0, credits.balance)
+	assert.Len(t, credits.reserved, 2)
+}
+
+func TestChecker_Check(t *testing.T) {
+	logger, _ := log.NewForTest()
+	checker := NewChecker(map[string]Feature{
+		"generate": {Plans: []string{"pro"}, Credits: 5},
+		"hd":       {Plans: []string{"pro"}},
+	}, true, nil, logger)
+	expiresAt := time.Now().Add(time.Hour)
+	subscriber := entity.User{Subscription: &entity.Subscription{Plan: "pro", Status: string(entity.SubscriptionStatusActive), ExpiresAt: &expiresAt}}
+
+	tests := []struct {
+		name    string
+		user    entity.User
+		feature string
+		want    Entitlement
+	}{
+		{"subscriber", subscriber, "hd", Entitlement{Feature: "hd", Allowed: true}},
+		{"subscription required", entity.User{}, "hd", Entitlement{Feature: "hd", ErrorCode: ErrorSubscriptionRequired}},
+		{"unknown feature", subscriber, "unknown", Entitlement{Feature: "unknown", ErrorCode: ErrorSubscriptionRequired}},
+		{"subscriber pays no credits", subscriber, "generate", Entitlement{Feature: "generate", Allowed: true}},
+		{"enough credits", entity.User{Credits: 5}, "generate", Entitlement{Feature: "generate", Allowed: true, Credits: 5}},
+		{"insufficient credits", entity.User{Credits: 4}, "generate", Entitlement{Feature: "generate", Credits: 5, ErrorCode: ErrorInsufficientCredits}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, checker.Check(tc.user, tc.feature))
+		})
+	}
+}
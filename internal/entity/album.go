@@ -8,6 +8,7 @@ import (
 type Album struct {
 	ID        string    `json:"id"`
 	Name      string    `json:"name"`
+	UserID    *string   `json:"-"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
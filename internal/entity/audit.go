@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+// Outcomes of an authentication event.
+const (
+	AuthEventOutcomeSuccess = "success"
+	AuthEventOutcomeFailure = "failure"
+)
+
+// AuthEvent is an entry of the security audit log of authentication events.
+type AuthEvent struct {
+	ID            string    `json:"id" db:"id"`
+	Type          string    `json:"type" db:"type"`
+	UserID        *string   `json:"user_id" db:"user_id"`
+	DeviceKeyHash *string   `json:"device_key_hash" db:"device_key_hash"`
+	IP            *string   `json:"ip" db:"ip"`
+	UserAgent     *string   `json:"user_agent" db:"user_agent"`
+	RequestID     *string   `json:"request_id" db:"request_id"`
+	Outcome       string    `json:"outcome" db:"outcome"`
+	Reason        *string   `json:"reason" db:"reason"`
+	Details       *string   `json:"details" db:"details"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
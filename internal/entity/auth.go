@@ -1,14 +1,65 @@
 package entity
 
+import "time"
+
 type AuthMethod string
 
 const (
 	AuthMethodAnonymous AuthMethod = "anonymous"
 	AuthMethodGoogle    AuthMethod = "google"
 	AuthMethodApple     AuthMethod = "apple"
+	AuthMethodPassword  AuthMethod = "password"
 )
 
 type AuthTokens struct {
 	RefreshToken string `json:"refresh_token"`
 	AccessToken  string `json:"access_token"`
 }
+
+// Credential represents the username and password a user signs in with.
+type Credential struct {
+	UserID         string     `db:"user_id"`
+	Username       string     `db:"username"`
+	PasswordHash   string     `db:"password_hash"`
+	FailedAttempts int        `db:"failed_attempts"`
+	LockedUntil    *time.Time `db:"locked_until"`
+}
+
+// IsLocked returns whether the credential is locked because of repeated failed login attempts.
+func (c Credential) IsLocked() bool {
+	return c.LockedUntil != nil && c.LockedUntil.After(time.Now())
+}
+
+// RefreshToken represents a stored refresh token. Tokens rotated from the same login share a family.
+type RefreshToken struct {
+	ID         string     `db:"id"`
+	UserID     string     `db:"user_id"`
+	FamilyID   string     `db:"family_id"`
+	ParentID   *string    `db:"parent_id"`
+	DeviceKey  string     `db:"device_key"`
+	DeviceName *string    `db:"device_name"`
+	Platform   *string    `db:"platform"`
+	CreatedAt  time.Time  `db:"created_at"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+	// Rotated tells whether the token has been revoked because it has been exchanged for a new one.
+	Rotated bool `db:"rotated"`
+}
+
+// Device represents the device a session is created on.
+// The name and the platform are optionally reported by the client.
+type Device struct {
+	Key      string
+	Name     string
+	Platform string
+}
+
+// Session represents a logged in device, i.e. the family of refresh tokens rotated from one login.
+type Session struct {
+	ID         string    `json:"id" db:"id"`
+	DeviceName *string   `json:"device_name" db:"device_name"`
+	Platform   *string   `json:"platform" db:"platform"`
+	CreatedAt  time.Time `json:"created_at" db:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at" db:"last_used_at"`
+	Current    bool      `json:"current" db:"-"`
+}
@@ -0,0 +1,53 @@
+package entity
+
+import "time"
+
+type CreditTransactionType string
+
+const (
+	// CreditTransactionGrant adds credits to the balance, e.g. the signup bonus or a purchase.
+	CreditTransactionGrant CreditTransactionType = "grant"
+	// CreditTransactionConsume takes credits from a lot when they are spent.
+	CreditTransactionConsume CreditTransactionType = "consume"
+	// CreditTransactionRefund gives consumed credits back to the lot they were taken from.
+	CreditTransactionRefund CreditTransactionType = "refund"
+	// CreditTransactionExpire removes the credits remaining in a lot when the lot expires.
+	CreditTransactionExpire CreditTransactionType = "expire"
+	// CreditTransactionAdjustment is a correction made by an admin. A positive adjustment is a new lot.
+	CreditTransactionAdjustment CreditTransactionType = "adjustment"
+	// CreditTransactionRevoke removes the credits remaining in a lot whose grant has been taken back, e.g. a canceled purchase.
+	CreditTransactionRevoke CreditTransactionType = "revoke"
+)
+
+// CreditTransaction is an entry of the credit ledger of a user.
+// Grants and positive adjustments are lots: they keep track of the credits remaining in them
+// and may expire. The other entries refer to the lot whose credits they change.
+type CreditTransaction struct {
+	ID        string     `json:"id" db:"id"`
+	UserID    string     `json:"-" db:"user_id"`
+	Type      string     `json:"type" db:"type"`
+	Amount    int        `json:"amount" db:"amount"`
+	LotID     *string    `json:"lot_id,omitempty" db:"lot_id"`
+	Remaining *int       `json:"remaining,omitempty" db:"remaining"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	Reason    string     `json:"reason" db:"reason"`
+	Reference *string    `json:"reference,omitempty" db:"reference"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+}
+
+// IsLot tells whether the transaction is a lot of credits.
+func (t CreditTransaction) IsLot() bool {
+	return t.Remaining != nil
+}
+
+// CreditAllowance is the allowance of credits granted to a subscriber for a period of their subscription.
+// The lot of the allowance refers to it by its ID.
+type CreditAllowance struct {
+	ID          string    `json:"id" db:"id"`
+	UserID      string    `json:"-" db:"user_id"`
+	Plan        string    `json:"plan" db:"plan"`
+	PeriodStart time.Time `json:"period_start" db:"period_start"`
+	PeriodEnd   time.Time `json:"period_end" db:"period_end"`
+	Credits     int       `json:"credits" db:"credits"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+}
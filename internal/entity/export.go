@@ -0,0 +1,28 @@
+package entity
+
+import "time"
+
+type ExportStatus string
+
+const (
+	ExportStatusPending   ExportStatus = "pending"
+	ExportStatusRunning   ExportStatus = "running"
+	ExportStatusCompleted ExportStatus = "completed"
+	ExportStatusFailed    ExportStatus = "failed"
+	ExportStatusExpired   ExportStatus = "expired"
+)
+
+// ExportJob represents a request of a user to export their personal data.
+type ExportJob struct {
+	ID          string     `json:"id" db:"id"`
+	UserID      string     `json:"-" db:"user_id"`
+	Status      string     `json:"status" db:"status"`
+	FileID      *string    `json:"-" db:"file_id"`
+	Error       *string    `json:"-" db:"error"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	StartedAt   *time.Time `json:"started_at" db:"started_at"`
+	CompletedAt *time.Time `json:"completed_at" db:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at" db:"expires_at"`
+	// DownloadURL is a short-lived link to the export archive. It is only set for completed exports.
+	DownloadURL string `json:"download_url,omitempty" db:"-"`
+}
@@ -19,6 +19,8 @@ func (f File) GetExtension() string {
 		return ".png"
 	case "image/jpeg":
 		return ".jpg"
+	case "application/zip":
+		return ".zip"
 	default:
 		return ""
 	}
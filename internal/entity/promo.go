@@ -0,0 +1,33 @@
+package entity
+
+import "time"
+
+// PromoCode is a code users redeem for credits, a promotional subscription or both.
+type PromoCode struct {
+	ID       string  `json:"id" db:"id"`
+	Code     string  `json:"code" db:"code"`
+	Campaign *string `json:"campaign" db:"campaign"`
+	Credits  int     `json:"credits" db:"credits"`
+	// SubscriptionPlan is the plan of the promotional subscription given for SubscriptionDays days, if any.
+	SubscriptionPlan *string `json:"subscription_plan" db:"subscription_plan"`
+	SubscriptionDays int     `json:"subscription_days" db:"subscription_days"`
+	// MaxRedemptions is the number of times the code can be redeemed by all users. Nil means no limit.
+	MaxRedemptions *int `json:"max_redemptions" db:"max_redemptions"`
+	// PerUserLimit is the number of times a user can redeem the code.
+	PerUserLimit int        `json:"per_user_limit" db:"per_user_limit"`
+	Redemptions  int        `json:"redemptions" db:"redemptions"`
+	StartsAt     *time.Time `json:"starts_at" db:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at" db:"ends_at"`
+	CreatedBy    *string    `json:"created_by" db:"created_by"`
+	CreatedAt    time.Time  `json:"created_at" db:"created_at"`
+}
+
+// PromoRedemption is the redemption of a promo code by a user.
+type PromoRedemption struct {
+	ID                    string     `json:"id" db:"id"`
+	CodeID                string     `json:"code_id" db:"code_id"`
+	UserID                string     `json:"-" db:"user_id"`
+	Credits               int        `json:"credits" db:"credits"`
+	SubscriptionExpiresAt *time.Time `json:"subscription_expires_at" db:"subscription_expires_at"`
+	CreatedAt             time.Time  `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,15 @@
+package entity
+
+import "time"
+
+// StorePurchase is a one-time purchase made in a store which has been credited to a user.
+// The transaction ID is unique per provider, so that a purchase is credited only once.
+type StorePurchase struct {
+	ID            string    `json:"id" db:"id"`
+	Provider      string    `json:"provider" db:"provider"`
+	TransactionID string    `json:"transaction_id" db:"transaction_id"`
+	UserID        string    `json:"-" db:"user_id"`
+	ProductID     string    `json:"product_id" db:"product_id"`
+	Credits       int       `json:"credits" db:"credits"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
@@ -0,0 +1,28 @@
+package entity
+
+import "time"
+
+type ReferralStatus string
+
+const (
+	// ReferralStatusPending is the status of a referral whose referee has not completed a qualifying action yet.
+	ReferralStatusPending ReferralStatus = "pending"
+	// ReferralStatusRewarded is the status of a referral whose rewards have been granted.
+	ReferralStatusRewarded ReferralStatus = "rewarded"
+	// ReferralStatusRejected is the status of a referral which has failed the fraud checks. It is never rewarded.
+	ReferralStatusRejected ReferralStatus = "rejected"
+)
+
+// Referral is the redemption of the referral code of a user, the referrer, by a new user, the referee.
+type Referral struct {
+	ID              string     `json:"id" db:"id"`
+	ReferrerID      string     `json:"referrer_id" db:"referrer_id"`
+	RefereeID       string     `json:"referee_id" db:"referee_id"`
+	Status          string     `json:"status" db:"status"`
+	Reason          *string    `json:"reason" db:"reason"`
+	ReferrerCredits int        `json:"referrer_credits" db:"referrer_credits"`
+	RefereeCredits  int        `json:"referee_credits" db:"referee_credits"`
+	IP              *string    `json:"-" db:"ip"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	RewardedAt      *time.Time `json:"rewarded_at" db:"rewarded_at"`
+}
@@ -0,0 +1,27 @@
+package entity
+
+import "time"
+
+type SubscriptionEventType string
+
+const (
+	// SubscriptionEventGracePeriodStarted is recorded when a subscription which is set to renew is not renewed
+	// by its expiry, or the store reports a billing issue without a grace period, and it gets a grace period.
+	SubscriptionEventGracePeriodStarted SubscriptionEventType = "grace_period_started"
+	// SubscriptionEventExpired is recorded when a subscription expires, e.g. at the end of its grace period.
+	SubscriptionEventExpired SubscriptionEventType = "expired"
+)
+
+// SubscriptionEvent is a lifecycle event of the subscription of a user, kept for notifications and analytics.
+// The subscription fields are the state of the subscription after the event.
+type SubscriptionEvent struct {
+	ID        string     `json:"id" db:"id"`
+	UserID    string     `json:"user_id" db:"user_id"`
+	Type      string     `json:"type" db:"type"`
+	Plan      *string    `json:"plan" db:"plan"`
+	Status    *string    `json:"status" db:"status"`
+	ExpiresAt *time.Time `json:"expires_at" db:"expires_at"`
+	// GraceExpiresAt is the end of the grace period of a subscription with a billing issue, if any.
+	GraceExpiresAt *time.Time `json:"grace_expires_at" db:"grace_expires_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+}
@@ -1,16 +1,37 @@
 package entity
 
+import "time"
+
 // User represents a user.
 type User struct {
 	ID           string        `json:"id"`
 	Name         string        `json:"name"`
+	Handle       string        `json:"handle"`
+	Locale       string        `json:"locale"`
+	AvatarURL    string        `json:"avatar_url"`
 	Credits      int           `json:"credits"`
 	Subscription *Subscription `json:"subscription"`
 	AuthMethod   string        `json:"auth_method"`
 	IsNewUser    bool          `json:"is_new_user"`
 	CustomerID   string        `json:"customer_id"`
+	Role         Role          `json:"role"`
 	FCMToken     string        `json:"-"`
 	AuthID       string        `json:"-"`
+	BannedAt     *time.Time    `json:"-"`
+}
+
+// Role determines what a user is authorized to do.
+type Role string
+
+const (
+	RoleUser    Role = "user"
+	RoleSupport Role = "support"
+	RoleAdmin   Role = "admin"
+)
+
+// IsValid returns whether the role is one of the known roles.
+func (r Role) IsValid() bool {
+	return r == RoleUser || r == RoleSupport || r == RoleAdmin
 }
 
 type SubscriptionType string
@@ -62,10 +83,47 @@ const (
 )
 
 type Subscription struct {
-	Plan   string `json:"plan"`
-	Type   string `json:"type"`
-	Period string `json:"period"`
-	Status string `json:"status"`
+	Plan      string     `json:"plan"`
+	Type      string     `json:"type"`
+	Period    string     `json:"period"`
+	Status    string     `json:"status"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// GraceExpiresAt is the end of the grace period of a subscription with a billing issue, if any.
+	GraceExpiresAt *time.Time `json:"grace_expires_at,omitempty"`
+}
+
+// EndsAt returns when the subscription ends: the end of its grace period if it has a billing issue, or else its expiry.
+// A nil time means the subscription does not end.
+func (s *Subscription) EndsAt() *time.Time {
+	if s.Status == string(SubscriptionStatusBillingIssue) && s.GraceExpiresAt != nil {
+		return s.GraceExpiresAt
+	}
+	return s.ExpiresAt
+}
+
+// HasAccess reports whether the subscription gives access to its plan: it is active and has not expired.
+// A subscription with a billing issue gives access until the end of its grace period if graceAccess is set.
+func (s *Subscription) HasAccess(graceAccess bool) bool {
+	if s == nil {
+		return false
+	}
+	if endsAt := s.EndsAt(); endsAt != nil && !endsAt.After(time.Now()) {
+		return false
+	}
+	return s.Status == string(SubscriptionStatusActive) ||
+		(graceAccess && s.Status == string(SubscriptionStatusBillingIssue))
+}
+
+// IsBetterThan reports whether the subscription should be preferred over the other one.
+// Any subscription is better than none, and a subscription without an expiry date outlives any other.
+func (s *Subscription) IsBetterThan(other *Subscription) bool {
+	if s == nil {
+		return false
+	}
+	if other == nil || s.ExpiresAt == nil {
+		return true
+	}
+	return other.ExpiresAt != nil && s.ExpiresAt.After(*other.ExpiresAt)
 }
 
 // GetID returns the user ID.
@@ -77,3 +135,23 @@ func (u User) GetID() string {
 func (u User) GetName() string {
 	return u.Name
 }
+
+// HasRole returns whether the user has one of the given roles.
+func (u User) HasRole(roles ...Role) bool {
+	for _, role := range roles {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBanned returns whether the user has been banned by an admin.
+func (u User) IsBanned() bool {
+	return u.BannedAt != nil
+}
+
+// IsAnonymous returns whether the user signed in only with a device key.
+func (u User) IsAnonymous() bool {
+	return u.AuthMethod == string(AuthMethodAnonymous)
+}
@@ -0,0 +1,35 @@
+package entity
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscription_HasAccess(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name         string
+		subscription *Subscription
+		graceAccess  bool
+		want         bool
+	}{
+		{"none", nil, true, false},
+		{"active", &Subscription{Status: string(SubscriptionStatusActive), ExpiresAt: &future}, false, true},
+		{"without expiry", &Subscription{Status: string(SubscriptionStatusActive)}, false, true},
+		{"expired", &Subscription{Status: string(SubscriptionStatusActive), ExpiresAt: &past}, true, false},
+		{"in grace period", &Subscription{Status: string(SubscriptionStatusBillingIssue), ExpiresAt: &past, GraceExpiresAt: &future}, true, true},
+		{"in grace period without grace access", &Subscription{Status: string(SubscriptionStatusBillingIssue), ExpiresAt: &past, GraceExpiresAt: &future}, false, false},
+		{"grace period ended", &Subscription{Status: string(SubscriptionStatusBillingIssue), ExpiresAt: &past, GraceExpiresAt: &past}, true, false},
+		{"billing issue without grace period", &Subscription{Status: string(SubscriptionStatusBillingIssue), ExpiresAt: &past}, true, false},
+		{"grace period of an active subscription", &Subscription{Status: string(SubscriptionStatusActive), ExpiresAt: &past, GraceExpiresAt: &future}, true, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.subscription.HasAccess(tc.graceAccess))
+		})
+	}
+}
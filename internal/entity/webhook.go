@@ -0,0 +1,29 @@
+package entity
+
+import "time"
+
+type WebhookEventStatus string
+
+const (
+	// WebhookEventStatusReceived is the status of an event which is stored but not processed yet.
+	WebhookEventStatusReceived WebhookEventStatus = "received"
+	// WebhookEventStatusProcessed is the status of an event which has been applied.
+	WebhookEventStatusProcessed WebhookEventStatus = "processed"
+	// WebhookEventStatusIgnored is the status of an event which has nothing to apply, e.g. a late event.
+	WebhookEventStatusIgnored WebhookEventStatus = "ignored"
+	// WebhookEventStatusFailed is the status of an event which could not be applied. It is processed again when it is replayed.
+	WebhookEventStatusFailed WebhookEventStatus = "failed"
+)
+
+// WebhookEvent is an event received from a billing provider. The raw payload is kept so that the event can be replayed.
+type WebhookEvent struct {
+	ID          string     `json:"id" db:"id"`
+	Provider    string     `json:"provider" db:"provider"`
+	EventID     string     `json:"event_id" db:"event_id"`
+	Type        string     `json:"type" db:"type"`
+	Payload     string     `json:"payload" db:"payload"`
+	Status      string     `json:"status" db:"status"`
+	Error       *string    `json:"error" db:"error"`
+	ReceivedAt  time.Time  `json:"received_at" db:"received_at"`
+	ProcessedAt *time.Time `json:"processed_at" db:"processed_at"`
+}
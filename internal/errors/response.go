@@ -57,6 +57,14 @@ func Unauthorized(msg string) ErrorResponse {
 	}
 }
 
+// UnauthorizedWithCode creates a new error response representing an authentication failure (HTTP 401)
+// with an error code that tells the client how to recover.
+func UnauthorizedWithCode(msg string, code string) ErrorResponse {
+	res := Unauthorized(msg)
+	res.Details = map[string]string{"error_code": code}
+	return res
+}
+
 // Forbidden creates a new error response representing an authorization failure (HTTP 403)
 func Forbidden(msg string) ErrorResponse {
 	if msg == "" {
@@ -68,6 +76,27 @@ func Forbidden(msg string) ErrorResponse {
 	}
 }
 
+// ForbiddenWithCode creates a new error response representing an authorization failure (HTTP 403)
+// with an error code that tells the client why the action is not allowed.
+func ForbiddenWithCode(msg string, code string) ErrorResponse {
+	res := Forbidden(msg)
+	res.Details = map[string]string{"error_code": code}
+	return res
+}
+
+// PaymentRequired creates a new error response representing an action which requires a payment (HTTP 402)
+// with an error code that tells the client what to pay for.
+func PaymentRequired(msg string, code string) ErrorResponse {
+	if msg == "" {
+		msg = "A payment is required to perform the requested action."
+	}
+	return ErrorResponse{
+		Status:  http.StatusPaymentRequired,
+		Message: msg,
+		Details: map[string]string{"error_code": code},
+	}
+}
+
 // BadRequest creates a new error response representing a bad request (HTTP 400)
 func BadRequest(msg string, code string) ErrorResponse {
 	if msg == "" {
@@ -80,6 +109,19 @@ func BadRequest(msg string, code string) ErrorResponse {
 	}
 }
 
+// TooManyRequests creates a new error response representing a request that is rejected
+// because too many attempts have been made (HTTP 429)
+func TooManyRequests(msg string, code string) ErrorResponse {
+	if msg == "" {
+		msg = "Too many requests. Please try again later."
+	}
+	return ErrorResponse{
+		Status:  http.StatusTooManyRequests,
+		Message: msg,
+		Details: map[string]string{"error_code": code},
+	}
+}
+
 type invalidField struct {
 	Field string `json:"field"`
 	Error string `json:"error"`
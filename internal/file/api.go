@@ -11,12 +11,17 @@ import (
 	"github.com/qiangxue/go-rest-api/pkg/log"
 )
 
-func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+// FeatureImageUpload is the entitlement feature of uploading an image.
+const FeatureImageUpload = "image_upload"
+
+// RegisterHandlers sets up the routing of the HTTP handlers. The upload handler is only reached through
+// uploadEntitlement, the middleware gating the uploads on the FeatureImageUpload entitlement.
+func RegisterHandlers(r *routing.RouteGroup, service Service, authHandler, uploadEntitlement routing.Handler, logger log.Logger) {
 	res := resource{service, logger}
 
 	r.Use(authHandler)
 	r.Get("/files/image/*", file.Server(file.PathMap{"/v1/files/image": "/storage"}))
-	r.Post("/files/image", res.uploadImage)
+	r.Post("/files/image", uploadEntitlement, res.uploadImage)
 }
 
 type resource struct {
@@ -25,46 +30,53 @@ type resource struct {
 }
 
 func (r resource) uploadImage(c *routing.Context) error {
+	fileBytes, fileSize, contentType, err := ReadImage(c, "image", r.logger)
+	if err != nil {
+		return err
+	}
+
+	file, err := r.service.UploadImage(c.Request.Context(), SubjectAlbum, fileBytes, fileSize, contentType)
+	if err != nil {
+		return err
+	}
+	return c.WriteWithStatus(file, http.StatusOK)
+}
+
+// ReadImage reads a PNG or JPEG image uploaded as the given multipart form field.
+// It returns the content, the size and the content type of the image.
+func ReadImage(c *routing.Context, field string, logger log.Logger) ([]byte, int64, string, error) {
 	err := c.Request.ParseMultipartForm(10 << 20) // 10 MiB =>  10 * 2 ^ 10 = 10 * 1024
 
 	if err != nil {
-		r.logger.Errorf("Error parsing the form data %v", err)
-		return errors.BadRequest(fmt.Sprintf("Error parsing the form data %v", err), "invalid_file")
+		logger.Errorf("Error parsing the form data %v", err)
+		return nil, 0, "", errors.BadRequest(fmt.Sprintf("Error parsing the form data %v", err), "invalid_file")
 	}
 
-	file, header, err := c.Request.FormFile("image")
+	file, header, err := c.Request.FormFile(field)
 
 	if err != nil {
-		r.logger.Errorf("Error reading form file %v", err)
-		return errors.BadRequest(fmt.Sprintf("Error reading form file %v", err), "invalid_file")
+		logger.Errorf("Error reading form file %v", err)
+		return nil, 0, "", errors.BadRequest(fmt.Sprintf("Error reading form file %v", err), "invalid_file")
 	}
 
 	defer file.Close()
 
 	if header.Size > (10 << 20) {
-		return errors.BadRequest("Image file is too big. Maximum 5 MiB allowed.", "file_size_too_big")
+		return nil, 0, "", errors.BadRequest("Image file is too big. Maximum 10 MiB allowed.", "file_size_too_big")
 	}
 
 	contentType := header.Header.Get("content-type")
 
 	switch contentType {
-	case "image/png":
-	case "image/jpeg":
+	case "image/png", "image/jpeg":
 		fileBytes, err := io.ReadAll(file)
 		if err != nil {
-			r.logger.Errorf("Error while reading file content %v", err)
-			return errors.InternalServerError("Error while reading file content")
+			logger.Errorf("Error while reading file content %v", err)
+			return nil, 0, "", errors.InternalServerError("Error while reading file content")
 		}
-		ctx := c.Request.Context()
-		file, err := r.service.UploadImage(ctx, fileBytes, header.Size, contentType)
-		if err != nil {
-			return err
-		}
-		return c.WriteWithStatus(file, http.StatusOK)
+		return fileBytes, header.Size, contentType, nil
 	default:
-		r.logger.Errorf("Invalid image type, %s is not supported", contentType)
-		return errors.BadRequest("Invalid image type. Not supported.", "file_type_not_supported")
+		logger.Errorf("Invalid image type, %s is not supported", contentType)
+		return nil, 0, "", errors.BadRequest("Invalid image type. Not supported.", "file_type_not_supported")
 	}
-
-	return nil
 }
@@ -5,17 +5,23 @@ import (
 	"context"
 	stderrors "errors"
 	"fmt"
+	"io"
 	"path/filepath"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/aws/smithy-go"
 	"github.com/qiangxue/go-rest-api/internal/entity"
 	"github.com/qiangxue/go-rest-api/internal/errors"
 	"github.com/qiangxue/go-rest-api/pkg/log"
 )
 
+// multipartPartSize is the size of the parts a stream is uploaded in. Every part but the last one
+// must be at least 5MB, so this is also the amount of the stream held in memory at a time.
+const multipartPartSize = 8 << 20
+
 func NewCloudStorage(awsClient *s3.Client, bucketName, publicDomain string, logger log.Logger) FileStorage {
 	return CloudStorage{awsClient, bucketName, publicDomain, logger}
 }
@@ -65,8 +71,144 @@ func (c CloudStorage) WriteFile(ctx context.Context, file entity.File, bytes []b
 	return c.GetFileURL(ctx, file)
 }
 
+// WriteStream implements FileStorage.
+// The stream is uploaded with a multipart upload, which is aborted if reading or uploading a part fails.
+func (c CloudStorage) WriteStream(ctx context.Context, file entity.File, r io.Reader) (int64, error) {
+	absolutePath := filepath.Join(file.Subject, file.GetName())
+
+	upload, err := c.awsClient.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(c.bucketName),
+		Key:         aws.String(absolutePath),
+		ContentType: aws.String(file.ContentType),
+	})
+	if err != nil {
+		c.logger.Errorf("Couldn't start the upload of file %v to %v:%v. Here's why: %v\n",
+			file.GetName(), c.bucketName, absolutePath, err)
+		return 0, errors.InternalServerError("Error while uploading the object.")
+	}
+
+	size, parts, err := c.uploadParts(ctx, absolutePath, upload.UploadId, r)
+	if err == nil {
+		_, err = c.awsClient.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(c.bucketName),
+			Key:             aws.String(absolutePath),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		c.logger.Errorf("Couldn't upload file %v to %v:%v. Here's why: %v\n",
+			file.GetName(), c.bucketName, absolutePath, err)
+		if _, abortErr := c.awsClient.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(c.bucketName),
+			Key:      aws.String(absolutePath),
+			UploadId: upload.UploadId,
+		}); abortErr != nil {
+			c.logger.Errorf("Couldn't abort the upload of file %v. Here's why: %v\n", file.GetName(), abortErr)
+		}
+		return 0, errors.InternalServerError("Error while uploading the object.")
+	}
+
+	return size, nil
+}
+
+// uploadParts reads the stream in parts of multipartPartSize and uploads them to the multipart upload.
+func (c CloudStorage) uploadParts(ctx context.Context, key string, uploadID *string, r io.Reader) (int64, []types.CompletedPart, error) {
+	var size int64
+	var parts []types.CompletedPart
+	buf := make([]byte, multipartPartSize)
+	for number := int32(1); ; number++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF && number > 1 {
+			return size, parts, nil
+		} else if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return size, parts, err
+		}
+
+		output, uploadErr := c.awsClient.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(c.bucketName),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int32(number),
+			Body:       stdbytes.NewReader(buf[:n]),
+		})
+		if uploadErr != nil {
+			return size, parts, uploadErr
+		}
+		parts = append(parts, types.CompletedPart{ETag: output.ETag, PartNumber: aws.Int32(number)})
+		size += int64(n)
+
+		if err != nil {
+			// the stream ended within this part
+			return size, parts, nil
+		}
+	}
+}
+
 // GetFileURL implements FileStorage.
 func (c CloudStorage) GetFileURL(_ context.Context, file entity.File) (string, error) {
 	// return filepath.Join(c.publicDomain, file.Subject, file.GetName()), nil
 	return fmt.Sprintf("%s/%s/%s", c.publicDomain, file.Subject, file.GetName()), nil
 }
+
+// DeleteFile implements FileStorage.
+func (c CloudStorage) DeleteFile(ctx context.Context, file entity.File) error {
+	absolutePath := filepath.Join(file.Subject, file.GetName())
+
+	_, err := c.awsClient.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(absolutePath),
+	})
+	if err != nil {
+		c.logger.Errorf("Couldn't delete file %v from %v:%v. Here's why: %v\n",
+			file.GetName(), c.bucketName, absolutePath, err)
+		return errors.InternalServerError("Error while deleting the object.")
+	}
+
+	return nil
+}
+
+// ReadFile implements FileStorage.
+func (c CloudStorage) ReadFile(ctx context.Context, file entity.File) ([]byte, error) {
+	absolutePath := filepath.Join(file.Subject, file.GetName())
+
+	output, err := c.awsClient.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(absolutePath),
+	})
+	var noSuchKey *types.NoSuchKey
+	if stderrors.As(err, &noSuchKey) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		c.logger.Errorf("Couldn't get file %v from %v:%v. Here's why: %v\n",
+			file.GetName(), c.bucketName, absolutePath, err)
+		return nil, errors.InternalServerError("Error while reading the object.")
+	}
+	defer output.Body.Close()
+
+	bytes, err := io.ReadAll(output.Body)
+	if err != nil {
+		c.logger.Errorf("Couldn't read file %v from %v:%v. Here's why: %v\n",
+			file.GetName(), c.bucketName, absolutePath, err)
+		return nil, errors.InternalServerError("Error while reading the object.")
+	}
+
+	return bytes, nil
+}
+
+// GetSignedURL implements FileStorage.
+func (c CloudStorage) GetSignedURL(ctx context.Context, file entity.File, expires time.Duration) (string, error) {
+	absolutePath := filepath.Join(file.Subject, file.GetName())
+
+	request, err := s3.NewPresignClient(c.awsClient).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(c.bucketName),
+		Key:    aws.String(absolutePath),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		c.logger.Errorf("Couldn't presign file %v of %v:%v. Here's why: %v\n",
+			file.GetName(), c.bucketName, absolutePath, err)
+		return "", errors.InternalServerError("Error while creating the download link.")
+	}
+
+	return request.URL, nil
+}
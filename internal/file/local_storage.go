@@ -3,8 +3,10 @@ package file
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/qiangxue/go-rest-api/internal/entity"
 	"github.com/qiangxue/go-rest-api/internal/errors"
@@ -51,7 +53,58 @@ func (l localStorage) WriteFile(ctx context.Context, file entity.File, bytes []b
 
 }
 
+// WriteStream implements FileStorage.
+func (l localStorage) WriteStream(_ context.Context, file entity.File, r io.Reader) (int64, error) {
+	absoluteDir := filepath.Join(l.localStoragePath, file.Subject)
+	if err := os.MkdirAll(absoluteDir, 0755); err != nil {
+		l.logger.Errorf("File save directory not created %v", err)
+		return 0, errors.InternalServerError("File save directory not created")
+	}
+
+	osfile, err := os.Create(filepath.Join(absoluteDir, file.GetName()))
+	if err != nil {
+		l.logger.Errorf("Error creating file in the local storage %v", err)
+		return 0, errors.InternalServerError("Error creating file in the local storage")
+	}
+	defer osfile.Close()
+
+	n, err := io.Copy(osfile, r)
+	if err != nil {
+		l.logger.Errorf("Error writing file in the local storage %v", err)
+		return n, errors.InternalServerError("Error writing file in the local storage")
+	}
+	return n, nil
+}
+
 // GetFileURL implements FileStorage.
 func (l localStorage) GetFileURL(_ context.Context, file entity.File) (string, error) {
 	return fmt.Sprintf("http://localhost:%d/v1/files/image/%s/%s", 8080, file.Subject, file.GetName()), nil
 }
+
+// DeleteFile implements FileStorage.
+func (l localStorage) DeleteFile(_ context.Context, file entity.File) error {
+	absolutePath := filepath.Join(l.localStoragePath, file.Subject, file.GetName())
+	if err := os.Remove(absolutePath); err != nil && !os.IsNotExist(err) {
+		l.logger.Errorf("Error deleting file from the local storage %v", err)
+		return errors.InternalServerError("Error deleting file from the local storage")
+	}
+	return nil
+}
+
+// ReadFile implements FileStorage.
+func (l localStorage) ReadFile(_ context.Context, file entity.File) ([]byte, error) {
+	bytes, err := os.ReadFile(filepath.Join(l.localStoragePath, file.Subject, file.GetName()))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		l.logger.Errorf("Error reading file from the local storage %v", err)
+		return nil, errors.InternalServerError("Error reading file from the local storage")
+	}
+	return bytes, nil
+}
+
+// GetSignedURL implements FileStorage.
+// The local storage is only used in development, so the plain file URL is returned.
+func (l localStorage) GetSignedURL(ctx context.Context, file entity.File, _ time.Duration) (string, error) {
+	return l.GetFileURL(ctx, file)
+}
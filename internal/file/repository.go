@@ -13,6 +13,9 @@ import (
 
 type Repository interface {
 	CreateFile(ctx context.Context, file entity.File) error
+	GetFile(ctx context.Context, fileID string) (entity.File, error)
+	ListFilesByUserID(ctx context.Context, userID string) ([]entity.File, error)
+	DeleteFile(ctx context.Context, fileID string) error
 }
 
 func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
@@ -54,3 +57,33 @@ func (r repository) CreateFile(ctx context.Context, file entity.File) error {
 
 	return nil
 }
+
+// GetFile returns the file with the given ID.
+func (r repository) GetFile(ctx context.Context, fileID string) (entity.File, error) {
+	var file entity.File
+	err := r.db.With(ctx).Select("id", "user_id", "subject", "content_type", "size").
+		From("file").
+		Where(dbx.HashExp{"id": fileID, "deleted_at": nil}).
+		One(&file)
+
+	return file, err
+}
+
+// ListFilesByUserID returns every file uploaded by the user, including the soft-deleted ones.
+func (r repository) ListFilesByUserID(ctx context.Context, userID string) ([]entity.File, error) {
+	files := []entity.File{}
+	err := r.db.With(ctx).Select("id", "user_id", "subject", "content_type", "size").
+		From("file").
+		Where(dbx.HashExp{"user_id": userID}).
+		OrderBy("created_at").
+		All(&files)
+
+	return files, err
+}
+
+// DeleteFile removes the file record from the database.
+func (r repository) DeleteFile(ctx context.Context, fileID string) error {
+	_, err := r.db.With(ctx).Delete("file", dbx.HashExp{"id": fileID}).Execute()
+
+	return err
+}
@@ -2,38 +2,58 @@ package file
 
 import (
 	"context"
+	stderrors "errors"
+	"io"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/qiangxue/go-rest-api/internal/auth"
 	"github.com/qiangxue/go-rest-api/internal/entity"
 	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/internal/referral"
 	"github.com/qiangxue/go-rest-api/pkg/log"
 )
 
+// File subjects group the files by what they are uploaded for.
+const (
+	SubjectAlbum  = "album"
+	SubjectAvatar = "avatar"
+	SubjectExport = "export"
+)
+
+// ErrNotFound is returned by FileStorage.ReadFile when the object of the file does not exist.
+var ErrNotFound = stderrors.New("file not found")
+
 type FileStorage interface {
 	WriteFile(_ context.Context, file entity.File, bytes []byte) (string, error)
+	// WriteStream stores the content read from the reader without holding it in memory and returns its size.
+	WriteStream(_ context.Context, file entity.File, r io.Reader) (int64, error)
 	GetFileURL(_ context.Context, file entity.File) (string, error)
+	DeleteFile(_ context.Context, file entity.File) error
+	ReadFile(_ context.Context, file entity.File) ([]byte, error)
+	// GetSignedURL returns a URL that grants access to the file until it expires.
+	GetSignedURL(_ context.Context, file entity.File, expires time.Duration) (string, error)
 }
 
 type Service interface {
-	UploadImage(ctx context.Context, fileBytes []byte, fileSize int64, contentType string) (entity.File, error)
+	UploadImage(ctx context.Context, subject string, fileBytes []byte, fileSize int64, contentType string) (entity.File, error)
 }
 
-func NewService(repository Repository, fileStorage FileStorage, logger log.Logger) Service {
-	return service{repository, fileStorage, logger}
+func NewService(repository Repository, fileStorage FileStorage, referrals referral.Service, logger log.Logger) Service {
+	return service{repository, fileStorage, referrals, logger}
 }
 
 type service struct {
 	repository  Repository
 	fileStorage FileStorage
+	referrals   referral.Service
 	logger      log.Logger
 }
 
 // UploadImage implements Service.
-func (s service) UploadImage(ctx context.Context, fileBytes []byte, fileSize int64, contenType string) (entity.File, error) {
+func (s service) UploadImage(ctx context.Context, fileSubject string, fileBytes []byte, fileSize int64, contenType string) (entity.File, error) {
 	// userID := auth.CurrentUser(ctx).GetID()
 	fileID := uuid.New().String()
-	fileSubject := "album"
 	userID := auth.CurrentUser(ctx).ID
 
 	file := entity.File{
@@ -57,6 +77,11 @@ func (s service) UploadImage(ctx context.Context, fileBytes []byte, fileSize int
 		return entity.File{}, errors.InternalServerError("Could not add file to database")
 	}
 
+	// the first album image qualifies the referral of the user. A failed reward is retried by the referral job.
+	if fileSubject == SubjectAlbum {
+		_ = s.referrals.Qualify(ctx, userID)
+	}
+
 	file.URL = fileURL
 	return file, nil
 }
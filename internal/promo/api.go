@@ -0,0 +1,89 @@
+package promo
+
+import (
+	"net/http"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/qiangxue/go-rest-api/pkg/pagination"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers.
+// Redemptions are rate limited by redeemLimit to prevent guessing codes.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler, redeemLimit routing.Handler, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Use(authHandler)
+
+	// the following endpoints require a valid JWT
+	rg.Post("/promo/redeem", redeemLimit, res.redeem)
+}
+
+// RegisterAdminHandlers registers the promo code handlers of the admin route group.
+// The route group must only be reachable by the staff. Creating codes is restricted to admins.
+func RegisterAdminHandlers(rg *routing.RouteGroup, service Service, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Post("/promo-codes", auth.RequireRole(entity.RoleAdmin), res.createCode)
+	rg.Get("/promo-codes/stats", res.stats)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) redeem(c *routing.Context) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+	if req.Code == "" {
+		return errors.BadRequest("The promo code is required", "invalid_code")
+	}
+
+	redemption, err := r.service.Redeem(c.Request.Context(), req.Code)
+	if err != nil {
+		return err
+	}
+
+	return c.Write(redemption)
+}
+
+func (r resource) createCode(c *routing.Context) error {
+	var req CreateCodeRequest
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+
+	promoCode, err := r.service.CreateCode(c.Request.Context(), req)
+	if err != nil {
+		return err
+	}
+
+	return c.WriteWithStatus(promoCode, http.StatusCreated)
+}
+
+// stats returns a page of the redemption statistics of the promo codes, which can be filtered by campaign.
+func (r resource) stats(c *routing.Context) error {
+	ctx := c.Request.Context()
+	campaign := c.Query("campaign")
+	count, err := r.service.CountStats(ctx, campaign)
+	if err != nil {
+		return err
+	}
+	pages := pagination.NewFromRequest(c.Request, count)
+	stats, err := r.service.QueryStats(ctx, campaign, pages.Offset(), pages.Limit())
+	if err != nil {
+		return err
+	}
+	pages.Items = stats
+	return c.Write(pages)
+}
@@ -0,0 +1,208 @@
+package promo
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access the promo codes and their redemptions.
+type Repository interface {
+	// CreateCode saves a new promo code.
+	CreateCode(ctx context.Context, code entity.PromoCode) error
+	// LockCode returns the promo code with the given code. The code is locked until the end of the transaction,
+	// so that its redemptions are serialized.
+	LockCode(ctx context.Context, code string) (entity.PromoCode, error)
+	// CountUserRedemptions returns the number of times the user has redeemed the promo code.
+	CountUserRedemptions(ctx context.Context, codeID, userID string) (int, error)
+	// CreateRedemption saves a redemption and counts it in the redemptions of the promo code.
+	CreateRedemption(ctx context.Context, redemption entity.PromoRedemption) error
+
+	// GetSubscription returns the current subscription of the user. Nil is returned if the user has no active subscription
+	// or subscription in its grace period.
+	GetSubscription(ctx context.Context, userID string) (*entity.Subscription, error)
+	// SetPromoSubscription gives the user a promotional subscription to the plan.
+	SetPromoSubscription(ctx context.Context, userID string, subscription entity.Subscription) error
+
+	// CountStats returns the number of the promo codes of the campaign. An empty campaign means all the codes.
+	CountStats(ctx context.Context, campaign string) (int, error)
+	// QueryStats returns the redemption statistics of the promo codes of the campaign, the latest code first.
+	QueryStats(ctx context.Context, campaign string, offset, limit int) ([]Stats, error)
+}
+
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new promo code repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// CreateCode implements Repository.
+func (r repository) CreateCode(ctx context.Context, code entity.PromoCode) error {
+	_, err := r.db.With(ctx).Insert("promo_code", dbx.Params{
+		"id":                code.ID,
+		"code":              code.Code,
+		"campaign":          code.Campaign,
+		"credits":           code.Credits,
+		"subscription_plan": code.SubscriptionPlan,
+		"subscription_days": code.SubscriptionDays,
+		"max_redemptions":   code.MaxRedemptions,
+		"per_user_limit":    code.PerUserLimit,
+		"redemptions":       code.Redemptions,
+		"starts_at":         code.StartsAt,
+		"ends_at":           code.EndsAt,
+		"created_by":        code.CreatedBy,
+		"created_at":        code.CreatedAt,
+	}).Execute()
+
+	return err
+}
+
+// LockCode implements Repository.
+func (r repository) LockCode(ctx context.Context, code string) (entity.PromoCode, error) {
+	var promoCode entity.PromoCode
+	err := r.db.With(ctx).NewQuery(`SELECT * FROM promo_code WHERE code = {:code} FOR UPDATE`).
+		Bind(dbx.Params{"code": code}).
+		One(&promoCode)
+
+	return promoCode, err
+}
+
+// CountUserRedemptions implements Repository.
+func (r repository) CountUserRedemptions(ctx context.Context, codeID, userID string) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("promo_redemption").
+		Where(dbx.HashExp{"code_id": codeID, "user_id": userID}).
+		Row(&count)
+
+	return count, err
+}
+
+// CreateRedemption implements Repository.
+func (r repository) CreateRedemption(ctx context.Context, redemption entity.PromoRedemption) error {
+	return r.db.Transactional(ctx, func(ctx context.Context) error {
+		_, err := r.db.With(ctx).Insert("promo_redemption", dbx.Params{
+			"id":                      redemption.ID,
+			"code_id":                 redemption.CodeID,
+			"user_id":                 redemption.UserID,
+			"credits":                 redemption.Credits,
+			"subscription_expires_at": redemption.SubscriptionExpiresAt,
+			"created_at":              redemption.CreatedAt,
+		}).Execute()
+		if err != nil {
+			return err
+		}
+
+		_, err = r.db.With(ctx).Update("promo_code",
+			dbx.Params{"redemptions": dbx.NewExp("redemptions + 1")},
+			dbx.HashExp{"id": redemption.CodeID},
+		).Execute()
+		return err
+	})
+}
+
+// GetSubscription implements Repository.
+func (r repository) GetSubscription(ctx context.Context, userID string) (*entity.Subscription, error) {
+	var row struct {
+		Plan           *string    `db:"subscription_plan"`
+		Type           *string    `db:"subscription_type"`
+		Period         *string    `db:"subscription_period"`
+		Status         *string    `db:"subscription_status"`
+		ExpiresAt      *time.Time `db:"subscription_expires_at"`
+		GraceExpiresAt *time.Time `db:"subscription_grace_expires_at"`
+	}
+	err := r.db.With(ctx).
+		Select("subscription_plan", "subscription_type", "subscription_period", "subscription_status",
+			"subscription_expires_at", "subscription_grace_expires_at").
+		From("public.user").
+		Where(dbx.HashExp{"id": userID}).
+		One(&row)
+	if err != nil {
+		return nil, err
+	}
+
+	if row.Plan == nil || row.Status == nil ||
+		(*row.Status != string(entity.SubscriptionStatusActive) && *row.Status != string(entity.SubscriptionStatusBillingIssue)) {
+		return nil, nil
+	}
+	subscription := &entity.Subscription{Plan: *row.Plan, Status: *row.Status, ExpiresAt: row.ExpiresAt, GraceExpiresAt: row.GraceExpiresAt}
+	if endsAt := subscription.EndsAt(); endsAt != nil && endsAt.Before(time.Now()) {
+		return nil, nil
+	}
+	if row.Type != nil {
+		subscription.Type = *row.Type
+	}
+	if row.Period != nil {
+		subscription.Period = *row.Period
+	}
+	return subscription, nil
+}
+
+// SetPromoSubscription implements Repository.
+// The time of the change is recorded as the time of the last billing event, so that only the later store events replace it.
+func (r repository) SetPromoSubscription(ctx context.Context, userID string, subscription entity.Subscription) error {
+	currentTime := time.Now()
+	_, err := r.db.With(ctx).Update("public.user",
+		dbx.Params{
+			"subscription_plan":             subscription.Plan,
+			"subscription_type":             subscription.Type,
+			"subscription_period":           subscription.Period,
+			"subscription_status":           subscription.Status,
+			"subscription_expires_at":       subscription.ExpiresAt,
+			"subscription_will_renew":       false,
+			"subscription_grace_expires_at": nil,
+			"subscription_event_at":         currentTime,
+			"updated_at":                    currentTime,
+		},
+		dbx.HashExp{"id": userID},
+	).Execute()
+
+	return err
+}
+
+// CountStats implements Repository.
+func (r repository) CountStats(ctx context.Context, campaign string) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("promo_code").
+		Where(campaignExp(campaign)).
+		Row(&count)
+
+	return count, err
+}
+
+// QueryStats implements Repository.
+func (r repository) QueryStats(ctx context.Context, campaign string, offset, limit int) ([]Stats, error) {
+	stats := []Stats{}
+	err := r.db.With(ctx).
+		Select(
+			"c.id", "c.code", "c.campaign", "c.max_redemptions", "c.redemptions", "c.starts_at", "c.ends_at",
+			"(COUNT(DISTINCT r.user_id)) AS users",
+			"(COALESCE(SUM(r.credits), 0)) AS credits",
+			"(COUNT(r.subscription_expires_at)) AS subscriptions",
+			"(MAX(r.created_at)) AS last_redeemed_at",
+		).
+		From("promo_code AS c").
+		LeftJoin("promo_redemption AS r", dbx.NewExp("r.code_id = c.id")).
+		Where(campaignExp(campaign)).
+		GroupBy("c.id").
+		OrderBy("c.created_at DESC").
+		Offset(int64(offset)).
+		Limit(int64(limit)).
+		All(&stats)
+
+	return stats, err
+}
+
+func campaignExp(campaign string) dbx.Expression {
+	if campaign == "" {
+		return nil
+	}
+	return dbx.HashExp{"campaign": campaign}
+}
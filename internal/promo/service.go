@@ -0,0 +1,287 @@
+package promo
+
+import (
+	"context"
+	"database/sql"
+	stderr "errors"
+	"regexp"
+	"strings"
+	"time"
+
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// creditReason is the reason of the credits granted for a promo code.
+const creditReason = "promo_code"
+
+// codePattern is the format of the promo codes, which are case insensitive and kept in uppercase.
+var codePattern = regexp.MustCompile(`^[A-Z0-9_-]+$`)
+
+// minCodeLength is the minimum length of the promo codes, which keeps them from being guessed.
+const minCodeLength = 8
+
+// Service encapsulates the usecase logic for the promo codes.
+type Service interface {
+	// Redeem redeems the promo code for the current user.
+	Redeem(ctx context.Context, code string) (Redemption, error)
+	// CreateCode creates a new promo code on behalf of an admin.
+	CreateCode(ctx context.Context, req CreateCodeRequest) (entity.PromoCode, error)
+	// CountStats returns the number of the promo codes of the campaign. An empty campaign means all the codes.
+	CountStats(ctx context.Context, campaign string) (int, error)
+	// QueryStats returns the redemption statistics of the promo codes of the campaign, the latest code first.
+	QueryStats(ctx context.Context, campaign string, offset, limit int) ([]Stats, error)
+}
+
+// Redemption is what the user has got for a promo code.
+type Redemption struct {
+	Credits      int                  `json:"credits"`
+	Subscription *entity.Subscription `json:"subscription,omitempty"`
+}
+
+// Stats are the redemption statistics of a promo code.
+type Stats struct {
+	ID             string     `json:"id" db:"id"`
+	Code           string     `json:"code" db:"code"`
+	Campaign       *string    `json:"campaign" db:"campaign"`
+	MaxRedemptions *int       `json:"max_redemptions" db:"max_redemptions"`
+	Redemptions    int        `json:"redemptions" db:"redemptions"`
+	StartsAt       *time.Time `json:"starts_at" db:"starts_at"`
+	EndsAt         *time.Time `json:"ends_at" db:"ends_at"`
+	// Users is the number of the distinct users who have redeemed the code.
+	Users int `json:"users" db:"users"`
+	// Credits is the number of the credits granted for the code.
+	Credits int `json:"credits" db:"credits"`
+	// Subscriptions is the number of the promotional subscriptions given for the code.
+	Subscriptions  int        `json:"subscriptions" db:"subscriptions"`
+	LastRedeemedAt *time.Time `json:"last_redeemed_at" db:"last_redeemed_at"`
+}
+
+// CreateCodeRequest represents a promo code creation request.
+type CreateCodeRequest struct {
+	Code     string `json:"code"`
+	Campaign string `json:"campaign"`
+	Credits  int    `json:"credits"`
+	// SubscriptionPlan is the plan of the promotional subscription given for SubscriptionDays days, if any.
+	SubscriptionPlan string `json:"subscription_plan"`
+	SubscriptionDays int    `json:"subscription_days"`
+	// MaxRedemptions is the number of times the code can be redeemed by all users. Nil means no limit.
+	MaxRedemptions *int `json:"max_redemptions"`
+	// PerUserLimit is the number of times a user can redeem the code. Defaults to 1.
+	PerUserLimit int        `json:"per_user_limit"`
+	StartsAt     *time.Time `json:"starts_at"`
+	EndsAt       *time.Time `json:"ends_at"`
+}
+
+// Validate validates the CreateCodeRequest fields.
+func (m CreateCodeRequest) Validate() error {
+	return validation.ValidateStruct(&m,
+		validation.Field(&m.Code, validation.Required, validation.Length(minCodeLength, 50), validation.Match(codePattern)),
+		validation.Field(&m.Campaign, validation.Length(0, 50)),
+		validation.Field(&m.Credits, validation.Min(0), validation.When(m.SubscriptionPlan == "", validation.Required)),
+		validation.Field(&m.SubscriptionPlan, validation.Length(0, 50)),
+		validation.Field(&m.SubscriptionDays, validation.Min(0), validation.When(m.SubscriptionPlan != "", validation.Required)),
+		validation.Field(&m.MaxRedemptions, validation.Min(1)),
+		validation.Field(&m.PerUserLimit, validation.Min(0)),
+		validation.Field(&m.EndsAt, validation.When(m.StartsAt != nil && m.EndsAt != nil,
+			validation.By(func(interface{}) error {
+				if !m.EndsAt.After(*m.StartsAt) {
+					return validation.NewError("validation_ends_at", "must be after starts_at")
+				}
+				return nil
+			}))),
+	)
+}
+
+type service struct {
+	repo     Repository
+	transact dbcontext.TransactionFunc
+	credits  credit.Service
+	users    auth.UserCache
+	logger   log.Logger
+}
+
+// NewService creates a new promo code service.
+func NewService(repo Repository, transact dbcontext.TransactionFunc, credits credit.Service, users auth.UserCache, logger log.Logger) Service {
+	return service{repo, transact, credits, users, logger}
+}
+
+// Redeem implements Service.
+// The promo code is locked while it is redeemed, so that concurrent redemptions cannot exceed its limits.
+func (s service) Redeem(ctx context.Context, code string) (Redemption, error) {
+	userID := auth.CurrentUser(ctx).GetID()
+	logger := s.logger.With(ctx, "user", userID)
+
+	var result Redemption
+	err := s.transact(ctx, func(ctx context.Context) error {
+		promoCode, err := s.repo.LockCode(ctx, normalizeCode(code))
+		if stderr.Is(err, sql.ErrNoRows) {
+			return errors.BadRequest("The promo code is not valid", "invalid_code")
+		} else if err != nil {
+			return err
+		}
+
+		currentTime := time.Now()
+		switch {
+		case promoCode.StartsAt != nil && currentTime.Before(*promoCode.StartsAt):
+			return errors.BadRequest("The promo code is not active yet", "code_not_active")
+		case promoCode.EndsAt != nil && !currentTime.Before(*promoCode.EndsAt):
+			return errors.BadRequest("The promo code has expired", "code_expired")
+		case promoCode.MaxRedemptions != nil && promoCode.Redemptions >= *promoCode.MaxRedemptions:
+			return errors.BadRequest("The promo code has been used up", "code_exhausted")
+		}
+		count, err := s.repo.CountUserRedemptions(ctx, promoCode.ID, userID)
+		if err != nil {
+			return err
+		}
+		if count >= promoCode.PerUserLimit {
+			return errors.BadRequest("You have already redeemed the promo code", "already_redeemed")
+		}
+
+		redemption := entity.PromoRedemption{
+			ID:        uuid.New().String(),
+			CodeID:    promoCode.ID,
+			UserID:    userID,
+			Credits:   promoCode.Credits,
+			CreatedAt: currentTime,
+		}
+		if promoCode.SubscriptionPlan != nil {
+			subscription, err := s.giveSubscription(ctx, userID, *promoCode.SubscriptionPlan, promoCode.SubscriptionDays)
+			if err != nil {
+				return err
+			}
+			redemption.SubscriptionExpiresAt = subscription.ExpiresAt
+			result.Subscription = &subscription
+		}
+		if err := s.repo.CreateRedemption(ctx, redemption); err != nil {
+			return err
+		}
+		if promoCode.Credits > 0 {
+			if _, err := s.credits.Grant(ctx, userID, promoCode.Credits, nil, creditReason, redemption.ID); err != nil {
+				return err
+			}
+			result.Credits = promoCode.Credits
+		}
+		return nil
+	})
+	var errorResponse errors.ErrorResponse
+	if stderr.As(err, &errorResponse) {
+		return Redemption{}, err
+	} else if err != nil {
+		logger.Errorf("There is an error while redeeming the promo code %s %v", code, err)
+		return Redemption{}, errors.InternalServerError("")
+	}
+	s.users.Invalidate(userID)
+
+	logger.Infof("promo code %s redeemed", normalizeCode(code))
+	return result, nil
+}
+
+// giveSubscription gives the user a promotional subscription to the plan for the given days.
+// A subscription bought in a store is never replaced, and neither is a promotional subscription which lasts longer.
+func (s service) giveSubscription(ctx context.Context, userID, plan string, days int) (entity.Subscription, error) {
+	expiresAt := time.Now().AddDate(0, 0, days)
+	subscription := entity.Subscription{
+		Plan:      plan,
+		Type:      string(entity.SubscriptionTypePromo),
+		Period:    string(promoPeriod(days)),
+		Status:    string(entity.SubscriptionStatusActive),
+		ExpiresAt: &expiresAt,
+	}
+
+	current, err := s.repo.GetSubscription(ctx, userID)
+	if err != nil {
+		return subscription, err
+	}
+	if current != nil && (current.Type != string(entity.SubscriptionTypePromo) || !subscription.IsBetterThan(current)) {
+		return subscription, errors.BadRequest("You already have a subscription", "already_subscribed")
+	}
+
+	return subscription, s.repo.SetPromoSubscription(ctx, userID, subscription)
+}
+
+// CreateCode implements Service.
+func (s service) CreateCode(ctx context.Context, req CreateCodeRequest) (entity.PromoCode, error) {
+	req.Code = normalizeCode(req.Code)
+	if err := req.Validate(); err != nil {
+		return entity.PromoCode{}, err
+	}
+	if req.PerUserLimit == 0 {
+		req.PerUserLimit = 1
+	}
+
+	promoCode := entity.PromoCode{
+		ID:               uuid.New().String(),
+		Code:             req.Code,
+		Campaign:         nullIfEmpty(req.Campaign),
+		Credits:          req.Credits,
+		SubscriptionPlan: nullIfEmpty(req.SubscriptionPlan),
+		SubscriptionDays: req.SubscriptionDays,
+		MaxRedemptions:   req.MaxRedemptions,
+		PerUserLimit:     req.PerUserLimit,
+		StartsAt:         req.StartsAt,
+		EndsAt:           req.EndsAt,
+		CreatedBy:        nullIfEmpty(auth.CurrentUser(ctx).GetID()),
+		CreatedAt:        time.Now(),
+	}
+	if promoCode.SubscriptionPlan == nil {
+		promoCode.SubscriptionDays = 0
+	}
+	err := s.repo.CreateCode(ctx, promoCode)
+	if isUniqueViolation(err) {
+		return promoCode, errors.BadRequest("The promo code already exists", "code_taken")
+	} else if err != nil {
+		s.logger.Errorf("There is an error while creating the promo code %s %v", promoCode.Code, err)
+		return promoCode, errors.InternalServerError("")
+	}
+
+	s.logger.With(ctx).Infof("promo code %s created", promoCode.Code)
+	return promoCode, nil
+}
+
+// CountStats implements Service.
+func (s service) CountStats(ctx context.Context, campaign string) (int, error) {
+	return s.repo.CountStats(ctx, campaign)
+}
+
+// QueryStats implements Service.
+func (s service) QueryStats(ctx context.Context, campaign string, offset, limit int) ([]Stats, error) {
+	return s.repo.QueryStats(ctx, campaign, offset, limit)
+}
+
+// promoPeriod returns the longest subscription period which fits in the given days, or a week for shorter subscriptions.
+func promoPeriod(days int) entity.SubscriptionPlanPeriod {
+	period := entity.SubscriptionPlanPeriod1W
+	for _, p := range []entity.SubscriptionPlanPeriod{
+		entity.SubscriptionPlanPeriod1M, entity.SubscriptionPlanPeriod6M, entity.SubscriptionPlanPeriod1Y,
+	} {
+		if p.GetDays() <= days {
+			period = p
+		}
+	}
+	return period
+}
+
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func nullIfEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// isUniqueViolation reports whether the error is caused by a unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return stderr.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,249 @@
+package promo
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type txKey struct{}
+
+// txState holds the promo codes locked by a transaction.
+type txState struct {
+	locked []*sync.Mutex
+}
+
+// mockRepository keeps the promo codes, the redemptions and the subscriptions in memory.
+// LockCode locks the code until the end of the transaction, as the row lock of the database does.
+type mockRepository struct {
+	Repository
+	mu            sync.Mutex
+	locks         map[string]*sync.Mutex
+	codes         map[string]entity.PromoCode
+	redemptions   []entity.PromoRedemption
+	subscriptions map[string]entity.Subscription
+}
+
+func newMockRepository(codes ...entity.PromoCode) *mockRepository {
+	r := &mockRepository{
+		locks:         map[string]*sync.Mutex{},
+		codes:         map[string]entity.PromoCode{},
+		subscriptions: map[string]entity.Subscription{},
+	}
+	for _, code := range codes {
+		r.codes[code.Code] = code
+		r.locks[code.Code] = &sync.Mutex{}
+	}
+	return r
+}
+
+// transact runs the function as a transaction, which releases the locked codes when it ends.
+func (r *mockRepository) transact(ctx context.Context, f func(ctx context.Context) error) error {
+	tx := &txState{}
+	defer func() {
+		for _, lock := range tx.locked {
+			lock.Unlock()
+		}
+	}()
+	return f(context.WithValue(ctx, txKey{}, tx))
+}
+
+func (r *mockRepository) LockCode(ctx context.Context, code string) (entity.PromoCode, error) {
+	r.mu.Lock()
+	lock, ok := r.locks[code]
+	r.mu.Unlock()
+	if !ok {
+		return entity.PromoCode{}, sql.ErrNoRows
+	}
+	lock.Lock()
+	tx := ctx.Value(txKey{}).(*txState)
+	tx.locked = append(tx.locked, lock)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.codes[code], nil
+}
+
+func (r *mockRepository) CountUserRedemptions(_ context.Context, codeID, userID string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	count := 0
+	for _, redemption := range r.redemptions {
+		if redemption.CodeID == codeID && redemption.UserID == userID {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *mockRepository) CreateRedemption(_ context.Context, redemption entity.PromoRedemption) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.redemptions = append(r.redemptions, redemption)
+	for key, code := range r.codes {
+		if code.ID == redemption.CodeID {
+			code.Redemptions++
+			r.codes[key] = code
+		}
+	}
+	return nil
+}
+
+func (r *mockRepository) GetSubscription(_ context.Context, userID string) (*entity.Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if subscription, ok := r.subscriptions[userID]; ok {
+		return &subscription, nil
+	}
+	return nil, nil
+}
+
+func (r *mockRepository) SetPromoSubscription(_ context.Context, userID string, subscription entity.Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions[userID] = subscription
+	return nil
+}
+
+// mockCredits records the credits granted to the users.
+type mockCredits struct {
+	credit.Service
+	mu      sync.Mutex
+	granted map[string]int
+}
+
+func (m *mockCredits) Grant(_ context.Context, userID string, amount int, _ *time.Time, _, _ string) (entity.CreditTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.granted[userID] += amount
+	return entity.CreditTransaction{}, nil
+}
+
+type mockCache struct {
+	auth.UserCache
+}
+
+func (mockCache) Invalidate(...string) {}
+
+func withUser(userID string) context.Context {
+	return auth.WithUser(context.Background(), entity.User{ID: userID})
+}
+
+// errorCode returns the error code of a bad request.
+func errorCode(err error) string {
+	if response, ok := err.(errors.ErrorResponse); ok && response.Status == http.StatusBadRequest {
+		return response.Details.(map[string]string)["error_code"]
+	}
+	return fmt.Sprintf("%v", err)
+}
+
+func TestService_Redeem(t *testing.T) {
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	one, two := 1, 2
+	pro := "pro"
+	storeExpiresAt := time.Now().AddDate(0, 1, 0)
+	promoExpiresAt := time.Now().AddDate(0, 0, 3)
+	longPromoExpiresAt := time.Now().AddDate(0, 6, 0)
+
+	repo := newMockRepository(
+		entity.PromoCode{ID: "1", Code: "WELCOME100", Credits: 100, PerUserLimit: 1},
+		entity.PromoCode{ID: "2", Code: "NOTYETACTIVE", Credits: 10, PerUserLimit: 1, StartsAt: &future},
+		entity.PromoCode{ID: "3", Code: "EXPIREDCODE", Credits: 10, PerUserLimit: 1, EndsAt: &past},
+		entity.PromoCode{ID: "4", Code: "USEDUPCODE", Credits: 10, PerUserLimit: 1, MaxRedemptions: &one, Redemptions: 1},
+		entity.PromoCode{ID: "5", Code: "TWICEACODE", Credits: 10, PerUserLimit: 2, MaxRedemptions: &two},
+		entity.PromoCode{ID: "6", Code: "PROMONTH30", SubscriptionPlan: &pro, SubscriptionDays: 30, PerUserLimit: 1},
+	)
+	repo.subscriptions["store"] = entity.Subscription{Plan: "pro", Type: string(entity.SubscriptionTypeNormal), Status: string(entity.SubscriptionStatusActive), ExpiresAt: &storeExpiresAt}
+	repo.subscriptions["promo"] = entity.Subscription{Plan: "pro", Type: string(entity.SubscriptionTypePromo), Status: string(entity.SubscriptionStatusActive), ExpiresAt: &promoExpiresAt}
+	repo.subscriptions["long"] = entity.Subscription{Plan: "pro", Type: string(entity.SubscriptionTypePromo), Status: string(entity.SubscriptionStatusActive), ExpiresAt: &longPromoExpiresAt}
+	credits := &mockCredits{granted: map[string]int{}}
+	logger, _ := log.NewForTest()
+	s := NewService(repo, repo.transact, credits, mockCache{}, logger)
+
+	tests := []struct {
+		name        string
+		user        string
+		code        string
+		wantCode    string
+		wantCredits int
+	}{
+		{"credits", "user1", "welcome100", "", 100},
+		{"already redeemed", "user1", "WELCOME100", "already_redeemed", 0},
+		{"unknown", "user1", "UNKNOWNCODE", "invalid_code", 0},
+		{"not active yet", "user1", "NOTYETACTIVE", "code_not_active", 0},
+		{"expired", "user1", "EXPIREDCODE", "code_expired", 0},
+		{"used up", "user1", "USEDUPCODE", "code_exhausted", 0},
+		{"limited first", "user1", "TWICEACODE", "", 10},
+		{"limited last", "user1", "TWICEACODE", "", 10},
+		{"limited used up", "user1", "TWICEACODE", "code_exhausted", 0},
+		{"subscription", "user1", "PROMONTH30", "", 0},
+		{"store subscription kept", "store", "PROMONTH30", "already_subscribed", 0},
+		{"shorter promo subscription replaced", "promo", "PROMONTH30", "", 0},
+		{"longer promo subscription kept", "long", "PROMONTH30", "already_subscribed", 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			redemption, err := s.Redeem(withUser(tc.user), tc.code)
+			if tc.wantCode != "" {
+				assert.Equal(t, tc.wantCode, errorCode(err))
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.wantCredits, redemption.Credits)
+			}
+		})
+	}
+
+	assert.Equal(t, map[string]int{"user1": 120}, credits.granted)
+	assert.Equal(t, string(entity.SubscriptionTypePromo), repo.subscriptions["user1"].Type)
+	assert.Equal(t, storeExpiresAt, *repo.subscriptions["store"].ExpiresAt)
+	assert.True(t, repo.subscriptions["promo"].ExpiresAt.After(promoExpiresAt))
+	assert.Equal(t, longPromoExpiresAt, *repo.subscriptions["long"].ExpiresAt)
+}
+
+func TestService_Redeem_Concurrent(t *testing.T) {
+	maxRedemptions := 5
+	repo := newMockRepository(entity.PromoCode{ID: "1", Code: "LIMITED50", Credits: 50, PerUserLimit: 2, MaxRedemptions: &maxRedemptions})
+	credits := &mockCredits{granted: map[string]int{}}
+	logger, _ := log.NewForTest()
+	s := NewService(repo, repo.transact, credits, mockCache{}, logger)
+
+	// 10 users redeem the code twice each at the same time
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	redeemed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if _, err := s.Redeem(withUser(user), "LIMITED50"); err == nil {
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			} else {
+				assert.Equal(t, "code_exhausted", errorCode(err))
+			}
+		}(fmt.Sprintf("user%d", i%10))
+	}
+	wg.Wait()
+
+	assert.Equal(t, maxRedemptions, redeemed)
+	assert.Len(t, repo.redemptions, maxRedemptions)
+	assert.Equal(t, maxRedemptions, repo.codes["LIMITED50"].Redemptions)
+	total := 0
+	for _, granted := range credits.granted {
+		total += granted
+	}
+	assert.Equal(t, maxRedemptions*50, total)
+}
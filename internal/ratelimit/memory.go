@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the buckets in memory. The limits are only enforced per server instance.
+type memoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+type memoryBucket struct {
+	bucket
+	fullAt time.Time
+}
+
+// NewMemoryStore creates a Store that keeps the buckets in memory.
+func NewMemoryStore() Store {
+	return &memoryStore{buckets: map[string]*memoryBucket{}}
+}
+
+// Take implements Store.
+func (s *memoryStore) Take(_ context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{bucket: bucket{tokens: limit.capacity(), updatedAt: now}}
+		s.buckets[key] = b
+	}
+	allowed, retryAfter := b.take(now, limit)
+	b.fullAt = b.bucket.fullAt(limit)
+	return allowed, retryAfter, nil
+}
+
+// Prune implements Store.
+func (s *memoryStore) Prune(_ context.Context) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, b := range s.buckets {
+		if b.fullAt.Before(now) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
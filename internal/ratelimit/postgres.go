@@ -0,0 +1,68 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+)
+
+// postgresStore keeps the buckets in the rate_limit_bucket table, so that the limits are shared
+// by every server instance.
+type postgresStore struct {
+	db *dbcontext.DB
+}
+
+// NewPostgresStore creates a Store that keeps the buckets in Postgres.
+func NewPostgresStore(db *dbcontext.DB) Store {
+	return postgresStore{db}
+}
+
+// Take implements Store.
+// The bucket row is locked while it is updated, so concurrent requests of the same key are serialized.
+func (s postgresStore) Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error) {
+	var allowed bool
+	var retryAfter time.Duration
+
+	err := s.db.Transactional(ctx, func(ctx context.Context) error {
+		now := time.Now()
+		_, err := s.db.With(ctx).NewQuery(`INSERT INTO rate_limit_bucket (key, tokens, updated_at, full_at)
+			VALUES ({:key}, {:tokens}, {:now}, {:now})
+			ON CONFLICT (key) DO NOTHING`,
+		).Bind(dbx.Params{"key": key, "tokens": limit.capacity(), "now": now}).Execute()
+		if err != nil {
+			return err
+		}
+
+		var row struct {
+			Tokens    float64   `db:"tokens"`
+			UpdatedAt time.Time `db:"updated_at"`
+		}
+		err = s.db.With(ctx).NewQuery(`SELECT tokens, updated_at FROM rate_limit_bucket WHERE key = {:key} FOR UPDATE`).
+			Bind(dbx.Params{"key": key}).
+			One(&row)
+		if err != nil {
+			return err
+		}
+
+		b := bucket{tokens: row.Tokens, updatedAt: row.UpdatedAt}
+		allowed, retryAfter = b.take(now, limit)
+		_, err = s.db.With(ctx).Update("rate_limit_bucket", dbx.Params{
+			"tokens":     b.tokens,
+			"updated_at": b.updatedAt,
+			"full_at":    b.fullAt(limit),
+		}, dbx.HashExp{"key": key}).Execute()
+		return err
+	})
+
+	return allowed, retryAfter, err
+}
+
+// Prune implements Store.
+func (s postgresStore) Prune(ctx context.Context) error {
+	_, err := s.db.With(ctx).Delete("rate_limit_bucket",
+		dbx.NewExp("full_at < {:now}", dbx.Params{"now": time.Now()}),
+	).Execute()
+	return err
+}
@@ -0,0 +1,178 @@
+// Package ratelimit provides a middleware that limits requests with token buckets.
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/client"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// maxBodySize is the maximum size of a request body read to extract a rate limiting key.
+const maxBodySize = 64 << 10
+
+// Limit configures a token bucket. The bucket holds up to Burst tokens and is refilled
+// with Requests tokens every Period. A Limit without requests does not limit anything.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// IsZero reports whether the limit is disabled.
+func (l Limit) IsZero() bool {
+	return l.Requests <= 0 || l.Period <= 0
+}
+
+func (l Limit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// rate returns the number of tokens added to the bucket per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// bucket is the state of a token bucket.
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// take refills the bucket for the time passed since the last update and takes a token if one is available.
+// If no token is available, it returns how long until the next token is added.
+func (b *bucket) take(now time.Time, limit Limit) (bool, time.Duration) {
+	elapsed := now.Sub(b.updatedAt).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(limit.capacity(), b.tokens+elapsed*limit.rate())
+		b.updatedAt = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / limit.rate()
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// fullAt returns the time at which the bucket is full again, after which its state can be discarded.
+func (b bucket) fullAt(limit Limit) time.Time {
+	missing := limit.capacity() - b.tokens
+	return b.updatedAt.Add(time.Duration(missing / limit.rate() * float64(time.Second)))
+}
+
+// Store keeps the token buckets.
+type Store interface {
+	// Take takes a token from the bucket with the given key. If the request is not allowed,
+	// it returns how long the client should wait before retrying.
+	Take(ctx context.Context, key string, limit Limit) (bool, time.Duration, error)
+	// Prune discards the buckets that are full, since they are equivalent to new buckets.
+	// It is meant to be run as a background job.
+	Prune(ctx context.Context) error
+}
+
+// KeyFunc returns the value a request is limited by. Requests with an empty value are not limited by the rule.
+type KeyFunc func(c *routing.Context) string
+
+// Rule limits the requests with the same key.
+type Rule struct {
+	// Name identifies the rule in the bucket keys, e.g. "ip" or "device".
+	Name  string
+	Key   KeyFunc
+	Limit Limit
+}
+
+// Limiter creates rate limiting middlewares sharing the same store.
+type Limiter struct {
+	store  Store
+	logger log.Logger
+}
+
+// New creates a new Limiter.
+func New(store Store, logger log.Logger) *Limiter {
+	return &Limiter{store, logger}
+}
+
+// Handler returns a middleware that limits the requests of a route group by the given rules.
+// Each rule has its own buckets. Requests exceeding a limit are rejected with 429 and a Retry-After header.
+// If the store fails, the request is let through so that an outage of the store does not take the API down.
+func (l *Limiter) Handler(group string, rules ...Rule) routing.Handler {
+	return func(c *routing.Context) error {
+		ctx := c.Request.Context()
+		for _, rule := range rules {
+			if rule.Limit.IsZero() {
+				continue
+			}
+			value := rule.Key(c)
+			if value == "" {
+				continue
+			}
+
+			allowed, retryAfter, err := l.store.Take(ctx, group+":"+rule.Name+":"+value, rule.Limit)
+			if err != nil {
+				l.logger.With(ctx).Errorf("There is an error while taking a rate limit token %v", err)
+				return nil
+			}
+			if !allowed {
+				seconds := int(math.Ceil(retryAfter.Seconds()))
+				c.Response.Header().Set("Retry-After", strconv.Itoa(seconds))
+				l.logger.With(ctx, "group", group, "rule", rule.Name).Infof("rate limit exceeded")
+				return errors.TooManyRequests("", "rate_limited")
+			}
+		}
+		return nil
+	}
+}
+
+// ByIP returns a KeyFunc that limits requests by the IP address of the client recorded by client.Handler.
+func ByIP() KeyFunc {
+	return func(c *routing.Context) string {
+		return client.FromContext(c.Request.Context()).IP
+	}
+}
+
+// ByUser returns a KeyFunc that limits requests by the ID of the authenticated user.
+// It must be used after the authentication middleware.
+func ByUser() KeyFunc {
+	return func(c *routing.Context) string {
+		if user := auth.CurrentUser(c.Request.Context()); user != nil {
+			return user.ID
+		}
+		return ""
+	}
+}
+
+// ByJSONField returns a KeyFunc that limits requests by a string field of the JSON request body.
+// The body is restored so that the handlers can still read it.
+func ByJSONField(field string) KeyFunc {
+	return func(c *routing.Context) string {
+		if c.Request.Body == nil {
+			return ""
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxBodySize))
+		c.Request.Body.Close()
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return ""
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			return ""
+		}
+		value, _ := fields[field].(string)
+		return value
+	}
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/test"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBucket_Take(t *testing.T) {
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	// 10 requests per minute, one every 6 seconds, with bursts of up to 5 requests
+	limit := Limit{Requests: 10, Period: time.Minute, Burst: 5}
+
+	tests := []struct {
+		name        string
+		tokens      float64
+		elapsed     time.Duration
+		wantAllowed bool
+		wantWait    time.Duration
+		wantTokens  float64
+	}{
+		{"full", 5, 0, true, 0, 4},
+		{"last token", 1, 0, true, 0, 0},
+		{"empty", 0, 0, false, 6 * time.Second, 0},
+		{"partly refilled", 0, 3 * time.Second, false, 3 * time.Second, 0.5},
+		{"refilled", 0, 6 * time.Second, true, 0, 0},
+		{"refilled up to the burst", 0, time.Hour, true, 0, 4},
+		{"clock going back", 0, -time.Second, false, 6 * time.Second, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := bucket{tokens: tc.tokens, updatedAt: start}
+			allowed, wait := b.take(start.Add(tc.elapsed), limit)
+			assert.Equal(t, tc.wantAllowed, allowed)
+			assert.Equal(t, tc.wantWait, wait)
+			assert.InDelta(t, tc.wantTokens, b.tokens, 1e-9)
+		})
+	}
+}
+
+func TestBucket_FullAt(t *testing.T) {
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		limit  Limit
+		tokens float64
+		want   time.Time
+	}{
+		{"full", Limit{Requests: 10, Period: time.Minute}, 10, start},
+		{"empty", Limit{Requests: 10, Period: time.Minute}, 0, start.Add(time.Minute)},
+		{"empty burst", Limit{Requests: 10, Period: time.Minute, Burst: 5}, 0, start.Add(30 * time.Second)},
+		{"half full", Limit{Requests: 20, Period: time.Hour, Burst: 5}, 2.5, start.Add(450 * time.Second)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := bucket{tokens: tc.tokens, updatedAt: start}
+			assert.Equal(t, tc.want, b.fullAt(tc.limit))
+		})
+	}
+}
+
+func TestLimit_IsZero(t *testing.T) {
+	assert.True(t, Limit{}.IsZero())
+	assert.True(t, Limit{Requests: 10}.IsZero())
+	assert.True(t, Limit{Period: time.Minute}.IsZero())
+	assert.False(t, Limit{Requests: 10, Period: time.Minute}.IsZero())
+}
+
+func TestLimiter_Handler(t *testing.T) {
+	logger, _ := log.NewForTest()
+	limiter := New(NewMemoryStore(), logger)
+
+	router := test.MockRouter(logger)
+	router.Post("/login",
+		limiter.Handler("login",
+			Rule{Name: "device", Key: ByJSONField("device_key"), Limit: Limit{Requests: 2, Period: time.Minute}},
+			Rule{Name: "disabled", Key: ByJSONField("device_key"), Limit: Limit{}},
+		),
+		func(c *routing.Context) error {
+			// the handler still reads the body the device key has been taken from
+			var req struct {
+				DeviceKey string `json:"device_key"`
+			}
+			if err := c.Read(&req); err != nil {
+				return err
+			}
+			return c.Write(req.DeviceKey)
+		},
+	)
+
+	tests := []test.APITestCase{
+		{Name: "first", Method: "POST", URL: "/login", Body: `{"device_key":"device1"}`, WantStatus: http.StatusOK, WantResponse: `"device1"`},
+		{Name: "second", Method: "POST", URL: "/login", Body: `{"device_key":"device1"}`, WantStatus: http.StatusOK, WantResponse: `"device1"`},
+		{Name: "limited", Method: "POST", URL: "/login", Body: `{"device_key":"device1"}`,
+			WantStatus: http.StatusTooManyRequests, WantResponse: `*"error_code":"rate_limited"*`},
+		{Name: "other device", Method: "POST", URL: "/login", Body: `{"device_key":"device2"}`, WantStatus: http.StatusOK, WantResponse: `"device2"`},
+		{Name: "no device key", Method: "POST", URL: "/login", Body: `{}`, WantStatus: http.StatusOK, WantResponse: `""`},
+	}
+	for _, tc := range tests {
+		test.Endpoint(t, router, tc)
+	}
+
+	// a token is added every 30 seconds
+	req, _ := http.NewRequest("POST", "/login", bytes.NewBufferString(`{"device_key":"device1"}`))
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	router.ServeHTTP(res, req)
+	assert.Equal(t, http.StatusTooManyRequests, res.Code)
+	assert.Equal(t, "30", res.Header().Get("Retry-After"))
+}
+
+func TestMemoryStore_Prune(t *testing.T) {
+	store := NewMemoryStore().(*memoryStore)
+	limit := Limit{Requests: 1, Period: time.Hour}
+	ctx := context.Background()
+
+	allowed, _, _ := store.Take(ctx, "key1", limit)
+	assert.True(t, allowed)
+	store.buckets["key2"] = &memoryBucket{fullAt: time.Now().Add(-time.Second)}
+
+	assert.NoError(t, store.Prune(ctx))
+	assert.Contains(t, store.buckets, "key1")
+	assert.NotContains(t, store.buckets, "key2")
+
+	allowed, retryAfter, _ := store.Take(ctx, "key1", limit)
+	assert.False(t, allowed)
+	assert.InDelta(t, time.Hour.Seconds(), retryAfter.Seconds(), 1)
+}
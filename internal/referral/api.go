@@ -0,0 +1,51 @@
+package referral
+
+import (
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// RegisterHandlers sets up the routing of the HTTP handlers.
+func RegisterHandlers(rg *routing.RouteGroup, service Service, authHandler routing.Handler, logger log.Logger) {
+	res := resource{service, logger}
+
+	rg.Use(authHandler)
+
+	// the following endpoints require a valid JWT
+	rg.Get("/referrals", res.summary)
+	rg.Post("/referrals/redeem", res.redeem)
+}
+
+type resource struct {
+	service Service
+	logger  log.Logger
+}
+
+func (r resource) summary(c *routing.Context) error {
+	summary, err := r.service.GetSummary(c.Request.Context())
+	if err != nil {
+		return err
+	}
+
+	return c.Write(summary)
+}
+
+func (r resource) redeem(c *routing.Context) error {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.Read(&req); err != nil {
+		r.logger.With(c.Request.Context()).Errorf("invalid request: %v", err)
+		return errors.BadRequest("", "")
+	}
+	if req.Code == "" {
+		return errors.BadRequest("The referral code is required", "invalid_code")
+	}
+
+	if err := r.service.Redeem(c.Request.Context(), req.Code); err != nil {
+		return err
+	}
+
+	return c.Write("success")
+}
@@ -0,0 +1,243 @@
+package referral
+
+import (
+	"context"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Repository encapsulates the logic to access the referral codes and the referrals.
+type Repository interface {
+	// GetCode returns the referral code of the user.
+	GetCode(ctx context.Context, userID string) (string, error)
+	// CreateCode saves the referral code of the user. It returns false without saving the code if the user already has one.
+	CreateCode(ctx context.Context, userID, code string) (bool, error)
+	// GetUserIDByCode returns the ID of the user the referral code belongs to.
+	GetUserIDByCode(ctx context.Context, code string) (string, error)
+	// LockReferrer locks the referral code of the referrer until the end of the transaction,
+	// so that the rewards of the referrer are granted one at a time.
+	LockReferrer(ctx context.Context, referrerID string) error
+	// GetUserCreatedAt returns the time the user has signed up.
+	GetUserCreatedAt(ctx context.Context, userID string) (time.Time, error)
+
+	// SharesDevice tells whether the users have signed in on the same device.
+	SharesDevice(ctx context.Context, userID, otherUserID string) (bool, error)
+	// SharesIP tells whether the users have signed in from the same IP address, or whether the first user
+	// has signed in from the given IP address.
+	SharesIP(ctx context.Context, userID, otherUserID, ip string) (bool, error)
+
+	// CreateReferral saves a new referral. It returns false without saving the referral if the referee has already been referred.
+	CreateReferral(ctx context.Context, referral entity.Referral) (bool, error)
+	// LockPendingReferral returns the pending referral of the referee. The referral is locked until the end of the transaction.
+	LockPendingReferral(ctx context.Context, refereeID string) (entity.Referral, error)
+	// HasQualified tells whether the user has completed a qualifying action: uploaded an album image or made a purchase.
+	HasQualified(ctx context.Context, userID string) (bool, error)
+	// ListQualifiedReferees returns the referees of the pending referrals who have completed a qualifying action.
+	ListQualifiedReferees(ctx context.Context, limit int) ([]string, error)
+	// CountRewardedReferrals returns the number of the rewarded referrals of the referrer, whether the referrer got credits for them or not.
+	CountRewardedReferrals(ctx context.Context, referrerID string) (int, error)
+	// SetRewarded records the rewards granted for the referral.
+	SetRewarded(ctx context.Context, id string, referrerCredits, refereeCredits int) error
+	// GetSummary returns the referrals of the referrer which have not been rejected and the credits the referrer has earned.
+	GetSummary(ctx context.Context, referrerID string) (Summary, error)
+}
+
+type repository struct {
+	db     *dbcontext.DB
+	logger log.Logger
+}
+
+// NewRepository creates a new referral repository.
+func NewRepository(db *dbcontext.DB, logger log.Logger) Repository {
+	return repository{db, logger}
+}
+
+// GetCode implements Repository.
+func (r repository) GetCode(ctx context.Context, userID string) (string, error) {
+	var code string
+	err := r.db.With(ctx).Select("code").From("referral_code").Where(dbx.HashExp{"user_id": userID}).Row(&code)
+
+	return code, err
+}
+
+// CreateCode implements Repository.
+func (r repository) CreateCode(ctx context.Context, userID, code string) (bool, error) {
+	result, err := r.db.With(ctx).NewQuery(`INSERT INTO referral_code (user_id, code, created_at)
+		VALUES ({:user_id}, {:code}, {:created_at})
+		ON CONFLICT (user_id) DO NOTHING`,
+	).Bind(dbx.Params{"user_id": userID, "code": code, "created_at": time.Now()}).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// GetUserIDByCode implements Repository.
+func (r repository) GetUserIDByCode(ctx context.Context, code string) (string, error) {
+	var userID string
+	err := r.db.With(ctx).NewQuery(`SELECT c.user_id FROM referral_code AS c
+		JOIN public.user AS u ON u.id = c.user_id
+		WHERE c.code = {:code} AND u.deleted_at IS NULL AND u.banned_at IS NULL`,
+	).Bind(dbx.Params{"code": code}).Row(&userID)
+
+	return userID, err
+}
+
+// LockReferrer implements Repository.
+func (r repository) LockReferrer(ctx context.Context, referrerID string) error {
+	var userID string
+	return r.db.With(ctx).NewQuery(`SELECT user_id FROM referral_code WHERE user_id = {:user_id} FOR UPDATE`).
+		Bind(dbx.Params{"user_id": referrerID}).
+		Row(&userID)
+}
+
+// GetUserCreatedAt implements Repository.
+func (r repository) GetUserCreatedAt(ctx context.Context, userID string) (time.Time, error) {
+	var createdAt time.Time
+	err := r.db.With(ctx).Select("created_at").From("public.user").Where(dbx.HashExp{"id": userID}).Row(&createdAt)
+
+	return createdAt, err
+}
+
+// SharesDevice implements Repository.
+// The devices are compared by the device keys of the sessions and of the audit log, which outlives the sessions.
+func (r repository) SharesDevice(ctx context.Context, userID, otherUserID string) (bool, error) {
+	var shares bool
+	err := r.db.With(ctx).NewQuery(`SELECT EXISTS (
+			SELECT 1 FROM refresh_token AS a JOIN refresh_token AS b ON b.device_key = a.device_key
+			WHERE a.user_id = {:user_id} AND b.user_id = {:other_user_id}
+		) OR EXISTS (
+			SELECT 1 FROM auth_event AS a JOIN auth_event AS b ON b.device_key_hash = a.device_key_hash
+			WHERE a.user_id = {:user_id} AND b.user_id = {:other_user_id}
+		)`,
+	).Bind(dbx.Params{"user_id": userID, "other_user_id": otherUserID}).Row(&shares)
+
+	return shares, err
+}
+
+// SharesIP implements Repository.
+func (r repository) SharesIP(ctx context.Context, userID, otherUserID, ip string) (bool, error) {
+	var shares bool
+	err := r.db.With(ctx).NewQuery(`SELECT EXISTS (
+			SELECT 1 FROM auth_event AS a
+			WHERE a.user_id = {:user_id} AND (a.ip = {:ip} OR a.ip IN (
+				SELECT b.ip FROM auth_event AS b WHERE b.user_id = {:other_user_id} AND b.ip IS NOT NULL
+			))
+		)`,
+	).Bind(dbx.Params{"user_id": userID, "other_user_id": otherUserID, "ip": ip}).Row(&shares)
+
+	return shares, err
+}
+
+// CreateReferral implements Repository.
+func (r repository) CreateReferral(ctx context.Context, referral entity.Referral) (bool, error) {
+	result, err := r.db.With(ctx).NewQuery(`INSERT INTO referral (id, referrer_id, referee_id, status, reason, ip, created_at)
+		VALUES ({:id}, {:referrer_id}, {:referee_id}, {:status}, {:reason}, {:ip}, {:created_at})
+		ON CONFLICT (referee_id) DO NOTHING`,
+	).Bind(dbx.Params{
+		"id":          referral.ID,
+		"referrer_id": referral.ReferrerID,
+		"referee_id":  referral.RefereeID,
+		"status":      referral.Status,
+		"reason":      referral.Reason,
+		"ip":          referral.IP,
+		"created_at":  referral.CreatedAt,
+	}).Execute()
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// LockPendingReferral implements Repository.
+func (r repository) LockPendingReferral(ctx context.Context, refereeID string) (entity.Referral, error) {
+	var referral entity.Referral
+	err := r.db.With(ctx).NewQuery(`SELECT * FROM referral
+		WHERE referee_id = {:referee_id} AND status = {:status}
+		FOR UPDATE`,
+	).Bind(dbx.Params{"referee_id": refereeID, "status": string(entity.ReferralStatusPending)}).One(&referral)
+
+	return referral, err
+}
+
+// qualifiedExp is the condition of the users who have completed a qualifying action. A trial or a promotional
+// subscription is not a purchase.
+const qualifiedExp = `(EXISTS (SELECT 1 FROM file AS f WHERE f.user_id = u.id AND f.subject = 'album' AND f.deleted_at IS NULL)
+	OR EXISTS (SELECT 1 FROM store_purchase AS p WHERE p.user_id = u.id)
+	OR (u.subscription_status = 'active' AND u.subscription_type NOT IN ('trial', 'promo')))`
+
+// HasQualified implements Repository.
+func (r repository) HasQualified(ctx context.Context, userID string) (bool, error) {
+	var qualified bool
+	err := r.db.With(ctx).NewQuery(`SELECT ` + qualifiedExp + ` FROM public.user AS u WHERE u.id = {:user_id}`).
+		Bind(dbx.Params{"user_id": userID}).
+		Row(&qualified)
+
+	return qualified, err
+}
+
+// ListQualifiedReferees implements Repository.
+func (r repository) ListQualifiedReferees(ctx context.Context, limit int) ([]string, error) {
+	refereeIDs := []string{}
+	err := r.db.With(ctx).NewQuery(`SELECT r.referee_id FROM referral AS r
+		JOIN public.user AS u ON u.id = r.referee_id
+		WHERE r.status = {:status} AND ` + qualifiedExp + `
+		ORDER BY r.created_at
+		LIMIT {:limit}`,
+	).Bind(dbx.Params{"status": string(entity.ReferralStatusPending), "limit": limit}).Column(&refereeIDs)
+
+	return refereeIDs, err
+}
+
+// CountRewardedReferrals implements Repository.
+func (r repository) CountRewardedReferrals(ctx context.Context, referrerID string) (int, error) {
+	var count int
+	err := r.db.With(ctx).Select("COUNT(*)").From("referral").
+		Where(dbx.HashExp{"referrer_id": referrerID, "status": string(entity.ReferralStatusRewarded)}).
+		Row(&count)
+
+	return count, err
+}
+
+// SetRewarded implements Repository.
+func (r repository) SetRewarded(ctx context.Context, id string, referrerCredits, refereeCredits int) error {
+	_, err := r.db.With(ctx).Update("referral",
+		dbx.Params{
+			"status":           string(entity.ReferralStatusRewarded),
+			"referrer_credits": referrerCredits,
+			"referee_credits":  refereeCredits,
+			"rewarded_at":      time.Now(),
+		},
+		dbx.HashExp{"id": id},
+	).Execute()
+
+	return err
+}
+
+// GetSummary implements Repository.
+func (r repository) GetSummary(ctx context.Context, referrerID string) (Summary, error) {
+	var summary Summary
+	err := r.db.With(ctx).NewQuery(`SELECT
+			COUNT(*) AS referrals,
+			COUNT(*) FILTER (WHERE status = {:pending}) AS pending,
+			COUNT(*) FILTER (WHERE status = {:rewarded}) AS rewarded,
+			COALESCE(SUM(referrer_credits), 0) AS credits_earned
+		FROM referral
+		WHERE referrer_id = {:referrer_id} AND status != {:rejected}`,
+	).Bind(dbx.Params{
+		"referrer_id": referrerID,
+		"pending":     string(entity.ReferralStatusPending),
+		"rewarded":    string(entity.ReferralStatusRewarded),
+		"rejected":    string(entity.ReferralStatusRejected),
+	}).One(&summary)
+
+	return summary, err
+}
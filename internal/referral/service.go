@@ -0,0 +1,306 @@
+package referral
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	stderr "errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/internal/errors"
+	"github.com/qiangxue/go-rest-api/pkg/client"
+	"github.com/qiangxue/go-rest-api/pkg/dbcontext"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+const (
+	// creditReason is the reason of the credits granted for a referral.
+	creditReason = "referral"
+	// codeLength is the length of the generated referral codes.
+	codeLength = 8
+	// codeAlphabet leaves out the characters which are easily confused, e.g. 0 and O.
+	codeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	// codeAttempts is the number of the codes tried when the generated codes are taken.
+	codeAttempts = 5
+	// qualifyBatchSize is the maximum number of referrals rewarded by one run of the referral job.
+	qualifyBatchSize = 500
+)
+
+// Service encapsulates the usecase logic for the referral program.
+type Service interface {
+	// GetSummary returns the referral code of the current user, which is created on the first call,
+	// along with their referrals and the credits they have earned.
+	GetSummary(ctx context.Context) (Summary, error)
+	// Redeem records that the current user has been referred by the owner of the referral code.
+	// Only new users can redeem a code, and a referral from the same device or IP address is rejected.
+	Redeem(ctx context.Context, code string) error
+	// Qualify rewards the pending referral of the user if they have completed a qualifying action.
+	// It is called after the actions which may qualify a referral.
+	Qualify(ctx context.Context, userID string) error
+	// QualifyReferrals rewards the pending referrals whose referees have completed a qualifying action.
+	// It is meant to be run as a background job, which makes up for the calls of Qualify which have failed.
+	QualifyReferrals(ctx context.Context) error
+}
+
+// Program holds the rewards and the limits of the referral program.
+type Program struct {
+	// ReferrerCredits is the number of the credits the referrer gets for a referral.
+	ReferrerCredits int
+	// RefereeCredits is the number of the credits the referee gets.
+	RefereeCredits int
+	// MaxRewards is the number of the referrals a referrer can be rewarded for. Zero means no limit.
+	// The referees of the referrers who have reached the limit are still rewarded.
+	MaxRewards int
+	// RedeemWindow is how long after signing up a user can redeem a referral code.
+	RedeemWindow time.Duration
+}
+
+// Summary is the referral code of a user and what their referrals have earned them.
+type Summary struct {
+	Code          string `json:"code" db:"-"`
+	Referrals     int    `json:"referrals" db:"referrals"`
+	Pending       int    `json:"pending" db:"pending"`
+	Rewarded      int    `json:"rewarded" db:"rewarded"`
+	CreditsEarned int    `json:"credits_earned" db:"credits_earned"`
+}
+
+type service struct {
+	repo     Repository
+	transact dbcontext.TransactionFunc
+	credits  credit.Service
+	program  Program
+	users    auth.UserCache
+	logger   log.Logger
+}
+
+// NewService creates a new referral service.
+func NewService(repo Repository, transact dbcontext.TransactionFunc, credits credit.Service, program Program, users auth.UserCache, logger log.Logger) Service {
+	return service{repo, transact, credits, program, users, logger}
+}
+
+// GetSummary implements Service.
+func (s service) GetSummary(ctx context.Context) (Summary, error) {
+	userID := auth.CurrentUser(ctx).GetID()
+	code, err := s.getOrCreateCode(ctx, userID)
+	if err != nil {
+		s.logger.Errorf("There is an error while creating the referral code of user %s %v", userID, err)
+		return Summary{}, errors.InternalServerError("")
+	}
+
+	summary, err := s.repo.GetSummary(ctx, userID)
+	if err != nil {
+		return Summary{}, err
+	}
+	summary.Code = code
+	return summary, nil
+}
+
+// getOrCreateCode returns the referral code of the user, generating a new one if the user has none.
+func (s service) getOrCreateCode(ctx context.Context, userID string) (string, error) {
+	code, err := s.repo.GetCode(ctx, userID)
+	if !stderr.Is(err, sql.ErrNoRows) {
+		return code, err
+	}
+
+	for i := 0; i < codeAttempts; i++ {
+		if code, err = generateCode(); err != nil {
+			return "", err
+		}
+		_, err = s.repo.CreateCode(ctx, userID, code)
+		if isUniqueViolation(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		// the code of a concurrent request may have been saved instead
+		return s.repo.GetCode(ctx, userID)
+	}
+	return "", err
+}
+
+// Redeem implements Service.
+func (s service) Redeem(ctx context.Context, code string) error {
+	userID := auth.CurrentUser(ctx).GetID()
+	ip := client.FromContext(ctx).IP
+	logger := s.logger.With(ctx, "user", userID)
+
+	var referral entity.Referral
+	err := s.transact(ctx, func(ctx context.Context) error {
+		referrerID, err := s.repo.GetUserIDByCode(ctx, strings.ToUpper(strings.TrimSpace(code)))
+		if stderr.Is(err, sql.ErrNoRows) {
+			return errors.BadRequest("The referral code is not valid", "invalid_code")
+		} else if err != nil {
+			return err
+		}
+		if referrerID == userID {
+			return errors.BadRequest("You cannot redeem your own referral code", "self_referral")
+		}
+		createdAt, err := s.repo.GetUserCreatedAt(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if time.Since(createdAt) > s.program.RedeemWindow {
+			return errors.BadRequest("Only new users can redeem a referral code", "not_eligible")
+		}
+
+		referral = entity.Referral{
+			ID:         uuid.New().String(),
+			ReferrerID: referrerID,
+			RefereeID:  userID,
+			Status:     string(entity.ReferralStatusPending),
+			IP:         nullIfEmpty(ip),
+			CreatedAt:  time.Now(),
+		}
+		if reason, err := s.fraudReason(ctx, referrerID, userID, ip); err != nil {
+			return err
+		} else if reason != "" {
+			referral.Status = string(entity.ReferralStatusRejected)
+			referral.Reason = &reason
+		}
+
+		created, err := s.repo.CreateReferral(ctx, referral)
+		if err != nil {
+			return err
+		}
+		if !created {
+			return errors.BadRequest("You have already redeemed a referral code", "already_referred")
+		}
+		return nil
+	})
+	var errorResponse errors.ErrorResponse
+	if stderr.As(err, &errorResponse) {
+		return err
+	} else if err != nil {
+		logger.Errorf("There is an error while redeeming the referral code %s %v", code, err)
+		return errors.InternalServerError("")
+	}
+
+	if referral.Status == string(entity.ReferralStatusRejected) {
+		logger.Infof("referral from %s rejected: %s", referral.ReferrerID, *referral.Reason)
+		return errors.BadRequest("The referral code cannot be redeemed", "referral_rejected")
+	}
+	// the user may have completed a qualifying action before redeeming the code. A failed reward is retried by the referral job.
+	_ = s.Qualify(ctx, userID)
+	return nil
+}
+
+// fraudReason returns why a referral between the users is not allowed, or an empty string if it is allowed.
+func (s service) fraudReason(ctx context.Context, referrerID, refereeID, ip string) (string, error) {
+	if shares, err := s.repo.SharesDevice(ctx, referrerID, refereeID); err != nil || shares {
+		return "same_device", err
+	}
+	if shares, err := s.repo.SharesIP(ctx, referrerID, refereeID, ip); err != nil || shares {
+		return "same_ip", err
+	}
+	return "", nil
+}
+
+// Qualify implements Service.
+// The referral is rewarded at most once since it is locked and leaves the pending status, and the referrer
+// is locked too, so that the referrals rewarded at the same time cannot exceed the limit of the referrer.
+func (s service) Qualify(ctx context.Context, userID string) error {
+	var referral entity.Referral
+	var referrerCredits, refereeCredits int
+	err := s.transact(ctx, func(ctx context.Context) error {
+		var err error
+		referral, err = s.repo.LockPendingReferral(ctx, userID)
+		if stderr.Is(err, sql.ErrNoRows) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if qualified, err := s.repo.HasQualified(ctx, userID); err != nil || !qualified {
+			referral.ID = ""
+			return err
+		}
+
+		if err := s.repo.LockReferrer(ctx, referral.ReferrerID); err != nil {
+			return err
+		}
+		rewarded, err := s.repo.CountRewardedReferrals(ctx, referral.ReferrerID)
+		if err != nil {
+			return err
+		}
+		referrerCredits = s.program.ReferrerCredits
+		if s.program.MaxRewards > 0 && rewarded >= s.program.MaxRewards {
+			referrerCredits = 0
+		}
+		refereeCredits = s.program.RefereeCredits
+
+		if referrerCredits > 0 {
+			if _, err := s.credits.Grant(ctx, referral.ReferrerID, referrerCredits, nil, creditReason, referral.ID); err != nil {
+				return err
+			}
+		}
+		if refereeCredits > 0 {
+			if _, err := s.credits.Grant(ctx, referral.RefereeID, refereeCredits, nil, creditReason, referral.ID); err != nil {
+				return err
+			}
+		}
+		return s.repo.SetRewarded(ctx, referral.ID, referrerCredits, refereeCredits)
+	})
+	if err != nil {
+		s.logger.Errorf("There is an error while rewarding the referral of user %s %v", userID, err)
+		return errors.InternalServerError("")
+	}
+
+	if referral.ID != "" {
+		// the users cached before the commit would still have their previous balances
+		s.users.Invalidate(referral.ReferrerID, referral.RefereeID)
+		s.logger.With(ctx, "user", userID).Infof("referral %s rewarded with %d credits for the referrer and %d for the referee",
+			referral.ID, referrerCredits, refereeCredits)
+	}
+	return nil
+}
+
+// QualifyReferrals implements Service.
+// A referral which fails to be rewarded is logged by Qualify and skipped, so that it does not hold up the others.
+func (s service) QualifyReferrals(ctx context.Context) error {
+	refereeIDs, err := s.repo.ListQualifiedReferees(ctx, qualifyBatchSize)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, refereeID := range refereeIDs {
+		if err := s.Qualify(ctx, refereeID); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		s.logger.With(ctx).Errorf("failed to reward %d of %d qualified referrals", failed, len(refereeIDs))
+	}
+	return nil
+}
+
+// generateCode generates a random referral code.
+func generateCode() (string, error) {
+	code := make([]byte, codeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(codeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = codeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+func nullIfEmpty(value string) *string {
+	if value == "" {
+		return nil
+	}
+	return &value
+}
+
+// isUniqueViolation reports whether the error is caused by a unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return stderr.As(err, &pqErr) && pqErr.Code == "23505"
+}
@@ -0,0 +1,150 @@
+package referral
+
+import (
+	"context"
+	"database/sql"
+	stderr "errors"
+	"testing"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/internal/auth"
+	"github.com/qiangxue/go-rest-api/internal/credit"
+	"github.com/qiangxue/go-rest-api/internal/entity"
+	"github.com/qiangxue/go-rest-api/pkg/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockRepository keeps the referrals in memory. Each referee is referred by the referrer with the ID "referrer".
+type mockRepository struct {
+	Repository
+	referrals map[string]*entity.Referral
+}
+
+func newMockRepository(refereeIDs ...string) *mockRepository {
+	r := &mockRepository{referrals: map[string]*entity.Referral{}}
+	for _, id := range refereeIDs {
+		r.referrals[id] = &entity.Referral{ID: "referral-" + id, ReferrerID: "referrer", RefereeID: id, Status: string(entity.ReferralStatusPending)}
+	}
+	return r
+}
+
+func (r *mockRepository) ListQualifiedReferees(_ context.Context, _ int) ([]string, error) {
+	var ids []string
+	for id, referral := range r.referrals {
+		if referral.Status == string(entity.ReferralStatusPending) {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r *mockRepository) LockPendingReferral(_ context.Context, refereeID string) (entity.Referral, error) {
+	if referral, ok := r.referrals[refereeID]; ok && referral.Status == string(entity.ReferralStatusPending) {
+		return *referral, nil
+	}
+	return entity.Referral{}, sql.ErrNoRows
+}
+
+func (r *mockRepository) HasQualified(_ context.Context, _ string) (bool, error) {
+	return true, nil
+}
+
+func (r *mockRepository) LockReferrer(_ context.Context, _ string) error {
+	return nil
+}
+
+func (r *mockRepository) CountRewardedReferrals(_ context.Context, referrerID string) (int, error) {
+	count := 0
+	for _, referral := range r.referrals {
+		if referral.ReferrerID == referrerID && referral.Status == string(entity.ReferralStatusRewarded) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (r *mockRepository) SetRewarded(_ context.Context, id string, referrerCredits, refereeCredits int) error {
+	for _, referral := range r.referrals {
+		if referral.ID == id {
+			referral.Status = string(entity.ReferralStatusRewarded)
+			referral.ReferrerCredits = referrerCredits
+			referral.RefereeCredits = refereeCredits
+		}
+	}
+	return nil
+}
+
+// mockCredits records the credits granted to the users, and fails to grant credits to the users in failing.
+type mockCredits struct {
+	credit.Service
+	granted map[string]int
+	failing map[string]bool
+}
+
+func (m *mockCredits) Grant(_ context.Context, userID string, amount int, _ *time.Time, _, _ string) (entity.CreditTransaction, error) {
+	if m.failing[userID] {
+		return entity.CreditTransaction{}, stderr.New("grant failed")
+	}
+	m.granted[userID] += amount
+	return entity.CreditTransaction{}, nil
+}
+
+// mockTransactor runs the functions as transactions and tells whether one is running.
+type mockTransactor struct {
+	active bool
+}
+
+func (m *mockTransactor) transact(ctx context.Context, f func(ctx context.Context) error) error {
+	m.active = true
+	defer func() { m.active = false }()
+	return f(ctx)
+}
+
+// mockCache records the users invalidated after the transactions have been committed.
+type mockCache struct {
+	auth.UserCache
+	tx          *mockTransactor
+	invalidated []string
+}
+
+func (c *mockCache) Invalidate(userIDs ...string) {
+	if !c.tx.active {
+		c.invalidated = append(c.invalidated, userIDs...)
+	}
+}
+
+func TestService_QualifyReferrals(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository("referee1", "referee2", "referee3")
+	credits := &mockCredits{granted: map[string]int{}, failing: map[string]bool{"referee2": true}}
+	tx := &mockTransactor{}
+	s := NewService(repo, tx.transact, credits, Program{ReferrerCredits: 10, RefereeCredits: 5}, &mockCache{tx: tx}, logger)
+
+	assert.NoError(t, s.QualifyReferrals(context.Background()))
+	assert.Equal(t, string(entity.ReferralStatusRewarded), repo.referrals["referee1"].Status)
+	assert.Equal(t, string(entity.ReferralStatusPending), repo.referrals["referee2"].Status)
+	assert.Equal(t, string(entity.ReferralStatusRewarded), repo.referrals["referee3"].Status)
+	assert.Equal(t, 5, credits.granted["referee1"])
+	assert.Equal(t, 5, credits.granted["referee3"])
+}
+
+func TestService_Qualify_MaxRewards(t *testing.T) {
+	logger, _ := log.NewForTest()
+	repo := newMockRepository("referee1", "referee2", "referee3")
+	credits := &mockCredits{granted: map[string]int{}}
+	tx := &mockTransactor{}
+	cache := &mockCache{tx: tx}
+	s := NewService(repo, tx.transact, credits, Program{ReferrerCredits: 10, RefereeCredits: 5, MaxRewards: 1}, cache, logger)
+
+	for _, id := range []string{"referee1", "referee2", "referee3"} {
+		assert.NoError(t, s.Qualify(context.Background(), id))
+		assert.Equal(t, string(entity.ReferralStatusRewarded), repo.referrals[id].Status)
+		assert.Equal(t, 5, credits.granted[id])
+	}
+	// the referrals rewarded after the limit is reached count towards it even though the referrer got no credits
+	assert.Equal(t, 10, credits.granted["referrer"])
+	assert.Equal(t, 10, repo.referrals["referee1"].ReferrerCredits)
+	assert.Equal(t, 0, repo.referrals["referee2"].ReferrerCredits)
+	assert.Equal(t, 0, repo.referrals["referee3"].ReferrerCredits)
+	assert.Equal(t, []string{"referrer", "referee1", "referrer", "referee2", "referrer", "referee3"}, cache.invalidated)
+}
@@ -0,0 +1 @@
+drop index user_auth_method_auth_id_idx;
@@ -0,0 +1,2 @@
+-- an identity belongs to one user at a time; the deleted users keep theirs until they are purged
+create unique index user_auth_method_auth_id_idx on public.user (auth_method, auth_id) where deleted_at is null;
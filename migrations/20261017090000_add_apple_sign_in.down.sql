@@ -0,0 +1,4 @@
+drop table apple_token;
+
+alter table public.user drop column email_disabled;
+alter table public.user drop column email;
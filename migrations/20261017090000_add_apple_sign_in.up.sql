@@ -0,0 +1,9 @@
+alter table public.user add column email text null;
+alter table public.user add column email_disabled boolean not null default false;
+
+create table apple_token (
+    user_id uuid primary key not null references public.user(id),
+    refresh_token text not null,
+    created_at TIMESTAMPTZ not null,
+    updated_at TIMESTAMPTZ not null
+);
@@ -0,0 +1,2 @@
+drop index credential_username_idx;
+drop table credential;
@@ -0,0 +1,11 @@
+create table credential (
+    user_id uuid primary key not null references public.user(id),
+    username varchar(50) not null,
+    password_hash text not null,
+    failed_attempts int not null default 0,
+    locked_until TIMESTAMPTZ null,
+    created_at TIMESTAMPTZ not null,
+    updated_at TIMESTAMPTZ not null
+);
+
+create unique index credential_username_idx on credential (lower(username));
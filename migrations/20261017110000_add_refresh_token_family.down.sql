@@ -0,0 +1,7 @@
+drop table security_event;
+
+drop index refresh_token_expires_at_idx;
+drop index refresh_token_family_id_idx;
+alter table refresh_token drop column rotated;
+alter table refresh_token drop column parent_id;
+alter table refresh_token drop column family_id;
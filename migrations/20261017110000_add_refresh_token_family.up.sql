@@ -0,0 +1,19 @@
+alter table refresh_token add column family_id uuid null;
+alter table refresh_token add column parent_id uuid null;
+-- tells the tokens revoked because they have been rotated apart from the ones revoked by a logout
+alter table refresh_token add column rotated boolean not null default false;
+update refresh_token set family_id = id;
+alter table refresh_token alter column family_id set not null;
+
+create index refresh_token_family_id_idx on refresh_token (family_id);
+create index refresh_token_expires_at_idx on refresh_token (expires_at);
+
+create table security_event (
+    id uuid primary key not null,
+    user_id uuid not null,
+    type varchar(50) not null,
+    details text not null,
+    created_at TIMESTAMPTZ not null
+);
+
+create index security_event_user_id_idx on security_event (user_id);
@@ -0,0 +1,4 @@
+drop index refresh_token_user_id_idx;
+
+alter table refresh_token drop column platform;
+alter table refresh_token drop column device_name;
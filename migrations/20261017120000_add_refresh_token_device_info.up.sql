@@ -0,0 +1,4 @@
+alter table refresh_token add column device_name varchar(100) null;
+alter table refresh_token add column platform varchar(20) null;
+
+create index refresh_token_user_id_idx on refresh_token (user_id);
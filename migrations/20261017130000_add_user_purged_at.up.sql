@@ -0,0 +1 @@
+alter table public.user add column purged_at TIMESTAMPTZ null;
@@ -0,0 +1,4 @@
+drop table export_job;
+
+drop index album_user_id_idx;
+alter table album drop column user_id;
@@ -0,0 +1,18 @@
+alter table album add column user_id uuid null references public.user(id);
+
+create index album_user_id_idx on album (user_id);
+
+create table export_job (
+    id uuid primary key not null,
+    user_id uuid not null references public.user(id),
+    status varchar(20) not null,
+    file_id uuid null,
+    error text null,
+    created_at TIMESTAMPTZ not null,
+    started_at TIMESTAMPTZ null,
+    completed_at TIMESTAMPTZ null,
+    expires_at TIMESTAMPTZ null
+);
+
+create index export_job_user_id_idx on export_job (user_id);
+create index export_job_status_idx on export_job (status);
@@ -0,0 +1,3 @@
+drop table revoked_token;
+
+alter table public.user drop column banned_at;
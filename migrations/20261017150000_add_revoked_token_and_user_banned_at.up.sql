@@ -0,0 +1,12 @@
+alter table public.user add column banned_at TIMESTAMPTZ null;
+
+create table revoked_token (
+    kind varchar(10) not null,
+    value text not null,
+    revoked_at TIMESTAMPTZ not null,
+    expires_at TIMESTAMPTZ not null,
+    primary key (kind, value)
+);
+
+create index revoked_token_revoked_at_idx on revoked_token (revoked_at);
+create index revoked_token_expires_at_idx on revoked_token (expires_at);
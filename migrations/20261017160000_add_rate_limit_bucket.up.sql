@@ -0,0 +1,8 @@
+create table rate_limit_bucket (
+    key text primary key not null,
+    tokens double precision not null,
+    updated_at TIMESTAMPTZ not null,
+    full_at TIMESTAMPTZ not null
+);
+
+create index rate_limit_bucket_full_at_idx on rate_limit_bucket (full_at);
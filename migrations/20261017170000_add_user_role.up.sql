@@ -0,0 +1 @@
+alter table public.user add column role varchar(20) not null default 'user';
@@ -0,0 +1,7 @@
+drop index user_fcm_token_idx;
+alter table public.user drop constraint user_handle_key;
+
+alter table public.user drop column avatar_url;
+alter table public.user drop column avatar_file_id;
+alter table public.user drop column locale;
+alter table public.user drop column handle;
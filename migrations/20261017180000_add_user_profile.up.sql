@@ -0,0 +1,7 @@
+alter table public.user add column handle varchar(30) null;
+alter table public.user add column locale varchar(35) null;
+alter table public.user add column avatar_file_id uuid null;
+alter table public.user add column avatar_url text null;
+
+alter table public.user add constraint user_handle_key unique (handle);
+create index user_fcm_token_idx on public.user (fcm_token);
@@ -0,0 +1,15 @@
+create table security_event (
+    id uuid primary key not null,
+    user_id uuid not null,
+    type varchar(50) not null,
+    details text not null,
+    created_at TIMESTAMPTZ not null
+);
+
+create index security_event_user_id_idx on security_event (user_id);
+
+insert into security_event (id, user_id, type, details, created_at)
+    select id, user_id, type, coalesce(details, ''), created_at from auth_event
+    where type = 'refresh_token_reuse' and user_id is not null;
+
+drop table auth_event;
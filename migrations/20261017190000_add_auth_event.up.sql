@@ -0,0 +1,25 @@
+create table auth_event (
+    id uuid primary key not null,
+    type varchar(50) not null,
+    user_id uuid null,
+    device_key_hash varchar(64) null,
+    ip varchar(64) null,
+    user_agent text null,
+    request_id varchar(100) null,
+    outcome varchar(20) not null,
+    reason varchar(100) null,
+    details text null,
+    created_at TIMESTAMPTZ not null
+);
+
+create index auth_event_user_id_created_at_idx on auth_event (user_id, created_at);
+create index auth_event_created_at_idx on auth_event (created_at);
+create index auth_event_ip_idx on auth_event (ip);
+
+-- the audit log is append-only: rows can only be deleted by the retention job
+create rule auth_event_no_update as on update to auth_event do instead nothing;
+
+insert into auth_event (id, type, user_id, outcome, details, created_at)
+    select id, type, user_id, 'failure', details, created_at from security_event;
+
+drop table security_event;
@@ -0,0 +1,14 @@
+alter table public.user add column credits bigint not null default 0, add column credits_expires_at TIMESTAMPTZ null;
+
+-- a single expiry is kept for the balance, so the soonest expiry of the remaining lots is used
+update public.user set
+    credits = credit_balance(id),
+    credits_expires_at = (
+        select min(expires_at) from credit_transaction
+        where user_id = public.user.id and remaining > 0 and expires_at > now()
+    );
+
+alter table public.user alter column credits drop default;
+
+drop function credit_balance(uuid);
+drop table credit_transaction;
@@ -0,0 +1,30 @@
+create table credit_transaction (
+    id uuid primary key not null,
+    user_id uuid not null references public.user(id),
+    type varchar(20) not null,
+    amount bigint not null,
+    lot_id uuid null references credit_transaction(id),
+    remaining bigint null,
+    expires_at TIMESTAMPTZ null,
+    reason varchar(50) not null,
+    reference varchar(255) null,
+    created_at TIMESTAMPTZ not null
+);
+
+create index credit_transaction_user_id_created_at_idx on credit_transaction (user_id, created_at);
+create index credit_transaction_lot_idx on credit_transaction (user_id, expires_at) where remaining > 0;
+create index credit_transaction_reference_idx on credit_transaction (user_id, reference) where reference is not null;
+
+-- the balance of a user is the sum of the credits remaining in the lots that have not expired
+create function credit_balance(uid uuid) returns bigint as $$
+    select coalesce(sum(remaining), 0)::bigint from credit_transaction
+    where user_id = uid and remaining > 0 and (expires_at is null or expires_at > now())
+$$ language sql stable;
+
+-- the current balances become the first lots of the ledger
+insert into credit_transaction (id, user_id, type, amount, remaining, expires_at, reason, created_at)
+    select md5('credit_transaction:' || id::text)::uuid, id, 'grant', credits, credits, credits_expires_at, 'migrated_balance', now()
+    from public.user
+    where credits > 0 and (credits_expires_at is null or credits_expires_at > now());
+
+alter table public.user drop column credits, drop column credits_expires_at;
@@ -0,0 +1,5 @@
+drop index user_customer_id_idx;
+
+alter table public.user drop column subscription_event_at;
+
+drop table webhook_event;
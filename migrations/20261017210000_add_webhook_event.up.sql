@@ -0,0 +1,19 @@
+create table webhook_event (
+    id uuid primary key not null,
+    provider varchar(20) not null,
+    event_id varchar(255) not null,
+    type varchar(50) not null,
+    payload text not null,
+    status varchar(20) not null,
+    error text null,
+    received_at TIMESTAMPTZ not null,
+    processed_at TIMESTAMPTZ null,
+    constraint webhook_event_provider_event_id_key unique (provider, event_id)
+);
+
+create index webhook_event_status_idx on webhook_event (status);
+
+-- the time of the billing event the subscription was last updated with, so that late events are not applied
+alter table public.user add column subscription_event_at TIMESTAMPTZ null;
+
+create index user_customer_id_idx on public.user (customer_id);
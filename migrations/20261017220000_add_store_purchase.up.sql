@@ -0,0 +1,13 @@
+-- the one-time store purchases credited to the users, so that a purchase is never credited twice
+create table store_purchase (
+    id uuid primary key not null,
+    provider varchar(20) not null,
+    transaction_id text not null,
+    user_id uuid not null references public.user(id),
+    product_id varchar(255) not null,
+    credits bigint not null,
+    created_at TIMESTAMPTZ not null,
+    constraint store_purchase_provider_transaction_id_key unique (provider, transaction_id)
+);
+
+create index store_purchase_user_id_idx on store_purchase (user_id);
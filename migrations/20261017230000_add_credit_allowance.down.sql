@@ -0,0 +1 @@
+drop table credit_allowance;
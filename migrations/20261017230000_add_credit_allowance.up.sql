@@ -0,0 +1,13 @@
+-- the credit allowances granted to the subscribers, one per user and period so that a period is never granted twice
+create table credit_allowance (
+    id uuid primary key not null,
+    user_id uuid not null references public.user(id),
+    plan varchar(50) not null,
+    period_start TIMESTAMPTZ not null,
+    period_end TIMESTAMPTZ not null,
+    credits bigint not null,
+    created_at TIMESTAMPTZ not null,
+    constraint credit_allowance_user_id_period_start_key unique (user_id, period_start)
+);
+
+create index credit_allowance_user_id_period_end_idx on credit_allowance (user_id, period_end);
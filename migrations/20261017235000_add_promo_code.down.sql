@@ -0,0 +1,3 @@
+drop table promo_redemption;
+
+drop table promo_code;
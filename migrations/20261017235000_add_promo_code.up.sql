@@ -0,0 +1,30 @@
+create table promo_code (
+    id uuid primary key not null,
+    code varchar(50) not null unique,
+    campaign varchar(50) null,
+    credits bigint not null default 0,
+    subscription_plan varchar(50) null,
+    subscription_days int not null default 0,
+    -- null means the code can be redeemed any number of times
+    max_redemptions int null,
+    per_user_limit int not null default 1,
+    redemptions int not null default 0,
+    starts_at TIMESTAMPTZ null,
+    ends_at TIMESTAMPTZ null,
+    created_by uuid null references public.user(id),
+    created_at TIMESTAMPTZ not null
+);
+
+create index promo_code_campaign_idx on promo_code (campaign);
+
+create table promo_redemption (
+    id uuid primary key not null,
+    code_id uuid not null references promo_code(id),
+    user_id uuid not null references public.user(id),
+    credits bigint not null,
+    subscription_expires_at TIMESTAMPTZ null,
+    created_at TIMESTAMPTZ not null
+);
+
+create index promo_redemption_code_id_user_id_idx on promo_redemption (code_id, user_id);
+create index promo_redemption_user_id_idx on promo_redemption (user_id);
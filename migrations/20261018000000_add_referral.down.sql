@@ -0,0 +1,3 @@
+drop table referral;
+
+drop table referral_code;
@@ -0,0 +1,23 @@
+-- the shareable referral code of a user, created when the user first asks for it
+create table referral_code (
+    user_id uuid primary key not null references public.user(id),
+    code varchar(20) not null unique,
+    created_at TIMESTAMPTZ not null
+);
+
+create table referral (
+    id uuid primary key not null,
+    referrer_id uuid not null references public.user(id),
+    -- a user can only be referred once
+    referee_id uuid not null unique references public.user(id),
+    status varchar(20) not null,
+    reason varchar(50) null,
+    referrer_credits bigint not null default 0,
+    referee_credits bigint not null default 0,
+    ip varchar(64) null,
+    created_at TIMESTAMPTZ not null,
+    rewarded_at TIMESTAMPTZ null
+);
+
+create index referral_referrer_id_status_idx on referral (referrer_id, status);
+create index referral_status_idx on referral (status) where status = 'pending';
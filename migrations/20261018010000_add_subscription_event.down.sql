@@ -0,0 +1,6 @@
+drop index user_subscription_status_expires_at_idx;
+
+drop table subscription_event;
+
+alter table public.user drop column subscription_grace_expires_at;
+alter table public.user drop column subscription_will_renew;
@@ -0,0 +1,24 @@
+-- whether the store renews the subscription at its expiry, and the end of the grace period of a subscription with a billing issue
+alter table public.user add column subscription_will_renew boolean not null default false;
+alter table public.user add column subscription_grace_expires_at TIMESTAMPTZ null;
+
+-- the subscriptions bought in a store keep getting a grace period until their next billing event tells whether they renew
+update public.user set subscription_will_renew = true
+where subscription_status = 'active' and subscription_type is distinct from 'promo';
+
+-- the lifecycle events of the subscriptions, e.g. a grace period started by the lifecycle job, for notifications and analytics
+create table subscription_event (
+    id uuid primary key not null,
+    user_id uuid not null references public.user(id),
+    type varchar(50) not null,
+    plan varchar(50) null,
+    status varchar(20) null,
+    expires_at TIMESTAMPTZ null,
+    grace_expires_at TIMESTAMPTZ null,
+    created_at TIMESTAMPTZ not null
+);
+
+create index subscription_event_user_id_created_at_idx on subscription_event (user_id, created_at);
+create index subscription_event_created_at_idx on subscription_event (created_at);
+
+create index user_subscription_status_expires_at_idx on public.user (subscription_status, subscription_expires_at);
@@ -0,0 +1,118 @@
+// Package client provides a middleware that records the address and the user agent of the client of a request.
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+)
+
+type contextKey int
+
+const infoKey contextKey = iota
+
+// Info describes the client of a request.
+type Info struct {
+	IP        string
+	UserAgent string
+}
+
+// Handler returns a middleware that stores the client information of every request in the request context.
+// If ipHeader is not empty, the IP address is taken from that header (e.g. CF-Connecting-IP or X-Forwarded-For),
+// but only when the request comes from one of the trusted proxies. Otherwise, or if the header is missing,
+// the remote address of the connection is used.
+func Handler(ipHeader string, trustedProxies []*net.IPNet) routing.Handler {
+	return func(c *routing.Context) error {
+		info := Info{
+			IP:        remoteIP(c.Request.RemoteAddr),
+			UserAgent: c.Request.UserAgent(),
+		}
+		if ipHeader != "" && isTrusted(info.IP, trustedProxies) {
+			info.IP = forwardedIP(info.IP, c.Request.Header.Get(ipHeader), trustedProxies)
+		}
+		c.Request = c.Request.WithContext(WithInfo(c.Request.Context(), info))
+		return nil
+	}
+}
+
+// ParseTrustedProxies parses the addresses of trusted proxies, given either as IP addresses or as CIDR ranges.
+func ParseTrustedProxies(values []string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, value := range values {
+		if !strings.Contains(value, "/") {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", value)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			value = fmt.Sprintf("%s/%d", value, bits)
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", value, err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+// forwardedIP returns the client IP from a header set by the trusted proxy at remoteIP.
+// X-Forwarded-For style headers are appended to by every hop, so only the entries added by trusted proxies
+// can be relied on: the header is read from the right and the first address which is not a trusted proxy
+// is the client. Single value headers like CF-Connecting-IP are handled the same way.
+func forwardedIP(remoteIP, value string, trustedProxies []*net.IPNet) string {
+	ip := remoteIP
+	hops := strings.Split(value, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			// an entry which is not an address was not added by a trusted proxy
+			break
+		}
+		ip = hop
+		if !isTrusted(hop, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+// isTrusted reports whether the IP address belongs to one of the trusted proxies.
+func isTrusted(ip string, trustedProxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithInfo returns a context that contains the given client information.
+func WithInfo(ctx context.Context, info Info) context.Context {
+	return context.WithValue(ctx, infoKey, info)
+}
+
+// FromContext returns the client information stored in the given context.
+// An empty Info is returned if the context has none.
+func FromContext(ctx context.Context) Info {
+	info, _ := ctx.Value(infoKey).(Info)
+	return info
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	routing "github.com/go-ozzo/ozzo-routing/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		remoteAddr string
+		value      string
+		want       string
+	}{
+		{"no header configured", "", "10.0.0.1:1234", "1.1.1.1", "10.0.0.1"},
+		{"header from untrusted address", "X-Forwarded-For", "8.8.8.8:1234", "1.1.1.1", "8.8.8.8"},
+		{"header missing", "X-Forwarded-For", "10.0.0.1:1234", "", "10.0.0.1"},
+		{"single value", "CF-Connecting-IP", "10.0.0.1:1234", "1.1.1.1", "1.1.1.1"},
+		{"spoofed first entry", "X-Forwarded-For", "10.0.0.1:1234", "6.6.6.6, 1.1.1.1", "1.1.1.1"},
+		{"trusted hops skipped", "X-Forwarded-For", "10.0.0.1:1234", "6.6.6.6, 1.1.1.1, 192.168.1.1, 10.0.0.2", "1.1.1.1"},
+		{"only trusted hops", "X-Forwarded-For", "10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "10.0.0.3"},
+		{"invalid entry", "X-Forwarded-For", "10.0.0.1:1234", "1.1.1.1, garbage", "10.0.0.1"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.value != "" {
+				req.Header.Set("X-Forwarded-For", tc.value)
+				req.Header.Set("CF-Connecting-IP", tc.value)
+			}
+			c := routing.NewContext(httptest.NewRecorder(), req)
+			assert.NoError(t, Handler(tc.header, proxies)(c))
+			assert.Equal(t, tc.want, FromContext(c.Request.Context()).IP)
+		})
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	_, err := ParseTrustedProxies([]string{"::1", "2001:db8::/32"})
+	assert.NoError(t, err)
+	_, err = ParseTrustedProxies([]string{"not-an-ip"})
+	assert.Error(t, err)
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	assert.Error(t, err)
+}
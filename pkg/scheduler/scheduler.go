@@ -0,0 +1,65 @@
+// Package scheduler runs background jobs periodically.
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/qiangxue/go-rest-api/pkg/log"
+)
+
+// Job is a unit of background work. It should return promptly when the context is cancelled.
+type Job func(ctx context.Context) error
+
+// Scheduler runs registered jobs at fixed intervals until it is stopped.
+type Scheduler struct {
+	logger log.Logger
+	mu     sync.Mutex
+	jobs   []entry
+}
+
+type entry struct {
+	name     string
+	interval time.Duration
+	job      Job
+}
+
+// New creates a new Scheduler.
+func New(logger log.Logger) *Scheduler {
+	return &Scheduler{logger: logger}
+}
+
+// Add registers a job that will be run every interval once the scheduler is started.
+func (s *Scheduler) Add(name string, interval time.Duration, job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, entry{name, interval, job})
+}
+
+// Start runs every registered job in its own goroutine until the given context is cancelled.
+// Each job runs once immediately and then after every interval.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.jobs {
+		go s.run(ctx, e)
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, e entry) {
+	logger := s.logger.With(ctx, "job", e.name)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.job(ctx); err != nil && ctx.Err() == nil {
+			logger.Errorf("background job failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}